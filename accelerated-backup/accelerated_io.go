@@ -1,10 +1,18 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
 	"flag"
 	"fmt"
 	"io"
+	"math/rand"
+	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"syscall"
@@ -20,9 +28,12 @@ type Task struct {
 }
 
 // Result holds the result of a read task.
+// A block that is all zeros is returned with zero set and only its size instead of the data.
 type Result struct {
 	index int
 	data  []byte
+	zero  bool
+	size  int
 	err   error
 }
 
@@ -36,6 +47,10 @@ type WriteTask struct {
 // BLKGETSIZE64 is the Linux-specific ioctl request code to get the size of a block device in bytes.
 const BLKGETSIZE64 = 0x80081272
 
+// directAlignment is the buffer, offset and length alignment used with O_DIRECT. It covers
+// devices with either 512-byte or 4 KiB logical sectors.
+const directAlignment = 4096
+
 // progressTicker controls the progress reporting interval.
 const progressTicker = 1 * time.Second
 
@@ -55,21 +70,101 @@ func blockDeviceSize(f *os.File) (int64, error) {
 	return size, nil
 }
 
-// readWorker processes read tasks.
-func readWorker(file *os.File, tasks <-chan Task, results chan<- Result) {
+// device is an open block device. With -direct, a second descriptor opened with O_DIRECT
+// bypasses the page cache for every aligned transfer; the rest (the tail block when the size
+// is not a multiple of directAlignment) falls back to the buffered descriptor.
+type device struct {
+	*os.File
+	direct *os.File
+}
+
+// openDevice opens path with the given flags, plus an O_DIRECT descriptor when direct is set.
+func openDevice(path string, flag int, direct bool) (*device, error) {
+	f, err := os.OpenFile(path, flag, 0644)
+	if err != nil {
+		return nil, err
+	}
+	d := &device{File: f}
+	if direct {
+		d.direct, err = os.OpenFile(path, flag|syscall.O_DIRECT, 0644)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("O_DIRECT: %w", err)
+		}
+	}
+	return d, nil
+}
+
+// alloc returns a buffer of size bytes, aligned for O_DIRECT when the device uses it.
+func (d *device) alloc(size int) []byte {
+	if d.direct == nil {
+		return make([]byte, size)
+	}
+	buf := make([]byte, size+directAlignment)
+	off := int(uintptr(unsafe.Pointer(&buf[0])) % directAlignment)
+	if off != 0 {
+		off = directAlignment - off
+	}
+	return buf[off : off+size : off+size]
+}
+
+// useDirect reports whether a transfer of p at off can go through the O_DIRECT descriptor.
+func (d *device) useDirect(p []byte, off int64) bool {
+	return d.direct != nil && len(p) > 0 &&
+		len(p)%directAlignment == 0 && off%directAlignment == 0 &&
+		uintptr(unsafe.Pointer(&p[0]))%directAlignment == 0
+}
+
+func (d *device) ReadAt(p []byte, off int64) (int, error) {
+	if d.useDirect(p, off) {
+		return d.direct.ReadAt(p, off)
+	}
+	return d.File.ReadAt(p, off)
+}
+
+func (d *device) WriteAt(p []byte, off int64) (int, error) {
+	if d.useDirect(p, off) {
+		return d.direct.WriteAt(p, off)
+	}
+	return d.File.WriteAt(p, off)
+}
+
+func (d *device) Close() error {
+	if d.direct != nil {
+		d.direct.Close()
+	}
+	return d.File.Close()
+}
+
+// isZero reports whether buf contains only zero bytes.
+func isZero(buf []byte) bool {
+	for _, b := range buf {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// readWorker processes read tasks. With skipZeros, all-zero blocks are reported by size only.
+func readWorker(file *device, tasks <-chan Task, results chan<- Result, skipZeros bool) {
 	for task := range tasks {
-		buf := make([]byte, task.size)
+		buf := file.alloc(task.size)
 		n, err := file.ReadAt(buf, task.offset)
 		if err != nil && err != io.EOF {
 			results <- Result{index: task.index, err: err}
 			continue
 		}
-		results <- Result{index: task.index, data: buf[:n]}
+		if skipZeros && isZero(buf[:n]) {
+			results <- Result{index: task.index, zero: true, size: n}
+			continue
+		}
+		results <- Result{index: task.index, data: buf[:n], size: n}
 	}
 }
 
 // writeWorker processes write tasks.
-func writeWorker(device *os.File, tasks <-chan WriteTask, wg *sync.WaitGroup) {
+func writeWorker(device *device, tasks <-chan WriteTask, wg *sync.WaitGroup) {
 	defer wg.Done()
 	for task := range tasks {
 		n, err := device.WriteAt(task.data, task.offset)
@@ -84,30 +179,93 @@ func writeWorker(device *os.File, tasks <-chan WriteTask, wg *sync.WaitGroup) {
 	}
 }
 
-// runProgressTicker starts a ticker that prints progress updates until the done channel is closed.
+// startProgressTicker starts a ticker that prints progress updates until the returned stop
+// function is called, which returns once the ticker has printed its last line.
 // The getCurrent function should return the current byte count,
 // totalSize is the device's total size, and label is a string (e.g., "READ" or "WRITE").
-func runProgressTicker(done <-chan struct{}, getCurrent func() int64, totalSize int64, label string) {
-	ticker := time.NewTicker(progressTicker)
-	defer ticker.Stop()
-	for {
-		select {
-		case <-ticker.C:
-			current := getCurrent()
-			percent := float64(current) / float64(totalSize) * 100
-			// \r returns to start of line, and \033[K clears the rest of the line.
-			fmt.Fprintf(os.Stderr, "%s progress: %d/%d bytes (%.2f%%)\n", label, current, totalSize, percent)
-		case <-done:
-			// Clear the line and then end.
-			fmt.Fprintln(os.Stderr)
-			return
+func startProgressTicker(getCurrent func() int64, totalSize int64, label string) (stop func()) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(progressTicker)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				current := getCurrent()
+				percent := float64(current) / float64(totalSize) * 100
+				// \r returns to start of line, and \033[K clears the rest of the line.
+				fmt.Fprintf(os.Stderr, "%s progress: %d/%d bytes (%.2f%%)\n", label, current, totalSize, percent)
+			case <-done:
+				// Clear the line and then end.
+				fmt.Fprintln(os.Stderr)
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// dispatchReadTasks sends a task for every block of a totalSize device to tasks, taking a slot of
+// inflight before each one, and closes tasks once all are sent.
+func dispatchReadTasks(tasks chan<- Task, inflight chan<- struct{}, totalSize int64, blockSize int) {
+	var offset int64
+	index := 0
+	for offset < totalSize {
+		size := blockSize
+		if offset+int64(size) > totalSize {
+			size = int(totalSize - offset)
+		}
+		inflight <- struct{}{}
+		tasks <- Task{index: index, offset: offset, size: size}
+		offset += int64(size)
+		index++
+	}
+	close(tasks)
+}
+
+// reorderResults passes results to emit in index order, buffering those that complete ahead of
+// the next expected block. It returns the most blocks that were buffered at once, or the first
+// error a worker reported.
+func reorderResults(results <-chan Result, emit func(Result)) (int, error) {
+	expected := 0
+	peak := 0
+	buffer := make(map[int]Result)
+	for res := range results {
+		if res.err != nil {
+			return peak, fmt.Errorf("(block %d): %w", res.index, res.err)
+		}
+		if res.index != expected {
+			buffer[res.index] = res
+			peak = max(peak, len(buffer))
+			continue
+		}
+		emit(res)
+		expected++
+		for {
+			next, ok := buffer[expected]
+			if !ok {
+				break
+			}
+			emit(next)
+			delete(buffer, expected)
+			expected++
 		}
 	}
+	return peak, nil
 }
 
 // readBlockDevice reads from the block device, reorders results, and reports progress.
-func readBlockDevice(devicePath string, blockSize, workers int) {
-	file, err := os.Open(devicePath)
+// The output is always the complete image, so offsets match on restore; with skipZeros,
+// zero blocks are not kept in the reorder buffer but written from a shared zero block.
+// At most maxInflight blocks are read but not yet written out, which bounds the reorder buffer.
+// With checksum, the SHA-256 of the stream is logged once it is complete.
+func readBlockDevice(devicePath string, blockSize, workers, maxInflight int, skipZeros, direct, checksum bool) {
+	file, err := openDevice(devicePath, os.O_RDONLY, direct)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error opening device: %v\n", err)
 		os.Exit(1)
@@ -115,7 +273,7 @@ func readBlockDevice(devicePath string, blockSize, workers int) {
 	defer file.Close()
 
 	// Determine total device size.
-	totalSize, err := blockDeviceSize(file)
+	totalSize, err := blockDeviceSize(file.File)
 	if err != nil {
 		stat, statErr := file.Stat()
 		if statErr != nil {
@@ -124,6 +282,8 @@ func readBlockDevice(devicePath string, blockSize, workers int) {
 		}
 		totalSize = stat.Size()
 	}
+	// The backup records this, since the device can be larger than the PVC requested
+	fmt.Fprintf(os.Stderr, "DEVICE size: %d\n", totalSize)
 
 	tasks := make(chan Task, workers)
 	results := make(chan Result, workers)
@@ -133,7 +293,7 @@ func readBlockDevice(devicePath string, blockSize, workers int) {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			readWorker(file, tasks, results)
+			readWorker(file, tasks, results, skipZeros)
 		}()
 	}
 
@@ -142,66 +302,68 @@ func readBlockDevice(devicePath string, blockSize, workers int) {
 		close(results)
 	}()
 
-	// Generate read tasks.
-	go func() {
-		var offset int64
-		index := 0
-		for offset < totalSize {
-			size := blockSize
-			if offset+int64(size) > totalSize {
-				size = int(totalSize - offset)
-			}
-			tasks <- Task{index: index, offset: offset, size: size}
-			offset += int64(size)
-			index++
-		}
-		close(tasks)
-	}()
+	// Each task takes a slot before it is dispatched and gives it back once its block is
+	// written out, so a slow reader of stdout stalls the workers instead of growing the buffer.
+	inflight := make(chan struct{}, maxInflight)
+
+	go dispatchReadTasks(tasks, inflight, totalSize, blockSize)
 
 	var bytesRead int64
-	done := make(chan struct{})
-	go runProgressTicker(done, func() int64 {
+	stopProgress := startProgressTicker(func() int64 {
 		return atomic.LoadInt64(&bytesRead)
 	}, totalSize, "READ")
 
-	expected := 0
-	buffer := make(map[int][]byte)
-	for res := range results {
-		if res.err != nil {
-			fmt.Fprintf(os.Stderr, "Error in worker (block %d): %v\n", res.index, res.err)
-			os.Exit(1)
-		}
-		if res.index == expected {
-			_, _ = os.Stdout.Write(res.data)
-			atomic.AddInt64(&bytesRead, int64(len(res.data)))
-			expected++
-			for {
-				if data, ok := buffer[expected]; ok {
-					_, _ = os.Stdout.Write(data)
-					atomic.AddInt64(&bytesRead, int64(len(data)))
-					delete(buffer, expected)
-					expected++
-				} else {
-					break
-				}
-			}
+	// Blocks are hashed in output order, so the sum matches what write mode computes on restore
+	var out io.Writer = os.Stdout
+	hash := sha256.New()
+	if checksum {
+		out = io.MultiWriter(os.Stdout, hash)
+	}
+
+	var zeroBytes int64
+	zeroBlock := make([]byte, blockSize)
+	emit := func(res Result) {
+		if res.zero {
+			_, _ = out.Write(zeroBlock[:res.size])
+			zeroBytes += int64(res.size)
 		} else {
-			buffer[res.index] = res.data
+			_, _ = out.Write(res.data)
 		}
+		atomic.AddInt64(&bytesRead, int64(res.size))
+		<-inflight
+	}
+
+	peak, err := reorderResults(results, emit)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error in worker %v\n", err)
+		os.Exit(1)
+	}
+	stopProgress()
+
+	fmt.Fprintf(os.Stderr, "READ buffered at most %d block(s) out of order\n", peak)
+	if skipZeros {
+		fmt.Fprintf(os.Stderr, "READ found %d zero bytes out of %d\n", zeroBytes, totalSize)
+	}
+	if checksum {
+		fmt.Fprintf(os.Stderr, "CHECKSUM sha256: %s\n", hex.EncodeToString(hash.Sum(nil)))
 	}
-	close(done)
 }
 
 // writeBlockDevice reads data from stdin and writes it to the block device, reporting progress.
-func writeBlockDevice(devicePath string, blockSize, workers int) {
-	device, err := os.OpenFile(devicePath, os.O_WRONLY, 0644)
+// With skipZeros, all-zero blocks are not written, leaving those regions unallocated on thin
+// provisioned devices; this is only correct for a device that already reads as zeros.
+// A device smaller than expectSize bytes is rejected before anything is written.
+// With checksum, the SHA-256 of the stream is logged at EOF; a non-empty expectChecksum
+// implies checksum and fails the write if the sums differ.
+func writeBlockDevice(devicePath string, blockSize, workers int, expectSize int64, skipZeros, direct, checksum bool, expectChecksum string) {
+	device, err := openDevice(devicePath, os.O_WRONLY, direct)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error opening device for writing: %v\n", err)
 		os.Exit(1)
 	}
 	defer device.Close()
 
-	totalSize, err := blockDeviceSize(device)
+	totalSize, err := blockDeviceSize(device.File)
 	if err != nil {
 		stat, statErr := device.Stat()
 		if statErr != nil {
@@ -210,6 +372,10 @@ func writeBlockDevice(devicePath string, blockSize, workers int) {
 		}
 		totalSize = stat.Size()
 	}
+	if totalSize < expectSize {
+		fmt.Fprintf(os.Stderr, "Error: device is %d bytes but the backup was taken from a %d byte device\n", totalSize, expectSize)
+		os.Exit(1)
+	}
 
 	tasks := make(chan WriteTask, workers)
 	var wg sync.WaitGroup
@@ -219,35 +385,241 @@ func writeBlockDevice(devicePath string, blockSize, workers int) {
 	}
 
 	var bytesWritten int64
-	done := make(chan struct{})
-	go runProgressTicker(done, func() int64 {
+	stopProgress := startProgressTicker(func() int64 {
 		return atomic.LoadInt64(&bytesWritten)
 	}, totalSize, "WRITE")
 
+	checksum = checksum || expectChecksum != ""
+	hash := sha256.New()
+
+	var skippedBytes int64
 	index := 0
 	offset := int64(0)
 	for {
-		buf := make([]byte, blockSize)
+		buf := device.alloc(blockSize)
 		n, err := io.ReadFull(os.Stdin, buf)
 		if err == io.EOF {
 			break
-		} else if err == io.ErrUnexpectedEOF {
-			tasks <- WriteTask{index: index, offset: offset, data: buf[:n]}
-			atomic.AddInt64(&bytesWritten, int64(n))
-			break
-		} else if err != nil {
+		} else if err != nil && err != io.ErrUnexpectedEOF {
 			fmt.Fprintf(os.Stderr, "Error reading input: %v\n", err)
 			os.Exit(1)
 		}
-		tasks <- WriteTask{index: index, offset: offset, data: buf[:n]}
+		if checksum {
+			hash.Write(buf[:n])
+		}
+		// Skipped blocks still advance the offset, so later blocks land where they belong
+		if skipZeros && isZero(buf[:n]) {
+			skippedBytes += int64(n)
+		} else {
+			tasks <- WriteTask{index: index, offset: offset, data: buf[:n]}
+		}
 		atomic.AddInt64(&bytesWritten, int64(n))
 		offset += int64(n)
 		index++
+		if err == io.ErrUnexpectedEOF {
+			break
+		}
 	}
 
 	close(tasks)
 	wg.Wait()
-	close(done)
+	stopProgress()
+
+	// The unaligned tail went through the page cache; flush it before exiting
+	if direct {
+		if err := device.File.Sync(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error syncing device: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if skipZeros {
+		fmt.Fprintf(os.Stderr, "WRITE skipped %d zero bytes out of %d\n", skippedBytes, offset)
+	}
+	if checksum {
+		sum := hex.EncodeToString(hash.Sum(nil))
+		fmt.Fprintf(os.Stderr, "CHECKSUM sha256: %s\n", sum)
+		if expectChecksum != "" && !strings.EqualFold(sum, expectChecksum) {
+			fmt.Fprintf(os.Stderr, "CHECKSUM mismatch: expected %s\n", expectChecksum)
+			os.Exit(1)
+		}
+	}
+}
+
+// verifyBlockDevice reads a stream (e.g. a restic dump of a backup) from stdin and compares
+// a number of randomly chosen blocks against the same offsets on the device.
+// It stops reading as soon as the last sampled block has been compared.
+func verifyBlockDevice(devicePath string, blockSize, samples int) {
+	device, err := os.Open(devicePath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error opening device: %v\n", err)
+		os.Exit(1)
+	}
+	defer device.Close()
+
+	totalSize, err := blockDeviceSize(device)
+	if err != nil {
+		stat, statErr := device.Stat()
+		if statErr != nil {
+			fmt.Fprintf(os.Stderr, "Error stat'ing device: %v\n", statErr)
+			os.Exit(1)
+		}
+		totalSize = stat.Size()
+	}
+
+	totalBlocks := (totalSize + int64(blockSize) - 1) / int64(blockSize)
+	picked := make(map[int64]bool)
+	for int64(len(picked)) < int64(samples) && int64(len(picked)) < totalBlocks {
+		picked[rand.Int63n(totalBlocks)] = true
+	}
+
+	remaining := len(picked)
+	streamBuf := make([]byte, blockSize)
+	deviceBuf := make([]byte, blockSize)
+	for index := int64(0); remaining > 0; index++ {
+		n, err := io.ReadFull(os.Stdin, streamBuf)
+		if err == io.EOF {
+			break
+		} else if err != nil && err != io.ErrUnexpectedEOF {
+			fmt.Fprintf(os.Stderr, "Error reading input: %v\n", err)
+			os.Exit(1)
+		}
+
+		if picked[index] {
+			offset := index * int64(blockSize)
+			m, readErr := device.ReadAt(deviceBuf[:n], offset)
+			if readErr != nil && readErr != io.EOF {
+				fmt.Fprintf(os.Stderr, "Error reading device block %d at offset %d: %v\n", index, offset, readErr)
+				os.Exit(1)
+			}
+			if m != n || !bytes.Equal(streamBuf[:n], deviceBuf[:n]) {
+				fmt.Fprintf(os.Stderr, "VERIFY mismatch: block %d at offset %d differs from the device\n", index, offset)
+				os.Exit(1)
+			}
+			fmt.Fprintf(os.Stderr, "VERIFY block %d at offset %d: OK\n", index, offset)
+			remaining--
+		}
+
+		if err == io.ErrUnexpectedEOF {
+			break
+		}
+	}
+
+	if remaining > 0 {
+		fmt.Fprintf(os.Stderr, "VERIFY mismatch: stream ended before %d sampled block(s) were reached\n", remaining)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "VERIFY passed: %d block(s) match\n", len(picked))
+}
+
+// receiveTokenEnv names the environment variable holding the token every receive request must
+// carry in the receiveTokenHeader header.
+const (
+	receiveTokenEnv    = "RECEIVE_TOKEN"
+	receiveTokenHeader = "X-Receive-Token"
+)
+
+// receiveBlockDevice serves HTTP on listenAddr so data can be written to the device from
+// outside the cluster through the API server's pod proxy:
+//
+//	PUT  /blocks?offset=N  writes the request body at offset N
+//	GET  /sha256?size=N    returns the hex SHA-256 of the first N bytes of the device
+//	POST /done             exits successfully
+//
+// Anything else on the pod network could reach the port too, so every request must carry the
+// token from $RECEIVE_TOKEN, and the mode refuses to start without one.
+func receiveBlockDevice(devicePath, listenAddr string) {
+	token := os.Getenv(receiveTokenEnv)
+	if token == "" {
+		fmt.Fprintf(os.Stderr, "Error: receive mode requires a token in $%s\n", receiveTokenEnv)
+		os.Exit(1)
+	}
+
+	device, err := os.OpenFile(devicePath, os.O_RDWR, 0644)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error opening device: %v\n", err)
+		os.Exit(1)
+	}
+	defer device.Close()
+
+	done := func() {
+		go func() {
+			time.Sleep(time.Second)
+			os.Exit(0)
+		}()
+	}
+
+	fmt.Fprintf(os.Stderr, "RECEIVE listening on %s\n", listenAddr)
+	if err := http.ListenAndServe(listenAddr, receiveHandler(device, token, done)); err != nil {
+		fmt.Fprintf(os.Stderr, "Error serving: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// receiveHandler serves the receive mode endpoints on device, rejecting requests without token.
+// done is called once POST /done has been answered.
+func receiveHandler(device *os.File, token string, done func()) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/blocks", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		offset, err := strconv.ParseInt(r.URL.Query().Get("offset"), 10, 64)
+		if err != nil || offset < 0 {
+			http.Error(w, "invalid offset", http.StatusBadRequest)
+			return
+		}
+		n, err := io.Copy(io.NewOffsetWriter(device, offset), r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintf(os.Stderr, "RECEIVE %d bytes at offset %d\n", n, offset)
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	mux.HandleFunc("/sha256", func(w http.ResponseWriter, r *http.Request) {
+		size, err := strconv.ParseInt(r.URL.Query().Get("size"), 10, 64)
+		if err != nil || size < 0 {
+			http.Error(w, "invalid size", http.StatusBadRequest)
+			return
+		}
+		if err := device.Sync(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		hash := sha256.New()
+		if _, err := io.Copy(hash, io.NewSectionReader(device, 0, size)); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprint(w, hex.EncodeToString(hash.Sum(nil)))
+	})
+
+	mux.HandleFunc("/done", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := device.Sync(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		fmt.Fprintln(os.Stderr, "RECEIVE done")
+		done()
+	})
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get(receiveTokenHeader)), []byte(token)) != 1 {
+			fmt.Fprintf(os.Stderr, "RECEIVE rejected %s %s from %s without a valid token\n", r.Method, r.URL.Path, r.RemoteAddr)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
 }
 
 func main() {
@@ -255,24 +627,52 @@ func main() {
 	var blockSize int
 	var workers int
 	var mode string
+	var samples int
+	var listenAddr string
+	var skipZeros bool
+	var maxInflight int
+	var direct bool
+	var expectSize int64
+	var checksum bool
+	var expectChecksum string
 
 	flag.StringVar(&devicePath, "device", "", "Path to block device (e.g., /dev/xvda)")
 	flag.IntVar(&blockSize, "bs", 64*1024, "Block size in bytes")
 	flag.IntVar(&workers, "workers", 4, "Number of concurrent workers")
-	flag.StringVar(&mode, "mode", "", "Mode: 'read' or 'write'")
+	flag.StringVar(&mode, "mode", "", "Mode: 'read', 'write', 'verify', or 'receive'")
+	flag.IntVar(&samples, "samples", 8, "Number of random blocks to compare in verify mode")
+	flag.StringVar(&listenAddr, "listen", ":8080", "Address to serve on in receive mode")
+	flag.IntVar(&maxInflight, "max-inflight", 256, "Maximum number of blocks read ahead of the output in read mode")
+	flag.Int64Var(&expectSize, "expect-size", 0, "Minimum device size in bytes required in write mode (0 disables the check)")
+	flag.BoolVar(&direct, "direct", false, fmt.Sprintf("Bypass the page cache with O_DIRECT in read and write mode (-bs must be a multiple of %d)", directAlignment))
+	flag.BoolVar(&skipZeros, "skip-zeros", false, "Do not write all-zero blocks in write mode, keeping the device sparse (the device must already read as zeros)")
+	flag.BoolVar(&checksum, "checksum", false, "Log the SHA-256 of the stream in read and write mode")
+	flag.StringVar(&expectChecksum, "expect-checksum", "", "SHA-256 the stream must match in write mode, exiting non-zero otherwise (implies -checksum)")
 	flag.Parse()
 
 	if devicePath == "" {
 		fmt.Fprintln(os.Stderr, "Error: No device specified. Use -device flag.")
 		os.Exit(1)
 	}
+	if direct && (blockSize <= 0 || blockSize%directAlignment != 0) {
+		fmt.Fprintf(os.Stderr, "Error: -bs must be a multiple of %d with -direct.\n", directAlignment)
+		os.Exit(1)
+	}
+	if maxInflight < 1 {
+		fmt.Fprintln(os.Stderr, "Error: -max-inflight must be at least 1.")
+		os.Exit(1)
+	}
 
 	if mode == "read" {
-		readBlockDevice(devicePath, blockSize, workers)
+		readBlockDevice(devicePath, blockSize, workers, maxInflight, skipZeros, direct, checksum)
 	} else if mode == "write" {
-		writeBlockDevice(devicePath, blockSize, workers)
+		writeBlockDevice(devicePath, blockSize, workers, expectSize, skipZeros, direct, checksum, expectChecksum)
+	} else if mode == "verify" {
+		verifyBlockDevice(devicePath, blockSize, samples)
+	} else if mode == "receive" {
+		receiveBlockDevice(devicePath, listenAddr)
 	} else {
-		fmt.Fprintln(os.Stderr, "Error: Invalid mode. Use -mode=read or -mode=write")
+		fmt.Fprintln(os.Stderr, "Error: Invalid mode. Use -mode=read, -mode=write, -mode=verify, or -mode=receive")
 		os.Exit(1)
 	}
 }
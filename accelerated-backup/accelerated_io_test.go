@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testImage returns size bytes of random data with a run of zeros in the middle, so block
+// boundaries, zero blocks and an unaligned tail are all exercised
+func testImage(size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(1)).Read(data)
+	for i := size / 4; i < size/2; i++ {
+		data[i] = 0
+	}
+	return data
+}
+
+// writeFile writes data to a new file in the test's temp dir and returns its path
+func writeFile(t *testing.T, name string, data []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// redirect points os.Stdin, os.Stdout and os.Stderr at files for the duration of the test and
+// returns the paths of the captured stdout and stderr
+func redirect(t *testing.T, stdin []byte) (stdoutPath, stderrPath string) {
+	t.Helper()
+	dir := t.TempDir()
+	in, err := os.Open(writeFile(t, "stdin", stdin))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdoutPath, stderrPath = filepath.Join(dir, "stdout"), filepath.Join(dir, "stderr")
+	out, err := os.Create(stdoutPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errOut, err := os.Create(stderrPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	savedIn, savedOut, savedErr := os.Stdin, os.Stdout, os.Stderr
+	os.Stdin, os.Stdout, os.Stderr = in, out, errOut
+	t.Cleanup(func() {
+		os.Stdin, os.Stdout, os.Stderr = savedIn, savedOut, savedErr
+		in.Close()
+		out.Close()
+		errOut.Close()
+	})
+	return stdoutPath, stderrPath
+}
+
+func readFile(t *testing.T, path string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestReadBlockDeviceChecksum(t *testing.T) {
+	image := testImage(10*4096 + 123)
+	device := writeFile(t, "device", image)
+	stdout, stderr := redirect(t, nil)
+
+	readBlockDevice(device, 4096, 3, 2, true, false, true)
+
+	if got := readFile(t, stdout); !bytes.Equal(got, image) {
+		t.Fatalf("stream is %d bytes and differs from the %d byte device", len(got), len(image))
+	}
+	want := "CHECKSUM sha256: " + sha256Hex(image)
+	if log := string(readFile(t, stderr)); !strings.Contains(log, want) {
+		t.Fatalf("log does not contain %q:\n%s", want, log)
+	}
+}
+
+func TestWriteBlockDeviceChecksum(t *testing.T) {
+	image := testImage(10*4096 + 123)
+	device := writeFile(t, "device", make([]byte, len(image)))
+	_, stderr := redirect(t, image)
+
+	// The expected sum is compared case-insensitively
+	writeBlockDevice(device, 4096, 3, int64(len(image)), false, false, false, strings.ToUpper(sha256Hex(image)))
+
+	if got := readFile(t, device); !bytes.Equal(got, image) {
+		t.Fatal("device content differs from the stream")
+	}
+	log := string(readFile(t, stderr))
+	if want := "CHECKSUM sha256: " + sha256Hex(image); !strings.Contains(log, want) {
+		t.Fatalf("log does not contain %q:\n%s", want, log)
+	}
+	if strings.Contains(log, "CHECKSUM mismatch") {
+		t.Fatalf("matching stream reported as a mismatch:\n%s", log)
+	}
+}
+
+func TestWriteBlockDeviceChecksumSkipZeros(t *testing.T) {
+	image := testImage(8 * 4096)
+	device := writeFile(t, "device", make([]byte, len(image)))
+	_, stderr := redirect(t, image)
+
+	// Skipped zero blocks are still part of the stream, so the sum is that of the whole image
+	writeBlockDevice(device, 4096, 2, 0, true, false, true, "")
+
+	if want := "CHECKSUM sha256: " + sha256Hex(image); !strings.Contains(string(readFile(t, stderr)), want) {
+		t.Fatalf("log does not contain %q", want)
+	}
+}
+
+// TestWriteBlockDeviceChecksumMismatch runs the write in a child process, since a mismatch
+// exits non-zero
+func TestWriteBlockDeviceChecksumMismatch(t *testing.T) {
+	if device := os.Getenv("ACCELERATED_IO_TEST_DEVICE"); device != "" {
+		writeBlockDevice(device, 4096, 2, 0, false, false, false, sha256Hex([]byte("another image")))
+		os.Exit(0)
+	}
+
+	image := testImage(4 * 4096)
+	cmd := exec.Command(os.Args[0], "-test.run=^TestWriteBlockDeviceChecksumMismatch$")
+	cmd.Env = append(os.Environ(), "ACCELERATED_IO_TEST_DEVICE="+writeFile(t, "device", make([]byte, len(image))))
+	cmd.Stdin = bytes.NewReader(image)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() != 1 {
+		t.Fatalf("write with a wrong checksum exited with %v, want exit status 1\n%s", err, stderr.String())
+	}
+	if !strings.Contains(stderr.String(), "CHECKSUM mismatch: expected "+sha256Hex([]byte("another image"))) {
+		t.Fatalf("mismatch not reported:\n%s", stderr.String())
+	}
+}
+
+func TestReceiveHandlerRequiresToken(t *testing.T) {
+	device, err := os.OpenFile(writeFile(t, "device", make([]byte, 8192)), os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer device.Close()
+	_, _ = redirect(t, nil)
+	doneCalled := false
+	server := httptest.NewServer(receiveHandler(device, "secret", func() { doneCalled = true }))
+	defer server.Close()
+
+	send := func(method, path, token, body string) int {
+		t.Helper()
+		req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != "" {
+			req.Header.Set(receiveTokenHeader, token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	for _, token := range []string{"", "wrong", "secre"} {
+		if code := send(http.MethodPut, "/blocks?offset=0", token, "data"); code != http.StatusUnauthorized {
+			t.Errorf("PUT /blocks with token %q answered %d, want %d", token, code, http.StatusUnauthorized)
+		}
+		if code := send(http.MethodGet, "/sha256?size=4", token, ""); code != http.StatusUnauthorized {
+			t.Errorf("GET /sha256 with token %q answered %d, want %d", token, code, http.StatusUnauthorized)
+		}
+		if code := send(http.MethodPost, "/done", token, ""); code != http.StatusUnauthorized {
+			t.Errorf("POST /done with token %q answered %d, want %d", token, code, http.StatusUnauthorized)
+		}
+	}
+	if doneCalled {
+		t.Fatal("unauthenticated POST /done stopped the receiver")
+	}
+	if data := readFile(t, device.Name()); !bytes.Equal(data, make([]byte, 8192)) {
+		t.Fatal("unauthenticated PUT /blocks wrote to the device")
+	}
+
+	if code := send(http.MethodPut, "/blocks?offset=4096", "secret", "data"); code != http.StatusNoContent {
+		t.Fatalf("PUT /blocks with the token answered %d", code)
+	}
+	if data := readFile(t, device.Name()); string(data[4096:4100]) != "data" {
+		t.Fatal("PUT /blocks with the token did not write to the device")
+	}
+	if code := send(http.MethodPost, "/done", "secret", ""); code != http.StatusNoContent || !doneCalled {
+		t.Fatalf("POST /done with the token answered %d, done called %v", code, doneCalled)
+	}
+}
+
+// reversingWorker takes every task it can get without waiting and completes them in reverse
+// order, so later blocks keep finishing before the ones the output waits for
+func reversingWorker(tasks <-chan Task, results chan<- Result) {
+	for task := range tasks {
+		batch := []Task{task}
+	collect:
+		for {
+			select {
+			case next, ok := <-tasks:
+				if !ok {
+					break collect
+				}
+				batch = append(batch, next)
+			case <-time.After(time.Millisecond):
+				break collect
+			}
+		}
+		for i := len(batch) - 1; i >= 0; i-- {
+			results <- Result{index: batch[i].index, size: batch[i].size}
+		}
+	}
+}
+
+func TestReorderResultsPeakBounded(t *testing.T) {
+	const (
+		blockSize   = 4096
+		blocks      = 2000
+		maxInflight = 16
+		workers     = 4
+	)
+	tasks := make(chan Task, workers)
+	results := make(chan Result, workers)
+	inflight := make(chan struct{}, maxInflight)
+	go dispatchReadTasks(tasks, inflight, blocks*blockSize, blockSize)
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			reversingWorker(tasks, results)
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	next := 0
+	peak, err := reorderResults(results, func(res Result) {
+		if res.index != next {
+			t.Errorf("emitted block %d, want %d", res.index, next)
+		}
+		next++
+		<-inflight
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next != blocks {
+		t.Fatalf("emitted %d blocks, want %d", next, blocks)
+	}
+	// The block the output waits for holds a slot too, so at most maxInflight-1 are buffered
+	if peak >= maxInflight {
+		t.Fatalf("buffered up to %d blocks, want fewer than -max-inflight %d", peak, maxInflight)
+	}
+	if peak == 0 {
+		t.Fatal("no block completed out of order; the test did not exercise the buffer")
+	}
+}
+
+func TestReorderResultsWorkerError(t *testing.T) {
+	results := make(chan Result, 3)
+	results <- Result{index: 1, size: 1}
+	results <- Result{index: 0, err: errors.New("read failed")}
+	close(results)
+	if _, err := reorderResults(results, func(Result) {}); err == nil || !strings.Contains(err.Error(), "block 0") {
+		t.Fatalf("error %v, want the failure of block 0", err)
+	}
+}
@@ -1,17 +1,42 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
 	"log"
+	"net"
+	"os"
+	"os/signal"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/yaml"
+
+	"github.com/webberhuang/hv-vmbr/pkg/backup"
 	"github.com/webberhuang/hv-vmbr/pkg/find"
 	"github.com/webberhuang/hv-vmbr/pkg/k8s"
+	"github.com/webberhuang/hv-vmbr/pkg/logutil"
 	"github.com/webberhuang/hv-vmbr/pkg/manifests"
+	"github.com/webberhuang/hv-vmbr/pkg/stats"
 	"github.com/webberhuang/hv-vmbr/pkg/vm"
 )
 
+// defaultNamespace is used when neither -namespace nor the kubeconfig context sets one.
+const defaultNamespace = "backup"
+
 // tagsFlag allows multiple -tag flags
 type tagsFlag []string
 
@@ -28,33 +53,308 @@ type cliFlags struct {
 	mode       string
 	namespace  string
 	kubeconfig string
+	kubeCtx    string
 	vscMapping string
 	awsID      string
 	awsSecret  string
 	repository string
 	password   string
+	passFile   string
 	tags       tagsFlag
 	vmName     string
 	backupName string
+	nameTmpl   string
+	vmFile     string
+	vmSelector string
+	allowDrv   string
+	privileged bool
+	annotsFile string
+	ioBlock    string
+	image      string
+	cpuRequest string
+	memRequest string
+	cpuLimit   string
+	memLimit   string
+	ioWorkers  int
+	sparse     bool
+	ioDirect   bool
+	repoDate   string
+	strict     bool
+	onExisting string
+	spotCheck  int
+	vsDelete   string
+	skipCheck  bool
+	keyPairs   bool
+	outputDir  string
+	inputDir   string
+	stagingSC  string
+	inclKinds  tagsFlag
+	groupBy    string
+	output     string
+	verbose    bool
+	pvcName    string
+	dataSubset string
+	keepLast   int
+	keepDaily  int
+	keepWeekly int
+	deadline   time.Duration
+	apiRetries int
+	pollIntvl  time.Duration
+	opDeadline time.Duration
+	restoreSC  string
+	createNs   bool
+	start      bool
+	keepMAC    bool
+	copyNsLbl  bool
+	nsRemap    string
+	host       string
+	dumpMans   bool
+	events     string
+	verifyBoot time.Duration
+	dryRun     bool
+	validate   bool
+	preserveAn tagsFlag
+	nodeSel    tagsFlag
+	tolerate   tagsFlag
+	resume     bool
+	latest     bool
+	macs       tagsFlag
+	resize     tagsFlag
+	configFile string
+	findRetry  int
+	newName    string
+	snapID     string
+	forceProt  bool
+	showETA    bool
+	throughput float64
+	parallel   int
+	maxInfl    string
+	exclVMs    tagsFlag
+	exclNs     tagsFlag
+}
+
+// configFile is the layout of a -config file. sigs.k8s.io/yaml decodes YAML through JSON,
+// so the json tags name the keys of both YAML and JSON files.
+type configFile struct {
+	Mode       string            `json:"mode"`
+	Namespace  string            `json:"namespace"`
+	VSC        map[string]string `json:"vsc"`
+	VM         string            `json:"vm"`
+	BackupName string            `json:"backupname"`
+	Tags       []string          `json:"tags"`
+	AWSID      string            `json:"awsid"`
+	AWSSecret  string            `json:"awssecret"`
+	Repository string            `json:"repository"`
+	Password   string            `json:"password"`
 }
 
 func parseFlags() *cliFlags {
 	flags := &cliFlags{}
-	flag.StringVar(&flags.mode, "mode", "", "Operation mode: find, vm-backup, vm-restore, or cleanup")
-	flag.StringVar(&flags.namespace, "namespace", "backup", "Kubernetes namespace (default: backup)")
-	flag.StringVar(&flags.kubeconfig, "kubeconfig", "", "Path to kubeconfig file (optional)")
-	flag.StringVar(&flags.vscMapping, "vsc", "driver.longhorn.io=longhorn-snapshot,nfs.csi.k8s.io=csi-nfs-snapclass", "Mapping between CSI driver and VolumeSnapshotClass (format: driver1=class1,driver2=class2)")
-	flag.StringVar(&flags.awsID, "awsid", "", "AWS_ACCESS_KEY_ID for restic")
-	flag.StringVar(&flags.awsSecret, "awssecret", "", "AWS_SECRET_ACCESS_KEY for restic")
-	flag.StringVar(&flags.repository, "repository", "", "RESTIC_REPOSITORY value")
-	flag.StringVar(&flags.password, "password", "", "RESTIC_PASSWORD value")
+	flag.StringVar(&flags.mode, "mode", "", "Operation mode: "+modeNames("")+"; help describes the flags of each mode")
+	flag.StringVar(&flags.namespace, "namespace", "", "Kubernetes namespace (default: namespace of the current kubeconfig context, or backup)")
+	flag.StringVar(&flags.kubeconfig, "kubeconfig", "", "Path to kubeconfig file (default: the in-cluster service account when running in a pod, else ~/.kube/config)")
+	flag.BoolVar(&flags.createNs, "create-namespace", false, "Create the namespace, labeled app.kubernetes.io/managed-by=hv-vmbr, if it does not exist")
+	flag.StringVar(&flags.kubeCtx, "context", "", "Name of the kubeconfig context to use (default: the current context)")
+	flag.StringVar(&flags.vscMapping, "vsc", "driver.longhorn.io=longhorn-snapshot,nfs.csi.k8s.io=csi-nfs-snapclass", "Mapping between CSI driver and VolumeSnapshotClass (format: driver1=class1,driver2=class2); other drivers use their default VolumeSnapshotClass")
+	flag.StringVar(&flags.allowDrv, "allowed-drivers", "", "Comma-separated list of the only CSI drivers whose volumes may be backed up (e.g. driver.longhorn.io); PVCs on other drivers fail the backup")
+	flag.StringVar(&flags.awsID, "awsid", "", "AWS_ACCESS_KEY_ID for restic (default: $AWS_ACCESS_KEY_ID)")
+	flag.StringVar(&flags.awsSecret, "awssecret", "", "AWS_SECRET_ACCESS_KEY for restic (default: $AWS_SECRET_ACCESS_KEY)")
+	flag.StringVar(&flags.repository, "repository", "", "RESTIC_REPOSITORY value; may contain {{date:LAYOUT}} tokens using Go time layouts (e.g. s3:host/bucket/{{date:2006-01}}) (default: $RESTIC_REPOSITORY)")
+	flag.StringVar(&flags.repoDate, "repository-date", "", "Date (YYYY-MM-DD) used to expand {{date:...}} tokens in -repository and -backupname; required for them outside vm-backup (default: now in vm-backup)")
+	flag.StringVar(&flags.password, "password", "", "RESTIC_PASSWORD value (default: $RESTIC_PASSWORD)")
+	flag.StringVar(&flags.passFile, "password-file", "", "File holding the restic password, which reaches the jobs through a Secret instead of their command line (default: $RESTIC_PASSWORD_FILE)")
 	flag.Var(&flags.tags, "tag", "Tag for filtering snapshots (can be specified multiple times, e.g., -tag ns=backup -tag sn=vm1-b). If not specified, lists all snapshots.")
 	flag.StringVar(&flags.vmName, "vm", "", "Name of the VirtualMachine to backup or restore")
 	flag.StringVar(&flags.backupName, "backupname", "", "Name for the VM backup (required for vm-backup, vm-restore, and cleanup). For find mode, specify this to get detailed backup info.")
+	flag.BoolVar(&flags.privileged, "privileged", false, "Run the backup/restore data jobs as privileged containers (requires the privileged Pod Security Standard)")
+	flag.StringVar(&flags.annotsFile, "annotations-file", "", "Path to a file of annotations (key=value lines or a YAML map) stamped on the backup config and on restored resources")
+	flag.StringVar(&flags.image, "image", manifests.DefaultImage, "Container image of the jobs, providing restic and accelerated_io (e.g. a pinned tag in an internal registry)")
+	flag.StringVar(&flags.cpuRequest, "cpu-request", manifests.DefaultCPURequest, "CPU request of the backup, restore, find and config jobs")
+	flag.StringVar(&flags.memRequest, "mem-request", manifests.DefaultMemRequest, "Memory request of the backup, restore, find and config jobs")
+	flag.StringVar(&flags.cpuLimit, "cpu-limit", manifests.DefaultCPULimit, "CPU limit of the backup, restore, find and config jobs")
+	flag.StringVar(&flags.memLimit, "mem-limit", manifests.DefaultMemLimit, "Memory limit of the backup, restore, find and config jobs")
+	flag.Var(&flags.nodeSel, "node-selector", "Node label the jobs that mount volumes must run on (format: key=value; can be specified multiple times)")
+	flag.Var(&flags.tolerate, "toleration", "Taint the jobs that mount volumes tolerate (format: key[=value][:effect]; can be specified multiple times)")
+	flag.StringVar(&flags.ioBlock, "io-block-size", "64Ki", "Block size used by accelerated_io in the backup/restore jobs (e.g. 64Ki, 1Mi)")
+	flag.IntVar(&flags.ioWorkers, "io-workers", 4, "Number of concurrent accelerated_io workers in the backup/restore jobs")
+	flag.BoolVar(&flags.ioDirect, "io-direct", false, "Open the volumes with O_DIRECT in the backup/restore jobs to bypass the node's page cache (-io-block-size must be a multiple of 4Ki)")
+	flag.BoolVar(&flags.sparse, "sparse-restore", false, "Skip writing all-zero blocks during vm-restore so thin-provisioned volumes stay sparse (the StorageClass must provision zeroed volumes)")
+	flag.BoolVar(&flags.strict, "strict", false, "Fail the operation on any warning that would leave an incomplete backup or restore (e.g. an unreadable secret)")
+	flag.StringVar(&flags.onExisting, "on-existing-secret", vm.SecretPolicySkip, "What vm-restore does when a secret already exists: skip, overwrite, or merge (add missing keys)")
+	flag.IntVar(&flags.spotCheck, "post-backup-spotcheck", 0, "Number of random blocks to compare between each clone PVC and its fresh restic snapshot before cleanup (0 disables)")
+	flag.StringVar(&flags.vsDelete, "snapshot-deletion-policy", "", "Deletion policy for the VolumeSnapshotContent of each backup: Retain or Delete (default: the VolumeSnapshotClass's policy)")
+	flag.BoolVar(&flags.skipCheck, "skip-repo-check", false, "Assume the repository is initialized and skip the upfront repository check job")
+	flag.BoolVar(&flags.keyPairs, "backup-keypairs", false, "Record the Harvester SSH KeyPairs referenced by the VM in the backup so vm-restore can recreate them")
+	flag.StringVar(&flags.outputDir, "output-dir", "", "Local directory the archive mode writes the backup config, volume data and manifest to")
+	flag.StringVar(&flags.inputDir, "input-dir", "", "Archive directory the unarchive mode uploads to the repository")
+	flag.StringVar(&flags.stagingSC, "staging-storage-class", "", "StorageClass of the PVCs unarchive stages volume data on (default: the cluster's default StorageClass)")
+	flag.Var(&flags.inclKinds, "include-kind", "Kind of resource owned by the VM to back up and restore with it, e.g. Service or ConfigMap (can be specified multiple times; use Kind.group for other API groups)")
+	flag.StringVar(&flags.groupBy, "group-by", "", "For find mode, group snapshots by a comma-separated list of host, paths and tags (e.g. -group-by tags)")
+	flag.StringVar(&flags.output, "output", "text", "For find, stats and ls-snapshot modes, and vm-backup and vm-restore with -dry-run, output format: text, or json to print the result or plan to stdout as JSON")
+	flag.BoolVar(&flags.verbose, "verbose", false, "With -output json, keep logging the progress of each job to stderr instead of only warnings and errors")
+	flag.StringVar(&flags.vmSelector, "vm-selector", "", "For vm-backup, back up every VM in the namespace matching this label selector (e.g. tier=db) instead of -vm, each under the backup name <backupname>-<vm>")
+	flag.Var(&flags.exclVMs, "exclude-vm", "For vm-backup with -vm-selector, VM to skip even if it matches, as name or namespace/name (can be specified multiple times)")
+	flag.Var(&flags.exclNs, "exclude-namespace", "For vm-backup with -vm-selector, namespace whose VMs are skipped (can be specified multiple times)")
+	flag.StringVar(&flags.vmFile, "vm-file", "", "For vm-backup, read the VM manifest from this YAML file instead of the cluster; its PVCs must still exist in the namespace")
+	flag.StringVar(&flags.nameTmpl, "backupname-template", "", "For vm-backup without -backupname, template generating the backup name from {{VM}}, {{NAMESPACE}} and {{date:LAYOUT}} tokens (e.g. '{{VM}}-{{date:20060102-150405}}')")
+	flag.BoolVar(&flags.latest, "latest", false, "For vm-restore, restore the most recent backup of the VM given with -vm instead of -backupname")
+	flag.StringVar(&flags.restoreSC, "storageclass", "", "For vm-restore, StorageClass of the restored PVCs (default: the StorageClass of each backed up PVC)")
+	flag.Var(&flags.resize, "resize", "For vm-restore, grow a restored PVC to a new size (format: pvcName=size, e.g. vm1-disk-0=100Gi; can be specified multiple times)")
+	flag.BoolVar(&flags.start, "start", false, "For vm-restore, start the restored VM (runStrategy RerunOnFailure) instead of leaving it Halted")
+	flag.BoolVar(&flags.resume, "resume", false, "For vm-restore, continue an interrupted restore of the same backup and VM name, reusing the PVCs it already restored")
+	flag.BoolVar(&flags.validate, "validate", false, "For find mode with -backupname, check that every volume in the backup config has a snapshot and fail if any is missing")
+	flag.StringVar(&flags.host, "host", "", "For vm-backup, the restic host recorded on the snapshots (default: the job pod's hostname); for find, list only the snapshots of this host")
+	flag.DurationVar(&flags.verifyBoot, "verify-boot", 0, "For vm-restore with -start, wait up to this long (e.g. 10m) for the VM to run with a connected guest agent, failing the restore otherwise (default: do not wait)")
+	flag.StringVar(&flags.nsRemap, "namespace-remap", "", "For vm-restore, restore a backup taken in one namespace into another (format: source=target, e.g. prod=dr-prod); the target is the restore's -namespace")
+	flag.StringVar(&flags.events, "events", "", "Emit lifecycle events of volume backups (snapshot_created, clone_created, backup_job_started, progress, backup_completed, backup_failed) to stderr; json writes one JSON object per line")
+	flag.BoolVar(&flags.dumpMans, "dump-manifests", false, "Print every job and object manifest to stderr, with placeholders substituted and credentials redacted, before applying it")
+	flag.BoolVar(&flags.dryRun, "dry-run", false, "For vm-backup and vm-restore, log the objects that would be created and the restic commands that would run without running them")
+	flag.BoolVar(&flags.copyNsLbl, "copy-namespace-labels", false, "For vm-restore, add the labels of the backed up VM's namespace (e.g. Pod Security admission levels) to the target namespace")
+	flag.BoolVar(&flags.keepMAC, "keep-mac", false, "For vm-restore, keep the MAC addresses of the backed up VM instead of clearing them (only when the source VM is gone)")
+	flag.Var(&flags.preserveAn, "preserve-annotation", "For vm-restore, keep a VM annotation the restore would otherwise remove; a key or a pattern such as harvesterhci.io/* (can be specified multiple times)")
+	flag.Var(&flags.macs, "mac", "For vm-restore, set a MAC address on an interface instead of clearing it (format: interfaceName=00:11:22:33:44:55; can be specified multiple times)")
+	flag.IntVar(&flags.keepLast, "keep-last", 0, "For prune mode, keep the n most recent backups of each VM")
+	flag.IntVar(&flags.keepDaily, "keep-daily", 0, "For prune mode, keep the most recent backup of each VM for each of the last n days with backups")
+	flag.IntVar(&flags.keepWeekly, "keep-weekly", 0, "For prune mode, keep the most recent backup of each VM for each of the last n weeks with backups")
+	flag.StringVar(&flags.dataSubset, "read-data-subset", "10%", "For verify mode, share of the repository data restic check reads (e.g. 10%, 1/5, or 2G)")
+	flag.StringVar(&flags.pvcName, "pvc", "", "For selftest mode, the Block PVC to back up, restore and compare")
+	flag.StringVar(&flags.snapID, "id", "", "For ls-snapshot mode, the ID or short ID of the restic snapshot to list")
+	flag.StringVar(&flags.newName, "new-name", "", "For rename mode, the new name of the backup given with -backupname")
+	flag.BoolVar(&flags.forceProt, "force-protected", false, "For cleanup mode, delete the backup even if it was marked with -mode=protect")
+	flag.BoolVar(&flags.showETA, "show-progress-eta", false, "For vm-backup, print the total PVC size and an estimated backup time before starting")
+	flag.Float64Var(&flags.throughput, "throughput-mbps", 0, "Expected backup throughput in megabytes per second for -show-progress-eta (default: the throughput measured by the VM's previous backup)")
+	flag.IntVar(&flags.parallel, "parallel", 1, "For vm-backup, number of PVCs backed up concurrently, each with its own VolumeSnapshot, clone PVC and backup job")
+	flag.StringVar(&flags.maxInfl, "max-inflight-bytes", "", "For vm-backup with -parallel, upper bound on the combined -io-block-size × -io-workers of the backup jobs running at once (e.g. 4Mi); further PVCs wait until one finishes (default: no limit)")
+	flag.DurationVar(&flags.deadline, "job-deadline", 0, "activeDeadlineSeconds of every job, after which the cluster terminates it (default: as long as the tool waits for that job)")
+	flag.DurationVar(&flags.opDeadline, "deadline", 0, "Upper bound on the whole operation (e.g. 30m); once it passes, no further jobs are started and the operation fails (default: none)")
+	flag.DurationVar(&flags.pollIntvl, "poll-interval", k8s.DefaultOptions().JobPollInterval, "Longest wait between two checks of a running job; checks start every second and back off towards it, with ±20% jitter")
+	flag.IntVar(&flags.apiRetries, "api-retries", k8s.DefaultOptions().APIRetries, "Number of times a Kubernetes API call applying a manifest is retried after a transient error, e.g. a conflict or an etcd timeout")
+	flag.IntVar(&flags.findRetry, "find-retries", k8s.DefaultOptions().ReadRetries, "Number of times the snapshot listing and repository check jobs are retried on failure (backoffLimit)")
+	flag.StringVar(&flags.configFile, "config", "", "YAML or JSON file setting mode, namespace, vsc, vm, backupname, tags and the restic credentials; explicitly set flags take precedence")
 	flag.Parse()
+
+	if flags.configFile != "" {
+		fileFlags, err := loadConfigFile(flags.configFile)
+		if err != nil {
+			log.Fatalf("❌ Failed to load config file %s: %v", flags.configFile, err)
+		}
+		mergeConfigFile(flags, fileFlags)
+	}
+	if err := readPasswordFile(flags); err != nil {
+		log.Fatalf("❌ %v", err)
+	}
+	applyEnvDefaults(flags)
 	return flags
 }
 
+// loadConfigFile reads a -config file into the flags it sets. Unknown keys are rejected
+// so that a misspelled key does not silently fall back to a default.
+func loadConfigFile(path string) (*cliFlags, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file configFile
+	if err := yaml.UnmarshalStrict(data, &file); err != nil {
+		return nil, err
+	}
+
+	vscPairs := make([]string, 0, len(file.VSC))
+	for driver, class := range file.VSC {
+		vscPairs = append(vscPairs, driver+"="+class)
+	}
+	sort.Strings(vscPairs)
+
+	return &cliFlags{
+		mode:       file.Mode,
+		namespace:  file.Namespace,
+		vscMapping: strings.Join(vscPairs, ","),
+		vmName:     file.VM,
+		backupName: file.BackupName,
+		tags:       file.Tags,
+		awsID:      file.AWSID,
+		awsSecret:  file.AWSSecret,
+		repository: file.Repository,
+		password:   file.Password,
+	}, nil
+}
+
+// mergeConfigFile copies the values set in the config file into flags that were not given
+// on the command line. Environment variables are applied afterwards and only fill what is
+// still empty, so the precedence is flag > config file > environment.
+func mergeConfigFile(flags, fileFlags *cliFlags) {
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	for _, v := range []struct {
+		name  string
+		value *string
+		file  string
+	}{
+		{"mode", &flags.mode, fileFlags.mode},
+		{"namespace", &flags.namespace, fileFlags.namespace},
+		{"vsc", &flags.vscMapping, fileFlags.vscMapping},
+		{"vm", &flags.vmName, fileFlags.vmName},
+		{"backupname", &flags.backupName, fileFlags.backupName},
+		{"awsid", &flags.awsID, fileFlags.awsID},
+		{"awssecret", &flags.awsSecret, fileFlags.awsSecret},
+		{"repository", &flags.repository, fileFlags.repository},
+		{"password", &flags.password, fileFlags.password},
+	} {
+		if !explicit[v.name] && v.file != "" {
+			*v.value = v.file
+		}
+	}
+	if !explicit["tag"] && len(fileFlags.tags) > 0 {
+		flags.tags = fileFlags.tags
+	}
+}
+
+// applyEnvDefaults fills the restic credentials that were not given as flags from the
+// environment, so they need not appear in shell history or process listings.
+func applyEnvDefaults(flags *cliFlags) {
+	for _, v := range []struct {
+		value *string
+		env   string
+	}{
+		{&flags.awsID, "AWS_ACCESS_KEY_ID"},
+		{&flags.awsSecret, "AWS_SECRET_ACCESS_KEY"},
+		{&flags.repository, "RESTIC_REPOSITORY"},
+		{&flags.password, "RESTIC_PASSWORD"},
+	} {
+		if *v.value == "" {
+			*v.value = os.Getenv(v.env)
+		}
+	}
+}
+
+// readPasswordFile sets the password from -password-file, or from $RESTIC_PASSWORD_FILE when no
+// password was given otherwise, which the jobs then read from a Secret. Like restic, it strips
+// the trailing newline.
+func readPasswordFile(flags *cliFlags) error {
+	if flags.passFile == "" && flags.password == "" && os.Getenv("RESTIC_PASSWORD") == "" {
+		flags.passFile = os.Getenv("RESTIC_PASSWORD_FILE")
+	}
+	if flags.passFile == "" {
+		return nil
+	}
+	if flags.password != "" {
+		return fmt.Errorf("-password and -password-file are mutually exclusive")
+	}
+	data, err := os.ReadFile(flags.passFile)
+	if err != nil {
+		return fmt.Errorf("failed to read password file: %w", err)
+	}
+	flags.password = strings.TrimRight(string(data), "\r\n")
+	if flags.password == "" {
+		return fmt.Errorf("password file %s is empty", flags.passFile)
+	}
+	return nil
+}
+
 func parseVSCMapping(mappingStr string) map[string]string {
 	mapping := make(map[string]string)
 	if mappingStr == "" {
@@ -63,43 +363,476 @@ func parseVSCMapping(mappingStr string) map[string]string {
 
 	pairs := strings.Split(mappingStr, ",")
 	for _, pair := range pairs {
-		kv := strings.Split(pair, "=")
-		if len(kv) == 2 {
-			driver := strings.TrimSpace(kv[0])
-			class := strings.TrimSpace(kv[1])
-			mapping[driver] = class
+		// Only the first = separates the driver from the class
+		driver, class, ok := strings.Cut(pair, "=")
+		driver, class = strings.TrimSpace(driver), strings.TrimSpace(class)
+		if !ok || driver == "" || class == "" {
+			log.Printf("⚠️  Ignoring malformed -vsc entry %q; expected driver=class", pair)
+			continue
+		}
+		if previous, ok := mapping[driver]; ok && previous != class {
+			log.Printf("⚠️  -vsc maps driver %s more than once; using %s instead of %s", driver, class, previous)
 		}
+		mapping[driver] = class
 	}
 	return mapping
 }
 
+// parseAllowedDrivers splits the comma-separated -allowed-drivers value, dropping the spaces
+// around each driver and empty entries
+func parseAllowedDrivers(value string) []string {
+	var drivers []string
+	for _, driver := range strings.Split(value, ",") {
+		if driver = strings.TrimSpace(driver); driver != "" {
+			drivers = append(drivers, driver)
+		}
+	}
+	return drivers
+}
+
+// loadAnnotationsFile reads annotations from a YAML map or from key=value lines. The file is
+// read as YAML if its first line that is not blank or a # comment is a "key: value" pair or a
+// flow map. Blank lines and lines starting with # are ignored in the key=value form.
+func loadAnnotationsFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if isYAMLMap(data) {
+		return parseYAMLAnnotations(path, data)
+	}
+
+	annotations := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return nil, fmt.Errorf("%s:%d: expected key=value, got %q", path, lineNo, line)
+		}
+		annotations[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return annotations, nil
+}
+
+// isYAMLMap reports whether the first line of data that is not blank or a comment starts a YAML
+// map: a flow map, or a key followed by a colon before any equals sign
+func isYAMLMap(data []byte) bool {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if line == "---" || strings.HasPrefix(line, "{") {
+			return true
+		}
+		colon, equals := strings.Index(line, ":"), strings.Index(line, "=")
+		return colon > 0 && (equals < 0 || colon < equals)
+	}
+	return false
+}
+
+// parseYAMLAnnotations parses a YAML map of annotations, rejecting values that are not strings,
+// such as an unquoted true or 8080, by key
+func parseYAMLAnnotations(path string, data []byte) (map[string]string, error) {
+	var fields map[string]interface{}
+	if err := yaml.Unmarshal(data, &fields); err != nil {
+		return nil, fmt.Errorf("%s: invalid YAML: %w", path, err)
+	}
+	annotations := make(map[string]string, len(fields))
+	for key, value := range fields {
+		str, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s: value of %s is %v, not a string; quote it", path, key, value)
+		}
+		annotations[key] = str
+	}
+	return annotations, nil
+}
+
+// parseMACAddresses converts -mac interfaceName=MAC values into a map from interface name to MAC.
+func parseMACAddresses(values []string) (map[string]string, error) {
+	macs := make(map[string]string)
+	for _, value := range values {
+		kv := strings.SplitN(value, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return nil, fmt.Errorf("expected interfaceName=MAC, got %q", value)
+		}
+		hw, err := net.ParseMAC(strings.TrimSpace(kv[1]))
+		if err != nil || len(hw) != 6 {
+			return nil, fmt.Errorf("invalid MAC address %q for interface %s", kv[1], kv[0])
+		}
+		macs[strings.TrimSpace(kv[0])] = hw.String()
+	}
+	return macs, nil
+}
+
+// parseNodeSelector converts -node-selector key=value values into the inline JSON of a nodeSelector.
+func parseNodeSelector(values []string) (string, error) {
+	selector := make(map[string]string)
+	for _, value := range values {
+		key, val, ok := strings.Cut(value, "=")
+		if !ok {
+			return "", fmt.Errorf("expected key=value, got %q", value)
+		}
+		if errs := validation.IsQualifiedName(key); len(errs) > 0 {
+			return "", fmt.Errorf("invalid label key %q: %s", key, strings.Join(errs, "; "))
+		}
+		if errs := validation.IsValidLabelValue(val); len(errs) > 0 {
+			return "", fmt.Errorf("invalid label value %q: %s", val, strings.Join(errs, "; "))
+		}
+		selector[key] = val
+	}
+	data, err := json.Marshal(selector)
+	return string(data), err
+}
+
+// parseTolerations converts -toleration key[=value][:effect] values, as in kubectl taint, into the
+// inline JSON of a tolerations list. Without a value the toleration uses the Exists operator,
+// and without an effect it tolerates every effect.
+func parseTolerations(values []string) (string, error) {
+	tolerations := []corev1.Toleration{}
+	for _, value := range values {
+		spec, effect, _ := strings.Cut(value, ":")
+		key, val, hasValue := strings.Cut(spec, "=")
+		if key == "" {
+			return "", fmt.Errorf("expected key[=value][:effect], got %q", value)
+		}
+		toleration := corev1.Toleration{Key: key, Operator: corev1.TolerationOpExists}
+		if hasValue {
+			toleration.Operator = corev1.TolerationOpEqual
+			toleration.Value = val
+		}
+		switch corev1.TaintEffect(effect) {
+		case "", corev1.TaintEffectNoSchedule, corev1.TaintEffectPreferNoSchedule, corev1.TaintEffectNoExecute:
+			toleration.Effect = corev1.TaintEffect(effect)
+		default:
+			return "", fmt.Errorf("invalid effect %q in %q; use NoSchedule, PreferNoSchedule or NoExecute", effect, value)
+		}
+		tolerations = append(tolerations, toleration)
+	}
+	data, err := json.Marshal(tolerations)
+	return string(data), err
+}
+
+// parseResize converts -resize pvcName=size values into a map from the backed up PVC name to its new size.
+func parseResize(values []string) (map[string]resource.Quantity, error) {
+	sizes := make(map[string]resource.Quantity)
+	for _, value := range values {
+		kv := strings.SplitN(value, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return nil, fmt.Errorf("expected pvcName=size, got %q", value)
+		}
+		size, err := resource.ParseQuantity(strings.TrimSpace(kv[1]))
+		if err != nil || size.Sign() <= 0 {
+			return nil, fmt.Errorf("invalid size %q for PVC %s", kv[1], kv[0])
+		}
+		sizes[strings.TrimSpace(kv[0])] = size
+	}
+	return sizes, nil
+}
+
+// parseByteSize converts a quantity such as "64Ki" or "1Mi" into a number of bytes.
+func parseByteSize(value string) (int64, error) {
+	q, err := resource.ParseQuantity(value)
+	if err != nil {
+		return 0, err
+	}
+	size, ok := q.AsInt64()
+	if !ok || size <= 0 {
+		return 0, fmt.Errorf("size %q must be a positive number of bytes", value)
+	}
+	return size, nil
+}
+
+// resolveNamespace fills in the namespace from the current kubeconfig context when -namespace
+// is not given, falling back to "backup" if the context does not set one.
+func resolveNamespace(flags *cliFlags) {
+	if flags.namespace != "" {
+		return
+	}
+	if _, target, ok := parseNamespaceRemap(flags.nsRemap); ok {
+		flags.namespace = target
+		return
+	}
+	ns, err := k8s.ContextNamespace(flags.kubeconfig, flags.kubeCtx)
+	if err != nil {
+		log.Printf("⚠️  Could not read the default namespace: %v", err)
+	}
+	if ns == "" {
+		ns = defaultNamespace
+	}
+	flags.namespace = ns
+	log.Printf("📁 Using namespace: %s", ns)
+}
+
+// hostPattern matches the -host values restic accepts that need no quoting in the job's shell
+var hostPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// parseNamespaceRemap splits a -namespace-remap source=target value
+func parseNamespaceRemap(value string) (source, target string, ok bool) {
+	source, target, ok = strings.Cut(value, "=")
+	source, target = strings.TrimSpace(source), strings.TrimSpace(target)
+	return source, target, ok && source != "" && target != ""
+}
+
+// tokenPattern matches the tokens of -repository, -backupname and -backupname-template:
+// {{date:LAYOUT}}, where LAYOUT is a Go time layout, and {{NAME}}.
+var tokenPattern = regexp.MustCompile(`\{\{(?:date:([^}]+)|([A-Z_]+))\}\}`)
+
+// expandTokens replaces every {{date:LAYOUT}} token in value with t formatted using LAYOUT and
+// every {{NAME}} token with fields[NAME]. A {{NAME}} token without a field is an error.
+func expandTokens(value string, t time.Time, fields map[string]string) (string, error) {
+	var err error
+	expanded := tokenPattern.ReplaceAllStringFunc(value, func(token string) string {
+		match := tokenPattern.FindStringSubmatch(token)
+		if layout := match[1]; layout != "" {
+			return t.Format(layout)
+		}
+		field, ok := fields[match[2]]
+		if !ok && err == nil {
+			err = fmt.Errorf("unknown token %s", token)
+		}
+		return field
+	})
+	return expanded, err
+}
+
+// expandTemplates resolves date tokens in -repository and -backupname so every job
+// in this invocation uses the same concrete values, and returns the time they were expanded
+// with. Only vm-backup writes to the repository of the current date; other modes read existing
+// backups, so their tokens are expanded only with an explicit -repository-date and are
+// rejected otherwise.
+func expandTemplates(flags *cliFlags) time.Time {
+	t := time.Now()
+	if flags.repoDate != "" {
+		var err error
+		t, err = time.ParseInLocation("2006-01-02", flags.repoDate, time.Local)
+		if err != nil {
+			log.Fatalf("❌ Invalid -repository-date %q, expected YYYY-MM-DD: %v", flags.repoDate, err)
+		}
+	} else if flags.mode != "vm-backup" {
+		for _, f := range []struct{ name, value string }{{"-repository", flags.repository}, {"-backupname", flags.backupName}} {
+			if tokenPattern.MatchString(f.value) {
+				log.Fatalf("❌ %s contains {{date:...}} tokens; %s expands them only with -repository-date set to the date of the backup, or pass the concrete value", f.name, flags.mode)
+			}
+		}
+		return t
+	}
+
+	repository, err := expandTokens(flags.repository, t, nil)
+	if err != nil {
+		log.Fatalf("❌ Invalid -repository: %v; only {{date:LAYOUT}} tokens are expanded", err)
+	}
+	if repository != flags.repository {
+		flags.repository = repository
+		log.Printf("📦 Resolved repository: %s", k8s.RedactRepository(repository))
+	}
+	backupName, err := expandTokens(flags.backupName, t, nil)
+	if err != nil {
+		log.Fatalf("❌ Invalid -backupname: %v; only {{date:LAYOUT}} tokens are expanded", err)
+	}
+	if backupName != flags.backupName {
+		flags.backupName = backupName
+		log.Printf("📦 Resolved backup name: %s", backupName)
+	}
+	return t
+}
+
+// applyBackupNameTemplate generates the backup name of a vm-backup from -backupname-template when
+// -backupname is not given, and reports whether it did. With -vm-selector the name depends on each
+// VM, so only the template is checked here and backupNamer names the backups as they are listed.
+func applyBackupNameTemplate(flags *cliFlags, t time.Time) bool {
+	if flags.mode != "vm-backup" || flags.backupName != "" || flags.nameTmpl == "" {
+		return false
+	}
+	namer := backupNamer(flags, t)
+	if flags.vmSelector != "" {
+		if _, err := namer("vm"); err != nil {
+			log.Fatalf("❌ %v", err)
+		}
+		log.Println("📦 Backup names are generated from -backupname-template for each VM matching -vm-selector")
+		return true
+	}
+	name, err := namer(flags.vmName)
+	if err != nil {
+		log.Fatalf("❌ %v", err)
+	}
+	flags.backupName = name
+	log.Printf("📦 Generated backup name: %s", flags.backupName)
+	return true
+}
+
+// backupNamer returns a function generating the backup name of a VM from -backupname-template,
+// expanding {{VM}}, {{NAMESPACE}} and {{date:LAYOUT}} with t, so every VM of a run shares the date.
+func backupNamer(flags *cliFlags, t time.Time) func(vmName string) (string, error) {
+	return func(vmName string) (string, error) {
+		name, err := expandTokens(flags.nameTmpl, t, map[string]string{"VM": vmName, "NAMESPACE": flags.namespace})
+		if err != nil {
+			return "", fmt.Errorf("invalid -backupname-template: %w; use {{VM}}, {{NAMESPACE}} and {{date:LAYOUT}}", err)
+		}
+
+		// The name ends up in restic tags, file names and Kubernetes object names
+		if errs := validation.IsDNS1123Label(name); len(errs) > 0 {
+			return "", fmt.Errorf("-backupname-template generated an invalid backup name %q: %s", name, strings.Join(errs, "; "))
+		}
+		return name, nil
+	}
+}
+
 func validateFlags(flags *cliFlags) {
-	if flags.mode != "find" && flags.mode != "vm-backup" && flags.mode != "vm-restore" && flags.mode != "cleanup" {
-		log.Fatal("❌ Please specify -mode=find, -mode=vm-backup, -mode=vm-restore, or -mode=cleanup")
+	spec := lookupMode(flags.mode)
+	if spec == nil {
+		log.Fatalf("❌ Please specify %s (-mode=help describes each mode)", modeNames("-mode="))
 	}
 	if flags.namespace == "" {
 		log.Fatal("❌ Please provide a valid namespace using -namespace")
 	}
-	if flags.awsID == "" || flags.awsSecret == "" || flags.repository == "" || flags.password == "" {
-		log.Fatal("❌ Please provide all secret parameters: -awsid, -awssecret, -repository, -password")
+	validateMode(spec, flags)
+	if flags.dryRun && flags.mode != "vm-backup" && flags.mode != "vm-restore" {
+		log.Fatal("❌ -dry-run is only supported for vm-backup and vm-restore")
+	}
+	if flags.output == "json" && !flags.dryRun && (flags.mode == "vm-backup" || flags.mode == "vm-restore") {
+		log.Fatalf("❌ -output json for %s prints the plan of -dry-run; please add -dry-run", flags.mode)
+	}
+	if flags.nsRemap != "" && flags.mode != "vm-restore" {
+		log.Fatal("❌ -namespace-remap is only supported for vm-restore")
+	}
+	if flags.host != "" {
+		if flags.mode != "vm-backup" && flags.mode != "find" {
+			log.Fatal("❌ -host is only supported for vm-backup and find")
+		}
+		if !hostPattern.MatchString(flags.host) {
+			log.Fatalf("❌ Invalid -host %q; use letters, digits, '.', '_' and '-'", flags.host)
+		}
 	}
 
-	switch flags.mode {
-	case "vm-backup":
-		if flags.vmName == "" || flags.backupName == "" {
-			log.Fatal("❌ For vm-backup mode, please provide -vm and -backupname")
+	if flags.image == "" {
+		log.Fatal("❌ -image must not be empty")
+	}
+	for _, r := range []struct {
+		name, request, limit string
+	}{
+		{"cpu", flags.cpuRequest, flags.cpuLimit},
+		{"mem", flags.memRequest, flags.memLimit},
+	} {
+		request, err := resource.ParseQuantity(r.request)
+		if err != nil {
+			log.Fatalf("❌ Invalid -%s-request: %v", r.name, err)
+		}
+		limit, err := resource.ParseQuantity(r.limit)
+		if err != nil {
+			log.Fatalf("❌ Invalid -%s-limit: %v", r.name, err)
 		}
-		if flags.vscMapping == "" {
-			log.Fatal("❌ For vm-backup mode, please provide -vsc mapping (format: driver1=class1,driver2=class2)")
+		if request.Cmp(limit) > 0 {
+			log.Fatalf("❌ -%s-request must not exceed -%s-limit", r.name, r.name)
+		}
+	}
+	if ioBlockSize, err := parseByteSize(flags.ioBlock); err != nil {
+		log.Fatalf("❌ Invalid -io-block-size: %v", err)
+	} else if flags.ioDirect && ioBlockSize%4096 != 0 {
+		log.Fatal("❌ -io-block-size must be a multiple of 4Ki with -io-direct")
+	}
+	if flags.ioWorkers < 1 {
+		log.Fatal("❌ -io-workers must be at least 1")
+	}
+	if flags.spotCheck < 0 {
+		log.Fatal("❌ -post-backup-spotcheck must not be negative")
+	}
+	if flags.parallel < 1 {
+		log.Fatal("❌ -parallel must be at least 1")
+	}
+	if flags.maxInfl != "" {
+		maxInflight, err := parseByteSize(flags.maxInfl)
+		if err != nil {
+			log.Fatalf("❌ Invalid -max-inflight-bytes: %v", err)
 		}
-	case "vm-restore", "cleanup":
-		if flags.backupName == "" {
-			log.Fatal("❌ For " + flags.mode + " mode, please provide -backupname")
+		if jobBytes := jobInflightBytes(flags); maxInflight < jobBytes {
+			log.Fatalf("❌ -max-inflight-bytes must be at least -io-block-size × -io-workers (%d bytes)", jobBytes)
 		}
 	}
+	if flags.throughput < 0 {
+		log.Fatal("❌ -throughput-mbps must not be negative")
+	}
+	if flags.events != "" && flags.events != "json" {
+		log.Fatal("❌ Please specify -events=json")
+	}
+	if flags.pollIntvl <= 0 {
+		log.Fatal("❌ -poll-interval must be positive")
+	}
+	if flags.deadline < 0 {
+		log.Fatal("❌ -job-deadline must not be negative")
+	}
+	if flags.opDeadline < 0 {
+		log.Fatal("❌ -deadline must not be negative")
+	}
+	if flags.apiRetries < 0 {
+		log.Fatal("❌ -api-retries must not be negative")
+	}
+	if flags.findRetry < 0 {
+		log.Fatal("❌ -find-retries must not be negative")
+	}
+	if flags.vsDelete != "" && flags.vsDelete != "Retain" && flags.vsDelete != "Delete" {
+		log.Fatal("❌ -snapshot-deletion-policy must be Retain or Delete")
+	}
+
+	if _, err := parseNodeSelector(flags.nodeSel); err != nil {
+		log.Fatalf("❌ Invalid -node-selector: %v", err)
+	}
+	if _, err := parseTolerations(flags.tolerate); err != nil {
+		log.Fatalf("❌ Invalid -toleration: %v", err)
+	}
+	for _, pattern := range flags.preserveAn {
+		if _, err := path.Match(pattern, ""); err != nil {
+			log.Fatalf("❌ Invalid -preserve-annotation pattern %q: %v", pattern, err)
+		}
+	}
+
+	if flags.output != "text" && flags.output != "json" {
+		log.Fatal("❌ -output must be text or json")
+	}
+
+	if flags.groupBy != "" {
+		for _, field := range strings.Split(flags.groupBy, ",") {
+			if field != "host" && field != "paths" && field != "tags" {
+				log.Fatalf("❌ Invalid -group-by field %q; use host, paths, or tags", field)
+			}
+		}
+	}
+
+	if flags.allowDrv != "" && len(parseAllowedDrivers(flags.allowDrv)) == 0 {
+		log.Fatalf("❌ -allowed-drivers %q names no CSI driver", flags.allowDrv)
+	}
+
+	if _, err := parseMACAddresses(flags.macs); err != nil {
+		log.Fatalf("❌ Invalid -mac: %v", err)
+	}
+	if _, err := parseResize(flags.resize); err != nil {
+		log.Fatalf("❌ Invalid -resize: %v", err)
+	}
+
 }
 
-func checkRepository(flags *cliFlags) bool {
+// Exit codes of restic 0.17 and later. The repository check job fails at once on either of
+// them instead of being retried.
+const (
+	// resticExitNoRepository means the repository does not exist
+	resticExitNoRepository = 10
+	// resticExitWrongPassword means the repository exists but cannot be opened with the given
+	// password
+	resticExitWrongPassword = 12
+)
+
+// checkRepository reports whether the repository is initialized. A wrong password is fatal
+// rather than being mistaken for a missing repository.
+func checkRepository(ctx context.Context, flags *cliFlags) bool {
 	log.Println("🔧 Applying repository check job manifest...")
 	jobSuffix, err := k8s.GenerateJobSuffix()
 	if err != nil {
@@ -111,21 +844,42 @@ func checkRepository(flags *cliFlags) bool {
 		"AWS_SECRET_ACCESS_KEY": flags.awsSecret,
 		"RESTIC_REPOSITORY":     flags.repository,
 		"RESTIC_PASSWORD":       flags.password,
+		"BACKOFF_LIMIT":         strconv.Itoa(flags.findRetry),
 	}
 	checkJobName := "restic-check-" + jobSuffix
 
-	if err := k8s.ApplyManifest(manifests.ResticCheckJob, flags.namespace, checkJobName, checkRepls); err != nil {
+	timeout := k8s.RetryTimeout(10*time.Second, flags.findRetry)
+	if err := k8s.ApplyJob(ctx, manifests.ResticCheckJob, flags.namespace, checkJobName, timeout, checkRepls); err != nil {
 		log.Fatalf("❌ Failed to apply repository check job manifest: %v", err)
 	}
 
 	log.Println("⌛ Waiting for repository check job to complete...")
-	return k8s.WaitForJob(checkJobName, flags.namespace, 10*time.Second) == nil
+	err = k8s.WaitForJob(ctx, checkJobName, flags.namespace, timeout)
+	if err == nil {
+		return true
+	}
+
+	var jobErr *k8s.JobFailedError
+	if errors.As(err, &jobErr) {
+		switch jobErr.ExitCode {
+		case resticExitWrongPassword:
+			log.Fatalf("❌ Repository %s exists but the password is wrong (%v)", k8s.RedactRepository(flags.repository), err)
+		case resticExitNoRepository:
+			log.Printf("🔍 Repository %s is not initialized", k8s.RedactRepository(flags.repository))
+			return false
+		}
+	}
+	log.Printf("⚠️  Repository check failed: %v", err)
+	return false
 }
 
 func displayBackupInfo(backupInfo *find.BackupInfo) {
 	log.Printf("✅ Backup Information:")
 	log.Printf("📦 Backup Name: %s", backupInfo.BackupName)
 	log.Printf("📁 Namespace: %s", backupInfo.Namespace)
+	if backupInfo.SourceVM != "" {
+		log.Printf("🖥️  Source VM: %s", backupInfo.SourceVM)
+	}
 	log.Printf("🕐 Backup Time: %s", backupInfo.BackupTime.Format("2006-01-02 15:04:05"))
 	log.Printf("💾 Total Size: %.2f MB", float64(backupInfo.TotalSize)/(1024*1024))
 	log.Println("")
@@ -154,57 +908,459 @@ func displayBackupInfo(backupInfo *find.BackupInfo) {
 	}
 }
 
-func handleFindMode(flags *cliFlags) {
+func handleFindMode(ctx context.Context, flags *cliFlags, _ runState) error {
 	// Handle specific backup info lookup
 	if flags.backupName != "" {
-		backupInfo, err := find.RunFindBackupInfo(flags.namespace, flags.backupName, flags.awsID, flags.awsSecret, flags.repository, flags.password)
+		backupInfo, err := find.RunFindBackupInfo(ctx, flags.namespace, flags.backupName, flags.awsID, flags.awsSecret, flags.repository, flags.password)
 		if err != nil {
-			log.Fatalf("❌ Failed to retrieve backup info: %v", err)
+			return fmt.Errorf("failed to retrieve backup info: %w", err)
 		}
-		displayBackupInfo(backupInfo)
-		return
+		var missing []string
+		if flags.validate {
+			if missing, err = backupInfo.Validate(ctx, flags.awsID, flags.awsSecret, flags.repository, flags.password); err != nil {
+				return fmt.Errorf("failed to validate backup: %w", err)
+			}
+		}
+		if flags.output == "json" {
+			if err := printJSON(backupInfo); err != nil {
+				return err
+			}
+		} else {
+			displayBackupInfo(backupInfo)
+		}
+		if len(missing) > 0 {
+			return fmt.Errorf("backup %s is incomplete; no snapshot of volume(s) %s", flags.backupName, strings.Join(missing, ", "))
+		}
+		if flags.validate {
+			log.Printf("✅ Every volume of backup %s has a snapshot", flags.backupName)
+		}
+		return nil
+	}
+
+	if flags.groupBy != "" {
+		return displaySnapshotGroups(ctx, flags)
 	}
 
 	// Handle general snapshot search
-	snapshots, err := find.RunFind(flags.namespace, flags.tags, flags.awsID, flags.awsSecret, flags.repository, flags.password)
+	snapshots, err := find.RunFindHost(ctx, flags.namespace, flags.tags, flags.host, flags.awsID, flags.awsSecret, flags.repository, flags.password)
 	if err != nil {
-		log.Fatalf("❌ Find job failed: %v", err)
+		return fmt.Errorf("find job failed: %w", err)
+	}
+
+	if flags.output == "json" {
+		if snapshots == nil {
+			snapshots = []find.Snapshot{}
+		}
+		return printJSON(snapshots)
 	}
 
 	if len(snapshots) == 0 {
 		log.Println("❌ No snapshots found.")
-		return
+		return nil
 	}
 
 	log.Printf("✅ Found %d snapshot(s):", len(snapshots))
 	for _, snap := range snapshots {
 		log.Printf("  ID: %s, Time: %s, Tags: %v", snap.ShortID, snap.Time.Format("2006-01-02 15:04:05"), snap.Tags)
 	}
+	return nil
+}
+
+// handleStatsMode prints the size of the repository, or of the snapshots matching -tags
+func handleStatsMode(ctx context.Context, flags *cliFlags, _ runState) error {
+	repoStats, err := stats.RunStats(ctx, flags.namespace, flags.tags, flags.awsID, flags.awsSecret, flags.repository, flags.password)
+	if err != nil {
+		return fmt.Errorf("stats job failed: %w", err)
+	}
+
+	if flags.output == "json" {
+		return printJSON(repoStats)
+	}
+
+	scope := "repository"
+	if len(flags.tags) > 0 {
+		scope = fmt.Sprintf("snapshots tagged %v", flags.tags)
+	}
+	log.Printf("📊 Statistics of the %s:", scope)
+	log.Printf("   Snapshots: %d", repoStats.SnapshotsCount)
+	log.Printf("   Files: %d", repoStats.TotalFileCount)
+	log.Printf("   Blobs: %d", repoStats.TotalBlobCount)
+	log.Printf("   Stored size: %s", formatBytes(repoStats.TotalSize))
+	if repoStats.TotalUncompressedSize > 0 {
+		log.Printf("   Uncompressed size: %s (compression ratio %.2fx)", formatBytes(repoStats.TotalUncompressedSize), repoStats.CompressionRatio)
+	}
+	log.Printf("   Restore size: %s (deduplication ratio %.2fx)", formatBytes(repoStats.RestoreSize), repoStats.DedupRatio())
+	return nil
+}
+
+// handleLsMode prints the files of the snapshot given with -id
+func handleLsMode(ctx context.Context, flags *cliFlags, _ runState) error {
+	snapshot, nodes, err := find.RunLs(ctx, flags.namespace, flags.snapID, flags.awsID, flags.awsSecret, flags.repository, flags.password)
+	if err != nil {
+		return fmt.Errorf("ls job failed: %w", err)
+	}
+
+	if flags.output == "json" {
+		return printJSON(struct {
+			Snapshot *find.Snapshot `json:"snapshot"`
+			Nodes    []find.Node    `json:"nodes"`
+		}{snapshot, nodes})
+	}
+
+	log.Printf("📸 Snapshot %s, Time: %s, Tags: %v", snapshot.ShortID, snapshot.Time.Format("2006-01-02 15:04:05"), snapshot.Tags)
+	for _, node := range nodes {
+		if node.Type == "dir" {
+			log.Printf("   📁 %s", node.Path)
+			continue
+		}
+		log.Printf("   📄 %s (%s)", node.Path, formatBytes(node.Size))
+	}
+	return nil
+}
+
+// formatBytes renders a byte count with a binary unit, e.g. "1.50 GiB"
+func formatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.2f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// displaySnapshotGroups lists the snapshots grouped by the -group-by fields
+func displaySnapshotGroups(ctx context.Context, flags *cliFlags) error {
+	groups, err := find.RunFindGrouped(ctx, flags.namespace, flags.tags, flags.host, flags.groupBy, flags.awsID, flags.awsSecret, flags.repository, flags.password)
+	if err != nil {
+		return fmt.Errorf("find job failed: %w", err)
+	}
+
+	if flags.output == "json" {
+		if groups == nil {
+			groups = []find.SnapshotGroup{}
+		}
+		return printJSON(groups)
+	}
+
+	if len(groups) == 0 {
+		log.Println("❌ No snapshots found.")
+		return nil
+	}
+
+	log.Printf("✅ Found %d group(s):", len(groups))
+	for _, group := range groups {
+		key := []string{}
+		if group.GroupKey.Hostname != "" {
+			key = append(key, "host: "+group.GroupKey.Hostname)
+		}
+		if len(group.GroupKey.Paths) > 0 {
+			key = append(key, fmt.Sprintf("paths: %v", group.GroupKey.Paths))
+		}
+		if len(group.GroupKey.Tags) > 0 {
+			key = append(key, fmt.Sprintf("tags: %v", group.GroupKey.Tags))
+		}
+		log.Printf("📂 %s (%d snapshot(s))", strings.Join(key, ", "), len(group.Snapshots))
+		for _, snap := range group.Snapshots {
+			log.Printf("  ID: %s, Time: %s, Tags: %v", snap.ShortID, snap.Time.Format("2006-01-02 15:04:05"), snap.Tags)
+		}
+	}
+	return nil
+}
+
+// printJSON writes v to stdout as indented JSON. Log lines go to stderr, so stdout holds only the result.
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		return fmt.Errorf("failed to encode the result as JSON: %w", err)
+	}
+	return nil
+}
+
+func handleMigrateMode(ctx context.Context, flags *cliFlags, _ runState) error {
+	log.Println("⚠️  Upgrading the repository to format version 2 is one-way: restic versions older than 0.14 can no longer read it.")
+	log.Println("⚠️  Make sure you have a copy of the repository before continuing.")
+
+	jobSuffix, err := k8s.GenerateJobSuffix()
+	if err != nil {
+		return fmt.Errorf("failed to generate job suffix: %w", err)
+	}
+
+	migrateRepls := map[string]string{
+		"AWS_ACCESS_KEY_ID":     flags.awsID,
+		"AWS_SECRET_ACCESS_KEY": flags.awsSecret,
+		"RESTIC_REPOSITORY":     flags.repository,
+		"RESTIC_PASSWORD":       flags.password,
+	}
+	migrateJobName := "restic-migrate-" + jobSuffix
+
+	log.Println("🔧 Applying repository migration job manifest...")
+	timeout := 600 * time.Second
+	if err := k8s.ApplyJob(ctx, manifests.ResticMigrateJob, flags.namespace, migrateJobName, timeout, migrateRepls); err != nil {
+		return fmt.Errorf("failed to apply repository migration job manifest: %w", err)
+	}
+
+	log.Println("⌛ Waiting for repository migration job to complete...")
+	if err := k8s.WaitForJob(ctx, migrateJobName, flags.namespace, timeout); err != nil {
+		return fmt.Errorf("repository migration job did not complete: %w", err)
+	}
+
+	if logs, err := k8s.GetJobLogs(migrateJobName, flags.namespace, "migrate"); err == nil {
+		for _, line := range strings.Split(strings.TrimSpace(logs), "\n") {
+			log.Printf("   %s", line)
+		}
+	}
+	log.Println("✅ Repository upgraded to format version 2.")
+	log.Println("💡 Existing data stays uncompressed until it is repacked with: restic prune --repack-uncompressed")
+	return nil
+}
+
+// k8sOptions returns the settings of the manifests and jobs the tool applies
+func k8sOptions(flags *cliFlags) k8s.Options {
+	nodeSelector, _ := parseNodeSelector(flags.nodeSel)
+	tolerations, _ := parseTolerations(flags.tolerate)
+	ioBlockSize, _ := parseByteSize(flags.ioBlock)
+	replacements := map[string]string{
+		"RESTIC_IMAGE":  flags.image,
+		"RESTIC_HOST":   flags.host,
+		"CPU_REQUEST":   flags.cpuRequest,
+		"MEM_REQUEST":   flags.memRequest,
+		"CPU_LIMIT":     flags.cpuLimit,
+		"MEM_LIMIT":     flags.memLimit,
+		"NODE_SELECTOR": nodeSelector,
+		"TOLERATIONS":   tolerations,
+		"IO_BLOCK_SIZE": strconv.FormatInt(ioBlockSize, 10),
+		"IO_WORKERS":    strconv.Itoa(flags.ioWorkers),
+		"IO_SKIP_ZEROS": strconv.FormatBool(flags.sparse),
+		"IO_DIRECT":     strconv.FormatBool(flags.ioDirect),
+	}
+	if flags.privileged {
+		replacements["DATA_POD_SECURITY_CONTEXT"] = manifests.PrivilegedPodSecurityContext
+		replacements["DATA_SECURITY_CONTEXT"] = manifests.PrivilegedSecurityContext
+	}
+	return k8s.Options{
+		Replacements:     replacements,
+		APIRetries:       flags.apiRetries,
+		DumpManifests:    flags.dumpMans,
+		JobPollInterval:  flags.pollIntvl,
+		JobDeadline:      flags.deadline,
+		PasswordInSecret: flags.passFile != "",
+		ReadRetries:      flags.findRetry,
+	}
 }
 
 func main() {
 	flags := parseFlags()
+	if flags.mode == "help" {
+		printModeHelp(os.Stdout)
+		return
+	}
+	if flags.output == "json" && !flags.verbose {
+		logutil.Quiet(os.Stderr)
+	}
+	resolveNamespace(flags)
+	tokenTime := expandTemplates(flags)
+	nameGenerated := applyBackupNameTemplate(flags, tokenTime)
 	validateFlags(flags)
 
-	if err := k8s.InitK8sClients(flags.kubeconfig); err != nil {
+	if flags.image != manifests.DefaultImage {
+		log.Printf("📦 Using job image %s", flags.image)
+	}
+	if flags.privileged {
+		log.Println("⚠️  Running data jobs as privileged containers")
+	}
+	if err := k8s.InitK8sClients(flags.kubeconfig, flags.kubeCtx, k8sOptions(flags)); err != nil {
 		log.Fatalf("❌ Error initializing Kubernetes clients: %v", err)
 	}
+	logutil.JSONEvents = flags.events == "json"
+	// Interrupting the tool stops the job it waits for and lets the cleanup of the operation run
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		// A second signal terminates the process without waiting for the cleanup
+		stop()
+		log.Println("🛑 Interrupted; stopping the running job and cleaning up (interrupt again to exit immediately)")
+	}()
+	if flags.opDeadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, flags.opDeadline)
+		defer cancel()
+		log.Printf("⏰ Operation deadline: %s", time.Now().Add(flags.opDeadline).Format(time.RFC3339))
+	}
+
+	if flags.createNs && flags.dryRun {
+		exists, err := k8s.NamespaceExists(flags.namespace)
+		if err != nil {
+			log.Fatalf("❌ %v", err)
+		}
+		if !exists {
+			// The rest of the plan runs jobs in the namespace, so it cannot go further without it
+			log.Printf("🧪 would create namespace %s", flags.namespace)
+			log.Println("🧪 Dry run complete; the rest of the plan needs the namespace to exist")
+			return
+		}
+	} else if flags.createNs {
+		created, err := k8s.EnsureNamespace(flags.namespace)
+		if err != nil {
+			log.Fatalf("❌ %v", err)
+		}
+		if created {
+			log.Printf("📁 Created namespace %s", flags.namespace)
+		}
+	}
 
-	repoInitialized := checkRepository(flags)
+	spec := lookupMode(flags.mode)
+	if !spec.repository {
+		if err := spec.run(ctx, flags, runState{}); err != nil {
+			log.Fatalf("❌ %v", err)
+		}
+		return
+	}
+
+	repoInitialized := true
+	if flags.skipCheck {
+		log.Println("⚠️  Skipping repository check; assuming the repository is initialized")
+	} else {
+		repoInitialized = checkRepository(ctx, flags)
+	}
+
+	if !spec.initializesRepository && !repoInitialized {
+		log.Fatalf("❌ Repository is not initialized; cannot run %s subcommand", flags.mode)
+	}
+
+	var annotations map[string]string
+	if flags.annotsFile != "" {
+		var err error
+		annotations, err = loadAnnotationsFile(flags.annotsFile)
+		if err != nil {
+			log.Fatalf("❌ Failed to load annotations file: %v", err)
+		}
+	}
+
+	state := runState{repoInitialized: repoInitialized, nameGenerated: nameGenerated, tokenTime: tokenTime, annotations: annotations}
+	if err := spec.run(ctx, flags, state); err != nil {
+		log.Fatalf("❌ %v", err)
+	}
+}
 
-	if (flags.mode == "find" || flags.mode == "vm-restore" || flags.mode == "cleanup") && !repoInitialized {
-		log.Fatal("❌ Repository is not initialized; cannot run find, vm-restore, or cleanup subcommand")
+// runVMBackupMode backs up the VM, or every VM matching -vm-selector, first making sure a
+// generated backup name is not taken
+func runVMBackupMode(ctx context.Context, flags *cliFlags, state runState) error {
+	vscMapping := parseVSCMapping(flags.vscMapping)
+	checkNameInUse := func(backupName string) error {
+		if !state.nameGenerated || !state.repoInitialized {
+			return nil
+		}
+		inUse, err := vm.BackupNameInUse(ctx, flags.namespace, backupName, flags.awsID, flags.awsSecret, flags.repository, flags.password)
+		if err != nil {
+			return err
+		}
+		if inUse {
+			return fmt.Errorf("generated backup name '%s' is already in use; add a finer-grained field to -backupname-template", backupName)
+		}
+		return nil
 	}
 
-	switch flags.mode {
-	case "find":
-		handleFindMode(flags)
-	case "vm-backup":
-		vscMapping := parseVSCMapping(flags.vscMapping)
-		vm.RunVMBackup(flags.namespace, flags.vmName, flags.backupName, vscMapping, flags.awsID, flags.awsSecret, flags.repository, flags.password, repoInitialized)
-	case "vm-restore":
-		vm.RunVMRestore(flags.namespace, flags.vmName, flags.backupName, flags.awsID, flags.awsSecret, flags.repository, flags.password)
-	case "cleanup":
-		vm.RunVMCleanup(flags.namespace, flags.backupName, flags.awsID, flags.awsSecret, flags.repository, flags.password)
+	if flags.vmSelector != "" {
+		backupNameFor := func(vmName string) (string, error) {
+			return fmt.Sprintf("%s-%s", flags.backupName, vmName), nil
+		}
+		if state.nameGenerated {
+			namer := backupNamer(flags, state.tokenTime)
+			backupNameFor = func(vmName string) (string, error) {
+				backupName, err := namer(vmName)
+				if err != nil {
+					return "", err
+				}
+				return backupName, checkNameInUse(backupName)
+			}
+		}
+		return vm.RunVMBackups(ctx, flags.namespace, flags.vmSelector, backupNameFor, vscMapping, flags.awsID, flags.awsSecret, flags.repository, flags.password, state.repoInitialized, backupOptions(flags, state))
+	}
+
+	if err := checkNameInUse(flags.backupName); err != nil {
+		return err
+	}
+	if err := vm.RunVMBackup(ctx, flags.namespace, flags.vmName, flags.backupName, vscMapping, flags.awsID, flags.awsSecret, flags.repository, flags.password, state.repoInitialized, backupOptions(flags, state)); err != nil {
+		return fmt.Errorf("VM backup failed: %w", err)
+	}
+	return nil
+}
+
+// jobInflightBytes returns the bytes each backup job's accelerated_io workers hold in flight
+func jobInflightBytes(flags *cliFlags) int64 {
+	ioBlockSize, _ := parseByteSize(flags.ioBlock)
+	return ioBlockSize * int64(flags.ioWorkers)
+}
+
+// backupOptions returns the settings of a VM backup given by the flags
+func backupOptions(flags *cliFlags, state runState) vm.BackupOptions {
+	var maxInflight int64
+	if flags.maxInfl != "" {
+		maxInflight, _ = parseByteSize(flags.maxInfl)
+	}
+	opts := vm.BackupOptions{
+		Annotations:       state.annotations,
+		Parallelism:       flags.parallel,
+		MaxInflightBytes:  maxInflight,
+		JobInflightBytes:  jobInflightBytes(flags),
+		AllowedDrivers:    parseAllowedDrivers(flags.allowDrv),
+		VMFile:            flags.vmFile,
+		KeyPairs:          flags.keyPairs,
+		IncludeKinds:      flags.inclKinds,
+		ExcludeVMs:        flags.exclVMs,
+		ExcludeNamespaces: flags.exclNs,
+		ProgressBoard:     flags.events != "json",
+		ShowETA:           flags.showETA,
+		ThroughputMBps:    flags.throughput,
+		Volume: backup.Options{
+			SpotCheckBlocks:        flags.spotCheck,
+			SnapshotDeletionPolicy: flags.vsDelete,
+		},
+		DryRun: flags.dryRun,
+		Strict: flags.strict,
+	}
+	if flags.output == "json" {
+		opts.Plan = func(plan *vm.BackupPlan) error { return printJSON(plan) }
+	}
+	return opts
+}
+
+// runVMRestoreMode restores the backup given with -backupname, or the latest one of -vm
+func runVMRestoreMode(ctx context.Context, flags *cliFlags, state runState) error {
+	if flags.latest {
+		backupName, err := find.RunFindLatestBackup(ctx, flags.namespace, flags.vmName, flags.awsID, flags.awsSecret, flags.repository, flags.password)
+		if err != nil {
+			return fmt.Errorf("failed to find the latest backup: %w", err)
+		}
+		log.Printf("📦 Latest backup of VM %s: %s", flags.vmName, backupName)
+		flags.backupName = backupName
+	}
+	macAddresses, _ := parseMACAddresses(flags.macs)
+	sizes, _ := parseResize(flags.resize)
+	sourceNamespace, _, _ := parseNamespaceRemap(flags.nsRemap)
+	restoreOpts := vm.RestoreOptions{
+		Annotations:         state.annotations,
+		OnExistingSecret:    flags.onExisting,
+		MACAddresses:        macAddresses,
+		StorageClass:        flags.restoreSC,
+		Resize:              sizes,
+		Start:               flags.start,
+		KeepMAC:             flags.keepMAC,
+		CopyNamespaceLabels: flags.copyNsLbl,
+		SourceNamespace:     sourceNamespace,
+		VerifyBoot:          flags.verifyBoot,
+		PreserveAnnotations: flags.preserveAn,
+		Resume:              flags.resume,
+		DryRun:              flags.dryRun,
+		Strict:              flags.strict,
+	}
+	if flags.output == "json" {
+		restoreOpts.Plan = func(plan *vm.RestorePlan) error { return printJSON(plan) }
 	}
+	return vm.RunVMRestore(ctx, flags.namespace, flags.vmName, flags.backupName, flags.awsID, flags.awsSecret, flags.repository, flags.password, restoreOpts)
 }
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseVSCMapping(t *testing.T) {
+	tests := []struct {
+		name    string
+		mapping string
+		want    map[string]string
+	}{
+		{"empty", "", map[string]string{}},
+		{"single", "driver.longhorn.io=longhorn-snapshot", map[string]string{"driver.longhorn.io": "longhorn-snapshot"}},
+		{
+			"several with spaces",
+			" driver.longhorn.io = longhorn-snapshot , nfs.csi.k8s.io=csi-nfs-snapclass",
+			map[string]string{"driver.longhorn.io": "longhorn-snapshot", "nfs.csi.k8s.io": "csi-nfs-snapclass"},
+		},
+		{
+			"class containing =",
+			"driver.longhorn.io=class,weird=a=b",
+			map[string]string{"driver.longhorn.io": "class", "weird": "a=b"},
+		},
+		{
+			"malformed entries skipped",
+			"no-separator,=class,driver.longhorn.io=,,rbd.csi.ceph.com=ceph-snapshot",
+			map[string]string{"rbd.csi.ceph.com": "ceph-snapshot"},
+		},
+		{
+			"duplicate driver uses the last class",
+			"driver.longhorn.io=first,driver.longhorn.io=second",
+			map[string]string{"driver.longhorn.io": "second"},
+		},
+		{
+			"repeated identical entry",
+			"driver.longhorn.io=class,driver.longhorn.io=class",
+			map[string]string{"driver.longhorn.io": "class"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := parseVSCMapping(test.mapping); !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("parseVSCMapping(%q) = %v, want %v", test.mapping, got, test.want)
+			}
+		})
+	}
+}
+
+func TestLoadAnnotationsFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    map[string]string
+		err     string
+	}{
+		{"key=value lines", "# owner\nteam=db\n\nticket = OPS-1\n", map[string]string{"team": "db", "ticket": "OPS-1"}, ""},
+		{"value containing a colon", "url=https://example.com\n", map[string]string{"url": "https://example.com"}, ""},
+		{"YAML map", "# owner\nteam: db\nexample.com/ticket: \"OPS-1\"\n", map[string]string{"team": "db", "example.com/ticket": "OPS-1"}, ""},
+		{"YAML flow map", "{team: db}\n", map[string]string{"team": "db"}, ""},
+		{"empty", "# nothing yet\n", map[string]string{}, ""},
+		{"YAML syntax error", "team: db\n  owner: [x\n", nil, "invalid YAML"},
+		{"YAML number", "team: db\nport: 8080\n", nil, "value of port is 8080, not a string"},
+		{"YAML boolean", "critical: true\n", nil, "value of critical is true, not a string"},
+		{"malformed line", "team=db\nowner\n", nil, "expected key=value"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "annotations")
+			if err := os.WriteFile(path, []byte(test.content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			got, err := loadAnnotationsFile(path)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("error %v, want one containing %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("loadAnnotationsFile = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseAllowedDrivers(t *testing.T) {
+	tests := []struct {
+		value string
+		want  []string
+	}{
+		{"", nil},
+		{"driver.longhorn.io", []string{"driver.longhorn.io"}},
+		{"driver.longhorn.io, rbd.csi.ceph.com", []string{"driver.longhorn.io", "rbd.csi.ceph.com"}},
+		{" driver.longhorn.io ,,rbd.csi.ceph.com,", []string{"driver.longhorn.io", "rbd.csi.ceph.com"}},
+		{" , ", nil},
+	}
+	for _, test := range tests {
+		if got := parseAllowedDrivers(test.value); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parseAllowedDrivers(%q) = %q, want %q", test.value, got, test.want)
+		}
+	}
+}
+
+func TestBackupNamer(t *testing.T) {
+	date := time.Date(2025, 3, 14, 2, 0, 0, 0, time.Local)
+	tests := []struct {
+		template string
+		want     string
+		wantErr  string
+	}{
+		{"{{VM}}-{{date:20060102-150405}}", "vm1-20250314-020000", ""},
+		{"{{NAMESPACE}}-{{VM}}-{{date:2006-01}}", "default-vm1-2025-03", ""},
+		{"nightly", "nightly", ""},
+		{"{{VM}}-{{DATE}}", "", "unknown token {{DATE}}"},
+		{"{{VM}}_{{date:20060102}}", "", "invalid backup name"},
+	}
+	for _, test := range tests {
+		flags := &cliFlags{nameTmpl: test.template, namespace: "default"}
+		got, err := backupNamer(flags, date)("vm1")
+		if test.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("template %q gave %q, %v; want an error containing %q", test.template, got, err, test.wantErr)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf("template %q gave %q, %v; want %q", test.template, got, err, test.want)
+		}
+	}
+}
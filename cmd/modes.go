@@ -0,0 +1,381 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/labels"
+
+	"github.com/webberhuang/hv-vmbr/pkg/verify"
+	"github.com/webberhuang/hv-vmbr/pkg/vm"
+)
+
+// requirement is a flag, or a combination of flags, that a mode cannot run without
+type requirement struct {
+	flags string // As shown to the user, e.g. "-backupname or -backupname-template"
+	met   func(flags *cliFlags) bool
+}
+
+// runState is what main determines before running a mode
+type runState struct {
+	repoInitialized bool
+	nameGenerated   bool      // -backupname was generated from -backupname-template
+	tokenTime       time.Time // Time the {{date:...}} tokens of the flags were expanded with
+	annotations     map[string]string
+}
+
+// modeSpec declares a -mode: validateFlags enforces what it needs, -mode=help prints it, and
+// main runs it. Adding a mode takes only a new entry in modes.
+type modeSpec struct {
+	name    string
+	summary string
+	// repository is set for modes that run restic and need the repository credentials; the
+	// repository is checked before they run
+	repository bool
+	// initializesRepository is set for modes that may run before the repository is initialized
+	initializesRepository bool
+	run                   func(ctx context.Context, flags *cliFlags, state runState) error
+	required              []requirement
+	optional              []string // Names of the flags that only this mode uses
+	example               string   // Arguments after the common flags
+	// validate checks the values of the mode's flags once all requirements are met
+	validate func(flags *cliFlags)
+}
+
+// commonRepositoryFlags are required by every mode with repository set, from flags or the
+// environment, as shown to the user; the password comes from exactly one of its two flags
+var commonRepositoryFlags = []string{"-awsid", "-awssecret", "-repository", "-password | -password-file"}
+
+// backupNameSet is a requirement shared by several modes
+var backupNameSet = requirement{"-backupname", func(flags *cliFlags) bool { return flags.backupName != "" }}
+
+var modes = []modeSpec{
+	{
+		name:       "find",
+		run:        handleFindMode,
+		summary:    "List snapshots, or show the details of a backup",
+		repository: true,
+		optional:   []string{"tag", "host", "backupname", "validate", "group-by", "output", "verbose"},
+		example:    "-tag ns=default",
+		validate: func(flags *cliFlags) {
+			if flags.validate && flags.backupName == "" {
+				log.Fatal("❌ -validate requires -backupname")
+			}
+			if flags.host != "" && flags.backupName != "" {
+				log.Fatal("❌ -host filters the snapshot list and cannot be combined with -backupname")
+			}
+		},
+	},
+	{
+		name:                  "vm-backup",
+		initializesRepository: true,
+		run:                   runVMBackupMode,
+		summary:               "Back up the volumes and configuration of a VirtualMachine",
+		repository:            true,
+		required: []requirement{
+			{"-vm or -vm-selector", func(flags *cliFlags) bool { return flags.vmName != "" || flags.vmSelector != "" }},
+			{"-backupname or -backupname-template", func(flags *cliFlags) bool { return flags.backupName != "" || flags.nameTmpl != "" }},
+		},
+		optional: []string{"vsc", "vm-selector", "exclude-vm", "exclude-namespace", "host", "backupname-template", "vm-file", "allowed-drivers", "parallel", "max-inflight-bytes", "show-progress-eta", "throughput-mbps", "backup-keypairs", "include-kind", "post-backup-spotcheck", "snapshot-deletion-policy", "annotations-file", "dry-run", "output", "verbose"},
+		example:  "-vm vm1 -backupname vm1-b1 -vsc driver.longhorn.io=longhorn-snapshot",
+		validate: func(flags *cliFlags) {
+			if flags.vmSelector == "" {
+				if len(flags.exclVMs) > 0 || len(flags.exclNs) > 0 {
+					log.Fatal("❌ -exclude-vm and -exclude-namespace require -vm-selector")
+				}
+				return
+			}
+			if flags.vmName != "" || flags.vmFile != "" {
+				log.Fatal("❌ -vm-selector cannot be combined with -vm or -vm-file")
+			}
+			if _, err := labels.Parse(flags.vmSelector); err != nil {
+				log.Fatalf("❌ Invalid -vm-selector: %v", err)
+			}
+		},
+	},
+	{
+		name:       "vm-restore",
+		run:        runVMRestoreMode,
+		summary:    "Restore a VirtualMachine from a backup as a new VM",
+		repository: true,
+		required: []requirement{
+			{"-backupname, or -vm with -latest", func(flags *cliFlags) bool {
+				if flags.latest {
+					return flags.vmName != ""
+				}
+				return flags.backupName != ""
+			}},
+		},
+		optional: []string{"vm", "latest", "storageclass", "resize", "mac", "keep-mac", "start", "resume", "on-existing-secret", "preserve-annotation", "copy-namespace-labels", "namespace-remap", "verify-boot", "sparse-restore", "annotations-file", "dry-run", "output", "verbose"},
+		example:  "-backupname vm1-b1 -vm vm1-restored",
+		validate: func(flags *cliFlags) {
+			if flags.latest && flags.backupName != "" {
+				log.Fatal("❌ For vm-restore with -latest, please provide -vm (the original VM name) instead of -backupname")
+			}
+			if flags.onExisting != vm.SecretPolicySkip && flags.onExisting != vm.SecretPolicyOverwrite && flags.onExisting != vm.SecretPolicyMerge {
+				log.Fatal("❌ Please specify -on-existing-secret=skip, overwrite, or merge")
+			}
+			if flags.nsRemap != "" {
+				_, target, ok := parseNamespaceRemap(flags.nsRemap)
+				if !ok {
+					log.Fatalf("❌ Invalid -namespace-remap %q; expected source=target", flags.nsRemap)
+				}
+				if flags.namespace != target {
+					log.Fatalf("❌ -namespace %s differs from the target namespace %s of -namespace-remap", flags.namespace, target)
+				}
+				if flags.latest {
+					log.Fatal("❌ -latest cannot be combined with -namespace-remap; please provide -backupname")
+				}
+			}
+			if flags.verifyBoot < 0 {
+				log.Fatal("❌ -verify-boot must not be negative")
+			}
+			if flags.verifyBoot > 0 && !flags.start {
+				log.Fatal("❌ -verify-boot requires -start, since a halted VM does not boot")
+			}
+		},
+	},
+	{
+		name: "cleanup",
+		run: func(ctx context.Context, flags *cliFlags, _ runState) error {
+			return vm.RunVMCleanup(ctx, flags.namespace, flags.backupName, flags.awsID, flags.awsSecret, flags.repository, flags.password, flags.forceProt)
+		},
+		summary:    "Delete a backup and all its snapshots from the repository",
+		repository: true,
+		required:   []requirement{backupNameSet},
+		optional:   []string{"force-protected"},
+		example:    "-backupname vm1-b1",
+	},
+	{
+		name: "rename",
+		run: func(ctx context.Context, flags *cliFlags, _ runState) error {
+			return vm.RunVMRename(ctx, flags.namespace, flags.backupName, flags.newName, flags.awsID, flags.awsSecret, flags.repository, flags.password, flags.strict)
+		},
+		summary:    "Rename a backup",
+		repository: true,
+		required: []requirement{
+			backupNameSet,
+			{"-new-name", func(flags *cliFlags) bool { return flags.newName != "" }},
+		},
+		example: "-backupname vm1-b1 -new-name vm1-before-upgrade",
+		validate: func(flags *cliFlags) {
+			if flags.newName == flags.backupName {
+				log.Fatal("❌ -new-name must differ from -backupname")
+			}
+		},
+	},
+	{
+		name:       "protect",
+		run:        runProtectMode,
+		summary:    "Protect a backup from cleanup and prune",
+		repository: true,
+		required:   []requirement{backupNameSet},
+		example:    "-backupname vm1-b1",
+	},
+	{
+		name:       "unprotect",
+		run:        runProtectMode,
+		summary:    "Remove the protection of a backup",
+		repository: true,
+		required:   []requirement{backupNameSet},
+		example:    "-backupname vm1-b1",
+	},
+	{
+		name: "archive",
+		run: func(ctx context.Context, flags *cliFlags, _ runState) error {
+			return vm.RunVMArchive(ctx, flags.namespace, flags.backupName, flags.outputDir, flags.awsID, flags.awsSecret, flags.repository, flags.password)
+		},
+		summary:    "Copy a backup out of the repository into a local directory",
+		repository: true,
+		required: []requirement{
+			backupNameSet,
+			{"-output-dir", func(flags *cliFlags) bool { return flags.outputDir != "" }},
+		},
+		example: "-backupname vm1-b1 -output-dir ./vm1-b1",
+	},
+	{
+		name:                  "unarchive",
+		initializesRepository: true,
+		run: func(ctx context.Context, flags *cliFlags, state runState) error {
+			opts := vm.UnarchiveOptions{StagingStorageClass: flags.stagingSC, Strict: flags.strict}
+			return vm.RunVMUnarchive(ctx, flags.namespace, flags.inputDir, flags.awsID, flags.awsSecret, flags.repository, flags.password, state.repoInitialized, opts)
+		},
+		summary:    "Upload an archived backup into the repository",
+		repository: true,
+		required: []requirement{
+			{"-input-dir", func(flags *cliFlags) bool { return flags.inputDir != "" }},
+		},
+		optional: []string{"staging-storage-class"},
+		example:  "-input-dir ./vm1-b1",
+	},
+	{
+		name:       "migrate-repo",
+		run:        handleMigrateMode,
+		summary:    "Upgrade the repository to format version 2 (compression)",
+		repository: true,
+	},
+	{
+		name: "list-orphans",
+		run: func(_ context.Context, flags *cliFlags, _ runState) error {
+			return vm.RunListOrphans(flags.namespace)
+		},
+		summary: "List the transient resources interrupted backups and restores left in the namespace",
+	},
+	{
+		name:                  "selftest",
+		initializesRepository: true,
+		run: func(ctx context.Context, flags *cliFlags, state runState) error {
+			if err := vm.RunSelfTest(ctx, flags.namespace, flags.pvcName, parseVSCMapping(flags.vscMapping), flags.awsID, flags.awsSecret, flags.repository, flags.password, state.repoInitialized, backupOptions(flags, state)); err != nil {
+				return fmt.Errorf("self-test failed: %w", err)
+			}
+			return nil
+		},
+		summary:    "Back up and restore a Block PVC and compare the checksums",
+		repository: true,
+		required: []requirement{
+			{"-pvc", func(flags *cliFlags) bool { return flags.pvcName != "" }},
+		},
+		optional: []string{"vsc"},
+		example:  "-pvc vm1-disk-0 -vsc driver.longhorn.io=longhorn-snapshot",
+	},
+	{
+		name: "verify",
+		run: func(ctx context.Context, flags *cliFlags, _ runState) error {
+			return verify.RunVerify(ctx, flags.namespace, flags.dataSubset, flags.awsID, flags.awsSecret, flags.repository, flags.password)
+		},
+		summary:    "Check the integrity of the repository",
+		repository: true,
+		required: []requirement{
+			{"-read-data-subset", func(flags *cliFlags) bool { return flags.dataSubset != "" }},
+		},
+		example: "-read-data-subset 10%",
+	},
+	{
+		name: "prune",
+		run: func(ctx context.Context, flags *cliFlags, _ runState) error {
+			policy := vm.PrunePolicy{Last: flags.keepLast, Daily: flags.keepDaily, Weekly: flags.keepWeekly}
+			return vm.RunVMPrune(ctx, flags.namespace, policy, flags.awsID, flags.awsSecret, flags.repository, flags.password)
+		},
+		summary:    "Apply a retention policy to the backups of each VM",
+		repository: true,
+		required: []requirement{
+			{"at least one of -keep-last, -keep-daily and -keep-weekly", func(flags *cliFlags) bool {
+				return flags.keepLast != 0 || flags.keepDaily != 0 || flags.keepWeekly != 0
+			}},
+		},
+		optional: []string{"keep-last", "keep-daily", "keep-weekly"},
+		example:  "-keep-last 3 -keep-daily 7",
+		validate: func(flags *cliFlags) {
+			if flags.keepLast < 0 || flags.keepDaily < 0 || flags.keepWeekly < 0 {
+				log.Fatal("❌ -keep-last, -keep-daily and -keep-weekly must not be negative")
+			}
+		},
+	},
+	{
+		name:       "stats",
+		run:        handleStatsMode,
+		summary:    "Print the size and deduplication ratio of the repository",
+		repository: true,
+		optional:   []string{"tag", "output", "verbose"},
+	},
+	{
+		name:       "ls-snapshot",
+		run:        handleLsMode,
+		summary:    "List the files a snapshot holds, e.g. the PV-named file a restore dumps",
+		repository: true,
+		required: []requirement{
+			{"-id", func(flags *cliFlags) bool { return flags.snapID != "" }},
+		},
+		optional: []string{"output", "verbose"},
+		example:  "-id 4f2a9c1e",
+		validate: func(flags *cliFlags) {
+			if !snapshotIDPattern.MatchString(flags.snapID) {
+				log.Fatalf("❌ Invalid -id %q; expected a hexadecimal restic snapshot ID", flags.snapID)
+			}
+		},
+	},
+}
+
+// snapshotIDPattern matches a full or short restic snapshot ID
+var snapshotIDPattern = regexp.MustCompile(`^[0-9a-f]{1,64}$`)
+
+// runProtectMode marks the backup protected, or removes the mark for unprotect mode
+func runProtectMode(ctx context.Context, flags *cliFlags, _ runState) error {
+	return vm.RunVMProtect(ctx, flags.namespace, flags.backupName, flags.mode == "protect", flags.awsID, flags.awsSecret, flags.repository, flags.password)
+}
+
+// lookupMode returns the spec of the named mode, or nil if there is none
+func lookupMode(name string) *modeSpec {
+	for i := range modes {
+		if modes[i].name == name {
+			return &modes[i]
+		}
+	}
+	return nil
+}
+
+// modeNames lists the modes for messages, e.g. "find, vm-backup, or stats"
+func modeNames(prefix string) string {
+	names := make([]string, len(modes))
+	for i, mode := range modes {
+		names[i] = prefix + mode.name
+	}
+	return strings.Join(names[:len(names)-1], ", ") + ", or " + names[len(names)-1]
+}
+
+// validateMode enforces the spec of the selected mode
+func validateMode(spec *modeSpec, flags *cliFlags) {
+	if spec.repository && (flags.awsID == "" || flags.awsSecret == "" || flags.repository == "" || flags.password == "") {
+		log.Fatal("❌ Please provide all secret parameters as flags (-awsid, -awssecret, -repository, and one of -password or -password-file) or environment variables (AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, RESTIC_REPOSITORY, and RESTIC_PASSWORD or RESTIC_PASSWORD_FILE)")
+	}
+	for _, req := range spec.required {
+		if !req.met(flags) {
+			log.Fatalf("❌ For %s mode, please provide %s", spec.name, req.flags)
+		}
+	}
+	if spec.validate != nil {
+		spec.validate(flags)
+	}
+}
+
+// printModeHelp writes the required and optional flags of every mode and an example invocation
+func printModeHelp(w io.Writer) {
+	fmt.Fprintln(w, "Modes (all take -namespace; see -h for the flags every mode accepts):")
+	for _, mode := range modes {
+		fmt.Fprintf(w, "\n  %s: %s\n", mode.name, mode.summary)
+		var required []string
+		if mode.repository {
+			required = append(required, commonRepositoryFlags...)
+		}
+		for _, req := range mode.required {
+			required = append(required, req.flags)
+		}
+		if len(required) > 0 {
+			fmt.Fprintf(w, "    required: %s\n", strings.Join(required, "; "))
+		}
+		if len(mode.optional) > 0 {
+			fmt.Fprintln(w, "    optional:")
+		}
+		for _, name := range mode.optional {
+			f := flag.Lookup(name)
+			if f == nil {
+				panic("mode " + mode.name + " lists unknown flag -" + name)
+			}
+			fmt.Fprintf(w, "      -%s: %s\n", name, f.Usage)
+		}
+		example := "restic-backup -mode " + mode.name + " -namespace default"
+		if mode.repository {
+			example += " -repository s3:<ENDPOINT>/<BUCKET> -password <PASSWORD> -awsid <KEY_ID> -awssecret <SECRET>"
+		}
+		if mode.example != "" {
+			example += " " + mode.example
+		}
+		fmt.Fprintf(w, "    example: %s\n", example)
+	}
+}
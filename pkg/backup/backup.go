@@ -1,15 +1,63 @@
 package backup
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"log"
+	"runtime/debug"
+	"strconv"
+	"strings"
 	"time"
 
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
 	"github.com/webberhuang/hv-vmbr/pkg/find"
 	"github.com/webberhuang/hv-vmbr/pkg/k8s"
+	"github.com/webberhuang/hv-vmbr/pkg/logutil"
 	"github.com/webberhuang/hv-vmbr/pkg/manifests"
 )
 
+// Options holds the optional settings of a PVC backup
+type Options struct {
+	// SpotCheckBlocks is the number of random blocks compared between the clone PVC and
+	// the fresh restic snapshot before cleanup. Zero disables the post-backup spot check.
+	SpotCheckBlocks int
+	// SnapshotDeletionPolicy, when set to Retain or Delete, overrides the deletionPolicy of the
+	// VolumeSnapshotContent created for each backup. Empty keeps the VolumeSnapshotClass's policy.
+	SnapshotDeletionPolicy string
+	// Progress, when set, receives the progress of the backup job instead of k8s.LogProgress
+	Progress k8s.ProgressFunc
+	// KeepClone leaves the VolumeSnapshot and clone PVC in place after a successful backup, so
+	// the caller can read the data that was backed up. The caller deletes them with
+	// k8s.CleanupResources. They are removed as usual when the backup fails.
+	KeepClone bool
+}
+
+// Phases of a PVC backup, reported by PhaseError
+const (
+	PhaseCheck    = "check"
+	PhaseSnapshot = "snapshot"
+	PhaseClone    = "clone"
+	PhaseBackup   = "backup"
+	PhaseVerify   = "verify"
+)
+
+// PhaseError is returned by RunBackup and names the phase of the backup that failed.
+type PhaseError struct {
+	Phase string
+	Err   error
+}
+
+func (e *PhaseError) Error() string {
+	return fmt.Sprintf("%s phase: %v", e.Phase, e.Err)
+}
+
+func (e *PhaseError) Unwrap() error {
+	return e.Err
+}
+
 type backupContext struct {
 	namespace       string
 	pvcName         string
@@ -23,20 +71,55 @@ type backupContext struct {
 	clonePVCName    string
 	vsCreated       bool
 	pvcCloneCreated bool
+	deviceSize      int64
+	checksum        string
+	opts            Options
 }
 
+// cleanup deletes the VolumeSnapshot and clone PVC the backup created. Calling it again is a no-op.
 func (b *backupContext) cleanup() {
 	k8s.CleanupResources(b.namespace, b.vsName, b.clonePVCName, b.vsCreated, b.pvcCloneCreated)
+	b.vsCreated = false
+	b.pvcCloneCreated = false
 }
 
-func (b *backupContext) fatalCleanup(format string, args ...interface{}) {
-	b.cleanup()
-	log.Fatalf(format, args...)
+// event emits a lifecycle event of the backup in the given phase
+func (b *backupContext) event(kind, phase string, fields map[string]interface{}) {
+	event := map[string]interface{}{
+		"phase":     phase,
+		"namespace": b.namespace,
+		"pvc":       b.pvcName,
+	}
+	for key, value := range fields {
+		event[key] = value
+	}
+	logutil.Event(kind, event)
+}
+
+// VolumeSnapshotName is the name of the VolumeSnapshot RunBackup takes of a PVC
+func VolumeSnapshotName(pvcName string) string {
+	return pvcName + "-vs"
+}
+
+// ClonePVCName is the name of the PVC RunBackup clones from the VolumeSnapshot and reads
+func ClonePVCName(pvcName string) string {
+	return pvcName + "-clone"
+}
+
+// Result describes the data a backup job read from the block device
+type Result struct {
+	// DeviceSize is the size of the block device
+	DeviceSize int64
+	// Checksum is the hex SHA-256 of the device contents
+	Checksum string
 }
 
 // RunBackup executes the backup workflow for a given namespace and PVC.
-func RunBackup(namespace, pvcName, snapshot, vsc, awsID, awsSecret, repository, password string, repoInitialized bool) {
-	ctx := &backupContext{
+// The VolumeSnapshot and clone PVC it creates are removed whether or not the backup succeeds,
+// even if it panics, unless opts.KeepClone keeps them after a success. Failures, panics
+// included, are returned as a *PhaseError.
+func RunBackup(ctx context.Context, namespace, pvcName, snapshot, vsc, awsID, awsSecret, repository, password string, repoInitialized bool, opts Options) (result Result, err error) {
+	b := &backupContext{
 		namespace:    namespace,
 		pvcName:      pvcName,
 		snapshot:     snapshot,
@@ -45,139 +128,323 @@ func RunBackup(namespace, pvcName, snapshot, vsc, awsID, awsSecret, repository,
 		awsSecret:    awsSecret,
 		repository:   repository,
 		password:     password,
-		vsName:       pvcName + "-vs",
-		clonePVCName: pvcName + "-clone",
+		vsName:       VolumeSnapshotName(pvcName),
+		clonePVCName: ClonePVCName(pvcName),
+		opts:         opts,
 	}
+	defer func() {
+		if err != nil || !b.opts.KeepClone {
+			b.cleanup()
+		}
+	}()
+	defer func() {
+		var phaseErr *PhaseError
+		if errors.As(err, &phaseErr) {
+			b.event("backup_failed", phaseErr.Phase, map[string]interface{}{"error": err.Error()})
+		}
+	}()
+	// A panic becomes an error, so concurrent backups of the VM's other PVCs keep running and
+	// clean up after themselves instead of being torn down with the process
+	phase := PhaseCheck
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("❌ Backup of PVC %s panicked: %v\n%s", pvcName, r, debug.Stack())
+			result, err = Result{}, &PhaseError{phase, fmt.Errorf("panic: %v", r)}
+		}
+	}()
 
-	checkExistingBackup(ctx, repoInitialized)
-	createVolumeSnapshot(ctx)
-	createClonePVC(ctx)
-	pvName := getPVName(ctx)
-	initializeRepository(ctx, repoInitialized)
-	runBackupJob(ctx, pvName)
+	if err := checkExistingBackup(ctx, b, repoInitialized); err != nil {
+		return Result{}, &PhaseError{PhaseCheck, err}
+	}
+	if err := checkSourcePVC(ctx, b); err != nil {
+		return Result{}, &PhaseError{PhaseCheck, err}
+	}
+	phase = PhaseSnapshot
+	if err := createVolumeSnapshot(ctx, b); err != nil {
+		return Result{}, &PhaseError{PhaseSnapshot, err}
+	}
+	phase = PhaseClone
+	if err := createClonePVC(ctx, b); err != nil {
+		return Result{}, &PhaseError{PhaseClone, err}
+	}
+	phase = PhaseBackup
+	// The source PV names the device file in the snapshot. It is read from the source PVC, which
+	// is bound, and not from the clone, which may stay unbound until the backup job mounts it.
+	pvName, err := k8s.GetPVCVolumeName(b.pvcName, b.namespace)
+	if err != nil {
+		return Result{}, &PhaseError{PhaseBackup, fmt.Errorf("failed to get PV name: %w", err)}
+	}
+	if err := initializeRepository(ctx, b, repoInitialized); err != nil {
+		return Result{}, &PhaseError{PhaseBackup, err}
+	}
+	if err := runBackupJob(ctx, b, pvName); err != nil {
+		return Result{}, &PhaseError{PhaseBackup, err}
+	}
+	if b.opts.SpotCheckBlocks > 0 {
+		phase = PhaseVerify
+		if err := runSpotCheck(ctx, b, pvName); err != nil {
+			return Result{}, &PhaseError{PhaseVerify, err}
+		}
+	}
 
 	log.Println("✅ Backup completed successfully.")
-	ctx.cleanup()
+	b.event("backup_completed", PhaseBackup, map[string]interface{}{"percent": 100, "snapshot": b.snapshot, "deviceSize": b.deviceSize})
+	return Result{DeviceSize: b.deviceSize, Checksum: b.checksum}, nil
 }
 
-func checkExistingBackup(ctx *backupContext, repoInitialized bool) {
+func checkExistingBackup(ctx context.Context, b *backupContext, repoInitialized bool) error {
 	if !repoInitialized {
-		return
+		return nil
 	}
-	snapshotID, err := find.RunFindByID(ctx.namespace, ctx.snapshot, ctx.awsID, ctx.awsSecret, ctx.repository, ctx.password)
+	snapshotID, err := find.RunFindByID(ctx, b.namespace, b.snapshot, b.awsID, b.awsSecret, b.repository, b.password)
 	if err == nil {
-		log.Fatalf("❌ Found existing backup snapshotID %s with same tags ns %s snapshot %s", snapshotID, ctx.namespace, ctx.snapshot)
+		return fmt.Errorf("found existing backup snapshotID %s with same tags ns %s snapshot %s", snapshotID, b.namespace, b.snapshot)
 	}
 	if !errors.Is(err, find.ErrSnapshotNotFound) {
-		log.Fatalf("❌ Failed to check %v current backup with ns %s snapshot %s", err, ctx.namespace, ctx.snapshot)
+		return fmt.Errorf("failed to check current backup with ns %s snapshot %s: %w", b.namespace, b.snapshot, err)
 	}
+	return nil
 }
 
-func createVolumeSnapshot(ctx *backupContext) {
+// checkSourcePVC fails fast if the PVC is not in the namespace; a VolumeSnapshot of a missing
+// PVC is created but never becomes ready.
+func checkSourcePVC(ctx context.Context, b *backupContext) error {
+	_, err := k8s.Clientset.CoreV1().PersistentVolumeClaims(b.namespace).Get(ctx, b.pvcName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return fmt.Errorf("PVC %s not found in namespace %s", b.pvcName, b.namespace)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get PVC %s in namespace %s: %w", b.pvcName, b.namespace, err)
+	}
+	return nil
+}
+
+func createVolumeSnapshot(ctx context.Context, b *backupContext) error {
 	vsRepls := map[string]string{
-		"PVC_NAME":                  ctx.pvcName,
-		"VOLUME_SNAPSHOT_CLASSNAME": ctx.vsc,
+		"PVC_NAME":                  b.pvcName,
+		"VOLUME_SNAPSHOT_CLASSNAME": b.vsc,
 	}
-	if err := k8s.ApplyManifest(manifests.VolumeSnapshot, ctx.namespace, ctx.vsName, vsRepls); err != nil {
-		ctx.fatalCleanup("❌ Failed to create VolumeSnapshot: %v", err)
+	if err := k8s.ApplyManifest(ctx, manifests.VolumeSnapshot, b.namespace, b.vsName, vsRepls); err != nil {
+		return fmt.Errorf("failed to create VolumeSnapshot: %w", err)
 	}
-	ctx.vsCreated = true
+	b.vsCreated = true
 
-	log.Printf("⌛ Waiting for VolumeSnapshot %s to be ready...", ctx.vsName)
-	if err := k8s.WaitForVolumeSnapshot(ctx.vsName, ctx.namespace, 300*time.Second); err != nil {
-		ctx.fatalCleanup("❌ VolumeSnapshot %s not ready: %v", ctx.vsName, err)
+	log.Printf("⌛ Waiting for VolumeSnapshot %s to be ready...", b.vsName)
+	if err := k8s.WaitForVolumeSnapshot(ctx, b.vsName, b.namespace, 300*time.Second); err != nil {
+		return fmt.Errorf("VolumeSnapshot %s not ready: %w", b.vsName, err)
 	}
+	b.event("snapshot_created", PhaseSnapshot, map[string]interface{}{"volumeSnapshot": b.vsName})
+
+	return applySnapshotDeletionPolicy(b)
 }
 
-func createClonePVC(ctx *backupContext) {
-	sc, err := k8s.GetPVCStorageClass(ctx.pvcName, ctx.namespace)
+// applySnapshotDeletionPolicy logs the deletion policy that decides whether removing the
+// VolumeSnapshot also reclaims the storage-side snapshot, and applies Options.SnapshotDeletionPolicy
+// to the bound VolumeSnapshotContent when it differs from the class default.
+func applySnapshotDeletionPolicy(b *backupContext) error {
+	classPolicy, err := k8s.GetVolumeSnapshotClassDeletionPolicy(b.vsc)
 	if err != nil {
-		ctx.fatalCleanup("❌ Failed to get storage class: %v", err)
+		log.Printf("⚠️  Unable to determine deletion policy of VolumeSnapshotClass %s: %v", b.vsc, err)
+	}
+
+	if b.opts.SnapshotDeletionPolicy == "" || b.opts.SnapshotDeletionPolicy == classPolicy {
+		if classPolicy != "" {
+			log.Printf("📋 VolumeSnapshot %s uses deletion policy %s from VolumeSnapshotClass %s", b.vsName, classPolicy, b.vsc)
+		}
+		return nil
 	}
-	ssize, err := k8s.GetPVCStorageSize(ctx.pvcName, ctx.namespace)
+
+	contentName, err := k8s.SetVolumeSnapshotContentDeletionPolicy(b.vsName, b.namespace, b.opts.SnapshotDeletionPolicy)
+	if err != nil {
+		return fmt.Errorf("failed to set deletion policy %s: %w", b.opts.SnapshotDeletionPolicy, err)
+	}
+	log.Printf("📋 VolumeSnapshotContent %s deletion policy set to %s (VolumeSnapshotClass %s default: %s)", contentName, b.opts.SnapshotDeletionPolicy, b.vsc, classPolicy)
+	return nil
+}
+
+func createClonePVC(ctx context.Context, b *backupContext) error {
+	sc, err := k8s.GetPVCStorageClass(b.pvcName, b.namespace)
 	if err != nil {
-		ctx.fatalCleanup("❌ Failed to get storage size: %v", err)
+		return fmt.Errorf("failed to get storage class: %w", err)
 	}
-	vmode, err := k8s.GetPVCVolumeMode(ctx.pvcName, ctx.namespace)
+	ssize, err := k8s.GetPVCStorageSize(b.pvcName, b.namespace)
 	if err != nil {
-		ctx.fatalCleanup("❌ Failed to get volume mode: %v", err)
+		return fmt.Errorf("failed to get storage size: %w", err)
+	}
+	vmode, err := k8s.GetPVCVolumeMode(b.pvcName, b.namespace)
+	if err != nil {
+		return fmt.Errorf("failed to get volume mode: %w", err)
 	}
 
 	cloneRepls := map[string]string{
 		"VOLUME_MODE":          vmode,
 		"STORAGE_CLASS":        sc,
 		"STORAGE_SIZE":         ssize,
-		"VOLUME_SNAPSHOT_NAME": ctx.vsName,
+		"VOLUME_SNAPSHOT_NAME": b.vsName,
 	}
-	if err := k8s.ApplyManifest(manifests.PVCClone, ctx.namespace, ctx.clonePVCName, cloneRepls); err != nil {
-		ctx.fatalCleanup("❌ Failed to create PVC clone: %v", err)
+	if err := k8s.ApplyManifest(ctx, manifests.PVCClone, b.namespace, b.clonePVCName, cloneRepls); err != nil {
+		return fmt.Errorf("failed to create PVC clone: %w", err)
 	}
-	ctx.pvcCloneCreated = true
-
-	log.Printf("✅ PVC clone %s created successfully", ctx.clonePVCName)
-}
+	b.pvcCloneCreated = true
 
-func getPVName(ctx *backupContext) string {
-	pvName, err := k8s.GetPVCVolumeName(ctx.pvcName, ctx.namespace)
-	if err != nil {
-		ctx.fatalCleanup("❌ Failed to get PV name: %v", err)
+	log.Printf("✅ PVC clone %s created successfully", b.clonePVCName)
+	b.event("clone_created", PhaseClone, map[string]interface{}{"clonePVC": b.clonePVCName})
+	// Nothing waits for the clone to bind: the backup job is its first consumer
+	if wffc, err := k8s.StorageClassWaitsForFirstConsumer(sc); err != nil {
+		log.Printf("⚠️  Unable to determine volume binding mode of StorageClass %s: %v", sc, err)
+	} else if wffc {
+		log.Printf("📋 StorageClass %s binds on first use; PVC clone %s stays Pending until the backup job mounts it", sc, b.clonePVCName)
 	}
-	return pvName
+	return nil
 }
 
-func initializeRepository(ctx *backupContext, repoInitialized bool) {
+func initializeRepository(ctx context.Context, b *backupContext, repoInitialized bool) error {
 	if repoInitialized {
 		log.Println("✅ Restic repository already initialized.")
-		return
+		return nil
 	}
 
 	log.Println("🔧 Restic repository not initialized. Applying init job...")
+	return InitializeRepository(ctx, b.namespace, b.awsID, b.awsSecret, b.repository, b.password)
+}
+
+// InitializeRepository runs "restic init" against the repository in a job.
+func InitializeRepository(ctx context.Context, namespace, awsID, awsSecret, repository, password string) error {
 	jobSuffix, err := k8s.GenerateJobSuffix()
 	if err != nil {
-		log.Fatalf("❌ Failed to generate job suffix for init job: %v", err)
+		return fmt.Errorf("failed to generate job suffix for init job: %w", err)
 	}
 
 	initRepls := map[string]string{
-		"AWS_ACCESS_KEY_ID":     ctx.awsID,
-		"AWS_SECRET_ACCESS_KEY": ctx.awsSecret,
-		"RESTIC_REPOSITORY":     ctx.repository,
-		"RESTIC_PASSWORD":       ctx.password,
+		"AWS_ACCESS_KEY_ID":     awsID,
+		"AWS_SECRET_ACCESS_KEY": awsSecret,
+		"RESTIC_REPOSITORY":     repository,
+		"RESTIC_PASSWORD":       password,
 	}
-	if err := k8s.ApplyManifest(manifests.ResticInitJob, ctx.namespace, "restic-init-"+jobSuffix, initRepls); err != nil {
-		ctx.fatalCleanup("❌ Failed to apply init job: %v", err)
+	timeout := 30 * time.Second
+	if err := k8s.ApplyJob(ctx, manifests.ResticInitJob, namespace, "restic-init-"+jobSuffix, timeout, initRepls); err != nil {
+		return fmt.Errorf("failed to apply init job: %w", err)
 	}
-	if err := k8s.WaitForJob("restic-init-"+jobSuffix, ctx.namespace, 30*time.Second); err != nil {
-		ctx.fatalCleanup("❌ Init job did not complete: %v", err)
+	if err := k8s.WaitForJob(ctx, "restic-init-"+jobSuffix, namespace, timeout); err != nil {
+		return fmt.Errorf("init job did not complete: %w", err)
 	}
+	return nil
 }
 
-func runBackupJob(ctx *backupContext, pvName string) {
+func runBackupJob(ctx context.Context, b *backupContext, pvName string) error {
 	jobSuffix, err := k8s.GenerateJobSuffix()
 	if err != nil {
-		log.Fatalf("❌ Failed to generate job suffix for backup job: %v", err)
+		return fmt.Errorf("failed to generate job suffix for backup job: %w", err)
 	}
 
 	backupRepls := map[string]string{
-		"AWS_ACCESS_KEY_ID":     ctx.awsID,
-		"AWS_SECRET_ACCESS_KEY": ctx.awsSecret,
-		"RESTIC_REPOSITORY":     ctx.repository,
-		"RESTIC_PASSWORD":       ctx.password,
-		"PVC_NAME":              ctx.clonePVCName,
+		"AWS_ACCESS_KEY_ID":     b.awsID,
+		"AWS_SECRET_ACCESS_KEY": b.awsSecret,
+		"RESTIC_REPOSITORY":     b.repository,
+		"RESTIC_PASSWORD":       b.password,
+		"PVC_NAME":              b.clonePVCName,
 		"PV_NAME":               pvName,
-		"SNAPSHOT_NAME":         ctx.snapshot,
+		"SNAPSHOT_NAME":         b.snapshot,
 	}
-	if err := k8s.ApplyManifest(manifests.BackupJob, ctx.namespace, "block-backup-job-"+jobSuffix, backupRepls); err != nil {
-		ctx.fatalCleanup("❌ Failed to apply backup job manifest: %v", err)
+	timeout := 3600 * time.Second
+	if err := k8s.ApplyJob(ctx, manifests.BackupJob, b.namespace, "block-backup-job-"+jobSuffix, timeout, backupRepls); err != nil {
+		return fmt.Errorf("failed to apply backup job manifest: %w", err)
 	}
+	b.event("backup_job_started", PhaseBackup, map[string]interface{}{"job": "block-backup-job-" + jobSuffix})
 
+	logProgress := k8s.LogProgress
+	if b.opts.Progress != nil {
+		logProgress = b.opts.Progress
+	}
+	progress := func(current, total int64, percent float64) {
+		logProgress(current, total, percent)
+		b.event("progress", PhaseBackup, map[string]interface{}{"percent": percent, "bytes": current, "totalBytes": total})
+	}
 	go func() {
-		if err := k8s.StreamJobProgressPercentage("block-backup-job-"+jobSuffix, ctx.namespace, "backup", "READ progress:"); err != nil {
+		if err := k8s.StreamJobProgressPercentage(ctx, "block-backup-job-"+jobSuffix, b.namespace, "backup", "READ progress:", progress); err != nil {
 			log.Printf("❌ Error streaming backup progress logs: %v", err)
 		}
 	}()
 
 	log.Println("⌛ Waiting for backup job to complete...")
-	if err := k8s.WaitForJob("block-backup-job-"+jobSuffix, ctx.namespace, 3600*time.Second); err != nil {
-		ctx.fatalCleanup("❌ Backup job did not complete: %v", err)
+	if err := k8s.WaitForJob(ctx, "block-backup-job-"+jobSuffix, b.namespace, timeout); err != nil {
+		return fmt.Errorf("backup job did not complete: %w", err)
+	}
+
+	// accelerated_io logs both markers only after reading the whole device, so a missing one
+	// means the snapshot may hold a truncated stream
+	logs, err := k8s.GetJobLogs("block-backup-job-"+jobSuffix, b.namespace, "backup")
+	if err != nil {
+		return fmt.Errorf("failed to read the device size and checksum from the backup job: %w", err)
+	}
+	if b.deviceSize = parseDeviceSize(logs); b.deviceSize == 0 {
+		return fmt.Errorf("backup job did not report the device size; the snapshot may be incomplete")
+	}
+	if b.checksum = parseChecksum(logs); b.checksum == "" {
+		return fmt.Errorf("backup job did not report the checksum; the snapshot may be incomplete")
+	}
+	return nil
+}
+
+// deviceSizeLabel prefixes the line accelerated_io logs with the size of the device it reads.
+const deviceSizeLabel = "DEVICE size:"
+
+// parseDeviceSize returns the device size reported in the backup job logs, or 0 if there is none.
+func parseDeviceSize(logs string) int64 {
+	for _, line := range strings.Split(logs, "\n") {
+		if value, ok := strings.CutPrefix(strings.TrimSpace(line), deviceSizeLabel); ok {
+			size, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+			if err == nil {
+				return size
+			}
+		}
+	}
+	return 0
+}
+
+// checksumLabel prefixes the line accelerated_io logs with the SHA-256 of the device it read.
+const checksumLabel = "CHECKSUM sha256:"
+
+// parseChecksum returns the checksum reported in the backup job logs, or "" if there is none.
+func parseChecksum(logs string) string {
+	for _, line := range strings.Split(logs, "\n") {
+		if value, ok := strings.CutPrefix(strings.TrimSpace(line), checksumLabel); ok {
+			return strings.TrimSpace(value)
+		}
+	}
+	return ""
+}
+
+func runSpotCheck(ctx context.Context, b *backupContext, pvName string) error {
+	snapshotID, err := find.RunFindByID(ctx, b.namespace, b.snapshot, b.awsID, b.awsSecret, b.repository, b.password)
+	if err != nil {
+		return fmt.Errorf("failed to find snapshot for spot check: %w", err)
+	}
+
+	jobSuffix, err := k8s.GenerateJobSuffix()
+	if err != nil {
+		return fmt.Errorf("failed to generate job suffix for verify job: %w", err)
+	}
+
+	verifyRepls := map[string]string{
+		"AWS_ACCESS_KEY_ID":     b.awsID,
+		"AWS_SECRET_ACCESS_KEY": b.awsSecret,
+		"RESTIC_REPOSITORY":     b.repository,
+		"RESTIC_PASSWORD":       b.password,
+		"PVC_NAME":              b.clonePVCName,
+		"PV_NAME":               pvName,
+		"SNAPSHOT_ID":           snapshotID,
+		"SAMPLES":               strconv.Itoa(b.opts.SpotCheckBlocks),
+	}
+	timeout := 3600 * time.Second
+	if err := k8s.ApplyJob(ctx, manifests.BackupVerifyJob, b.namespace, "block-verify-job-"+jobSuffix, timeout, verifyRepls); err != nil {
+		return fmt.Errorf("failed to apply verify job manifest: %w", err)
+	}
+
+	log.Printf("🔍 Spot-checking %d random block(s) of snapshot %s against %s...", b.opts.SpotCheckBlocks, snapshotID, b.clonePVCName)
+	if err := k8s.WaitForJob(ctx, "block-verify-job-"+jobSuffix, b.namespace, timeout); err != nil {
+		return fmt.Errorf("spot check of snapshot %s failed: %w", snapshotID, err)
 	}
+	log.Printf("✅ Spot check of snapshot %s passed", snapshotID)
+	return nil
 }
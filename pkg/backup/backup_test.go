@@ -0,0 +1,171 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	clienttesting "k8s.io/client-go/testing"
+
+	"github.com/webberhuang/hv-vmbr/pkg/k8s"
+)
+
+const testNamespace = "default"
+
+// fakeCluster points the k8s package at fake clients holding source, a PVC to back up, for the
+// duration of the test. VolumeSnapshots are ready as soon as they are created, and the Jobs and
+// PVCs applied through the dynamic client show up in the typed client too, where the backup
+// reads them. onJob is called with each Job as it is created and may change it.
+func fakeCluster(t *testing.T, source *corev1.PersistentVolumeClaim, onJob func(job *batchv1.Job)) (*kubefake.Clientset, *dynamicfake.FakeDynamicClient) {
+	t.Helper()
+	kube := kubefake.NewSimpleClientset(source)
+	dyn := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		k8s.VsGVR: "VolumeSnapshotList",
+		{Version: "v1", Resource: "persistentvolumeclaims"}:                                  "PersistentVolumeClaimList",
+		{Group: "batch", Version: "v1", Resource: "jobs"}:                                    "JobList",
+		{Group: "snapshot.storage.k8s.io", Version: "v1", Resource: "volumesnapshotclasses"}: "VolumeSnapshotClassList",
+	})
+
+	dyn.PrependReactor("create", "volumesnapshots", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		obj := action.(clienttesting.CreateAction).GetObject().(*unstructured.Unstructured)
+		return false, nil, unstructured.SetNestedField(obj.Object, true, "status", "readyToUse")
+	})
+	dyn.PrependReactor("create", "persistentvolumeclaims", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		var pvc corev1.PersistentVolumeClaim
+		if err := fromUnstructured(action, &pvc); err != nil {
+			return true, nil, err
+		}
+		return false, nil, kube.Tracker().Add(&pvc)
+	})
+	dyn.PrependReactor("create", "jobs", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		var job batchv1.Job
+		if err := fromUnstructured(action, &job); err != nil {
+			return true, nil, err
+		}
+		onJob(&job)
+		return false, nil, kube.Tracker().Add(&job)
+	})
+
+	mapper := meta.NewDefaultRESTMapper(nil)
+	mapper.Add(schema.GroupVersionKind{Group: "snapshot.storage.k8s.io", Version: "v1", Kind: "VolumeSnapshot"}, meta.RESTScopeNamespace)
+	mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "PersistentVolumeClaim"}, meta.RESTScopeNamespace)
+	mapper.Add(schema.GroupVersionKind{Group: "batch", Version: "v1", Kind: "Job"}, meta.RESTScopeNamespace)
+
+	clientset, dynamicClient, restMapper := k8s.Clientset, k8s.DynamicClient, k8s.RestMapper
+	k8s.Clientset, k8s.DynamicClient, k8s.RestMapper = kube, dyn, mapper
+	t.Cleanup(func() {
+		k8s.Clientset, k8s.DynamicClient, k8s.RestMapper = clientset, dynamicClient, restMapper
+	})
+	return kube, dyn
+}
+
+// fromUnstructured converts the object of a create action to a typed object
+func fromUnstructured(action clienttesting.Action, into interface{}) error {
+	obj := action.(clienttesting.CreateAction).GetObject().(*unstructured.Unstructured)
+	return runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, into)
+}
+
+// sourcePVC returns the PVC to back up, bound to a PV unless volumeName is empty
+func sourcePVC(volumeName string) *corev1.PersistentVolumeClaim {
+	storageClass := "longhorn"
+	volumeMode := corev1.PersistentVolumeBlock
+	return &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: "disk-0", Namespace: testNamespace},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			StorageClassName: &storageClass,
+			VolumeMode:       &volumeMode,
+			VolumeName:       volumeName,
+			Resources: corev1.VolumeResourceRequirements{
+				Requests: corev1.ResourceList{corev1.ResourceStorage: resource.MustParse("1Gi")},
+			},
+		},
+	}
+}
+
+// assertCleanedUp fails the test unless the VolumeSnapshot and clone PVC of the backup are gone
+// and their deletion was requested, while the source PVC is left alone
+func assertCleanedUp(t *testing.T, kube *kubefake.Clientset, dyn *dynamicfake.FakeDynamicClient) {
+	t.Helper()
+	ctx := context.Background()
+	if _, err := dyn.Resource(k8s.VsGVR).Namespace(testNamespace).Get(ctx, VolumeSnapshotName("disk-0"), metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("VolumeSnapshot %s still exists (err %v)", VolumeSnapshotName("disk-0"), err)
+	}
+	if _, err := kube.CoreV1().PersistentVolumeClaims(testNamespace).Get(ctx, ClonePVCName("disk-0"), metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("clone PVC %s still exists (err %v)", ClonePVCName("disk-0"), err)
+	}
+	if _, err := kube.CoreV1().PersistentVolumeClaims(testNamespace).Get(ctx, "disk-0", metav1.GetOptions{}); err != nil {
+		t.Errorf("source PVC was touched: %v", err)
+	}
+	if !deleted(dyn.Actions(), "volumesnapshots", VolumeSnapshotName("disk-0")) {
+		t.Error("deletion of the VolumeSnapshot was not requested")
+	}
+	if !deleted(kube.Actions(), "persistentvolumeclaims", ClonePVCName("disk-0")) {
+		t.Error("deletion of the clone PVC was not requested")
+	}
+}
+
+// deleted reports whether actions include the deletion of the named resource
+func deleted(actions []clienttesting.Action, resource, name string) bool {
+	for _, action := range actions {
+		if del, ok := action.(clienttesting.DeleteAction); ok && del.GetResource().Resource == resource && del.GetName() == name {
+			return true
+		}
+	}
+	return false
+}
+
+func TestRunBackupCleansUpWhenInterruptedDuringBackupJob(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var backupJob string
+	kube, dyn := fakeCluster(t, sourcePVC("pv-disk-0"), func(job *batchv1.Job) {
+		if strings.HasPrefix(job.Name, "restic-init-") {
+			job.Status.Succeeded = 1
+			return
+		}
+		// The backup job is running when the operation is interrupted
+		backupJob = job.Name
+		cancel()
+	})
+
+	_, err := RunBackup(ctx, testNamespace, "disk-0", "snap-1", "longhorn-snapshot", "id", "secret", "s3:repo", "password", false, Options{})
+
+	var phaseErr *PhaseError
+	if !errors.As(err, &phaseErr) || phaseErr.Phase != PhaseBackup || !errors.Is(err, context.Canceled) {
+		t.Fatalf("RunBackup returned %v, want a canceled backup phase", err)
+	}
+	if backupJob == "" {
+		t.Fatal("the backup job was never created")
+	}
+	if _, err := kube.BatchV1().Jobs(testNamespace).Get(context.Background(), backupJob, metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("backup job %s still exists (err %v)", backupJob, err)
+	}
+	assertCleanedUp(t, kube, dyn)
+}
+
+func TestRunBackupCleansUpWhenFailingAfterClone(t *testing.T) {
+	// An unbound source PVC fails the backup once the snapshot and clone exist
+	kube, dyn := fakeCluster(t, sourcePVC(""), func(job *batchv1.Job) {
+		t.Errorf("job %s created although the backup failed before its jobs", job.Name)
+	})
+
+	_, err := RunBackup(context.Background(), testNamespace, "disk-0", "snap-1", "longhorn-snapshot", "id", "secret", "s3:repo", "password", false, Options{})
+
+	var phaseErr *PhaseError
+	if !errors.As(err, &phaseErr) || phaseErr.Phase != PhaseBackup || !strings.Contains(err.Error(), "not bound") {
+		t.Fatalf("RunBackup returned %v, want the backup phase failing on the unbound PVC", err)
+	}
+	assertCleanedUp(t, kube, dyn)
+}
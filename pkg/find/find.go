@@ -1,9 +1,12 @@
 package find
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -14,14 +17,20 @@ import (
 // ErrSnapshotNotFound is returned when a snapshot is not found.
 var ErrSnapshotNotFound = errors.New("snapshot not found")
 
+// ErrNoBackup is returned by RunFindLatestBackup when the VM has no backup.
+var ErrNoBackup = errors.New("no backup found")
+
 // BackupInfo represents detailed information about a backup
 type BackupInfo struct {
 	BackupName string               `json:"backupName"`
 	Namespace  string               `json:"namespace"`
+	SourceVM   string               `json:"sourceVM,omitempty"`
 	VMConfig   *BackupSnapshotInfo  `json:"vmConfig,omitempty"`
 	PVCBackups []BackupSnapshotInfo `json:"pvcBackups"`
 	TotalSize  uint64               `json:"totalSize"`
 	BackupTime time.Time            `json:"backupTime"`
+	// MissingVolumes are the PVCs the backup config declares that have no snapshot; set by Validate
+	MissingVolumes []string `json:"missingVolumes,omitempty"`
 }
 
 // BackupSnapshotInfo represents information about a specific snapshot
@@ -40,10 +49,47 @@ type BackupSnapshotInfo struct {
 // RunFind creates and executes a job to run "restic snapshots" with optional tags.
 // If tags are provided, it filters by those tags. Otherwise, it lists all snapshots.
 // Returns a slice of matching snapshots.
-func RunFind(namespace string, tags []string, awsID, awsSecret, repository, password string) ([]Snapshot, error) {
+func RunFind(ctx context.Context, namespace string, tags []string, awsID, awsSecret, repository, password string) ([]Snapshot, error) {
+	return RunFindHost(ctx, namespace, tags, "", awsID, awsSecret, repository, password)
+}
+
+// RunFindHost is like RunFind but, unless host is empty, lists only the snapshots restic
+// recorded for that host.
+func RunFindHost(ctx context.Context, namespace string, tags []string, host, awsID, awsSecret, repository, password string) ([]Snapshot, error) {
+	logs, err := runFindJob(ctx, namespace, tags, host, "", awsID, awsSecret, repository, password)
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshots []Snapshot
+	if err := json.Unmarshal([]byte(logs), &snapshots); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal JSON output: %w", err)
+	}
+
+	return snapshots, nil
+}
+
+// RunFindGrouped is like RunFindHost but groups the snapshots with restic's --group-by,
+// where groupBy is a comma-separated list of host, paths and tags.
+func RunFindGrouped(ctx context.Context, namespace string, tags []string, host, groupBy, awsID, awsSecret, repository, password string) ([]SnapshotGroup, error) {
+	logs, err := runFindJob(ctx, namespace, tags, host, groupBy, awsID, awsSecret, repository, password)
+	if err != nil {
+		return nil, err
+	}
+
+	var groups []SnapshotGroup
+	if err := json.Unmarshal([]byte(logs), &groups); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal JSON output: %w", err)
+	}
+
+	return groups, nil
+}
+
+// runFindJob runs the find job and returns the JSON it printed
+func runFindJob(ctx context.Context, namespace string, tags []string, host, groupBy, awsID, awsSecret, repository, password string) (string, error) {
 	jobSuffix, err := k8s.GenerateJobSuffix()
 	if err != nil {
-		return nil, fmt.Errorf("failed to generate job suffix for find job: %w", err)
+		return "", fmt.Errorf("failed to generate job suffix for find job: %w", err)
 	}
 	jobName := "find-snapshots-" + jobSuffix
 
@@ -59,67 +105,69 @@ func RunFind(namespace string, tags []string, awsID, awsSecret, repository, pass
 		"RESTIC_REPOSITORY":     repository,
 		"RESTIC_PASSWORD":       password,
 		"TAG_FILTER":            tagFilter,
+		"HOST_FILTER":           host,
+		"GROUP_BY":              groupBy,
+		"BACKOFF_LIMIT":         strconv.Itoa(k8s.ReadRetries()),
 	}
 
-	if err := k8s.ApplyManifest(manifests.FindJob, namespace, jobName, findRepls); err != nil {
-		return nil, fmt.Errorf("failed to apply find job manifest: %w", err)
-	}
-
-	logCh := make(chan string, 1)
-	errCh := make(chan error, 1)
-	go func() {
-		logs, err := k8s.GetJobLogs(jobName, namespace, "find")
-		if err != nil {
-			errCh <- err
-			return
-		}
-		logCh <- logs
-	}()
-
-	if err := k8s.WaitForJob(jobName, namespace, 60*time.Second); err != nil {
-		return nil, fmt.Errorf("find job did not complete: %w", err)
+	// Listing snapshots is idempotent, so retrying rides out transient object storage errors
+	timeout := k8s.RetryTimeout(60*time.Second, k8s.ReadRetries())
+	if err := k8s.ApplyJob(ctx, manifests.FindJob, namespace, jobName, timeout, findRepls); err != nil {
+		return "", fmt.Errorf("failed to apply find job manifest: %w", err)
 	}
 
-	var logs string
-	select {
-	case logs = <-logCh:
-	case err := <-errCh:
-		return nil, fmt.Errorf("failed to retrieve job logs: %w", err)
-	case <-time.After(10 * time.Second):
-		return nil, fmt.Errorf("timed out waiting for job logs")
+	if err := k8s.WaitForJob(ctx, jobName, namespace, timeout); err != nil {
+		return "", fmt.Errorf("find job did not complete: %w", err)
 	}
 
-	var snapshots []Snapshot
-	if err := json.Unmarshal([]byte(logs), &snapshots); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal JSON output: %w", err)
+	logs, err := k8s.GetJobLogs(jobName, namespace, "find")
+	if err != nil {
+		return "", fmt.Errorf("failed to retrieve job logs: %w", err)
 	}
 
-	return snapshots, nil
+	return logs, nil
 }
 
 // RunFindByID is a helper function that searches for a snapshot by namespace and snapshot name tags,
 // and returns the first matching snapshot ID. This is used internally by backup/restore operations.
-func RunFindByID(namespace, snapshot, awsID, awsSecret, repository, password string) (string, error) {
+func RunFindByID(ctx context.Context, namespace, snapshot, awsID, awsSecret, repository, password string) (string, error) {
+	snap, err := RunFindSnapshot(ctx, namespace, snapshot, awsID, awsSecret, repository, password)
+	if err != nil {
+		return "", err
+	}
+	return snap.ShortID, nil
+}
+
+// RunFindSnapshot searches for a snapshot by namespace and snapshot name tags and returns the
+// first match, including its full tag set.
+func RunFindSnapshot(ctx context.Context, namespace, snapshot, awsID, awsSecret, repository, password string) (*Snapshot, error) {
+	return RunFindSnapshotFrom(ctx, namespace, namespace, snapshot, awsID, awsSecret, repository, password)
+}
+
+// RunFindSnapshotFrom is RunFindSnapshot for a snapshot taken in sourceNamespace, which is
+// searched for by a job in namespace, e.g. when restoring into another namespace than the
+// backup was taken in.
+func RunFindSnapshotFrom(ctx context.Context, namespace, sourceNamespace, snapshot, awsID, awsSecret, repository, password string) (*Snapshot, error) {
 	tags := []string{
-		fmt.Sprintf("ns=%s", namespace),
+		fmt.Sprintf("ns=%s", sourceNamespace),
 		fmt.Sprintf("sn=%s", snapshot),
 	}
 
-	snapshots, err := RunFind(namespace, tags, awsID, awsSecret, repository, password)
+	snapshots, err := RunFind(ctx, namespace, tags, awsID, awsSecret, repository, password)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	if len(snapshots) == 0 {
-		return "", ErrSnapshotNotFound
+		return nil, ErrSnapshotNotFound
 	}
 
-	// Return the first matching snapshot's ID
-	return snapshots[0].ShortID, nil
+	// Return the first matching snapshot
+	return &snapshots[0], nil
 }
 
 // RunFindBackupInfo retrieves detailed information about a specific backup
-func RunFindBackupInfo(namespace, backupName, awsID, awsSecret, repository, password string) (*BackupInfo, error) {
+func RunFindBackupInfo(ctx context.Context, namespace, backupName, awsID, awsSecret, repository, password string) (*BackupInfo, error) {
 	backupInfo := &BackupInfo{
 		BackupName: backupName,
 		Namespace:  namespace,
@@ -133,7 +181,7 @@ func RunFindBackupInfo(namespace, backupName, awsID, awsSecret, repository, pass
 		"type=vm-config",
 	}
 
-	vmConfigSnapshots, err := RunFind(namespace, vmConfigTags, awsID, awsSecret, repository, password)
+	vmConfigSnapshots, err := RunFind(ctx, namespace, vmConfigTags, awsID, awsSecret, repository, password)
 	if err != nil {
 		return nil, fmt.Errorf("failed to find VM config: %w", err)
 	}
@@ -155,6 +203,12 @@ func RunFindBackupInfo(namespace, backupName, awsID, awsSecret, repository, pass
 		}
 		backupInfo.BackupTime = snap.Time
 		backupInfo.TotalSize += backupInfo.VMConfig.DataAdded
+
+		sourceVM, err := findSourceVM(ctx, namespace, backupName, snap.Tags, awsID, awsSecret, repository, password)
+		if err != nil {
+			return nil, fmt.Errorf("failed to determine source VM: %w", err)
+		}
+		backupInfo.SourceVM = sourceVM
 	}
 
 	// Find all PVC snapshots with the backup name prefix
@@ -165,7 +219,7 @@ func RunFindBackupInfo(namespace, backupName, awsID, awsSecret, repository, pass
 		fmt.Sprintf("ns=%s", namespace),
 	}
 
-	allSnapshots, err := RunFind(namespace, nsTags, awsID, awsSecret, repository, password)
+	allSnapshots, err := RunFind(ctx, namespace, nsTags, awsID, awsSecret, repository, password)
 	if err != nil {
 		return nil, fmt.Errorf("failed to find PVC snapshots: %w", err)
 	}
@@ -212,3 +266,135 @@ func RunFindBackupInfo(namespace, backupName, awsID, awsSecret, repository, pass
 
 	return backupInfo, nil
 }
+
+// RunFindLatestBackup returns the name of the most recent backup taken from the given VM.
+func RunFindLatestBackup(ctx context.Context, namespace, vmName, awsID, awsSecret, repository, password string) (string, error) {
+	configTags := []string{
+		fmt.Sprintf("ns=%s", namespace),
+		"type=vm-config",
+	}
+
+	snapshots, err := RunFind(ctx, namespace, configTags, awsID, awsSecret, repository, password)
+	if err != nil {
+		return "", fmt.Errorf("failed to find VM configs: %w", err)
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].Time.After(snapshots[j].Time)
+	})
+
+	for _, snap := range snapshots {
+		backupName := ""
+		for _, tag := range snap.Tags {
+			if strings.HasPrefix(tag, "sn=") {
+				backupName = strings.TrimPrefix(tag, "sn=")
+				break
+			}
+		}
+		if backupName == "" {
+			continue
+		}
+
+		sourceVM, err := findSourceVM(ctx, namespace, backupName, snap.Tags, awsID, awsSecret, repository, password)
+		if err != nil {
+			return "", fmt.Errorf("failed to determine source VM of backup %s: %w", backupName, err)
+		}
+		if sourceVM == vmName {
+			return backupName, nil
+		}
+	}
+
+	return "", fmt.Errorf("%w for VM %s", ErrNoBackup, vmName)
+}
+
+// findSourceVM returns the name of the VM a backup was taken from. It uses the vm= tag of the
+// config snapshot when present and otherwise downloads the (small) backup config.
+func findSourceVM(ctx context.Context, namespace, backupName string, configTags []string, awsID, awsSecret, repository, password string) (string, error) {
+	for _, tag := range configTags {
+		if strings.HasPrefix(tag, "vm=") {
+			return strings.TrimPrefix(tag, "vm="), nil
+		}
+	}
+
+	var config backupConfig
+	if err := downloadConfig(ctx, namespace, backupName, awsID, awsSecret, repository, password, &config); err != nil {
+		return "", err
+	}
+	return config.BackupSpec.Source.Name, nil
+}
+
+// backupConfig holds the fields of a backup config that find needs; the full VMBackupConfig
+// lives in the vm package.
+type backupConfig struct {
+	BackupSpec struct {
+		Source struct {
+			Name string `json:"name"`
+		} `json:"source"`
+	} `json:"backupSpec"`
+	VolumeBackups []struct {
+		PersistentVolumeClaim struct {
+			Metadata struct {
+				Name string `json:"name"`
+			} `json:"metadata"`
+		} `json:"persistentVolumeClaim"`
+	} `json:"volumeBackups"`
+}
+
+// downloadConfig downloads the config of a backup and unmarshals it into config
+func downloadConfig(ctx context.Context, namespace, backupName, awsID, awsSecret, repository, password string, config interface{}) error {
+	jobSuffix, err := k8s.GenerateJobSuffix()
+	if err != nil {
+		return fmt.Errorf("failed to generate job suffix: %w", err)
+	}
+
+	replacements := map[string]string{
+		"AWS_ACCESS_KEY_ID":     awsID,
+		"AWS_SECRET_ACCESS_KEY": awsSecret,
+		"RESTIC_REPOSITORY":     repository,
+		"RESTIC_PASSWORD":       password,
+		"BACKUP_NAME":           backupName,
+		"BACKUP_NAMESPACE":      namespace,
+	}
+
+	jobName := "find-config-" + jobSuffix
+	timeout := 60 * time.Second
+	if err := k8s.ApplyJob(ctx, manifests.VMRestoreConfigJob, namespace, jobName, timeout, replacements); err != nil {
+		return fmt.Errorf("failed to apply config job: %w", err)
+	}
+	if err := k8s.WaitForJob(ctx, jobName, namespace, timeout); err != nil {
+		return fmt.Errorf("config job failed: %w", err)
+	}
+
+	logs, err := k8s.GetJobLogs(jobName, namespace, "restore-config")
+	if err != nil {
+		return fmt.Errorf("failed to get job logs: %w", err)
+	}
+	if err := json.Unmarshal([]byte(logs), config); err != nil {
+		return fmt.Errorf("failed to parse backup config: %w", err)
+	}
+	return nil
+}
+
+// Validate downloads the backup config and records in MissingVolumes every PVC it declares that
+// has no snapshot among PVCBackups, i.e. a volume a restore of the backup would fail on. It
+// returns the missing PVCs; none means the backup is complete.
+func (b *BackupInfo) Validate(ctx context.Context, awsID, awsSecret, repository, password string) ([]string, error) {
+	if b.VMConfig == nil {
+		return nil, fmt.Errorf("backup %s has no VM config snapshot, so its volumes cannot be checked", b.BackupName)
+	}
+	var config backupConfig
+	if err := downloadConfig(ctx, b.Namespace, b.BackupName, awsID, awsSecret, repository, password, &config); err != nil {
+		return nil, err
+	}
+
+	found := map[string]bool{}
+	for _, pvc := range b.PVCBackups {
+		found[pvc.Name] = true
+	}
+	b.MissingVolumes = nil
+	for _, volume := range config.VolumeBackups {
+		if name := volume.PersistentVolumeClaim.Metadata.Name; !found[name] {
+			b.MissingVolumes = append(b.MissingVolumes, name)
+		}
+	}
+	return b.MissingVolumes, nil
+}
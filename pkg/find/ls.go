@@ -0,0 +1,81 @@
+package find
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/webberhuang/hv-vmbr/pkg/k8s"
+	"github.com/webberhuang/hv-vmbr/pkg/manifests"
+)
+
+// RunLs runs "restic ls" on the snapshot with the given ID and returns the snapshot and the
+// files and directories it holds. Volume snapshots hold one file, named after the PV at backup
+// time, which is the path a restore dumps.
+func RunLs(ctx context.Context, namespace, snapshotID, awsID, awsSecret, repository, password string) (*Snapshot, []Node, error) {
+	jobSuffix, err := k8s.GenerateJobSuffix()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate job suffix for ls job: %w", err)
+	}
+	jobName := "restic-ls-" + jobSuffix
+
+	replacements := map[string]string{
+		"AWS_ACCESS_KEY_ID":     awsID,
+		"AWS_SECRET_ACCESS_KEY": awsSecret,
+		"RESTIC_REPOSITORY":     repository,
+		"RESTIC_PASSWORD":       password,
+		"SNAPSHOT_ID":           snapshotID,
+	}
+
+	timeout := 120 * time.Second
+	if err := k8s.ApplyJob(ctx, manifests.ResticLsJob, namespace, jobName, timeout, replacements); err != nil {
+		return nil, nil, fmt.Errorf("failed to apply ls job manifest: %w", err)
+	}
+	if err := k8s.WaitForJob(ctx, jobName, namespace, timeout); err != nil {
+		return nil, nil, fmt.Errorf("ls job did not complete: %w", err)
+	}
+
+	logs, err := k8s.GetJobLogs(jobName, namespace, "ls")
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to retrieve job logs: %w", err)
+	}
+	return parseLsOutput(logs)
+}
+
+// parseLsOutput parses the output of "restic ls --json": a snapshot line followed by a line per
+// node. restic 0.17 marks each line with struct_type, later versions also with message_type.
+func parseLsOutput(logs string) (*Snapshot, []Node, error) {
+	var snapshot *Snapshot
+	nodes := []Node{}
+	for _, line := range strings.Split(strings.TrimSpace(logs), "\n") {
+		if line == "" {
+			continue
+		}
+		var kind struct {
+			StructType  string `json:"struct_type"`
+			MessageType string `json:"message_type"`
+		}
+		if err := json.Unmarshal([]byte(line), &kind); err != nil {
+			return nil, nil, fmt.Errorf("failed to parse ls output line %q: %w", line, err)
+		}
+		switch {
+		case kind.StructType == "snapshot" || kind.MessageType == "snapshot":
+			snapshot = &Snapshot{}
+			if err := json.Unmarshal([]byte(line), snapshot); err != nil {
+				return nil, nil, fmt.Errorf("failed to unmarshal snapshot: %w", err)
+			}
+		case kind.StructType == "node" || kind.MessageType == "node":
+			var node Node
+			if err := json.Unmarshal([]byte(line), &node); err != nil {
+				return nil, nil, fmt.Errorf("failed to unmarshal node: %w", err)
+			}
+			nodes = append(nodes, node)
+		}
+	}
+	if snapshot == nil {
+		return nil, nil, fmt.Errorf("ls output holds no snapshot")
+	}
+	return snapshot, nodes, nil
+}
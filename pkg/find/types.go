@@ -62,3 +62,13 @@ type SnapshotGroup struct {
 	GroupKey  SnapshotGroupKey `json:"group_key"`
 	Snapshots []Snapshot       `json:"snapshots"`
 }
+
+// Node is a file or directory in a snapshot, as printed by "restic ls --json".
+// See https://github.com/restic/restic/blob/v0.17.3/cmd/restic/cmd_ls.go
+type Node struct {
+	Name  string    `json:"name"`
+	Type  string    `json:"type"`
+	Path  string    `json:"path"`
+	Size  uint64    `json:"size"`
+	Mtime time.Time `json:"mtime"`
+}
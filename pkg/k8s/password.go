@@ -0,0 +1,105 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// With Options.PasswordInSecret, the restic password is kept out of the job specs. ApplyManifest
+// substitutes an empty {{RESTIC_PASSWORD}} and gives every Job a Secret holding the password,
+// owned by the Job so it is deleted along with it, mounted at passwordMountPath and named by
+// RESTIC_PASSWORD_FILE.
+const (
+	passwordVolume    = "restic-password"
+	passwordMountPath = "/etc/restic"
+	passwordKey       = "password"
+)
+
+// passwordSecretName is the name of the Secret holding the restic password of a job
+func passwordSecretName(jobName string) string {
+	return jobName + "-restic-password"
+}
+
+// mountPasswordSecret adds the password Secret of job as a volume of its pod and points the
+// RESTIC_PASSWORD_FILE of every container at it
+func mountPasswordSecret(job *unstructured.Unstructured) error {
+	podSpec := []string{"spec", "template", "spec"}
+	volumes, _, err := unstructured.NestedSlice(job.Object, append(podSpec, "volumes")...)
+	if err != nil {
+		return fmt.Errorf("failed to read volumes of job %s: %w", job.GetName(), err)
+	}
+	volumes = append(volumes, map[string]interface{}{
+		"name":   passwordVolume,
+		"secret": map[string]interface{}{"secretName": passwordSecretName(job.GetName())},
+	})
+	if err := unstructured.SetNestedSlice(job.Object, volumes, append(podSpec, "volumes")...); err != nil {
+		return fmt.Errorf("failed to set volumes of job %s: %w", job.GetName(), err)
+	}
+
+	containers, _, err := unstructured.NestedSlice(job.Object, append(podSpec, "containers")...)
+	if err != nil {
+		return fmt.Errorf("failed to read containers of job %s: %w", job.GetName(), err)
+	}
+	for _, item := range containers {
+		container, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		mounts, _, _ := unstructured.NestedSlice(container, "volumeMounts")
+		container["volumeMounts"] = append(mounts, map[string]interface{}{
+			"name":      passwordVolume,
+			"mountPath": passwordMountPath,
+			"readOnly":  true,
+		})
+		env, _, _ := unstructured.NestedSlice(container, "env")
+		container["env"] = append(env, map[string]interface{}{
+			"name":  "RESTIC_PASSWORD_FILE",
+			"value": passwordMountPath + "/" + passwordKey,
+		})
+	}
+	return unstructured.SetNestedSlice(job.Object, containers, append(podSpec, "containers")...)
+}
+
+// createPasswordSecret creates the Secret holding password for the job, which must exist. The
+// job's pod waits for the Secret to be mounted, so it is created after the job it belongs to.
+func createPasswordSecret(ctx context.Context, namespace, jobName, password string) error {
+	return CreateJobSecret(ctx, namespace, jobName, passwordSecretName(jobName), map[string]string{passwordKey: password})
+}
+
+// CreateJobSecret creates or updates the Secret name holding data for the job, which must exist.
+// The Secret is owned by the job so it is deleted along with it.
+func CreateJobSecret(ctx context.Context, namespace, jobName, name string, data map[string]string) error {
+	return retryAPI(ctx, true, func() error {
+		job, err := Clientset.BatchV1().Jobs(namespace).Get(ctx, jobName, metav1.GetOptions{})
+		if err != nil {
+			return fmt.Errorf("failed to get job %s: %w", jobName, err)
+		}
+		secret := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: namespace,
+				OwnerReferences: []metav1.OwnerReference{{
+					APIVersion: "batch/v1",
+					Kind:       "Job",
+					Name:       jobName,
+					UID:        job.UID,
+				}},
+			},
+			Type:       corev1.SecretTypeOpaque,
+			StringData: data,
+		}
+		_, err = Clientset.CoreV1().Secrets(namespace).Create(ctx, secret, metav1.CreateOptions{})
+		if apierrors.IsAlreadyExists(err) {
+			_, err = Clientset.CoreV1().Secrets(namespace).Update(ctx, secret, metav1.UpdateOptions{})
+		}
+		if err != nil {
+			return fmt.Errorf("failed to create secret %s of job %s: %w", name, jobName, err)
+		}
+		return nil
+	})
+}
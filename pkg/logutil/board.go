@@ -0,0 +1,142 @@
+package logutil
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+)
+
+// ProgressBoard shows one status line per item of a batch, such as the VMs of a -vm-selector
+// backup, and how many have finished. On a terminal the lines are redrawn in place and the
+// standard logger only passes on warnings and errors, printed above the board; elsewhere every
+// status change is logged as a line of its own.
+type ProgressBoard struct {
+	mu       sync.Mutex
+	w        io.Writer
+	live     bool
+	noun     string
+	names    []string
+	status   map[string]string
+	finished int
+	drawn    int       // Lines of the board currently on the terminal
+	logOut   io.Writer // Output of the standard logger before the board took it over
+}
+
+// NewProgressBoard starts a board for the named items on f, e.g. os.Stderr. noun names the
+// items in the overall count, e.g. "VMs". Stop ends it.
+func NewProgressBoard(f *os.File, names []string, noun string) *ProgressBoard {
+	b := &ProgressBoard{w: f, live: IsTerminal(f), noun: noun, names: names, status: make(map[string]string, len(names))}
+	for _, name := range names {
+		b.status[name] = "pending"
+	}
+	if b.live {
+		b.logOut = log.Writer()
+		log.SetOutput(boardWriter{b})
+		b.mu.Lock()
+		b.draw()
+		b.mu.Unlock()
+	}
+	return b
+}
+
+// IsTerminal reports whether f is a terminal rather than a file or pipe
+func IsTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// Live reports whether the board is redrawn in place, so frequent updates such as the
+// percentage of a job can be sent to it without flooding the log
+func (b *ProgressBoard) Live() bool {
+	return b != nil && b.live
+}
+
+// Update sets the status of an item that is still running
+func (b *ProgressBoard) Update(name, status string) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.status[name] = status
+	if b.live {
+		b.draw()
+		return
+	}
+	log.Printf("📊 %s: %s", name, status)
+}
+
+// Finish sets the final status of an item and counts it as finished
+func (b *ProgressBoard) Finish(name, status string) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.status[name] = status
+	b.finished++
+	if b.live {
+		b.draw()
+		return
+	}
+	log.Printf("📊 %s: %s (%d/%d %s complete)", name, status, b.finished, len(b.names), b.noun)
+}
+
+// Stop leaves the last state of the board on the terminal and hands the standard logger back
+func (b *ProgressBoard) Stop() {
+	if b == nil || !b.live {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	log.SetOutput(b.logOut)
+	b.live = false
+	b.drawn = 0
+}
+
+// draw redraws the board over its previous lines. b.mu must be held.
+func (b *ProgressBoard) draw() {
+	var buf bytes.Buffer
+	b.clear(&buf)
+	for _, name := range b.names {
+		fmt.Fprintf(&buf, "   %s: %s\n", name, b.status[name])
+	}
+	fmt.Fprintf(&buf, "📊 %d/%d %s complete\n", b.finished, len(b.names), b.noun)
+	b.drawn = len(b.names) + 1
+	b.w.Write(buf.Bytes())
+}
+
+// clear moves the cursor up to the first line of the board and erases it to the end of the screen
+func (b *ProgressBoard) clear(buf *bytes.Buffer) {
+	if b.drawn > 0 {
+		fmt.Fprintf(buf, "\033[%dA\r\033[J", b.drawn)
+	}
+	b.drawn = 0
+}
+
+// boardWriter takes over the standard logger while a live board is shown: lines with an
+// attention marker are printed above the board, the others dropped
+type boardWriter struct {
+	b *ProgressBoard
+}
+
+func (bw boardWriter) Write(p []byte) (int, error) {
+	for _, marker := range attentionMarkers {
+		if bytes.Contains(p, marker) {
+			bw.b.mu.Lock()
+			defer bw.b.mu.Unlock()
+			var buf bytes.Buffer
+			bw.b.clear(&buf)
+			buf.Write(p)
+			if _, err := bw.b.w.Write(buf.Bytes()); err != nil {
+				return 0, err
+			}
+			bw.b.draw()
+			return len(p), nil
+		}
+	}
+	return len(p), nil
+}
@@ -0,0 +1,57 @@
+package logutil
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestProgressBoardLogsWithoutTerminal(t *testing.T) {
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	defer log.SetOutput(os.Stderr)
+
+	f, err := os.CreateTemp(t.TempDir(), "board")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	board := NewProgressBoard(f, []string{"vm1", "vm2"}, "VMs")
+	if board.Live() {
+		t.Fatal("board on a file is live")
+	}
+	board.Update("vm1", "backing up")
+	board.Finish("vm1", "done")
+	board.Stop()
+
+	got := out.String()
+	for _, want := range []string{"📊 vm1: backing up", "📊 vm1: done (1/2 VMs complete)"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("log %q lacks %q", got, want)
+		}
+	}
+}
+
+func TestProgressBoardRedrawsInPlace(t *testing.T) {
+	var out bytes.Buffer
+	board := &ProgressBoard{w: &out, live: true, noun: "VMs", names: []string{"vm1", "vm2"}, status: map[string]string{"vm1": "pending", "vm2": "pending"}, logOut: os.Stderr}
+	board.Update("vm1", "backing up")
+	out.Reset()
+
+	boardWriter{board}.Write([]byte("⌛ Waiting for backup job to complete...\n"))
+	if out.Len() != 0 {
+		t.Errorf("informational line was printed: %q", out.String())
+	}
+	boardWriter{board}.Write([]byte("⚠️  Retrying\n"))
+	board.Finish("vm1", "done")
+
+	got := out.String()
+	if !strings.HasPrefix(got, "\033[3A\r\033[J⚠️  Retrying\n") {
+		t.Errorf("warning not printed over the board: %q", got)
+	}
+	if !strings.HasSuffix(got, "\033[3A\r\033[J   vm1: done\n   vm2: pending\n📊 1/2 VMs complete\n") {
+		t.Errorf("board not redrawn in place: %q", got)
+	}
+}
@@ -0,0 +1,38 @@
+package logutil
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// JSONEvents makes Event write lifecycle events to stderr, one JSON object per line, for
+// orchestrators that follow an operation without parsing the log lines around them.
+var JSONEvents bool
+
+var eventMu sync.Mutex
+
+// Event emits a lifecycle event of the given kind, e.g. "snapshot_created", with its fields
+// (such as phase, pvc and percent) and a timestamp. It does nothing unless JSONEvents is set.
+func Event(kind string, fields map[string]interface{}) {
+	if !JSONEvents {
+		return
+	}
+	event := make(map[string]interface{}, len(fields)+2)
+	for key, value := range fields {
+		event[key] = value
+	}
+	event["event"] = kind
+	event["timestamp"] = time.Now().UTC().Format(time.RFC3339Nano)
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		Errorf("Failed to encode %s event: %v", kind, err)
+		return
+	}
+	eventMu.Lock()
+	defer eventMu.Unlock()
+	fmt.Fprintln(os.Stderr, string(data))
+}
@@ -1,6 +1,8 @@
 package logutil
 
 import (
+	"bytes"
+	"io"
 	"log"
 )
 
@@ -39,3 +41,27 @@ func Errorf(format string, args ...interface{}) {
 func Fatalf(format string, args ...interface{}) {
 	log.Fatalf(ColorRed+format+ColorReset, args...)
 }
+
+// attentionMarkers start the log lines that stay visible in quiet mode: warnings, errors and
+// the notice of an interruption
+var attentionMarkers = [][]byte{[]byte("⚠️"), []byte("❌"), []byte("🛑")}
+
+// Quiet makes the standard logger drop the informational lines, such as the per-job progress,
+// and write only warnings and errors to w.
+func Quiet(w io.Writer) {
+	log.SetOutput(quietWriter{w})
+}
+
+// quietWriter passes on the log lines that carry an attention marker and drops the others
+type quietWriter struct {
+	w io.Writer
+}
+
+func (q quietWriter) Write(p []byte) (int, error) {
+	for _, marker := range attentionMarkers {
+		if bytes.Contains(p, marker) {
+			return q.w.Write(p)
+		}
+	}
+	return len(p), nil
+}
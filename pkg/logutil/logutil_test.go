@@ -0,0 +1,29 @@
+package logutil
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestQuiet(t *testing.T) {
+	var out bytes.Buffer
+	Quiet(&out)
+	defer log.SetOutput(os.Stderr)
+
+	log.Println("⌛ Waiting for find job to complete...")
+	log.Printf("⚠️  Retrying transient Kubernetes API error: %v", "timeout")
+	Errorf("❌ %v", "find job failed")
+
+	got := out.String()
+	for _, want := range []string{"⚠️  Retrying transient Kubernetes API error: timeout", "❌ find job failed"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("quiet log %q lacks %q", got, want)
+		}
+	}
+	if strings.Contains(got, "Waiting") {
+		t.Errorf("quiet log %q has the progress line", got)
+	}
+}
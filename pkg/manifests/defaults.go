@@ -0,0 +1,59 @@
+package manifests
+
+// ImageTag is the release of the job image whose accelerated_io understands every flag and
+// environment variable the job manifests pass. Bump it, and release the image under the new tag,
+// along with any change to those, so that nodes holding an older image never run the jobs.
+const ImageTag = "v1.8.0"
+
+// DefaultImage is the container image of every job, holding restic and accelerated_io.
+const DefaultImage = "webberhuang/restic-accelerated:" + ImageTag
+
+// DefaultCPURequest, DefaultMemRequest, DefaultCPULimit and DefaultMemLimit are the resources of the
+// backup, restore, find and config jobs.
+const (
+	DefaultCPURequest = "250m"
+	DefaultMemRequest = "256Mi"
+	DefaultCPULimit   = "2"
+	DefaultMemLimit   = "2Gi"
+)
+
+// DefaultNodeSelector and DefaultTolerations, as inline JSON, place the jobs that mount volumes
+// anywhere the scheduler likes.
+const (
+	DefaultNodeSelector = "{}"
+	DefaultTolerations  = "[]"
+)
+
+// DefaultIOBlockSize, DefaultIOWorkers, DefaultIOSkipZeros and DefaultIODirect match the
+// accelerated_io built-in defaults.
+const (
+	DefaultIOBlockSize = "65536"
+	DefaultIOWorkers   = "4"
+	DefaultIOSkipZeros = "false"
+	DefaultIODirect    = "false"
+)
+
+// DefaultResticHost leaves the host of backup snapshots to restic, which records the pod's hostname.
+const DefaultResticHost = ""
+
+// DefaultReplacements returns the values for the tokens shared by every job manifest.
+func DefaultReplacements() map[string]string {
+	return map[string]string{
+		"RESTIC_IMAGE":              DefaultImage,
+		"POD_SECURITY_CONTEXT":      RestrictedPodSecurityContext,
+		"SECURITY_CONTEXT":          RestrictedSecurityContext,
+		"DATA_POD_SECURITY_CONTEXT": BlockDevicePodSecurityContext,
+		"DATA_SECURITY_CONTEXT":     BlockDeviceSecurityContext,
+		"CPU_REQUEST":               DefaultCPURequest,
+		"MEM_REQUEST":               DefaultMemRequest,
+		"CPU_LIMIT":                 DefaultCPULimit,
+		"MEM_LIMIT":                 DefaultMemLimit,
+		"NODE_SELECTOR":             DefaultNodeSelector,
+		"TOLERATIONS":               DefaultTolerations,
+		"IO_BLOCK_SIZE":             DefaultIOBlockSize,
+		"IO_WORKERS":                DefaultIOWorkers,
+		"IO_SKIP_ZEROS":             DefaultIOSkipZeros,
+		"IO_DIRECT":                 DefaultIODirect,
+		"RESTIC_HOST":               DefaultResticHost,
+	}
+}
@@ -15,7 +15,9 @@ stringData:
   RESTIC_PASSWORD: "abc"
 `
 
-// ResticCheckJob checks if the repository is initialized.
+// ResticCheckJob checks if the repository is initialized. Like FindJob it only lists snapshots,
+// so it is retried up to BACKOFF_LIMIT times, except when restic exits with 10 (no repository)
+// or 12 (wrong password): retrying cannot change those answers.
 const ResticCheckJob = `
 apiVersion: batch/v1
 kind: Job
@@ -23,15 +25,28 @@ metadata:
   name: {{NAME}}
   namespace: {{NAMESPACE}}
 spec:
-  backoffLimit: 0
+  backoffLimit: {{BACKOFF_LIMIT}}
+  podFailurePolicy:
+    rules:
+    - action: FailJob
+      onExitCodes:
+        containerName: restic-check
+        operator: In
+        values: [10, 12]
+  activeDeadlineSeconds: {{ACTIVE_DEADLINE_SECONDS}}
   ttlSecondsAfterFinished: 30
   template:
     spec:
       restartPolicy: Never
+      securityContext: {{POD_SECURITY_CONTEXT}}
       containers:
       - name: restic-check
-        image: webberhuang/restic-accelerated:latest
+        image: {{RESTIC_IMAGE}}
         imagePullPolicy: IfNotPresent
+        securityContext: {{SECURITY_CONTEXT}}
+        env:
+        - name: XDG_CACHE_HOME
+          value: /tmp/.cache
         command: ["/bin/sh", "-c"]
         args:
           - export AWS_ACCESS_KEY_ID={{AWS_ACCESS_KEY_ID}} && export AWS_SECRET_ACCESS_KEY={{AWS_SECRET_ACCESS_KEY}} && export RESTIC_REPOSITORY={{RESTIC_REPOSITORY}} && export RESTIC_PASSWORD={{RESTIC_PASSWORD}} && restic snapshots > /dev/null 2>&1
@@ -46,14 +61,20 @@ metadata:
   namespace: {{NAMESPACE}}
 spec:
   backoffLimit: 0
+  activeDeadlineSeconds: {{ACTIVE_DEADLINE_SECONDS}}
   ttlSecondsAfterFinished: 30
   template:
     spec:
       restartPolicy: Never
+      securityContext: {{POD_SECURITY_CONTEXT}}
       containers:
       - name: restic-init
-        image: webberhuang/restic-accelerated:latest
+        image: {{RESTIC_IMAGE}}
         imagePullPolicy: IfNotPresent
+        securityContext: {{SECURITY_CONTEXT}}
+        env:
+        - name: XDG_CACHE_HOME
+          value: /tmp/.cache
         command: ["/bin/sh", "-c"]
         args:
           - export AWS_ACCESS_KEY_ID={{AWS_ACCESS_KEY_ID}} && export AWS_SECRET_ACCESS_KEY={{AWS_SECRET_ACCESS_KEY}} && export RESTIC_REPOSITORY={{RESTIC_REPOSITORY}} && export RESTIC_PASSWORD={{RESTIC_PASSWORD}} && restic init
@@ -93,7 +114,8 @@ spec:
     apiGroup: snapshot.storage.k8s.io
 `
 
-// BackupJob defines the backup job.
+// BackupJob defines the backup job. It runs under bash with pipefail, so that accelerated_io
+// failing or exiting early fails the job instead of restic storing a truncated stream.
 const BackupJob = `
 apiVersion: batch/v1
 kind: Job
@@ -102,17 +124,29 @@ metadata:
   namespace: {{NAMESPACE}}
 spec:
   backoffLimit: 0
+  activeDeadlineSeconds: {{ACTIVE_DEADLINE_SECONDS}}
   ttlSecondsAfterFinished: 30
   template:
     spec:
       restartPolicy: Never
+      securityContext: {{DATA_POD_SECURITY_CONTEXT}}
+      nodeSelector: {{NODE_SELECTOR}}
+      tolerations: {{TOLERATIONS}}
       containers:
       - name: backup
-        image: webberhuang/restic-accelerated:latest
+        image: {{RESTIC_IMAGE}}
         imagePullPolicy: IfNotPresent
-        command: ["/bin/sh", "-c"]
+        securityContext: {{DATA_SECURITY_CONTEXT}}
+        resources:
+          requests:
+            cpu: "{{CPU_REQUEST}}"
+            memory: "{{MEM_REQUEST}}"
+          limits:
+            cpu: "{{CPU_LIMIT}}"
+            memory: "{{MEM_LIMIT}}"
+        command: ["/bin/bash", "-c"]
         args:
-          - export AWS_ACCESS_KEY_ID={{AWS_ACCESS_KEY_ID}} && export AWS_SECRET_ACCESS_KEY={{AWS_SECRET_ACCESS_KEY}} && export RESTIC_REPOSITORY={{RESTIC_REPOSITORY}} && export RESTIC_PASSWORD={{RESTIC_PASSWORD}} && /usr/local/bin/accelerated_io -device /dev/{{PVC_NAME}} -mode=read | restic -q backup --stdin --stdin-filename {{PV_NAME}} --tag=ns={{NAMESPACE}},sn={{SNAPSHOT_NAME}}
+          - set -o pipefail && export AWS_ACCESS_KEY_ID={{AWS_ACCESS_KEY_ID}} && export AWS_SECRET_ACCESS_KEY={{AWS_SECRET_ACCESS_KEY}} && export RESTIC_REPOSITORY={{RESTIC_REPOSITORY}} && export RESTIC_PASSWORD={{RESTIC_PASSWORD}} && /usr/local/bin/accelerated_io -device /dev/{{PVC_NAME}} -mode=read -bs={{IO_BLOCK_SIZE}} -workers={{IO_WORKERS}} -direct={{IO_DIRECT}} -checksum | restic -q backup --stdin --stdin-filename {{PV_NAME}} --host={{RESTIC_HOST}} --tag=ns={{NAMESPACE}},sn={{SNAPSHOT_NAME}}
         volumeDevices:
         - name: vol1
           devicePath: /dev/{{PVC_NAME}}
@@ -131,17 +165,29 @@ metadata:
   namespace: {{NAMESPACE}}
 spec:
   backoffLimit: 0
+  activeDeadlineSeconds: {{ACTIVE_DEADLINE_SECONDS}}
   ttlSecondsAfterFinished: 30
   template:
     spec:
       restartPolicy: Never
+      securityContext: {{DATA_POD_SECURITY_CONTEXT}}
+      nodeSelector: {{NODE_SELECTOR}}
+      tolerations: {{TOLERATIONS}}
       containers:
       - name: restore
-        image: webberhuang/restic-accelerated:latest
+        image: {{RESTIC_IMAGE}}
         imagePullPolicy: IfNotPresent
+        securityContext: {{DATA_SECURITY_CONTEXT}}
+        resources:
+          requests:
+            cpu: "{{CPU_REQUEST}}"
+            memory: "{{MEM_REQUEST}}"
+          limits:
+            cpu: "{{CPU_LIMIT}}"
+            memory: "{{MEM_LIMIT}}"
         command: ["/bin/sh", "-c"]
         args:
-          - export AWS_ACCESS_KEY_ID={{AWS_ACCESS_KEY_ID}} && export AWS_SECRET_ACCESS_KEY={{AWS_SECRET_ACCESS_KEY}} && export RESTIC_REPOSITORY={{RESTIC_REPOSITORY}} && export RESTIC_PASSWORD={{RESTIC_PASSWORD}} && restic -v=2 dump {{SNAPSHOT_ID}} {{PV_NAME}} | /usr/local/bin/accelerated_io -device /dev/{{PVC_NAME}} -mode=write
+          - export AWS_ACCESS_KEY_ID={{AWS_ACCESS_KEY_ID}} && export AWS_SECRET_ACCESS_KEY={{AWS_SECRET_ACCESS_KEY}} && export RESTIC_REPOSITORY={{RESTIC_REPOSITORY}} && export RESTIC_PASSWORD={{RESTIC_PASSWORD}} && restic -v=2 dump {{SNAPSHOT_ID}} {{PV_NAME}} | /usr/local/bin/accelerated_io -device /dev/{{PVC_NAME}} -mode=write -bs={{IO_BLOCK_SIZE}} -workers={{IO_WORKERS}} -direct={{IO_DIRECT}} -expect-size={{DEVICE_SIZE}} -skip-zeros={{IO_SKIP_ZEROS}} -expect-checksum={{EXPECT_CHECKSUM}}
         volumeDevices:
         - name: vol2
           devicePath: /dev/{{PVC_NAME}}
@@ -151,8 +197,9 @@ spec:
           claimName: {{PVC_NAME}}
 `
 
-// FindJob defines the job to execute "restic snapshots" with optional tag filtering and JSON output.
-const FindJob = `
+// BackupVerifyJob defines the job that spot-checks a fresh snapshot by streaming it
+// with "restic dump" and comparing randomly sampled blocks against the clone PVC.
+const BackupVerifyJob = `
 apiVersion: batch/v1
 kind: Job
 metadata:
@@ -160,14 +207,61 @@ metadata:
   namespace: {{NAMESPACE}}
 spec:
   backoffLimit: 0
+  activeDeadlineSeconds: {{ACTIVE_DEADLINE_SECONDS}}
+  ttlSecondsAfterFinished: 30
+  template:
+    spec:
+      restartPolicy: Never
+      securityContext: {{DATA_POD_SECURITY_CONTEXT}}
+      nodeSelector: {{NODE_SELECTOR}}
+      tolerations: {{TOLERATIONS}}
+      containers:
+      - name: verify
+        image: {{RESTIC_IMAGE}}
+        imagePullPolicy: IfNotPresent
+        securityContext: {{DATA_SECURITY_CONTEXT}}
+        command: ["/bin/sh", "-c"]
+        args:
+          - export AWS_ACCESS_KEY_ID={{AWS_ACCESS_KEY_ID}} && export AWS_SECRET_ACCESS_KEY={{AWS_SECRET_ACCESS_KEY}} && export RESTIC_REPOSITORY={{RESTIC_REPOSITORY}} && export RESTIC_PASSWORD={{RESTIC_PASSWORD}} && restic dump {{SNAPSHOT_ID}} {{PV_NAME}} | /usr/local/bin/accelerated_io -device /dev/{{PVC_NAME}} -mode=verify -samples={{SAMPLES}} -bs={{IO_BLOCK_SIZE}}
+        volumeDevices:
+        - name: vol1
+          devicePath: /dev/{{PVC_NAME}}
+      volumes:
+      - name: vol1
+        persistentVolumeClaim:
+          claimName: {{PVC_NAME}}
+`
+
+// FindJob defines the job to execute "restic snapshots" with optional tag filtering, grouping and JSON output.
+const FindJob = `
+apiVersion: batch/v1
+kind: Job
+metadata:
+  name: {{NAME}}
+  namespace: {{NAMESPACE}}
+spec:
+  backoffLimit: {{BACKOFF_LIMIT}}
+  activeDeadlineSeconds: {{ACTIVE_DEADLINE_SECONDS}}
   ttlSecondsAfterFinished: 60
   template:
     spec:
       restartPolicy: Never
+      securityContext: {{POD_SECURITY_CONTEXT}}
       containers:
       - name: find
-        image: webberhuang/restic-accelerated:latest
+        image: {{RESTIC_IMAGE}}
         imagePullPolicy: IfNotPresent
+        securityContext: {{SECURITY_CONTEXT}}
+        resources:
+          requests:
+            cpu: "{{CPU_REQUEST}}"
+            memory: "{{MEM_REQUEST}}"
+          limits:
+            cpu: "{{CPU_LIMIT}}"
+            memory: "{{MEM_LIMIT}}"
+        env:
+        - name: XDG_CACHE_HOME
+          value: /tmp/.cache
         command: ["/bin/sh", "-c"]
         args:
           - |
@@ -175,11 +269,17 @@ spec:
             export AWS_SECRET_ACCESS_KEY={{AWS_SECRET_ACCESS_KEY}}
             export RESTIC_REPOSITORY={{RESTIC_REPOSITORY}}
             export RESTIC_PASSWORD={{RESTIC_PASSWORD}}
+            ARGS="--json"
             if [ -n "{{TAG_FILTER}}" ]; then
-              restic snapshots --tag={{TAG_FILTER}} --json
-            else
-              restic snapshots --json
+              ARGS="$ARGS --tag={{TAG_FILTER}}"
+            fi
+            if [ -n "{{HOST_FILTER}}" ]; then
+              ARGS="$ARGS --host={{HOST_FILTER}}"
+            fi
+            if [ -n "{{GROUP_BY}}" ]; then
+              ARGS="$ARGS --group-by={{GROUP_BY}}"
             fi
+            restic snapshots $ARGS
 `
 
 // VMBackupConfigJob backs up VM configuration to restic repository.
@@ -191,17 +291,30 @@ metadata:
   namespace: {{NAMESPACE}}
 spec:
   backoffLimit: 0
+  activeDeadlineSeconds: {{ACTIVE_DEADLINE_SECONDS}}
   ttlSecondsAfterFinished: 30
   template:
     spec:
       restartPolicy: Never
+      securityContext: {{POD_SECURITY_CONTEXT}}
       containers:
       - name: backup-config
-        image: webberhuang/restic-accelerated:latest
+        image: {{RESTIC_IMAGE}}
         imagePullPolicy: IfNotPresent
+        securityContext: {{SECURITY_CONTEXT}}
+        resources:
+          requests:
+            cpu: "{{CPU_REQUEST}}"
+            memory: "{{MEM_REQUEST}}"
+          limits:
+            cpu: "{{CPU_LIMIT}}"
+            memory: "{{MEM_LIMIT}}"
+        env:
+        - name: XDG_CACHE_HOME
+          value: /tmp/.cache
         command: ["/bin/sh", "-c"]
         args:
-          - export AWS_ACCESS_KEY_ID={{AWS_ACCESS_KEY_ID}} && export AWS_SECRET_ACCESS_KEY={{AWS_SECRET_ACCESS_KEY}} && export RESTIC_REPOSITORY={{RESTIC_REPOSITORY}} && export RESTIC_PASSWORD={{RESTIC_PASSWORD}} && cat /config/{{FILENAME}} | restic backup --stdin --stdin-filename /config/{{FILENAME}} --tag=ns={{NAMESPACE}},sn={{SNAPSHOT}},type=vm-config
+          - export AWS_ACCESS_KEY_ID={{AWS_ACCESS_KEY_ID}} && export AWS_SECRET_ACCESS_KEY={{AWS_SECRET_ACCESS_KEY}} && export RESTIC_REPOSITORY={{RESTIC_REPOSITORY}} && export RESTIC_PASSWORD={{RESTIC_PASSWORD}} && cat /config/{{FILENAME}} | restic backup --stdin --stdin-filename /config/{{FILENAME}} --host={{RESTIC_HOST}} --tag={{TAGS}}
         volumeMounts:
         - name: config
           mountPath: /config
@@ -220,14 +333,27 @@ metadata:
   namespace: {{NAMESPACE}}
 spec:
   backoffLimit: 0
+  activeDeadlineSeconds: {{ACTIVE_DEADLINE_SECONDS}}
   ttlSecondsAfterFinished: 30
   template:
     spec:
       restartPolicy: Never
+      securityContext: {{POD_SECURITY_CONTEXT}}
       containers:
       - name: restore-config
-        image: webberhuang/restic-accelerated:latest
+        image: {{RESTIC_IMAGE}}
         imagePullPolicy: IfNotPresent
+        securityContext: {{SECURITY_CONTEXT}}
+        resources:
+          requests:
+            cpu: "{{CPU_REQUEST}}"
+            memory: "{{MEM_REQUEST}}"
+          limits:
+            cpu: "{{CPU_LIMIT}}"
+            memory: "{{MEM_LIMIT}}"
+        env:
+        - name: XDG_CACHE_HOME
+          value: /tmp/.cache
         command: ["/bin/sh", "-c"]
         args:
           - |
@@ -236,7 +362,7 @@ spec:
             export RESTIC_REPOSITORY={{RESTIC_REPOSITORY}}
             export RESTIC_PASSWORD={{RESTIC_PASSWORD}}
             
-            restic snapshots --tag=ns={{NAMESPACE}},sn={{BACKUP_NAME}},type=vm-config --json 2>/dev/null > /tmp/snapshots.json
+            restic snapshots --tag=ns={{BACKUP_NAMESPACE}},sn={{BACKUP_NAME}},type=vm-config --json 2>/dev/null > /tmp/snapshots.json
             SNAPSHOT_ID=$(cat /tmp/snapshots.json | grep -o '"short_id":"[^"]*"' | head -n1 | cut -d'"' -f4)
             
             if [ -z "$SNAPSHOT_ID" ]; then
@@ -256,15 +382,375 @@ metadata:
   namespace: {{NAMESPACE}}
 spec:
   backoffLimit: 0
+  activeDeadlineSeconds: {{ACTIVE_DEADLINE_SECONDS}}
   ttlSecondsAfterFinished: 30
   template:
     spec:
       restartPolicy: Never
+      securityContext: {{POD_SECURITY_CONTEXT}}
       containers:
       - name: delete-snapshot
-        image: webberhuang/restic-accelerated:latest
+        image: {{RESTIC_IMAGE}}
         imagePullPolicy: IfNotPresent
+        securityContext: {{SECURITY_CONTEXT}}
+        env:
+        - name: XDG_CACHE_HOME
+          value: /tmp/.cache
         command: ["/bin/sh", "-c"]
         args:
           - export AWS_ACCESS_KEY_ID={{AWS_ACCESS_KEY_ID}} && export AWS_SECRET_ACCESS_KEY={{AWS_SECRET_ACCESS_KEY}} && export RESTIC_REPOSITORY={{RESTIC_REPOSITORY}} && export RESTIC_PASSWORD={{RESTIC_PASSWORD}} && restic forget {{SNAPSHOT_ID}} --prune
 `
+
+// ResticTagJob changes the tags of a restic snapshot; TAG_ARGS holds the --add/--remove options.
+// restic rewrites the snapshot, so it gets a new ID.
+const ResticTagJob = `
+apiVersion: batch/v1
+kind: Job
+metadata:
+  name: {{NAME}}
+  namespace: {{NAMESPACE}}
+spec:
+  backoffLimit: 0
+  activeDeadlineSeconds: {{ACTIVE_DEADLINE_SECONDS}}
+  ttlSecondsAfterFinished: 30
+  template:
+    spec:
+      restartPolicy: Never
+      securityContext: {{POD_SECURITY_CONTEXT}}
+      containers:
+      - name: tag-snapshot
+        image: {{RESTIC_IMAGE}}
+        imagePullPolicy: IfNotPresent
+        securityContext: {{SECURITY_CONTEXT}}
+        env:
+        - name: XDG_CACHE_HOME
+          value: /tmp/.cache
+        command: ["/bin/sh", "-c"]
+        args:
+          - export AWS_ACCESS_KEY_ID={{AWS_ACCESS_KEY_ID}} && export AWS_SECRET_ACCESS_KEY={{AWS_SECRET_ACCESS_KEY}} && export RESTIC_REPOSITORY={{RESTIC_REPOSITORY}} && export RESTIC_PASSWORD={{RESTIC_PASSWORD}} && restic tag {{TAG_ARGS}} {{SNAPSHOT_ID}}
+`
+
+// ResticMigrateJob upgrades the repository format to version 2, which enables compression.
+const ResticMigrateJob = `
+apiVersion: batch/v1
+kind: Job
+metadata:
+  name: {{NAME}}
+  namespace: {{NAMESPACE}}
+spec:
+  backoffLimit: 0
+  activeDeadlineSeconds: {{ACTIVE_DEADLINE_SECONDS}}
+  ttlSecondsAfterFinished: 30
+  template:
+    spec:
+      restartPolicy: Never
+      securityContext: {{POD_SECURITY_CONTEXT}}
+      containers:
+      - name: migrate
+        image: {{RESTIC_IMAGE}}
+        imagePullPolicy: IfNotPresent
+        securityContext: {{SECURITY_CONTEXT}}
+        env:
+        - name: XDG_CACHE_HOME
+          value: /tmp/.cache
+        command: ["/bin/sh", "-c"]
+        args:
+          - export AWS_ACCESS_KEY_ID={{AWS_ACCESS_KEY_ID}} && export AWS_SECRET_ACCESS_KEY={{AWS_SECRET_ACCESS_KEY}} && export RESTIC_REPOSITORY={{RESTIC_REPOSITORY}} && export RESTIC_PASSWORD={{RESTIC_PASSWORD}} && restic migrate upgrade_repo_v2
+`
+
+// ResticVerifyJob runs "restic check", reading READ_DATA_SUBSET of the pack files (e.g. 10%)
+// so that corrupted data is found as well as damaged repository structure.
+const ResticVerifyJob = `
+apiVersion: batch/v1
+kind: Job
+metadata:
+  name: {{NAME}}
+  namespace: {{NAMESPACE}}
+spec:
+  backoffLimit: 0
+  activeDeadlineSeconds: {{ACTIVE_DEADLINE_SECONDS}}
+  ttlSecondsAfterFinished: 30
+  template:
+    spec:
+      restartPolicy: Never
+      securityContext: {{POD_SECURITY_CONTEXT}}
+      containers:
+      - name: verify
+        image: {{RESTIC_IMAGE}}
+        imagePullPolicy: IfNotPresent
+        securityContext: {{SECURITY_CONTEXT}}
+        env:
+        - name: XDG_CACHE_HOME
+          value: /tmp/.cache
+        command: ["/bin/sh", "-c"]
+        args:
+          - export AWS_ACCESS_KEY_ID={{AWS_ACCESS_KEY_ID}} && export AWS_SECRET_ACCESS_KEY={{AWS_SECRET_ACCESS_KEY}} && export RESTIC_REPOSITORY={{RESTIC_REPOSITORY}} && export RESTIC_PASSWORD={{RESTIC_PASSWORD}} && restic check --read-data-subset={{READ_DATA_SUBSET}}
+`
+
+// ResticStatsJob prints "restic stats --json" of the snapshots matching TAG_FILTER (all
+// snapshots if empty), first in raw-data mode and then in restore-size mode, one line each.
+const ResticStatsJob = `
+apiVersion: batch/v1
+kind: Job
+metadata:
+  name: {{NAME}}
+  namespace: {{NAMESPACE}}
+spec:
+  backoffLimit: 0
+  activeDeadlineSeconds: {{ACTIVE_DEADLINE_SECONDS}}
+  ttlSecondsAfterFinished: 60
+  template:
+    spec:
+      restartPolicy: Never
+      securityContext: {{POD_SECURITY_CONTEXT}}
+      containers:
+      - name: stats
+        image: {{RESTIC_IMAGE}}
+        imagePullPolicy: IfNotPresent
+        securityContext: {{SECURITY_CONTEXT}}
+        resources:
+          requests:
+            cpu: "{{CPU_REQUEST}}"
+            memory: "{{MEM_REQUEST}}"
+          limits:
+            cpu: "{{CPU_LIMIT}}"
+            memory: "{{MEM_LIMIT}}"
+        env:
+        - name: XDG_CACHE_HOME
+          value: /tmp/.cache
+        command: ["/bin/sh", "-c"]
+        args:
+          - |
+            export AWS_ACCESS_KEY_ID={{AWS_ACCESS_KEY_ID}}
+            export AWS_SECRET_ACCESS_KEY={{AWS_SECRET_ACCESS_KEY}}
+            export RESTIC_REPOSITORY={{RESTIC_REPOSITORY}}
+            export RESTIC_PASSWORD={{RESTIC_PASSWORD}}
+            ARGS="--json"
+            if [ -n "{{TAG_FILTER}}" ]; then
+              ARGS="$ARGS --tag={{TAG_FILTER}}"
+            fi
+            restic stats --mode=raw-data $ARGS && restic stats --mode=restore-size $ARGS
+`
+
+// ResticLsJob prints the files and directories of snapshot SNAPSHOT_ID as JSON, one per line
+// after a first line describing the snapshot.
+const ResticLsJob = `
+apiVersion: batch/v1
+kind: Job
+metadata:
+  name: {{NAME}}
+  namespace: {{NAMESPACE}}
+spec:
+  backoffLimit: 0
+  activeDeadlineSeconds: {{ACTIVE_DEADLINE_SECONDS}}
+  ttlSecondsAfterFinished: 60
+  template:
+    spec:
+      restartPolicy: Never
+      securityContext: {{POD_SECURITY_CONTEXT}}
+      containers:
+      - name: ls
+        image: {{RESTIC_IMAGE}}
+        imagePullPolicy: IfNotPresent
+        securityContext: {{SECURITY_CONTEXT}}
+        resources:
+          requests:
+            cpu: "{{CPU_REQUEST}}"
+            memory: "{{MEM_REQUEST}}"
+          limits:
+            cpu: "{{CPU_LIMIT}}"
+            memory: "{{MEM_LIMIT}}"
+        env:
+        - name: XDG_CACHE_HOME
+          value: /tmp/.cache
+        command: ["/bin/sh", "-c"]
+        args:
+          - export AWS_ACCESS_KEY_ID={{AWS_ACCESS_KEY_ID}} && export AWS_SECRET_ACCESS_KEY={{AWS_SECRET_ACCESS_KEY}} && export RESTIC_REPOSITORY={{RESTIC_REPOSITORY}} && export RESTIC_PASSWORD={{RESTIC_PASSWORD}} && restic ls {{SNAPSHOT_ID}} --json
+`
+
+// ResticPruneJob applies a retention policy (KEEP_ARGS, e.g. "--keep-last 3") to the snapshots
+// carrying all of TAGS as a single group, without removing anything: it prints restic's plan as
+// JSON. Snapshots tagged protected=true are always kept.
+const ResticPruneJob = `
+apiVersion: batch/v1
+kind: Job
+metadata:
+  name: {{NAME}}
+  namespace: {{NAMESPACE}}
+spec:
+  backoffLimit: 0
+  activeDeadlineSeconds: {{ACTIVE_DEADLINE_SECONDS}}
+  ttlSecondsAfterFinished: 30
+  template:
+    spec:
+      restartPolicy: Never
+      securityContext: {{POD_SECURITY_CONTEXT}}
+      containers:
+      - name: prune
+        image: {{RESTIC_IMAGE}}
+        imagePullPolicy: IfNotPresent
+        securityContext: {{SECURITY_CONTEXT}}
+        env:
+        - name: XDG_CACHE_HOME
+          value: /tmp/.cache
+        command: ["/bin/sh", "-c"]
+        args:
+          - export AWS_ACCESS_KEY_ID={{AWS_ACCESS_KEY_ID}} && export AWS_SECRET_ACCESS_KEY={{AWS_SECRET_ACCESS_KEY}} && export RESTIC_REPOSITORY={{RESTIC_REPOSITORY}} && export RESTIC_PASSWORD={{RESTIC_PASSWORD}} && restic forget --dry-run --json --tag={{TAGS}} --group-by='' --keep-tag=protected=true {{KEEP_ARGS}}
+`
+
+// ArchiveDumpJob streams a volume snapshot out through the container log as base64 lines,
+// followed by an ARCHIVE-END line carrying the SHA-256 of the raw data (or ARCHIVE-ERROR).
+const ArchiveDumpJob = `
+apiVersion: batch/v1
+kind: Job
+metadata:
+  name: {{NAME}}
+  namespace: {{NAMESPACE}}
+spec:
+  backoffLimit: 0
+  activeDeadlineSeconds: {{ACTIVE_DEADLINE_SECONDS}}
+  ttlSecondsAfterFinished: 300
+  template:
+    spec:
+      restartPolicy: Never
+      securityContext: {{POD_SECURITY_CONTEXT}}
+      containers:
+      - name: archive
+        image: {{RESTIC_IMAGE}}
+        imagePullPolicy: IfNotPresent
+        securityContext: {{SECURITY_CONTEXT}}
+        env:
+        - name: XDG_CACHE_HOME
+          value: /tmp/.cache
+        command: ["/bin/sh", "-c"]
+        args:
+          - |
+            export AWS_ACCESS_KEY_ID={{AWS_ACCESS_KEY_ID}}
+            export AWS_SECRET_ACCESS_KEY={{AWS_SECRET_ACCESS_KEY}}
+            export RESTIC_REPOSITORY={{RESTIC_REPOSITORY}}
+            export RESTIC_PASSWORD={{RESTIC_PASSWORD}}
+
+            mkfifo /tmp/data
+            sha256sum < /tmp/data > /tmp/sum &
+            { restic dump {{SNAPSHOT_ID}} {{PV_NAME}} 2>/tmp/err || echo $? > /tmp/rc; } | tee /tmp/data | base64
+            wait
+
+            if [ -f /tmp/rc ]; then
+              echo "ARCHIVE-ERROR $(tr '\n' ' ' < /tmp/err)"
+              exit 1
+            fi
+            echo "ARCHIVE-END $(cut -d' ' -f1 /tmp/sum)"
+`
+
+// UnarchiveReceiveJob serves the staging PVC over HTTP so the tool can write archived
+// volume data into it through the API server's pod proxy. Requests must carry the token held
+// by the Secret TOKEN_SECRET. Its deadline frees the staging PVC if the tool never tells it
+// to stop.
+const UnarchiveReceiveJob = `
+apiVersion: batch/v1
+kind: Job
+metadata:
+  name: {{NAME}}
+  namespace: {{NAMESPACE}}
+spec:
+  backoffLimit: 0
+  activeDeadlineSeconds: {{ACTIVE_DEADLINE_SECONDS}}
+  ttlSecondsAfterFinished: 30
+  template:
+    spec:
+      restartPolicy: Never
+      securityContext: {{DATA_POD_SECURITY_CONTEXT}}
+      nodeSelector: {{NODE_SELECTOR}}
+      tolerations: {{TOLERATIONS}}
+      containers:
+      - name: receive
+        image: {{RESTIC_IMAGE}}
+        imagePullPolicy: IfNotPresent
+        securityContext: {{DATA_SECURITY_CONTEXT}}
+        command: ["/usr/local/bin/accelerated_io"]
+        args: ["-device", "/dev/{{PVC_NAME}}", "-mode=receive", "-listen=:{{PORT}}"]
+        env:
+        - name: RECEIVE_TOKEN
+          valueFrom:
+            secretKeyRef:
+              name: {{TOKEN_SECRET}}
+              key: token
+        ports:
+        - containerPort: {{PORT}}
+        volumeDevices:
+        - name: staging
+          devicePath: /dev/{{PVC_NAME}}
+      volumes:
+      - name: staging
+        persistentVolumeClaim:
+          claimName: {{PVC_NAME}}
+`
+
+// UnarchiveBackupJob backs up the first SIZE bytes of the staging PVC to restic with the
+// filename and tags recorded in the archive.
+const UnarchiveBackupJob = `
+apiVersion: batch/v1
+kind: Job
+metadata:
+  name: {{NAME}}
+  namespace: {{NAMESPACE}}
+spec:
+  backoffLimit: 0
+  activeDeadlineSeconds: {{ACTIVE_DEADLINE_SECONDS}}
+  ttlSecondsAfterFinished: 30
+  template:
+    spec:
+      restartPolicy: Never
+      securityContext: {{DATA_POD_SECURITY_CONTEXT}}
+      nodeSelector: {{NODE_SELECTOR}}
+      tolerations: {{TOLERATIONS}}
+      containers:
+      - name: backup
+        image: {{RESTIC_IMAGE}}
+        imagePullPolicy: IfNotPresent
+        securityContext: {{DATA_SECURITY_CONTEXT}}
+        command: ["/bin/sh", "-c"]
+        args:
+          - export AWS_ACCESS_KEY_ID={{AWS_ACCESS_KEY_ID}} && export AWS_SECRET_ACCESS_KEY={{AWS_SECRET_ACCESS_KEY}} && export RESTIC_REPOSITORY={{RESTIC_REPOSITORY}} && export RESTIC_PASSWORD={{RESTIC_PASSWORD}} && head -c {{SIZE}} /dev/{{PVC_NAME}} | restic -q backup --stdin --stdin-filename {{PV_NAME}} --tag={{TAGS}}
+        volumeDevices:
+        - name: staging
+          devicePath: /dev/{{PVC_NAME}}
+      volumes:
+      - name: staging
+        persistentVolumeClaim:
+          claimName: {{PVC_NAME}}
+`
+
+// ChecksumJob prints the SHA-256 of the first SIZE bytes of a block PVC.
+const ChecksumJob = `
+apiVersion: batch/v1
+kind: Job
+metadata:
+  name: {{NAME}}
+  namespace: {{NAMESPACE}}
+spec:
+  backoffLimit: 0
+  activeDeadlineSeconds: {{ACTIVE_DEADLINE_SECONDS}}
+  ttlSecondsAfterFinished: 30
+  template:
+    spec:
+      restartPolicy: Never
+      securityContext: {{DATA_POD_SECURITY_CONTEXT}}
+      nodeSelector: {{NODE_SELECTOR}}
+      tolerations: {{TOLERATIONS}}
+      containers:
+      - name: checksum
+        image: {{RESTIC_IMAGE}}
+        imagePullPolicy: IfNotPresent
+        securityContext: {{DATA_SECURITY_CONTEXT}}
+        command: ["/bin/sh", "-c"]
+        args:
+          - head -c {{SIZE}} /dev/{{PVC_NAME}} | sha256sum
+        volumeDevices:
+        - name: vol1
+          devicePath: /dev/{{PVC_NAME}}
+      volumes:
+      - name: vol1
+        persistentVolumeClaim:
+          claimName: {{PVC_NAME}}
+`
@@ -0,0 +1,30 @@
+package manifests
+
+// Security contexts are substituted into the job manifests as single-line JSON,
+// which is valid YAML flow syntax and avoids any indentation concerns.
+//
+// Jobs that only talk to the restic repository (check, init, find, config, forget)
+// use the restricted profile and satisfy the "restricted" Pod Security Standard.
+// The data-movement jobs (BackupJob, RestoreJob) must open the raw block device,
+// which the kubelet creates as root-owned, so they run as UID 0 with every
+// capability dropped. That satisfies the "baseline" Pod Security Standard.
+// The privileged profile is an escape hatch for CSI drivers whose device nodes
+// are not accessible without extra privileges; it requires the "privileged" level.
+
+// RestrictedPodSecurityContext is the pod-level securityContext for restic-only jobs.
+const RestrictedPodSecurityContext = `{"runAsNonRoot": true, "runAsUser": 65534, "runAsGroup": 65534, "seccompProfile": {"type": "RuntimeDefault"}}`
+
+// RestrictedSecurityContext is the container-level securityContext for restic-only jobs.
+const RestrictedSecurityContext = `{"allowPrivilegeEscalation": false, "capabilities": {"drop": ["ALL"]}}`
+
+// BlockDevicePodSecurityContext is the pod-level securityContext for the data-movement jobs.
+const BlockDevicePodSecurityContext = `{"runAsUser": 0, "runAsGroup": 0, "seccompProfile": {"type": "RuntimeDefault"}}`
+
+// BlockDeviceSecurityContext is the container-level securityContext for the data-movement jobs.
+const BlockDeviceSecurityContext = `{"allowPrivilegeEscalation": false, "capabilities": {"drop": ["ALL"]}}`
+
+// PrivilegedPodSecurityContext is the pod-level securityContext used with -privileged.
+const PrivilegedPodSecurityContext = `{"runAsUser": 0, "runAsGroup": 0}`
+
+// PrivilegedSecurityContext is the container-level securityContext used with -privileged.
+const PrivilegedSecurityContext = `{"privileged": true}`
@@ -1,7 +1,12 @@
 package restore
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/webberhuang/hv-vmbr/pkg/find"
@@ -9,16 +14,36 @@ import (
 	"github.com/webberhuang/hv-vmbr/pkg/manifests"
 )
 
+// ErrRepoCorruption is returned by RunRestore when restic finds the snapshot but cannot read its
+// data from the repository, e.g. because a pack file is missing
+var ErrRepoCorruption = errors.New("repository data of the snapshot is missing or damaged")
+
+// corruptionMessages are restic errors about data a snapshot references that the repository lacks,
+// and the accelerated_io error about restored data that differs from what the backup read
+var corruptionMessages = []string{
+	"pack file not found",
+	"blob not found",
+	"not found in repository",
+	"not found in index",
+	"ciphertext verification failed",
+	"CHECKSUM mismatch",
+}
+
 // RunRestore executes the restore workflow.
-func RunRestore(namespace, destPVC, sourceNs, sourcePV, snapshot, awsID, awsSecret, repository, password string) {
-	snapshotID, err := find.RunFindByID(sourceNs, snapshot, awsID, awsSecret, repository, password)
+// The restore job fails before writing if destPVC is smaller than deviceSize bytes (0 skips the check),
+// and after writing if the data does not match checksum, the SHA-256 the backup job reported
+// (empty skips the check). If restic cannot read the snapshot's data, the error wraps ErrRepoCorruption.
+func RunRestore(ctx context.Context, namespace, destPVC, sourceNs, sourcePV, snapshot string, deviceSize int64, checksum, awsID, awsSecret, repository, password string) error {
+	// The source namespace need not exist here, so the snapshot is searched for from namespace
+	snap, err := find.RunFindSnapshotFrom(ctx, namespace, sourceNs, snapshot, awsID, awsSecret, repository, password)
 	if err != nil {
-		log.Fatalf("❌ Failed to find backup %v with ns %s snapshot %s", err, sourceNs, snapshot)
+		return fmt.Errorf("failed to find backup with ns %s snapshot %s: %w", sourceNs, snapshot, err)
 	}
+	snapshotID := snap.ShortID
 
 	jobSuffix, err := k8s.GenerateJobSuffix()
 	if err != nil {
-		log.Fatalf("❌ Failed to generate job suffix for restore job: %v", err)
+		return fmt.Errorf("failed to generate job suffix for restore job: %w", err)
 	}
 	log.Println("🔧 Applying restore job manifest...")
 	// For the restore job, the manifest uses default tokens {{NAMESPACE}} and {{NAME}}.
@@ -31,21 +56,49 @@ func RunRestore(namespace, destPVC, sourceNs, sourcePV, snapshot, awsID, awsSecr
 		"PVC_NAME":              destPVC,  // extra token used in command args
 		"PV_NAME":               sourcePV, // extra token for the source PV filename
 		"SNAPSHOT_ID":           snapshotID,
+		"DEVICE_SIZE":           strconv.FormatInt(deviceSize, 10),
+		"EXPECT_CHECKSUM":       checksum,
 	}
-	if err := k8s.ApplyManifest(manifests.RestoreJob, namespace, "block-restore-job-"+jobSuffix, restoreRepls); err != nil {
-		log.Fatalf("❌ Failed to apply restore job manifest: %v", err)
+	timeout := 3600 * time.Second
+	if err := k8s.ApplyJob(ctx, manifests.RestoreJob, namespace, "block-restore-job-"+jobSuffix, timeout, restoreRepls); err != nil {
+		return fmt.Errorf("failed to apply restore job manifest: %w", err)
 	}
 
 	// Launch log streaming to capture restore progress.
 	go func() {
-		if err := k8s.StreamJobProgressPercentage("block-restore-job-"+jobSuffix, namespace, "restore", "WRITE progress:"); err != nil {
+		if err := k8s.StreamJobProgressPercentage(ctx, "block-restore-job-"+jobSuffix, namespace, "restore", "WRITE progress:", k8s.LogProgress); err != nil {
 			log.Printf("❌ Error streaming restore progress logs: %v", err)
 		}
 	}()
 
 	log.Println("⌛ Waiting for restore job to complete...")
-	if err := k8s.WaitForJob("block-restore-job-"+jobSuffix, namespace, 3600*time.Second); err != nil {
-		log.Fatalf("❌ Restore job did not complete: %v", err)
+	if err := k8s.WaitForJob(ctx, "block-restore-job-"+jobSuffix, namespace, timeout); err != nil {
+		var jobErr *k8s.JobFailedError
+		if errors.As(err, &jobErr) {
+			if line := corruptionLine("block-restore-job-"+jobSuffix, namespace); line != "" {
+				return fmt.Errorf("%w: snapshot %s could not be dumped into PVC %s (%s); run \"restic check --read-data\" to find the damaged pack files", ErrRepoCorruption, snapshotID, destPVC, line)
+			}
+		}
+		return fmt.Errorf("restore job did not complete: %w", err)
 	}
 	log.Println("✅ Restore completed successfully.")
+	return nil
+}
+
+// corruptionLine returns the first line of the failed restore job's log reporting data missing
+// from the repository, or an empty string if there is none
+func corruptionLine(jobName, namespace string) string {
+	logs, err := k8s.GetJobLogs(jobName, namespace, "restore")
+	if err != nil {
+		log.Printf("⚠️  Could not read the logs of restore job %s: %v", jobName, err)
+		return ""
+	}
+	for _, line := range strings.Split(logs, "\n") {
+		for _, message := range corruptionMessages {
+			if strings.Contains(line, message) {
+				return strings.TrimSpace(line)
+			}
+		}
+	}
+	return ""
 }
@@ -0,0 +1,90 @@
+package stats
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/webberhuang/hv-vmbr/pkg/k8s"
+	"github.com/webberhuang/hv-vmbr/pkg/manifests"
+)
+
+// Stats holds the output of "restic stats --mode=raw-data --json", plus the restore size of
+// the same snapshots from --mode=restore-size.
+type Stats struct {
+	TotalSize             uint64  `json:"total_size"`
+	TotalUncompressedSize uint64  `json:"total_uncompressed_size,omitempty"`
+	CompressionRatio      float64 `json:"compression_ratio,omitempty"`
+	TotalFileCount        int     `json:"total_file_count,omitempty"`
+	TotalBlobCount        int     `json:"total_blob_count"`
+	SnapshotsCount        int     `json:"snapshots_count"`
+	// RestoreSize is how much data restoring every snapshot would write
+	RestoreSize uint64 `json:"restore_size"`
+}
+
+// DedupRatio is the restore size of the snapshots divided by the size of the unique data they
+// reference before compression, or 0 if the snapshots reference no data.
+func (s Stats) DedupRatio() float64 {
+	unique := s.TotalUncompressedSize
+	if unique == 0 {
+		// Repositories of format version 1 are not compressed and omit the uncompressed size
+		unique = s.TotalSize
+	}
+	if unique == 0 {
+		return 0
+	}
+	return float64(s.RestoreSize) / float64(unique)
+}
+
+// RunStats runs a job printing "restic stats" of the snapshots carrying all of tags, or of the
+// whole repository if tags is empty.
+func RunStats(ctx context.Context, namespace string, tags []string, awsID, awsSecret, repository, password string) (*Stats, error) {
+	jobSuffix, err := k8s.GenerateJobSuffix()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate job suffix for stats job: %w", err)
+	}
+	jobName := "restic-stats-" + jobSuffix
+
+	replacements := map[string]string{
+		"AWS_ACCESS_KEY_ID":     awsID,
+		"AWS_SECRET_ACCESS_KEY": awsSecret,
+		"RESTIC_REPOSITORY":     repository,
+		"RESTIC_PASSWORD":       password,
+		"TAG_FILTER":            strings.Join(tags, ","),
+	}
+
+	// Restore-size mode walks the tree of every snapshot, which takes a while for large repositories
+	timeout := 600 * time.Second
+	if err := k8s.ApplyJob(ctx, manifests.ResticStatsJob, namespace, jobName, timeout, replacements); err != nil {
+		return nil, fmt.Errorf("failed to apply stats job manifest: %w", err)
+	}
+
+	if err := k8s.WaitForJob(ctx, jobName, namespace, timeout); err != nil {
+		return nil, fmt.Errorf("stats job did not complete: %w", err)
+	}
+
+	logs, err := k8s.GetJobLogs(jobName, namespace, "stats")
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve job logs: %w", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(logs), "\n")
+	if len(lines) != 2 {
+		return nil, fmt.Errorf("expected two lines of JSON output from stats job, got %d", len(lines))
+	}
+	var stats Stats
+	if err := json.Unmarshal([]byte(lines[0]), &stats); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal raw-data stats: %w", err)
+	}
+	var restoreSize Stats
+	if err := json.Unmarshal([]byte(lines[1]), &restoreSize); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal restore-size stats: %w", err)
+	}
+	// raw-data mode counts blobs, not files
+	stats.RestoreSize = restoreSize.TotalSize
+	stats.TotalFileCount = restoreSize.TotalFileCount
+
+	return &stats, nil
+}
@@ -0,0 +1,55 @@
+package verify
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/webberhuang/hv-vmbr/pkg/k8s"
+	"github.com/webberhuang/hv-vmbr/pkg/manifests"
+)
+
+// verifyTimeout bounds the check job; reading pack data downloads that share of the repository.
+const verifyTimeout = 24 * time.Hour
+
+// RunVerify checks the repository with "restic check", reading subset (e.g. "10%", "1/5" or
+// "2G") of its pack files, and returns an error if restic reports any damage.
+func RunVerify(ctx context.Context, namespace, subset, awsID, awsSecret, repository, password string) error {
+	jobSuffix, err := k8s.GenerateJobSuffix()
+	if err != nil {
+		return fmt.Errorf("failed to generate job suffix: %w", err)
+	}
+
+	replacements := map[string]string{
+		"AWS_ACCESS_KEY_ID":     awsID,
+		"AWS_SECRET_ACCESS_KEY": awsSecret,
+		"RESTIC_REPOSITORY":     repository,
+		"RESTIC_PASSWORD":       password,
+		"READ_DATA_SUBSET":      subset,
+	}
+	jobName := "restic-verify-" + jobSuffix
+
+	log.Printf("🔧 Applying repository check job reading %s of the data...", subset)
+	if err := k8s.ApplyJob(ctx, manifests.ResticVerifyJob, namespace, jobName, verifyTimeout, replacements); err != nil {
+		return fmt.Errorf("failed to apply repository check job: %w", err)
+	}
+
+	stream, err := k8s.StreamJobLogs(ctx, jobName, namespace, "verify")
+	if err != nil {
+		log.Printf("⚠️  Failed to stream repository check logs: %v", err)
+	} else {
+		scanner := bufio.NewScanner(stream)
+		for scanner.Scan() {
+			log.Printf("   %s", scanner.Text())
+		}
+		stream.Close()
+	}
+
+	if err := k8s.WaitForJob(ctx, jobName, namespace, verifyTimeout); err != nil {
+		return fmt.Errorf("restic check failed; the repository may be damaged: %w", err)
+	}
+	log.Println("✅ Repository check passed.")
+	return nil
+}
@@ -0,0 +1,212 @@
+package vm
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/webberhuang/hv-vmbr/pkg/find"
+	"github.com/webberhuang/hv-vmbr/pkg/k8s"
+	"github.com/webberhuang/hv-vmbr/pkg/manifests"
+)
+
+// Layout of an archive directory
+const (
+	ArchiveManifestFile = "manifest.json"
+	archiveConfigFile   = "config.json"
+	archiveVolumesDir   = "volumes"
+)
+
+// Markers written by the ArchiveDumpJob after the base64 data lines
+const (
+	archiveEndMarker   = "ARCHIVE-END "
+	archiveErrorMarker = "ARCHIVE-ERROR "
+)
+
+// RunVMArchive downloads a backup's config and the raw data of each volume from restic into
+// outputDir, and writes a manifest describing how to re-upload them to another repository.
+func RunVMArchive(ctx context.Context, namespace, backupName, outputDir, awsID, awsSecret, repository, password string) error {
+	log.Printf("🔧 Starting archive of backup %s into %s", backupName, outputDir)
+
+	config, err := downloadBackupConfig(ctx, namespace, backupName, awsID, awsSecret, repository, password)
+	if err != nil {
+		return fmt.Errorf("failed to download backup config: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Join(outputDir, archiveVolumesDir), 0755); err != nil {
+		return fmt.Errorf("failed to create archive directory: %w", err)
+	}
+
+	configData, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal backup config: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(outputDir, archiveConfigFile), configData, 0644); err != nil {
+		return fmt.Errorf("failed to write backup config: %w", err)
+	}
+
+	configTags := config.ConfigTags
+	if len(configTags) == 0 {
+		configTags = configSnapshotTags(namespace, backupName)
+	}
+
+	archive := ArchiveManifest{
+		BackupName: backupName,
+		Namespace:  namespace,
+		SourceVM:   config.BackupSpec.Source.Name,
+		Repository: repository,
+		CreatedAt:  time.Now().UTC(),
+		ConfigFile: archiveConfigFile,
+		ConfigTags: configTags,
+		Volumes:    []ArchivedVolume{},
+	}
+
+	for _, volumeBackup := range config.VolumeBackups {
+		volume, err := archiveVolume(ctx, volumeBackup, namespace, backupName, outputDir, awsID, awsSecret, repository, password)
+		if err != nil {
+			return fmt.Errorf("failed to archive volume %s: %w", volumeBackup.PersistentVolumeClaim.Name, err)
+		}
+		archive.Volumes = append(archive.Volumes, volume)
+	}
+
+	manifestData, err := json.MarshalIndent(archive, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal archive manifest: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(outputDir, ArchiveManifestFile), manifestData, 0644); err != nil {
+		return fmt.Errorf("failed to write archive manifest: %w", err)
+	}
+
+	log.Printf("✅ Archived backup %s (%d volume(s)) to %s", backupName, len(archive.Volumes), outputDir)
+	return nil
+}
+
+// archiveVolume streams one volume snapshot into a local file and verifies its checksum
+func archiveVolume(ctx context.Context, volumeBackup VolumeBackup, namespace, backupName, outputDir, awsID, awsSecret, repository, password string) (_ ArchivedVolume, err error) {
+	pvcName := volumeBackup.PersistentVolumeClaim.Name
+	tags := volumeSnapshotTags(namespace, backupName, volumeBackup)
+
+	snapshots, err := find.RunFind(ctx, namespace, tags, awsID, awsSecret, repository, password)
+	if err != nil {
+		return ArchivedVolume{}, fmt.Errorf("failed to find snapshot: %w", err)
+	}
+	if len(snapshots) == 0 {
+		return ArchivedVolume{}, fmt.Errorf("snapshot not found with tags: %s", strings.Join(tags, ","))
+	}
+	snapshot := snapshots[0]
+	pvName := volumeBackup.PersistentVolumeClaim.Spec.VolumeName
+
+	jobSuffix, err := k8s.GenerateJobSuffix()
+	if err != nil {
+		return ArchivedVolume{}, fmt.Errorf("failed to generate job suffix: %w", err)
+	}
+
+	replacements := map[string]string{
+		"AWS_ACCESS_KEY_ID":     awsID,
+		"AWS_SECRET_ACCESS_KEY": awsSecret,
+		"RESTIC_REPOSITORY":     repository,
+		"RESTIC_PASSWORD":       password,
+		"SNAPSHOT_ID":           snapshot.ShortID,
+		"PV_NAME":               pvName,
+	}
+
+	jobName := "vm-archive-" + jobSuffix
+	timeout := 3600 * time.Second
+	if err := k8s.ApplyJob(ctx, manifests.ArchiveDumpJob, namespace, jobName, timeout, replacements); err != nil {
+		return ArchivedVolume{}, fmt.Errorf("failed to apply archive job: %w", err)
+	}
+	// Stop a job whose output is no longer read instead of leaving it to its deadline
+	defer func() {
+		if err != nil {
+			k8s.DeleteJob(jobName, namespace)
+		}
+	}()
+
+	file := filepath.Join(archiveVolumesDir, pvcName+".raw")
+	out, err := os.Create(filepath.Join(outputDir, file))
+	if err != nil {
+		return ArchivedVolume{}, err
+	}
+	defer out.Close()
+
+	log.Printf("⌛ Downloading snapshot %s of PVC %s to %s...", snapshot.ShortID, pvcName, file)
+	stream, err := k8s.StreamJobLogs(ctx, jobName, namespace, "archive")
+	if err != nil {
+		return ArchivedVolume{}, err
+	}
+	size, sum, err := decodeArchiveStream(stream, out)
+	stream.Close()
+	if err != nil {
+		return ArchivedVolume{}, err
+	}
+	if err := out.Sync(); err != nil {
+		return ArchivedVolume{}, err
+	}
+
+	if err := k8s.WaitForJob(ctx, jobName, namespace, 60*time.Second); err != nil {
+		return ArchivedVolume{}, fmt.Errorf("archive job failed: %w", err)
+	}
+
+	log.Printf("✅ Archived PVC %s: %d bytes, sha256 %s", pvcName, size, sum)
+	return ArchivedVolume{
+		PVCName:       pvcName,
+		File:          file,
+		StdinFilename: pvName,
+		Tags:          snapshot.Tags,
+		Size:          size,
+		SHA256:        sum,
+	}, nil
+}
+
+// decodeArchiveStream decodes the base64 lines written by the ArchiveDumpJob into w and checks
+// the result against the checksum on the end marker. Lines lost to container log rotation
+// show up as a checksum mismatch.
+func decodeArchiveStream(r io.Reader, w io.Writer) (int64, string, error) {
+	hash := sha256.New()
+	dst := io.MultiWriter(w, hash)
+	buf := make([]byte, base64.StdEncoding.DecodedLen(1024))
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	var size int64
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, archiveErrorMarker):
+			return size, "", fmt.Errorf("restic dump failed: %s", strings.TrimPrefix(line, archiveErrorMarker))
+		case strings.HasPrefix(line, archiveEndMarker):
+			sum := hex.EncodeToString(hash.Sum(nil))
+			if expected := strings.TrimSpace(strings.TrimPrefix(line, archiveEndMarker)); expected != sum {
+				return size, "", fmt.Errorf("checksum mismatch after %d bytes: job reported %s, received %s", size, expected, sum)
+			}
+			return size, sum, nil
+		}
+
+		if len(line) > 1024 {
+			return size, "", fmt.Errorf("unexpected line of %d bytes in archive stream", len(line))
+		}
+		n, err := base64.StdEncoding.Decode(buf, []byte(line))
+		if err != nil {
+			return size, "", fmt.Errorf("corrupt archive stream after %d bytes: %w", size, err)
+		}
+		if _, err := dst.Write(buf[:n]); err != nil {
+			return size, "", err
+		}
+		size += int64(n)
+	}
+	if err := scanner.Err(); err != nil {
+		return size, "", err
+	}
+	return size, "", fmt.Errorf("archive stream ended after %d bytes without an end marker", size)
+}
@@ -1,22 +1,31 @@
 package vm
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/yaml"
 
 	"github.com/webberhuang/hv-vmbr/pkg/backup"
 	"github.com/webberhuang/hv-vmbr/pkg/find"
 	"github.com/webberhuang/hv-vmbr/pkg/k8s"
+	"github.com/webberhuang/hv-vmbr/pkg/logutil"
 	"github.com/webberhuang/hv-vmbr/pkg/manifests"
 )
 
@@ -29,27 +38,229 @@ var (
 	}
 )
 
-// RunVMBackup executes the VM backup workflow
-func RunVMBackup(namespace, vmName, backupName string, vscMapping map[string]string, awsID, awsSecret, repository, password string, repoInitialized bool) {
-	log.Printf("🔧 Starting VM backup for %s/%s", namespace, vmName)
+// RunVMBackups backs up every VM in the namespace matching the label selector, one after the
+// other, each under the backup name backupNameFor returns for it. backupNameFor is called for
+// every VM once the repository is initialized, before any backup starts. A VM whose backup fails
+// does not stop the others; the failures are summarized at the end and returned as one error.
+func RunVMBackups(ctx context.Context, namespace, selector string, backupNameFor func(vmName string) (string, error), vscMapping map[string]string, awsID, awsSecret, repository, password string, repoInitialized bool, opts BackupOptions) error {
+	vmNames, err := ListVMs(namespace, selector)
+	if err != nil {
+		return err
+	}
+	if len(vmNames) == 0 {
+		return fmt.Errorf("no VirtualMachine in namespace %s matches %s", namespace, selector)
+	}
+	log.Printf("🔍 %d VirtualMachine(s) match %s", len(vmNames), selector)
+	vmNames, excluded := excludeVMs(namespace, vmNames, opts.ExcludeVMs, opts.ExcludeNamespaces)
+	if len(excluded) > 0 {
+		log.Printf("⏭️  Skipping %d excluded VirtualMachine(s): %s", len(excluded), strings.Join(excluded, ", "))
+	}
+	if len(vmNames) == 0 {
+		return fmt.Errorf("every VirtualMachine in namespace %s matching %s is excluded", namespace, selector)
+	}
+
+	// Initialize the repository once up front, so a VM failing after it did does not make the
+	// next one initialize it again
+	if !repoInitialized && !opts.DryRun {
+		log.Println("🔧 Restic repository not initialized. Applying init job...")
+		if err := backup.InitializeRepository(ctx, namespace, awsID, awsSecret, repository, password); err != nil {
+			return err
+		}
+		repoInitialized = true
+	}
+
+	// Name every backup up front, so a bad or colliding name fails before anything is backed up
+	backupNames := make(map[string]string, len(vmNames))
+	namedVM := make(map[string]string, len(vmNames))
+	for _, vmName := range vmNames {
+		vmBackupName, err := backupNameFor(vmName)
+		if err != nil {
+			return fmt.Errorf("failed to name the backup of VM %s: %w", vmName, err)
+		}
+		if other, ok := namedVM[vmBackupName]; ok {
+			return fmt.Errorf("VMs %s and %s would both be backed up as %s", other, vmName, vmBackupName)
+		}
+		namedVM[vmBackupName] = vmName
+		backupNames[vmName] = vmBackupName
+	}
+
+	var board *logutil.ProgressBoard
+	if opts.ProgressBoard && !opts.DryRun {
+		board = logutil.NewProgressBoard(os.Stderr, vmNames, "VMs")
+	}
+	var succeeded, failed []string
+	for _, vmName := range vmNames {
+		vmBackupName := backupNames[vmName]
+		vmOpts := opts
+		board.Update(vmName, "backing up as "+vmBackupName)
+		if board.Live() {
+			vmOpts.Progress = boardProgress(board, vmName, vmBackupName)
+		}
+		if err := RunVMBackup(ctx, namespace, vmName, vmBackupName, vscMapping, awsID, awsSecret, repository, password, repoInitialized, vmOpts); err != nil {
+			log.Printf("❌ Backup %s of VM %s failed: %v", vmBackupName, vmName, err)
+			board.Finish(vmName, "❌ failed")
+			failed = append(failed, vmName)
+			if ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+		board.Finish(vmName, "✅ "+vmBackupName)
+		succeeded = append(succeeded, vmName)
+	}
+	board.Stop()
+
+	log.Printf("📊 Backed up %d of %d VM(s)", len(succeeded), len(vmNames))
+	for _, vmName := range succeeded {
+		log.Printf("   ✅ %s: %s", vmName, backupNames[vmName])
+	}
+	for _, vmName := range failed {
+		log.Printf("   ❌ %s", vmName)
+	}
+	for _, vmName := range excluded {
+		log.Printf("   ⏭️  %s: excluded", vmName)
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("backup of %d VM(s) failed: %s", len(failed), strings.Join(failed, ", "))
+	}
+	return nil
+}
 
-	vmObj, err := k8s.DynamicClient.Resource(VMGVR).Namespace(namespace).Get(context.Background(), vmName, metav1.GetOptions{})
+// ListVMs returns the names of the VirtualMachines in the namespace matching the label
+// selector, sorted
+func ListVMs(namespace, selector string) ([]string, error) {
+	vmList, err := k8s.DynamicClient.Resource(VMGVR).Namespace(namespace).List(context.Background(), metav1.ListOptions{LabelSelector: selector})
 	if err != nil {
-		log.Fatalf("❌ Failed to get VirtualMachine %s: %v", vmName, err)
+		return nil, fmt.Errorf("failed to list VirtualMachines matching %s: %w", selector, err)
+	}
+	names := make([]string, 0, len(vmList.Items))
+	for _, item := range vmList.Items {
+		names = append(names, item.GetName())
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// boardProgress returns the Progress of a VM's backup that shows the percentage of each of its
+// PVCs on the board
+func boardProgress(board *logutil.ProgressBoard, vmName, backupName string) func(pvcName string, percent float64) {
+	var mu sync.Mutex
+	percents := map[string]float64{}
+	return func(pvcName string, percent float64) {
+		mu.Lock()
+		defer mu.Unlock()
+		percents[pvcName] = percent
+		pvcNames := make([]string, 0, len(percents))
+		for name := range percents {
+			pvcNames = append(pvcNames, name)
+		}
+		sort.Strings(pvcNames)
+		parts := make([]string, len(pvcNames))
+		for i, name := range pvcNames {
+			parts[i] = fmt.Sprintf("%s %.1f%%", name, percents[name])
+		}
+		board.Update(vmName, fmt.Sprintf("backing up as %s: %s", backupName, strings.Join(parts, ", ")))
+	}
+}
+
+// excludeVMs splits the VMs of the namespace into those to back up and those skipped by name,
+// namespace/name or namespace
+func excludeVMs(namespace string, vmNames, excludeVMs, excludeNamespaces []string) (included, excluded []string) {
+	skip := make(map[string]bool, len(excludeVMs))
+	for _, name := range excludeVMs {
+		skip[name] = true
+	}
+	skipNamespace := false
+	for _, ns := range excludeNamespaces {
+		skipNamespace = skipNamespace || ns == namespace
+	}
+	for _, vmName := range vmNames {
+		if skipNamespace || skip[vmName] || skip[namespace+"/"+vmName] {
+			excluded = append(excluded, vmName)
+		} else {
+			included = append(included, vmName)
+		}
+	}
+	return included, excluded
+}
+
+// RunVMBackup executes the VM backup workflow.
+func RunVMBackup(ctx context.Context, namespace, vmName, backupName string, vscMapping map[string]string, awsID, awsSecret, repository, password string, repoInitialized bool, opts BackupOptions) (err error) {
+	log.Printf("🔧 Starting VM backup for %s/%s", namespace, vmName)
+
+	var vmObj *unstructured.Unstructured
+	if opts.VMFile != "" {
+		vmObj, err = loadVMFile(opts.VMFile, namespace, vmName, opts)
+		if err != nil {
+			return err
+		}
+	} else {
+		vmObj, err = k8s.DynamicClient.Resource(VMGVR).Namespace(namespace).Get(context.Background(), vmName, metav1.GetOptions{})
+		if err != nil {
+			return fmt.Errorf("failed to get VirtualMachine %s: %w", vmName, err)
+		}
+	}
+
+	if opts.DryRun {
+		return planBackup(ctx, vmObj, namespace, backupName, vscMapping, awsID, awsSecret, repository, password, repoInitialized, opts)
+	}
+
+	k8s.RecordEvent(vmObj, corev1.EventTypeNormal, "BackupStarted", fmt.Sprintf("Backup %s started", backupName))
+	defer func() {
+		if err != nil {
+			k8s.RecordEvent(vmObj, corev1.EventTypeWarning, "BackupFailed", fmt.Sprintf("Backup %s failed: %v", backupName, err))
+		}
+	}()
+
+	if repoInitialized {
+		if err := checkBackupNameOwner(ctx, namespace, vmName, backupName, awsID, awsSecret, repository, password); err != nil {
+			return err
+		}
 	}
 
 	sanitizedVM := sanitizeVMManifest(vmObj)
 	pvcList := extractPVCsFromVM(vmObj)
 	if len(pvcList) == 0 {
-		log.Println("⚠️  No PVCs found in VM, backing up manifest only")
+		if err := strictf(opts.Strict, "No PVCs found in VM, backing up manifest only"); err != nil {
+			return err
+		}
+	}
+
+	if opts.ShowETA && len(pvcList) > 0 {
+		estimateBackupTime(ctx, namespace, vmName, pvcList, opts.ThroughputMBps, awsID, awsSecret, repository, password, repoInitialized)
 	}
 
-	volumeBackups, repoInit := backupPVCs(vmObj, namespace, backupName, pvcList, vscMapping, awsID, awsSecret, repository, password, repoInitialized)
-	secretBackups := extractAndBackupSecrets(vmObj, namespace)
+	start := time.Now()
+	volumeBackups, err := backupPVCs(ctx, vmObj, namespace, backupName, pvcList, vscMapping, awsID, awsSecret, repository, password, repoInitialized, opts)
+	if err != nil {
+		return err
+	}
+	throughput := measuredThroughput(volumeBackups, time.Since(start))
+	if throughput > 0 {
+		log.Printf("⏱️  Backed up volumes in %s (%.2f MB/s)", time.Since(start).Round(time.Second), throughput)
+	}
+	secretBackups, err := extractAndBackupSecrets(vmObj, namespace, opts.Strict)
+	if err != nil {
+		return err
+	}
+	var keyPairBackups []KeyPairBackup
+	if opts.KeyPairs {
+		if keyPairBackups, err = backupKeyPairs(vmObj, opts.Strict); err != nil {
+			return err
+		}
+	}
+	ownedResources, err := backupOwnedResources(vmObj, secretBackups, opts)
+	if err != nil {
+		return err
+	}
+	networks := backupNetworks(vmObj)
 
 	backupConfig := VMBackupConfig{
-		Name:      backupName,
-		Namespace: namespace,
+		Name:        backupName,
+		Namespace:   namespace,
+		Annotations: opts.Annotations,
+		Repository:  repository,
+		ConfigTags:  append(configSnapshotTags(namespace, backupName), "vm="+vmName),
 		BackupSpec: BackupSpec{
 			Source: SourceRef{
 				APIGroup: "kubevirt.io",
@@ -58,82 +269,294 @@ func RunVMBackup(namespace, vmName, backupName string, vscMapping map[string]str
 			},
 			Type: "backup",
 		},
-		VMSourceSpec:  sanitizedVM,
-		VolumeBackups: volumeBackups,
-		SecretBackups: secretBackups,
+		VMSourceSpec:    sanitizedVM,
+		VolumeBackups:   volumeBackups,
+		SecretBackups:   secretBackups,
+		KeyPairBackups:  keyPairBackups,
+		Networks:        networks,
+		NamespaceLabels: namespaceLabels(ctx, namespace),
+		OwnedResources:  ownedResources,
+		ThroughputMBps:  throughput,
 	}
 
-	if err := saveBackupConfig(backupConfig, namespace, backupName, awsID, awsSecret, repository, password); err != nil {
-		log.Fatalf("❌ Failed to save backup config: %v", err)
+	if err := saveBackupConfig(ctx, backupConfig, namespace, awsID, awsSecret, repository, password, opts.Strict); err != nil {
+		return fmt.Errorf("failed to save backup config: %w", err)
 	}
 
-	_ = repoInit // Suppress unused variable warning
 	log.Printf("✅ VM backup completed successfully: %s", backupName)
+	k8s.RecordEvent(vmObj, corev1.EventTypeNormal, "BackupCompleted", fmt.Sprintf("Backup %s completed with %d volume(s)", backupName, len(volumeBackups)))
+	return nil
 }
 
-// backupPVCs handles the backup of all PVCs in the VM
-func backupPVCs(vmObj *unstructured.Unstructured, namespace, backupName string, pvcList []string, vscMapping map[string]string, awsID, awsSecret, repository, password string, repoInitialized bool) ([]VolumeBackup, bool) {
-	volumeBackups := []VolumeBackup{}
+// BackupNameInUse reports whether a backup config named backupName exists in the namespace.
+func BackupNameInUse(ctx context.Context, namespace, backupName, awsID, awsSecret, repository, password string) (bool, error) {
+	snapshots, err := find.RunFind(ctx, namespace, configSnapshotTags(namespace, backupName), awsID, awsSecret, repository, password)
+	if err != nil {
+		return false, fmt.Errorf("failed to check whether backup name %s is in use: %w", backupName, err)
+	}
+	return len(snapshots) > 0, nil
+}
 
-	for _, pvcName := range pvcList {
-		log.Printf("📦 Backing up PVC: %s", pvcName)
+// loadVMFile reads a VirtualMachine manifest from a YAML or JSON file. The VM is taken to live in
+// namespace, where the PVCs and secrets it references must exist.
+func loadVMFile(path, namespace, vmName string, opts BackupOptions) (*unstructured.Unstructured, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read VM file: %w", err)
+	}
+	vmObj := &unstructured.Unstructured{}
+	if err := yaml.Unmarshal(data, &vmObj.Object); err != nil {
+		return nil, fmt.Errorf("failed to parse VM file %s: %w", path, err)
+	}
+	if vmObj.GetKind() != "VirtualMachine" {
+		return nil, fmt.Errorf("VM file %s holds a %q, not a VirtualMachine", path, vmObj.GetKind())
+	}
+	if vmObj.GetName() == "" {
+		vmObj.SetName(vmName)
+	} else if vmObj.GetName() != vmName {
+		return nil, fmt.Errorf("VM file %s defines VM %s, not %s", path, vmObj.GetName(), vmName)
+	}
+	if ns := vmObj.GetNamespace(); ns != "" && ns != namespace {
+		log.Printf("⚠️  VM file is for namespace %s; backing it up from namespace %s", ns, namespace)
+	}
+	vmObj.SetNamespace(namespace)
+	if len(opts.IncludeKinds) > 0 && vmObj.GetUID() == "" {
+		log.Println("⚠️  VM file has no UID; no resources will be found as owned by the VM")
+	}
 
-		pvc, err := k8s.Clientset.CoreV1().PersistentVolumeClaims(namespace).Get(context.Background(), pvcName, metav1.GetOptions{})
+	log.Printf("📄 Read VM %s from %s", vmName, path)
+	return vmObj, nil
+}
+
+// checkBackupNameOwner fails if the backup name is already used by another VM in the namespace.
+// Backups of different VMs under the same name would share sn=<backupName>-... tags and intermingle.
+func checkBackupNameOwner(ctx context.Context, namespace, vmName, backupName, awsID, awsSecret, repository, password string) error {
+	snapshots, err := find.RunFind(ctx, namespace, configSnapshotTags(namespace, backupName), awsID, awsSecret, repository, password)
+	if err != nil {
+		return fmt.Errorf("failed to check whether backup name %s is in use: %w", backupName, err)
+	}
+	if len(snapshots) == 0 {
+		return nil
+	}
+
+	owner := ""
+	for _, tag := range snapshots[0].Tags {
+		if strings.HasPrefix(tag, "vm=") {
+			owner = strings.TrimPrefix(tag, "vm=")
+			break
+		}
+	}
+	if owner == "" {
+		// Config snapshots taken before the vm= tag was recorded; read the source VM from the config itself
+		config, err := downloadBackupConfig(ctx, namespace, backupName, awsID, awsSecret, repository, password)
 		if err != nil {
-			log.Fatalf("❌ Failed to get PVC %s: %v", pvcName, err)
+			return fmt.Errorf("failed to determine which VM uses backup name %s: %w", backupName, err)
 		}
+		owner = config.BackupSpec.Source.Name
+	}
 
-		csiDriver := getCSIDriverName(pvc)
-		log.Printf("📋 PVC %s uses CSI driver: %s", pvcName, csiDriver)
+	if owner != vmName {
+		return fmt.Errorf("backup name '%s' already used by VM %s", backupName, owner)
+	}
+	return nil
+}
 
-		vsc, ok := vscMapping[csiDriver]
-		if !ok {
-			log.Fatalf("❌ No VolumeSnapshotClass mapping found for CSI driver: %s. Please provide mapping using -vsc flag", csiDriver)
-		}
-		log.Printf("📸 Using VolumeSnapshotClass: %s for PVC %s", vsc, pvcName)
+// inflightBudget is a shared counter of the bytes held in flight by the running backup jobs
+type inflightBudget struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	max  int64
+	used int64
+}
 
-		pvcSnapshotTag := fmt.Sprintf("%s-pvc-%s", backupName, pvcName)
-		backup.RunBackup(namespace, pvcName, pvcSnapshotTag, vsc, awsID, awsSecret, repository, password, repoInitialized)
-		repoInitialized = true
+// newInflightBudget returns a budget of max bytes, or nil (no limit) if max is not positive
+func newInflightBudget(max int64) *inflightBudget {
+	if max <= 0 {
+		return nil
+	}
+	b := &inflightBudget{max: max}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
 
-		snapshotID, err := find.RunFindByID(namespace, pvcSnapshotTag, awsID, awsSecret, repository, password)
-		if err != nil {
-			log.Fatalf("❌ Failed to verify backup for PVC %s: %v", pvcName, err)
+// acquire waits until n more bytes fit in the budget and takes them. A job always starts when
+// nothing else is in flight, so one larger than the budget cannot wait forever.
+func (b *inflightBudget) acquire(n int64) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.used > 0 && b.used+n > b.max {
+		log.Printf("⏳ %d of %d in-flight bytes in use; waiting for a running backup to finish", b.used, b.max)
+	}
+	for b.used > 0 && b.used+n > b.max {
+		b.cond.Wait()
+	}
+	b.used += n
+}
+
+// release returns n bytes taken by acquire to the budget
+func (b *inflightBudget) release(n int64) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	b.used -= n
+	b.mu.Unlock()
+	b.cond.Broadcast()
+}
+
+// backupPVCs backs up the PVCs of the VM, up to opts.Parallelism at a time and within
+// opts.MaxInflightBytes. The results are sorted by PVC name. If any PVC fails, no further
+// backups start and a *BackupError reporting each PVC is returned once the running ones finish.
+func backupPVCs(ctx context.Context, vmObj *unstructured.Unstructured, namespace, backupName string, pvcList []string, vscMapping map[string]string, awsID, awsSecret, repository, password string, repoInitialized bool, opts BackupOptions) ([]VolumeBackup, error) {
+	// Initialize the repository once up front rather than racing the first concurrent backups
+	if !repoInitialized && len(pvcList) > 0 {
+		log.Println("🔧 Restic repository not initialized. Applying init job...")
+		if err := backup.InitializeRepository(ctx, namespace, awsID, awsSecret, repository, password); err != nil {
+			return nil, err
 		}
+	}
 
-		volumeBackup := VolumeBackup{
-			Name:                  fmt.Sprintf("%s-volume-%s", backupName, pvcName),
-			VolumeName:            getVolumeNameForPVC(vmObj, pvcName),
-			CSIDriverName:         csiDriver,
-			PersistentVolumeClaim: *pvc,
-			ResticSnapshotID:      snapshotID,
-			VolumeSize:            pvc.Spec.Resources.Requests.Storage().Value(),
-			Progress:              100,
+	workers := opts.Parallelism
+	if workers < 1 {
+		workers = 1
+	}
+
+	volumeBackups := make([]VolumeBackup, len(pvcList))
+	results := make([]VolumeResult, len(pvcList))
+	var (
+		wg     sync.WaitGroup
+		failed atomic.Bool
+	)
+	sem := make(chan struct{}, workers)
+	budget := newInflightBudget(opts.MaxInflightBytes)
+	for i, pvcName := range pvcList {
+		results[i] = VolumeResult{PVC: pvcName, Err: errVolumeSkipped}
+		sem <- struct{}{}
+		budget.acquire(opts.JobInflightBytes)
+		// Start no further backups once one has failed
+		if failed.Load() {
+			budget.release(opts.JobInflightBytes)
+			<-sem
+			continue
 		}
-		volumeBackups = append(volumeBackups, volumeBackup)
-		log.Printf("✅ PVC %s backed up with snapshot ID: %s", pvcName, snapshotID)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			defer budget.release(opts.JobInflightBytes)
+			volumeBackup, err := backupPVC(ctx, vmObj, namespace, backupName, pvcName, vscMapping, awsID, awsSecret, repository, password, opts)
+			results[i] = VolumeResult{PVC: pvcName, Err: err}
+			if err != nil {
+				var phaseErr *backup.PhaseError
+				if errors.As(err, &phaseErr) {
+					results[i] = VolumeResult{PVC: pvcName, Phase: phaseErr.Phase, Err: phaseErr.Err}
+				}
+				failed.Store(true)
+				return
+			}
+			volumeBackups[i] = volumeBackup
+			k8s.RecordEvent(vmObj, corev1.EventTypeNormal, "VolumeBackedUp", fmt.Sprintf("Backup %s: PVC %s backed up", backupName, pvcName))
+		}()
+	}
+	wg.Wait()
+	if failed.Load() {
+		return nil, &BackupError{Results: results}
+	}
+
+	sort.Slice(volumeBackups, func(i, j int) bool {
+		return volumeBackups[i].PersistentVolumeClaim.Name < volumeBackups[j].PersistentVolumeClaim.Name
+	})
+	return volumeBackups, nil
+}
+
+// backupPVC backs up a single PVC of the VM into restic. Failures are returned as a
+// *backup.PhaseError.
+func backupPVC(ctx context.Context, vmObj *unstructured.Unstructured, namespace, backupName, pvcName string, vscMapping map[string]string, awsID, awsSecret, repository, password string, opts BackupOptions) (VolumeBackup, error) {
+	log.Printf("📦 Backing up PVC: %s", pvcName)
+
+	pvc, err := k8s.Clientset.CoreV1().PersistentVolumeClaims(namespace).Get(context.Background(), pvcName, metav1.GetOptions{})
+	if err != nil {
+		return VolumeBackup{}, &backup.PhaseError{Phase: phasePrepare, Err: err}
+	}
+
+	vsc, csiDriver, err := vscForPVC(pvc, vscMapping, opts)
+	if err != nil {
+		return VolumeBackup{}, &backup.PhaseError{Phase: phasePrepare, Err: err}
+	}
+	log.Printf("📸 Using VolumeSnapshotClass: %s for PVC %s", vsc, pvcName)
+
+	volumeMode, err := k8s.GetPVCVolumeMode(pvcName, namespace)
+	if err != nil {
+		return VolumeBackup{}, &backup.PhaseError{Phase: phasePrepare, Err: fmt.Errorf("failed to get volume mode: %w", err)}
+	}
+	if volumeMode != string(corev1.PersistentVolumeBlock) {
+		return VolumeBackup{}, &backup.PhaseError{Phase: phasePrepare, Err: fmt.Errorf("volume mode %s is not supported; only Block volumes can be backed up", volumeMode)}
 	}
 
-	return volumeBackups, repoInitialized
+	pvcSnapshotTag := fmt.Sprintf("%s-pvc-%s", backupName, pvcName)
+	volumeOpts := opts.Volume
+	if opts.Progress != nil {
+		volumeOpts.Progress = func(_, _ int64, percent float64) { opts.Progress(pvcName, percent) }
+	}
+	result, err := backup.RunBackup(ctx, namespace, pvcName, pvcSnapshotTag, vsc, awsID, awsSecret, repository, password, true, volumeOpts)
+	if err != nil {
+		return VolumeBackup{}, err
+	}
+
+	snapshot, err := find.RunFindSnapshot(ctx, namespace, pvcSnapshotTag, awsID, awsSecret, repository, password)
+	if err != nil {
+		return VolumeBackup{}, &backup.PhaseError{Phase: backup.PhaseVerify, Err: fmt.Errorf("failed to find the new snapshot: %w", err)}
+	}
+
+	log.Printf("✅ PVC %s backed up with snapshot ID: %s", pvcName, snapshot.ShortID)
+	return VolumeBackup{
+		Name:                  fmt.Sprintf("%s-volume-%s", backupName, pvcName),
+		VolumeName:            getVolumeNameForPVC(vmObj, pvcName),
+		CSIDriverName:         csiDriver,
+		VolumeMode:            volumeMode,
+		PersistentVolumeClaim: *pvc,
+		ResticSnapshotID:      snapshot.ShortID,
+		SnapshotTags:          snapshot.Tags,
+		VolumeSize:            pvc.Spec.Resources.Requests.Storage().Value(),
+		DeviceSize:            result.DeviceSize,
+		Checksum:              result.Checksum,
+		Progress:              100,
+	}, nil
 }
 
-// RunVMCleanup removes all backup resources for a given backup name
-func RunVMCleanup(namespace, backupName, awsID, awsSecret, repository, password string) {
+// RunVMCleanup removes all backup resources for a given backup name. A protected backup is
+// removed only with forceProtected.
+func RunVMCleanup(ctx context.Context, namespace, backupName, awsID, awsSecret, repository, password string, forceProtected bool) error {
 	log.Printf("🔧 Starting cleanup for backup: %s", backupName)
 
 	// Download backup config to get the list of PVCs
-	backupConfig, err := downloadBackupConfigForCleanup(namespace, backupName, awsID, awsSecret, repository, password)
+	backupConfig, err := downloadBackupConfigForCleanup(ctx, namespace, backupName, awsID, awsSecret, repository, password)
 	if err != nil {
 		log.Printf("⚠️  Failed to download backup config (may already be deleted): %v", err)
 	}
 
+	configTags := configSnapshotTags(namespace, backupName)
+	if backupConfig != nil && len(backupConfig.ConfigTags) > 0 {
+		configTags = backupConfig.ConfigTags
+	}
+	tagSets := [][]string{configTags}
+	if backupConfig != nil {
+		tagSets = backupSnapshotTags(backupConfig, namespace, backupName)
+	}
+	if err := checkNotProtected(ctx, tagSets, namespace, backupName, awsID, awsSecret, repository, password, forceProtected); err != nil {
+		return err
+	}
+
 	// Delete PVC snapshots from restic
 	if backupConfig != nil {
 		for _, volumeBackup := range backupConfig.VolumeBackups {
-			snapshotTag := fmt.Sprintf("%s-pvc-%s", backupName, volumeBackup.PersistentVolumeClaim.Name)
+			tags := volumeSnapshotTags(namespace, backupName, volumeBackup)
 			log.Printf("🗑️  Deleting snapshot for PVC: %s", volumeBackup.PersistentVolumeClaim.Name)
 
-			if err := deleteResticSnapshot(namespace, snapshotTag, awsID, awsSecret, repository, password); err != nil {
+			if err := deleteResticSnapshot(ctx, namespace, tags, awsID, awsSecret, repository, password); err != nil {
 				log.Printf("⚠️  Failed to delete snapshot for PVC %s: %v", volumeBackup.PersistentVolumeClaim.Name, err)
 				continue
 			}
@@ -143,7 +566,7 @@ func RunVMCleanup(namespace, backupName, awsID, awsSecret, repository, password
 
 	// Delete VM config from restic
 	log.Printf("🗑️  Deleting VM config from restic...")
-	if err := deleteVMConfigSnapshot(namespace, backupName, awsID, awsSecret, repository, password); err != nil {
+	if err := deleteVMConfigSnapshot(ctx, namespace, configTags, awsID, awsSecret, repository, password); err != nil {
 		log.Printf("⚠️  Failed to delete VM config: %v", err)
 	} else {
 		log.Printf("✅ Deleted VM config from restic")
@@ -158,10 +581,11 @@ func RunVMCleanup(namespace, backupName, awsID, awsSecret, repository, password
 	}
 
 	log.Printf("✅ Cleanup completed for backup: %s", backupName)
+	return nil
 }
 
 // downloadBackupConfigForCleanup attempts to download the backup config (used for cleanup)
-func downloadBackupConfigForCleanup(namespace, backupName, awsID, awsSecret, repository, password string) (*VMBackupConfig, error) {
+func downloadBackupConfigForCleanup(ctx context.Context, namespace, backupName, awsID, awsSecret, repository, password string) (*VMBackupConfig, error) {
 	jobSuffix, err := k8s.GenerateJobSuffix()
 	if err != nil {
 		return nil, fmt.Errorf("failed to generate job suffix: %w", err)
@@ -173,14 +597,16 @@ func downloadBackupConfigForCleanup(namespace, backupName, awsID, awsSecret, rep
 		"RESTIC_REPOSITORY":     repository,
 		"RESTIC_PASSWORD":       password,
 		"BACKUP_NAME":           backupName,
+		"BACKUP_NAMESPACE":      namespace,
 	}
 
 	jobName := "vm-cleanup-config-" + jobSuffix
-	if err := k8s.ApplyManifest(manifests.VMRestoreConfigJob, namespace, jobName, replacements); err != nil {
+	timeout := 60 * time.Second
+	if err := k8s.ApplyJob(ctx, manifests.VMRestoreConfigJob, namespace, jobName, timeout, replacements); err != nil {
 		return nil, fmt.Errorf("failed to apply cleanup config job: %w", err)
 	}
 
-	if err := k8s.WaitForJob(jobName, namespace, 60*time.Second); err != nil {
+	if err := k8s.WaitForJob(ctx, jobName, namespace, timeout); err != nil {
 		return nil, fmt.Errorf("cleanup config job failed: %w", err)
 	}
 
@@ -197,21 +623,16 @@ func downloadBackupConfigForCleanup(namespace, backupName, awsID, awsSecret, rep
 	return &config, nil
 }
 
-// deleteResticSnapshot deletes a restic snapshot by tag
-func deleteResticSnapshot(namespace, snapshotTag, awsID, awsSecret, repository, password string) error {
+// deleteResticSnapshot deletes the restic snapshot carrying all of the given tags
+func deleteResticSnapshot(ctx context.Context, namespace string, tags []string, awsID, awsSecret, repository, password string) error {
 	// First, find the snapshot ID
-	tags := []string{
-		fmt.Sprintf("ns=%s", namespace),
-		fmt.Sprintf("sn=%s", snapshotTag),
-	}
-
-	snapshots, err := find.RunFind(namespace, tags, awsID, awsSecret, repository, password)
+	snapshots, err := find.RunFind(ctx, namespace, tags, awsID, awsSecret, repository, password)
 	if err != nil {
 		return fmt.Errorf("failed to find snapshot: %w", err)
 	}
 
 	if len(snapshots) == 0 {
-		return fmt.Errorf("snapshot not found with tag: %s", snapshotTag)
+		return fmt.Errorf("%w with tags: %s", errSnapshotNotFound, strings.Join(tags, ","))
 	}
 
 	// Delete the snapshot
@@ -230,27 +651,50 @@ func deleteResticSnapshot(namespace, snapshotTag, awsID, awsSecret, repository,
 	}
 
 	jobName := "delete-snapshot-" + jobSuffix
-	if err := k8s.ApplyManifest(manifests.ResticForgetJob, namespace, jobName, replacements); err != nil {
+	timeout := 120 * time.Second
+	if err := k8s.ApplyJob(ctx, manifests.ResticForgetJob, namespace, jobName, timeout, replacements); err != nil {
 		return fmt.Errorf("failed to apply delete job: %w", err)
 	}
 
-	if err := k8s.WaitForJob(jobName, namespace, 120*time.Second); err != nil {
+	if err := k8s.WaitForJob(ctx, jobName, namespace, timeout); err != nil {
 		return fmt.Errorf("delete job failed: %w", err)
 	}
 
 	return nil
 }
 
-// deleteVMConfigSnapshot deletes the VM config snapshot from restic
-func deleteVMConfigSnapshot(namespace, backupName, awsID, awsSecret, repository, password string) error {
-	// Find the VM config snapshot
-	tags := []string{
+// volumeSnapshotTags returns the restic tags of a volume's snapshot as recorded in the backup config.
+// Backups taken before tags were recorded follow the {backupName}-pvc-{pvcName} convention.
+// ProtectedTag is left out, as it comes and goes with -mode=protect and -mode=unprotect.
+func volumeSnapshotTags(namespace, backupName string, volumeBackup VolumeBackup) []string {
+	if len(volumeBackup.SnapshotTags) > 0 {
+		tags := []string{}
+		for _, tag := range volumeBackup.SnapshotTags {
+			if tag != ProtectedTag {
+				tags = append(tags, tag)
+			}
+		}
+		return tags
+	}
+	return []string{
+		fmt.Sprintf("ns=%s", namespace),
+		fmt.Sprintf("sn=%s-pvc-%s", backupName, volumeBackup.PersistentVolumeClaim.Name),
+	}
+}
+
+// configSnapshotTags returns the restic tags applied to the VM config snapshot of a backup
+func configSnapshotTags(namespace, backupName string) []string {
+	return []string{
 		fmt.Sprintf("ns=%s", namespace),
 		fmt.Sprintf("sn=%s", backupName),
 		"type=vm-config",
 	}
+}
 
-	snapshots, err := find.RunFind(namespace, tags, awsID, awsSecret, repository, password)
+// deleteVMConfigSnapshot deletes the VM config snapshot carrying the given tags from restic
+func deleteVMConfigSnapshot(ctx context.Context, namespace string, tags []string, awsID, awsSecret, repository, password string) error {
+	// Find the VM config snapshot
+	snapshots, err := find.RunFind(ctx, namespace, tags, awsID, awsSecret, repository, password)
 	if err != nil {
 		return fmt.Errorf("failed to find VM config snapshot: %w", err)
 	}
@@ -275,11 +719,12 @@ func deleteVMConfigSnapshot(namespace, backupName, awsID, awsSecret, repository,
 	}
 
 	jobName := "delete-vm-config-" + jobSuffix
-	if err := k8s.ApplyManifest(manifests.ResticForgetJob, namespace, jobName, replacements); err != nil {
+	timeout := 120 * time.Second
+	if err := k8s.ApplyJob(ctx, manifests.ResticForgetJob, namespace, jobName, timeout, replacements); err != nil {
 		return fmt.Errorf("failed to apply delete job: %w", err)
 	}
 
-	if err := k8s.WaitForJob(jobName, namespace, 120*time.Second); err != nil {
+	if err := k8s.WaitForJob(ctx, jobName, namespace, timeout); err != nil {
 		return fmt.Errorf("delete job failed: %w", err)
 	}
 
@@ -381,54 +826,135 @@ func getVolumeNameForPVC(vmObj *unstructured.Unstructured, pvcName string) strin
 	return pvcName
 }
 
-// getCSIDriverName extracts CSI driver from PV or PVC annotations
-func getCSIDriverName(pvc *corev1.PersistentVolumeClaim) string {
+// vscForPVC detects the CSI driver of the PVC and returns the VolumeSnapshotClass -vsc maps it to,
+// or the one discovered for the driver, along with the driver
+func vscForPVC(pvc *corev1.PersistentVolumeClaim, vscMapping map[string]string, opts BackupOptions) (string, string, error) {
+	csiDriver, isStorageClass, err := getCSIDriverName(pvc, opts)
+	if err != nil {
+		return "", "", err
+	}
+	if isStorageClass {
+		log.Printf("⚠️  Could not determine the CSI driver of PVC %s; falling back to its StorageClass name %s", pvc.Name, csiDriver)
+	} else {
+		log.Printf("📋 PVC %s uses CSI driver: %s", pvc.Name, csiDriver)
+	}
+
+	if vsc, ok := vscMapping[csiDriver]; ok {
+		return vsc, csiDriver, nil
+	}
+	if isStorageClass {
+		return "", "", fmt.Errorf("could not determine CSI driver of PVC %s; fell back to storage class '%s', which has no VolumeSnapshotClass mapping. Map the PVC's CSI driver, or the StorageClass name, using -vsc flag", pvc.Name, csiDriver)
+	}
+	vsc, err := k8s.SnapshotClassForDriver(csiDriver)
+	if err != nil {
+		return "", "", fmt.Errorf("no -vsc mapping for CSI driver %s, and %w. Please provide mapping using -vsc flag", csiDriver, err)
+	}
+	return vsc, csiDriver, nil
+}
+
+// getCSIDriverName extracts CSI driver from PV or PVC annotations. It reports whether it had to
+// fall back to the PVC's StorageClass name, which is not a driver name.
+func getCSIDriverName(pvc *corev1.PersistentVolumeClaim, opts BackupOptions) (string, bool, error) {
+	if len(opts.AllowedDrivers) > 0 {
+		driver, err := allowedCSIDriverName(pvc, opts.AllowedDrivers)
+		return driver, false, err
+	}
+
 	// Use the k8s package function for accurate CSI driver detection
-	driver, err := k8s.GetPVCSIDriver(pvc.Name, pvc.Namespace)
+	driver, isStorageClass, err := k8s.GetPVCSIDriver(pvc.Name, pvc.Namespace)
 	if err != nil {
-		log.Printf("⚠️  Failed to get CSI driver for PVC %s: %v, using fallback", pvc.Name, err)
+		if err := strictf(opts.Strict, "Failed to get CSI driver for PVC %s: %v, using fallback", pvc.Name, err); err != nil {
+			return "", false, err
+		}
 		// Fallback to annotation
 		if fallbackDriver, ok := pvc.Annotations["volume.kubernetes.io/storage-provisioner"]; ok {
-			return fallbackDriver
+			return fallbackDriver, false, nil
 		}
 		// Last resort: storage class name
 		if pvc.Spec.StorageClassName != nil {
-			return *pvc.Spec.StorageClassName
+			return *pvc.Spec.StorageClassName, true, nil
 		}
-		return "unknown"
+		return "unknown", false, nil
 	}
-	return driver
+	return driver, isStorageClass, nil
+}
+
+// allowedCSIDriverName returns the CSI driver of the PV bound to the PVC, failing if it is not one
+// of allowedDrivers. The annotation and StorageClass fallbacks are not used, as they may name
+// something other than the driver.
+func allowedCSIDriverName(pvc *corev1.PersistentVolumeClaim, allowedDrivers []string) (string, error) {
+	if pvc.Spec.VolumeName == "" {
+		return "", fmt.Errorf("PVC %s is not bound, so its CSI driver cannot be checked against -allowed-drivers", pvc.Name)
+	}
+	pv, err := k8s.Clientset.CoreV1().PersistentVolumes().Get(context.Background(), pvc.Spec.VolumeName, metav1.GetOptions{})
+	if err != nil {
+		return "", fmt.Errorf("failed to get PV %s of PVC %s: %w", pvc.Spec.VolumeName, pvc.Name, err)
+	}
+	if pv.Spec.CSI == nil {
+		return "", fmt.Errorf("PVC %s is not a CSI volume; only volumes of -allowed-drivers (%s) may be backed up", pvc.Name, strings.Join(allowedDrivers, ", "))
+	}
+	for _, driver := range allowedDrivers {
+		if pv.Spec.CSI.Driver == driver {
+			return driver, nil
+		}
+	}
+	return "", fmt.Errorf("PVC %s uses CSI driver %s, which is not in -allowed-drivers (%s)", pvc.Name, pv.Spec.CSI.Driver, strings.Join(allowedDrivers, ", "))
 }
 
 // extractAndBackupSecrets finds and backs up secrets referenced in VM
-func extractAndBackupSecrets(vmObj *unstructured.Unstructured, namespace string) []SecretBackup {
+func extractAndBackupSecrets(vmObj *unstructured.Unstructured, namespace string, strict bool) ([]SecretBackup, error) {
 	secretBackups := []SecretBackup{}
 	secretNames := extractSecretNames(vmObj)
 
 	for _, secretName := range secretNames {
 		secret, err := k8s.Clientset.CoreV1().Secrets(namespace).Get(context.Background(), secretName, metav1.GetOptions{})
 		if err != nil {
-			log.Printf("⚠️  Failed to get secret %s: %v", secretName, err)
+			if err := strictf(strict, "Failed to get secret %s: %v", secretName, err); err != nil {
+				return nil, err
+			}
 			continue
 		}
 
-		// Convert binary data to base64 strings
+		// Convert binary data to base64 strings, compressing values that shrink
 		dataMap := make(map[string]string)
+		compressed := make(map[string]bool)
 		for k, v := range secret.Data {
+			if gz, ok := gzipIfSmaller(v); ok {
+				dataMap[k] = base64.StdEncoding.EncodeToString(gz)
+				compressed[k] = true
+				continue
+			}
 			dataMap[k] = base64.StdEncoding.EncodeToString(v)
 		}
 
 		secretBackups = append(secretBackups, SecretBackup{
-			Name: secretName,
-			Data: dataMap,
+			Name:       secretName,
+			Data:       dataMap,
+			Compressed: compressed,
 		})
 		log.Printf("📝 Backed up secret: %s", secretName)
 	}
 
-	return secretBackups
+	return secretBackups, nil
 }
 
-// extractSecretNames extracts secret names from VM volumes
+// gzipIfSmaller returns data gzip-compressed, and false if compressing does not make it smaller
+func gzipIfSmaller(data []byte) ([]byte, bool) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, false
+	}
+	if err := w.Close(); err != nil {
+		return nil, false
+	}
+	if buf.Len() >= len(data) {
+		return nil, false
+	}
+	return buf.Bytes(), true
+}
+
+// extractSecretNames extracts the sorted, unique names of the secrets the VM template references
 func extractSecretNames(vmObj *unstructured.Unstructured) []string {
 	secretNames := []string{}
 
@@ -437,42 +963,69 @@ func extractSecretNames(vmObj *unstructured.Unstructured) []string {
 		return secretNames
 	}
 
-	volumes, found, err := unstructured.NestedSlice(spec, "volumes")
-	if err != nil || !found {
-		return secretNames
+	unique := map[string]struct{}{}
+	for _, ref := range templateSecretRefs(spec) {
+		if name := ref.name(); name != "" {
+			unique[name] = struct{}{}
+		}
+	}
+	for name := range unique {
+		secretNames = append(secretNames, name)
 	}
+	sort.Strings(secretNames)
 
-	for _, vol := range volumes {
-		volume := vol.(map[string]interface{})
+	return secretNames
+}
 
-		// Check cloudInitNoCloud
-		if cloudInit, found := volume["cloudInitNoCloud"]; found {
-			cloudInitMap := cloudInit.(map[string]interface{})
+// secretRef is a field of a VM template spec holding the name of a secret
+type secretRef struct {
+	holder map[string]interface{}
+	field  string
+}
 
-			if secretRef, found := cloudInitMap["secretRef"]; found {
-				secretRefMap := secretRef.(map[string]interface{})
-				if name, ok := secretRefMap["name"].(string); ok {
-					secretNames = append(secretNames, name)
-				}
-			}
+func (r secretRef) name() string {
+	name, _ := r.holder[r.field].(string)
+	return name
+}
 
-			if networkRef, found := cloudInitMap["networkDataSecretRef"]; found {
-				networkRefMap := networkRef.(map[string]interface{})
-				if name, ok := networkRefMap["name"].(string); ok {
-					// Avoid duplicates
-					if len(secretNames) == 0 || secretNames[len(secretNames)-1] != name {
-						secretNames = append(secretNames, name)
-					}
-				}
+// templateSecretRefs returns every reference to a secret in a VM template spec: cloud-init user
+// and network data, secret and sysprep volumes, and SSH key and password access credentials
+func templateSecretRefs(templateSpec map[string]interface{}) []secretRef {
+	var refs []secretRef
+	add := func(obj interface{}, path ...string) {
+		holder, ok := obj.(map[string]interface{})
+		for _, key := range path[:len(path)-1] {
+			if !ok {
+				return
 			}
+			holder, ok = holder[key].(map[string]interface{})
+		}
+		field := path[len(path)-1]
+		if _, isString := holder[field].(string); ok && isString {
+			refs = append(refs, secretRef{holder: holder, field: field})
 		}
 	}
 
-	return secretNames
+	volumes, _ := templateSpec["volumes"].([]interface{})
+	for _, volume := range volumes {
+		for _, source := range []string{"cloudInitNoCloud", "cloudInitConfigDrive"} {
+			add(volume, source, "secretRef", "name")
+			add(volume, source, "networkDataSecretRef", "name")
+		}
+		add(volume, "secret", "secretName")
+		add(volume, "sysprep", "secret", "name")
+	}
+
+	credentials, _ := templateSpec["accessCredentials"].([]interface{})
+	for _, credential := range credentials {
+		add(credential, "sshPublicKey", "source", "secret", "secretName")
+		add(credential, "userPassword", "source", "secret", "secretName")
+	}
+	return refs
 }
 
 // saveBackupConfig saves the backup configuration to restic repository
-func saveBackupConfig(config VMBackupConfig, namespace, backupName, awsID, awsSecret, repository, password string) error {
+func saveBackupConfig(ctx context.Context, config VMBackupConfig, namespace, awsID, awsSecret, repository, password string, strict bool) error {
 	// Marshal to JSON
 	jsonData, err := json.MarshalIndent(config, "", "  ")
 	if err != nil {
@@ -498,6 +1051,7 @@ func saveBackupConfig(config VMBackupConfig, namespace, backupName, awsID, awsSe
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      configMapName,
 			Namespace: namespace,
+			Labels:    map[string]string{k8s.ManagedByLabel: k8s.ManagedByValue},
 		},
 		Data: map[string]string{
 			filename: string(jsonData),
@@ -516,23 +1070,26 @@ func saveBackupConfig(config VMBackupConfig, namespace, backupName, awsID, awsSe
 		"RESTIC_REPOSITORY":     repository,
 		"RESTIC_PASSWORD":       password,
 		"FILENAME":              filename,
-		"SNAPSHOT":              backupName,
+		"TAGS":                  strings.Join(config.ConfigTags, ","),
 		"CONFIGMAP_NAME":        configMapName,
 	}
 
 	jobName := "vm-backup-config-" + jobSuffix
-	if err := k8s.ApplyManifest(manifests.VMBackupConfigJob, namespace, jobName, replacements); err != nil {
+	timeout := 60 * time.Second
+	if err := k8s.ApplyJob(ctx, manifests.VMBackupConfigJob, namespace, jobName, timeout, replacements); err != nil {
 		return fmt.Errorf("failed to apply backup config job: %w", err)
 	}
 
 	log.Println("⌛ Uploading VM config to restic...")
-	if err := k8s.WaitForJob(jobName, namespace, 60*time.Second); err != nil {
+	if err := k8s.WaitForJob(ctx, jobName, namespace, timeout); err != nil {
 		return fmt.Errorf("backup config job failed: %w", err)
 	}
 
 	// Cleanup ConfigMap
 	if err := k8s.Clientset.CoreV1().ConfigMaps(namespace).Delete(context.Background(), configMapName, metav1.DeleteOptions{}); err != nil {
-		log.Printf("⚠️  Failed to cleanup ConfigMap: %v", err)
+		if err := strictf(strict, "Failed to cleanup ConfigMap: %v", err); err != nil {
+			return err
+		}
 	}
 
 	log.Println("✅ VM config uploaded to restic")
@@ -0,0 +1,291 @@
+package vm
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/kubernetes"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+
+	"github.com/webberhuang/hv-vmbr/pkg/backup"
+	"github.com/webberhuang/hv-vmbr/pkg/k8s"
+)
+
+// vmWithTemplateSpec returns a VirtualMachine whose template spec is templateSpec
+func vmWithTemplateSpec(templateSpec map[string]interface{}) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "kubevirt.io/v1",
+		"kind":       "VirtualMachine",
+		"metadata":   map[string]interface{}{"name": "vm1", "namespace": "default"},
+		"spec": map[string]interface{}{
+			"template": map[string]interface{}{"spec": templateSpec},
+		},
+	}}
+}
+
+func TestExtractSecretNames(t *testing.T) {
+	tests := []struct {
+		name         string
+		templateSpec map[string]interface{}
+		want         []string
+	}{
+		{
+			name: "cloudInitNoCloud user and network data",
+			templateSpec: map[string]interface{}{
+				"volumes": []interface{}{
+					map[string]interface{}{
+						"name": "cloudinitdisk",
+						"cloudInitNoCloud": map[string]interface{}{
+							"secretRef":            map[string]interface{}{"name": "vm1-userdata"},
+							"networkDataSecretRef": map[string]interface{}{"name": "vm1-networkdata"},
+						},
+					},
+					map[string]interface{}{
+						"name":                  "rootdisk",
+						"persistentVolumeClaim": map[string]interface{}{"claimName": "vm1-root"},
+					},
+				},
+			},
+			want: []string{"vm1-networkdata", "vm1-userdata"},
+		},
+		{
+			name: "accessCredentials",
+			templateSpec: map[string]interface{}{
+				"accessCredentials": []interface{}{
+					map[string]interface{}{
+						"sshPublicKey": map[string]interface{}{
+							"source":            map[string]interface{}{"secret": map[string]interface{}{"secretName": "vm1-ssh"}},
+							"propagationMethod": map[string]interface{}{"qemuGuestAgent": map[string]interface{}{}},
+						},
+					},
+					map[string]interface{}{
+						"userPassword": map[string]interface{}{
+							"source": map[string]interface{}{"secret": map[string]interface{}{"secretName": "vm1-password"}},
+						},
+					},
+				},
+			},
+			want: []string{"vm1-password", "vm1-ssh"},
+		},
+		{
+			name: "duplicate names",
+			templateSpec: map[string]interface{}{
+				"volumes": []interface{}{
+					map[string]interface{}{
+						"name": "cloudinitdisk",
+						"cloudInitNoCloud": map[string]interface{}{
+							"secretRef":            map[string]interface{}{"name": "vm1-cloudinit"},
+							"networkDataSecretRef": map[string]interface{}{"name": "vm1-cloudinit"},
+						},
+					},
+					map[string]interface{}{
+						"name":   "config",
+						"secret": map[string]interface{}{"secretName": "vm1-cloudinit"},
+					},
+				},
+				"accessCredentials": []interface{}{
+					map[string]interface{}{
+						"sshPublicKey": map[string]interface{}{
+							"source": map[string]interface{}{"secret": map[string]interface{}{"secretName": "vm1-cloudinit"}},
+						},
+					},
+				},
+			},
+			want: []string{"vm1-cloudinit"},
+		},
+		{
+			name: "inline user data",
+			templateSpec: map[string]interface{}{
+				"volumes": []interface{}{
+					map[string]interface{}{
+						"name":             "cloudinitdisk",
+						"cloudInitNoCloud": map[string]interface{}{"userData": "#cloud-config\n"},
+					},
+				},
+			},
+			want: []string{},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := extractSecretNames(vmWithTemplateSpec(test.templateSpec)); !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("extractSecretNames = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestExtractSecretNamesWithoutTemplate(t *testing.T) {
+	vmObj := &unstructured.Unstructured{Object: map[string]interface{}{"spec": map[string]interface{}{}}}
+	if got := extractSecretNames(vmObj); len(got) != 0 {
+		t.Fatalf("extractSecretNames = %q, want none", got)
+	}
+}
+
+func TestGzipIfSmallerRoundTrip(t *testing.T) {
+	random := make([]byte, 4096)
+	if _, err := rand.Read(random); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		data       []byte
+		compressed bool
+	}{
+		{"cloud-init user data", []byte(strings.Repeat("#cloud-config\npackages:\n  - qemu-guest-agent\n", 50)), true},
+		{"short value", []byte("password"), false},
+		{"empty value", []byte{}, false},
+		{"random bytes", random, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			compressed, ok := gzipIfSmaller(test.data)
+			if ok != test.compressed {
+				t.Fatalf("gzipIfSmaller compressed = %v, want %v", ok, test.compressed)
+			}
+			if !ok {
+				if compressed != nil {
+					t.Fatalf("gzipIfSmaller returned %d bytes for data it did not compress", len(compressed))
+				}
+				return
+			}
+			if len(compressed) >= len(test.data) {
+				t.Fatalf("compressed to %d bytes, not smaller than %d", len(compressed), len(test.data))
+			}
+			restored, err := gunzip(compressed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(restored, test.data) {
+				t.Fatal("gunzip did not restore the original data")
+			}
+		})
+	}
+}
+
+func TestGunzipRejectsUncompressed(t *testing.T) {
+	if _, err := gunzip([]byte("plain value")); err == nil {
+		t.Fatal("gunzip accepted data that is not gzip-compressed")
+	}
+}
+
+func TestInflightBudget(t *testing.T) {
+	budget := newInflightBudget(10)
+	budget.acquire(4)
+	budget.acquire(4)
+
+	acquired := make(chan struct{})
+	go func() {
+		budget.acquire(4)
+		close(acquired)
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("acquire exceeded the budget")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	budget.release(4)
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatal("acquire did not proceed after release")
+	}
+}
+
+func TestInflightBudgetAdmitsOversizedJobAlone(t *testing.T) {
+	budget := newInflightBudget(1)
+	budget.acquire(4)
+	budget.release(4)
+
+	var unlimited *inflightBudget
+	unlimited.acquire(4)
+	unlimited.release(4)
+}
+
+func TestPlanBackupHandsPlanToCallback(t *testing.T) {
+	blockMode := corev1.PersistentVolumeBlock
+	kube := kubefake.NewSimpleClientset(
+		&corev1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{Name: "vm1-disk", Namespace: "default"},
+			Spec:       corev1.PersistentVolumeClaimSpec{VolumeMode: &blockMode, VolumeName: "pv1"},
+		},
+		&corev1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: "pv1"},
+			Spec: corev1.PersistentVolumeSpec{PersistentVolumeSource: corev1.PersistentVolumeSource{
+				CSI: &corev1.CSIPersistentVolumeSource{Driver: "driver.longhorn.io"},
+			}},
+		},
+	)
+	defer func(clientset kubernetes.Interface) { k8s.Clientset = clientset }(k8s.Clientset)
+	k8s.Clientset = kube
+
+	vmObj := vmWithTemplateSpec(map[string]interface{}{
+		"volumes": []interface{}{
+			map[string]interface{}{"name": "disk", "persistentVolumeClaim": map[string]interface{}{"claimName": "vm1-disk"}},
+		},
+	})
+	var plan *BackupPlan
+	opts := BackupOptions{Plan: func(p *BackupPlan) error {
+		plan = p
+		return nil
+	}}
+	vscMapping := map[string]string{"driver.longhorn.io": "longhorn-snapshot"}
+	if err := planBackup(context.Background(), vmObj, "default", "vm1-b1", vscMapping, "", "", "", "", false, opts); err != nil {
+		t.Fatalf("planBackup returned %v", err)
+	}
+
+	if plan == nil {
+		t.Fatal("the plan was not handed to opts.Plan")
+	}
+	if !plan.InitializeRepository {
+		t.Error("plan does not initialize the uninitialized repository")
+	}
+	want := []PlannedVolume{{
+		PVC:                 "vm1-disk",
+		Size:                "0",
+		CSIDriver:           "driver.longhorn.io",
+		VolumeSnapshotClass: "longhorn-snapshot",
+		VolumeSnapshot:      backup.VolumeSnapshotName("vm1-disk"),
+		ClonePVC:            backup.ClonePVCName("vm1-disk"),
+		SnapshotTag:         "vm1-b1-pvc-vm1-disk",
+	}}
+	if !reflect.DeepEqual(plan.Volumes, want) {
+		t.Errorf("plan volumes = %+v, want %+v", plan.Volumes, want)
+	}
+}
+
+func TestExcludeVMs(t *testing.T) {
+	vmNames := []string{"db1", "db2", "test-huge"}
+
+	included, excluded := excludeVMs("prod", vmNames, []string{"test-huge", "prod/db2", "dev/db1"}, nil)
+	if want := []string{"db1"}; !reflect.DeepEqual(included, want) {
+		t.Errorf("included = %v, want %v", included, want)
+	}
+	if want := []string{"db2", "test-huge"}; !reflect.DeepEqual(excluded, want) {
+		t.Errorf("excluded = %v, want %v", excluded, want)
+	}
+
+	included, excluded = excludeVMs("prod", vmNames, nil, []string{"prod"})
+	if len(included) != 0 || !reflect.DeepEqual(excluded, vmNames) {
+		t.Errorf("excluding the namespace gave included %v, excluded %v", included, excluded)
+	}
+}
+
+func TestMeasuredThroughputPrefersDeviceSize(t *testing.T) {
+	volumeBackups := []VolumeBackup{
+		{VolumeSize: 1 << 20, DeviceSize: 3 << 20},
+		{VolumeSize: 1 << 20},
+	}
+	if got := measuredThroughput(volumeBackups, 2*time.Second); got != 2 {
+		t.Errorf("measuredThroughput = %v MB/s, want 2", got)
+	}
+}
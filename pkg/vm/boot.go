@@ -0,0 +1,76 @@
+package vm
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+
+	"github.com/webberhuang/hv-vmbr/pkg/k8s"
+)
+
+// VMIGVR is the GroupVersionResource for KubeVirt VirtualMachineInstances
+var VMIGVR = schema.GroupVersionResource{
+	Group:    "kubevirt.io",
+	Version:  "v1",
+	Resource: "virtualmachineinstances",
+}
+
+// vmiPollInterval is how often waitForGuestAgent looks at the VMI
+const vmiPollInterval = 5 * time.Second
+
+// waitForGuestAgent waits until the VMI of the VM is Running and its QEMU guest agent reports
+// connected, which shows the restored disks booted into a working guest. A VMI that fails or
+// does not get there within timeout is an error.
+func waitForGuestAgent(ctx context.Context, namespace, vmName string, timeout time.Duration) error {
+	log.Printf("⌛ Waiting up to %s for VM %s/%s to boot and its guest agent to connect...", timeout, namespace, vmName)
+	var phase string
+	err := wait.PollUntilContextTimeout(ctx, vmiPollInterval, timeout, true, func(ctx context.Context) (bool, error) {
+		vmi, err := k8s.DynamicClient.Resource(VMIGVR).Namespace(namespace).Get(ctx, vmName, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return false, nil
+		}
+		if err != nil {
+			log.Printf("⚠️  Failed to get VMI %s/%s: %v", namespace, vmName, err)
+			return false, nil
+		}
+		current, _, _ := unstructured.NestedString(vmi.Object, "status", "phase")
+		if current != phase {
+			log.Printf("🖥️  VMI %s/%s is %s", namespace, vmName, current)
+			phase = current
+		}
+		if current == "Failed" {
+			return false, fmt.Errorf("VMI %s/%s failed", namespace, vmName)
+		}
+		return current == "Running" && agentConnected(vmi), nil
+	})
+	if err != nil {
+		if phase == "" {
+			phase = "not created"
+		}
+		return fmt.Errorf("VM %s/%s did not boot with a connected guest agent (VMI %s): %w", namespace, vmName, phase, err)
+	}
+	log.Printf("✅ VM %s/%s is running and its guest agent is connected", namespace, vmName)
+	return nil
+}
+
+// agentConnected reports whether the VMI's AgentConnected condition is true
+func agentConnected(vmi *unstructured.Unstructured) bool {
+	conditions, _, _ := unstructured.NestedSlice(vmi.Object, "status", "conditions")
+	for _, item := range conditions {
+		condition, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if condition["type"] == "AgentConnected" && condition["status"] == "True" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,87 @@
+package vm
+
+import (
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// diskBinding describes one entry of spec.template.spec.domain.devices.disks together with
+// the PVC backing the volume of the same name.
+type diskBinding struct {
+	Disk      string
+	BootOrder int64
+	ClaimName string
+}
+
+// diskBindings returns the VM's disks in spec order with their boot order and backing PVC.
+func diskBindings(spec interface{}) []diskBinding {
+	specMap, ok := spec.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+
+	claims := map[string]string{}
+	volumes, _, _ := unstructured.NestedSlice(specMap, "template", "spec", "volumes")
+	for _, vol := range volumes {
+		volume, ok := vol.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		name, _, _ := unstructured.NestedString(volume, "name")
+		claimName, _, _ := unstructured.NestedString(volume, "persistentVolumeClaim", "claimName")
+		claims[name] = claimName
+	}
+
+	bindings := []diskBinding{}
+	disks, _, _ := unstructured.NestedSlice(specMap, "template", "spec", "domain", "devices", "disks")
+	for _, d := range disks {
+		disk, ok := d.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		name, _, _ := unstructured.NestedString(disk, "name")
+		bindings = append(bindings, diskBinding{
+			Disk:      name,
+			BootOrder: bootOrder(disk),
+			ClaimName: claims[name],
+		})
+	}
+	return bindings
+}
+
+// bootOrder reads a disk's bootOrder, which is a float64 after a JSON round-trip
+// and an int64 on objects returned by the dynamic client. Zero means unset.
+func bootOrder(disk map[string]interface{}) int64 {
+	switch v := disk["bootOrder"].(type) {
+	case int64:
+		return v
+	case float64:
+		return int64(v)
+	}
+	return 0
+}
+
+// verifyDiskBindings checks that disk order, boot order and disk-to-volume bindings survived
+// the restore. Claim names are expected to have been renamed according to pvcMapping.
+func verifyDiskBindings(original, restored []diskBinding, pvcMapping map[string]string) error {
+	if len(original) != len(restored) {
+		return fmt.Errorf("VM has %d disk(s) after restore, expected %d", len(restored), len(original))
+	}
+	for i, want := range original {
+		if newName, ok := pvcMapping[want.ClaimName]; ok {
+			want.ClaimName = newName
+		}
+		got := restored[i]
+		if got.Disk != want.Disk {
+			return fmt.Errorf("disk[%d] is %q after restore, expected %q", i, got.Disk, want.Disk)
+		}
+		if got.BootOrder != want.BootOrder {
+			return fmt.Errorf("disk %q has bootOrder %d after restore, expected %d", got.Disk, got.BootOrder, want.BootOrder)
+		}
+		if got.ClaimName != want.ClaimName {
+			return fmt.Errorf("disk %q is backed by PVC %q after restore, expected %q", got.Disk, got.ClaimName, want.ClaimName)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package vm
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// vmSpecWithDisks returns a VM spec with the given disks, each a name and a boot order (0 for
+// none), and volumes binding disk names to PVCs
+func vmSpecWithDisks(disks [][2]interface{}, claims map[string]string) map[string]interface{} {
+	diskList := []interface{}{}
+	for _, disk := range disks {
+		entry := map[string]interface{}{"name": disk[0], "disk": map[string]interface{}{"bus": "virtio"}}
+		if order := disk[1]; order != 0 {
+			entry["bootOrder"] = order
+		}
+		diskList = append(diskList, entry)
+	}
+	volumes := []interface{}{}
+	for name, claim := range claims {
+		volumes = append(volumes, map[string]interface{}{
+			"name":                  name,
+			"persistentVolumeClaim": map[string]interface{}{"claimName": claim},
+		})
+	}
+	return map[string]interface{}{
+		"template": map[string]interface{}{
+			"spec": map[string]interface{}{
+				"domain":  map[string]interface{}{"devices": map[string]interface{}{"disks": diskList}},
+				"volumes": volumes,
+			},
+		},
+	}
+}
+
+func TestDiskBindings(t *testing.T) {
+	spec := vmSpecWithDisks(
+		[][2]interface{}{{"rootdisk", int64(1)}, {"cdrom", float64(2)}, {"data", 0}, {"cloudinit", 0}},
+		map[string]string{"rootdisk": "vm1-root", "cdrom": "vm1-iso", "data": "vm1-data"},
+	)
+	want := []diskBinding{
+		{Disk: "rootdisk", BootOrder: 1, ClaimName: "vm1-root"},
+		{Disk: "cdrom", BootOrder: 2, ClaimName: "vm1-iso"},
+		{Disk: "data", ClaimName: "vm1-data"},
+		{Disk: "cloudinit"},
+	}
+	if got := diskBindings(spec); !reflect.DeepEqual(got, want) {
+		t.Fatalf("diskBindings = %+v, want %+v", got, want)
+	}
+	if got := diskBindings("not a spec"); got != nil {
+		t.Fatalf("diskBindings of a non-map spec = %+v, want nil", got)
+	}
+}
+
+func TestVerifyDiskBindings(t *testing.T) {
+	original := []diskBinding{
+		{Disk: "rootdisk", BootOrder: 1, ClaimName: "vm1-root"},
+		{Disk: "data", ClaimName: "vm1-data"},
+		{Disk: "cloudinit"},
+	}
+	pvcMapping := map[string]string{"vm1-root": "vm1-root-r1", "vm1-data": "vm1-data-r1"}
+
+	tests := []struct {
+		name     string
+		restored []diskBinding
+		err      string
+	}{
+		{
+			name: "matched",
+			restored: []diskBinding{
+				{Disk: "rootdisk", BootOrder: 1, ClaimName: "vm1-root-r1"},
+				{Disk: "data", ClaimName: "vm1-data-r1"},
+				{Disk: "cloudinit"},
+			},
+		},
+		{
+			name: "missing disk",
+			restored: []diskBinding{
+				{Disk: "rootdisk", BootOrder: 1, ClaimName: "vm1-root-r1"},
+				{Disk: "data", ClaimName: "vm1-data-r1"},
+			},
+			err: "2 disk(s) after restore, expected 3",
+		},
+		{
+			name: "extra disk",
+			restored: []diskBinding{
+				{Disk: "rootdisk", BootOrder: 1, ClaimName: "vm1-root-r1"},
+				{Disk: "data", ClaimName: "vm1-data-r1"},
+				{Disk: "cloudinit"},
+				{Disk: "scratch", ClaimName: "scratch"},
+			},
+			err: "4 disk(s) after restore, expected 3",
+		},
+		{
+			name: "reordered disks",
+			restored: []diskBinding{
+				{Disk: "data", ClaimName: "vm1-data-r1"},
+				{Disk: "rootdisk", BootOrder: 1, ClaimName: "vm1-root-r1"},
+				{Disk: "cloudinit"},
+			},
+			err: `disk[0] is "data" after restore, expected "rootdisk"`,
+		},
+		{
+			name: "boot order changed",
+			restored: []diskBinding{
+				{Disk: "rootdisk", ClaimName: "vm1-root-r1"},
+				{Disk: "data", ClaimName: "vm1-data-r1"},
+				{Disk: "cloudinit"},
+			},
+			err: `disk "rootdisk" has bootOrder 0 after restore, expected 1`,
+		},
+		{
+			name: "claim not renamed",
+			restored: []diskBinding{
+				{Disk: "rootdisk", BootOrder: 1, ClaimName: "vm1-root"},
+				{Disk: "data", ClaimName: "vm1-data-r1"},
+				{Disk: "cloudinit"},
+			},
+			err: `disk "rootdisk" is backed by PVC "vm1-root" after restore, expected "vm1-root-r1"`,
+		},
+		{
+			name: "disks swapped between claims",
+			restored: []diskBinding{
+				{Disk: "rootdisk", BootOrder: 1, ClaimName: "vm1-data-r1"},
+				{Disk: "data", ClaimName: "vm1-root-r1"},
+				{Disk: "cloudinit"},
+			},
+			err: `disk "rootdisk" is backed by PVC "vm1-data-r1" after restore, expected "vm1-root-r1"`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := verifyDiskBindings(original, test.restored, pvcMapping)
+			if test.err == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("error %v, want one containing %q", err, test.err)
+			}
+		})
+	}
+}
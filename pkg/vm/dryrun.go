@@ -0,0 +1,176 @@
+package vm
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/webberhuang/hv-vmbr/pkg/backup"
+	"github.com/webberhuang/hv-vmbr/pkg/find"
+	"github.com/webberhuang/hv-vmbr/pkg/k8s"
+)
+
+// planBackup logs what backing up the VM would create and run, and hands it to opts.Plan if set.
+// It fails where the backup would fail before its first snapshot, e.g. on a PVC that is not in
+// Block mode.
+func planBackup(ctx context.Context, vmObj *unstructured.Unstructured, namespace, backupName string, vscMapping map[string]string, awsID, awsSecret, repository, password string, repoInitialized bool, opts BackupOptions) error {
+	log.Printf("🧪 Dry run: backup %s of VM %s/%s", backupName, namespace, vmObj.GetName())
+	plan := &BackupPlan{VM: vmObj.GetName(), Namespace: namespace, BackupName: backupName, Volumes: []PlannedVolume{}, Secrets: []string{}}
+	if repoInitialized {
+		if err := checkBackupNameOwner(ctx, namespace, vmObj.GetName(), backupName, awsID, awsSecret, repository, password); err != nil {
+			return err
+		}
+	}
+
+	pvcList := extractPVCsFromVM(vmObj)
+	if len(pvcList) == 0 {
+		if err := strictf(opts.Strict, "No PVCs found in VM, backing up manifest only"); err != nil {
+			return err
+		}
+	} else if !repoInitialized {
+		plan.InitializeRepository = true
+		log.Printf("   would initialize repository %s: restic init", k8s.RedactRepository(repository))
+	}
+
+	for _, pvcName := range pvcList {
+		pvc, err := k8s.Clientset.CoreV1().PersistentVolumeClaims(namespace).Get(context.Background(), pvcName, metav1.GetOptions{})
+		if err != nil {
+			return fmt.Errorf("failed to get PVC %s: %w", pvcName, err)
+		}
+		vsc, csiDriver, err := vscForPVC(pvc, vscMapping, opts)
+		if err != nil {
+			return err
+		}
+		if pvc.Spec.VolumeMode == nil || *pvc.Spec.VolumeMode != corev1.PersistentVolumeBlock {
+			return fmt.Errorf("PVC %s is not a Block volume; only Block volumes can be backed up", pvcName)
+		}
+		snapshotTag := fmt.Sprintf("%s-pvc-%s", backupName, pvcName)
+		log.Printf("📦 PVC %s (%s):", pvcName, pvc.Spec.Resources.Requests.Storage().String())
+		log.Printf("   would create VolumeSnapshot %s/%s with class %s", namespace, backup.VolumeSnapshotName(pvcName), vsc)
+		log.Printf("   would create PersistentVolumeClaim %s/%s from the snapshot", namespace, backup.ClonePVCName(pvcName))
+		log.Printf("   would run: restic backup --stdin --stdin-filename %s --tag=ns=%s,sn=%s", pvc.Spec.VolumeName, namespace, snapshotTag)
+		log.Printf("   would delete the VolumeSnapshot and clone PVC afterwards")
+		plan.Volumes = append(plan.Volumes, PlannedVolume{
+			PVC:                 pvcName,
+			Size:                pvc.Spec.Resources.Requests.Storage().String(),
+			CSIDriver:           csiDriver,
+			VolumeSnapshotClass: vsc,
+			VolumeSnapshot:      backup.VolumeSnapshotName(pvcName),
+			ClonePVC:            backup.ClonePVCName(pvcName),
+			SnapshotTag:         snapshotTag,
+		})
+	}
+
+	for _, secretName := range extractSecretNames(vmObj) {
+		log.Printf("🔐 would record Secret %s/%s in the backup config", namespace, secretName)
+		plan.Secrets = append(plan.Secrets, secretName)
+	}
+	plan.ConfigTags = append(configSnapshotTags(namespace, backupName), "vm="+vmObj.GetName())
+	log.Printf("📝 would run: restic backup --stdin --stdin-filename /config/%s.cfg --tag=%s", backupName, strings.Join(plan.ConfigTags, ","))
+	log.Println("🧪 Dry run complete; nothing was created")
+	if opts.Plan != nil {
+		return opts.Plan(plan)
+	}
+	return nil
+}
+
+// planRestore logs the PVCs, secrets and VM restoring the backup would create, and the restic
+// snapshots it would read, and hands them to opts.Plan if set. New PVC names end in a random
+// suffix, which the actual restore generates anew.
+func planRestore(ctx context.Context, config *VMBackupConfig, namespace, vmName, backupName, restoreID, awsID, awsSecret, repository, password string, opts RestoreOptions) error {
+	log.Printf("🧪 Dry run: restore of backup %s as VM %s/%s", backupName, namespace, vmName)
+	plan := &RestorePlan{VM: vmName, Namespace: namespace, BackupName: backupName, Volumes: []PlannedRestore{}, Secrets: []PlannedSecret{}, Start: opts.Start}
+
+	var previous map[string]*corev1.PersistentVolumeClaim
+	if opts.Resume {
+		var err error
+		previous, err = previouslyRestoredPVCs(namespace, restoreID)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, volumeBackup := range config.VolumeBackups {
+		oldPVCName := volumeBackup.PersistentVolumeClaim.Name
+		if pvc, ok := previous[oldPVCName]; ok && pvc.Annotations[restoredAnnotation] == "true" {
+			log.Printf("⏭️  Volume %s was already restored into PVC %s", oldPVCName, pvc.Name)
+			plan.Volumes = append(plan.Volumes, PlannedRestore{SourcePVC: oldPVCName, PVC: pvc.Name, Existing: true, Restored: true})
+			continue
+		}
+
+		snapshotTag := fmt.Sprintf("%s-pvc-%s", backupName, oldPVCName)
+		snapshot, err := find.RunFindSnapshotFrom(ctx, namespace, volumeBackup.PersistentVolumeClaim.Namespace, snapshotTag, awsID, awsSecret, repository, password)
+		if err != nil {
+			return fmt.Errorf("failed to find the snapshot of volume %s: %w", oldPVCName, err)
+		}
+
+		planned := PlannedRestore{SourcePVC: oldPVCName, Snapshot: snapshot.ShortID}
+		var newPVCName string
+		if pvc, ok := previous[oldPVCName]; ok {
+			newPVCName = pvc.Name
+			planned.Existing = true
+			log.Printf("📦 Volume %s: would restore again into existing PVC %s/%s", oldPVCName, namespace, newPVCName)
+		} else {
+			newPVCName = fmt.Sprintf("%s-%s", oldPVCName, generateRandomSuffix(5))
+			newPVC := createCleanPVC(&volumeBackup.PersistentVolumeClaim, newPVCName, namespace, opts.StorageClass)
+			if size, ok := opts.Resize[oldPVCName]; ok {
+				if newPVC.Spec.Resources.Requests == nil {
+					newPVC.Spec.Resources.Requests = corev1.ResourceList{}
+				}
+				newPVC.Spec.Resources.Requests[corev1.ResourceStorage] = size
+			}
+			requestDeviceSize(newPVC, volumeBackup.DeviceSize)
+			storageClass := "default"
+			if newPVC.Spec.StorageClassName != nil {
+				storageClass = *newPVC.Spec.StorageClassName
+			}
+			log.Printf("📦 Volume %s: would create PersistentVolumeClaim %s/%s (%s, StorageClass %s)", oldPVCName, namespace, newPVCName, newPVC.Spec.Resources.Requests.Storage().String(), storageClass)
+			planned.Size = newPVC.Spec.Resources.Requests.Storage().String()
+			planned.StorageClass = storageClass
+		}
+		log.Printf("   would run: restic dump %s %s into PVC %s", snapshot.ShortID, volumeBackup.PersistentVolumeClaim.Spec.VolumeName, newPVCName)
+		planned.PVC = newPVCName
+		plan.Volumes = append(plan.Volumes, planned)
+	}
+
+	for _, name := range generateSecretMapping(config) {
+		_, err := k8s.Clientset.CoreV1().Secrets(namespace).Get(context.Background(), name, metav1.GetOptions{})
+		switch {
+		case err == nil:
+			log.Printf("🔐 Secret %s/%s already exists: would apply the %s policy", namespace, name, opts.OnExistingSecret)
+			plan.Secrets = append(plan.Secrets, PlannedSecret{Name: name, Exists: true})
+		case apierrors.IsNotFound(err):
+			log.Printf("🔐 would create Secret %s/%s", namespace, name)
+			plan.Secrets = append(plan.Secrets, PlannedSecret{Name: name})
+		default:
+			return fmt.Errorf("failed to check secret %s/%s: %w", namespace, name, err)
+		}
+	}
+	for _, keyPair := range config.KeyPairBackups {
+		log.Printf("🔑 would recreate KeyPair %s/%s if it is missing", keyPair.Namespace, keyPair.Name)
+		plan.KeyPairs = append(plan.KeyPairs, keyPair.Namespace+"/"+keyPair.Name)
+	}
+	if err := checkNetworks(config, namespace, opts.Strict); err != nil {
+		return err
+	}
+
+	log.Printf("🖥️  would create VirtualMachine %s/%s with runStrategy Halted", namespace, vmName)
+	for _, owned := range config.OwnedResources {
+		log.Printf("📎 would create %s %s/%s owned by the VM", owned.Kind, namespace, owned.Name)
+		plan.OwnedResources = append(plan.OwnedResources, owned.Kind+"/"+owned.Name)
+	}
+	if opts.Start {
+		log.Printf("▶️  would then start VirtualMachine %s/%s with runStrategy RerunOnFailure", namespace, vmName)
+	}
+	log.Println("🧪 Dry run complete; nothing was created")
+	if opts.Plan != nil {
+		return opts.Plan(plan)
+	}
+	return nil
+}
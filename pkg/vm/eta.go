@@ -0,0 +1,82 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+
+	"github.com/webberhuang/hv-vmbr/pkg/find"
+	"github.com/webberhuang/hv-vmbr/pkg/k8s"
+)
+
+// estimateBackupTime logs the total size of the PVCs and, when a throughput is known, how long
+// backing them up at throughputMBps, or else at the VM's previous throughput, is expected to take.
+func estimateBackupTime(ctx context.Context, namespace, vmName string, pvcList []string, throughputMBps float64, awsID, awsSecret, repository, password string, repoInitialized bool) {
+	var totalBytes int64
+	for _, pvcName := range pvcList {
+		size, err := k8s.GetPVCStorageSize(pvcName, namespace)
+		if err != nil {
+			log.Printf("⚠️  Failed to get size of PVC %s for the estimate: %v", pvcName, err)
+			continue
+		}
+		q, err := resource.ParseQuantity(size)
+		if err != nil {
+			log.Printf("⚠️  Failed to parse size %q of PVC %s for the estimate: %v", size, pvcName, err)
+			continue
+		}
+		totalBytes += q.Value()
+	}
+	totalMB := float64(totalBytes) / (1024 * 1024)
+	log.Printf("📏 %d PVC(s), %.2f MB in total", len(pvcList), totalMB)
+
+	throughput, source := throughputMBps, "-throughput-mbps"
+	if throughput <= 0 && repoInitialized {
+		throughput, source = previousThroughput(ctx, namespace, vmName, awsID, awsSecret, repository, password)
+	}
+	if throughput <= 0 {
+		log.Println("⏱️  No throughput known for an estimate; pass -throughput-mbps or take a backup first")
+		return
+	}
+
+	eta := time.Duration(totalMB / throughput * float64(time.Second))
+	log.Printf("⏱️  Estimated backup time: %s at %.2f MB/s (%s); expected to finish around %s",
+		eta.Round(time.Second), throughput, source, time.Now().Add(eta).Format("2006-01-02 15:04:05"))
+}
+
+// previousThroughput returns the throughput recorded by the most recent backup of the VM
+// and a description of where it came from, or zero if there is none or it cannot be read.
+func previousThroughput(ctx context.Context, namespace, vmName, awsID, awsSecret, repository, password string) (float64, string) {
+	backupName, err := find.RunFindLatestBackup(ctx, namespace, vmName, awsID, awsSecret, repository, password)
+	if err != nil {
+		if !errors.Is(err, find.ErrNoBackup) {
+			log.Printf("⚠️  Failed to find the previous backup of VM %s for the estimate: %v", vmName, err)
+		}
+		return 0, ""
+	}
+	config, err := downloadBackupConfig(ctx, namespace, backupName, awsID, awsSecret, repository, password)
+	if err != nil {
+		log.Printf("⚠️  Failed to read throughput of backup %s: %v", backupName, err)
+		return 0, ""
+	}
+	return config.ThroughputMBps, "measured by backup " + backupName
+}
+
+// measuredThroughput returns the MB/s achieved backing up the volumes, or zero if nothing was
+// measured. The bytes accelerated_io read count where known, since they may exceed the PVC request.
+func measuredThroughput(volumeBackups []VolumeBackup, elapsed time.Duration) float64 {
+	var totalBytes int64
+	for _, volumeBackup := range volumeBackups {
+		if volumeBackup.DeviceSize > 0 {
+			totalBytes += volumeBackup.DeviceSize
+		} else {
+			totalBytes += volumeBackup.VolumeSize
+		}
+	}
+	if totalBytes == 0 || elapsed <= 0 {
+		return 0
+	}
+	return float64(totalBytes) / (1024 * 1024) / elapsed.Seconds()
+}
@@ -0,0 +1,155 @@
+package vm
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"strings"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"github.com/webberhuang/hv-vmbr/pkg/k8s"
+)
+
+// Harvester annotations on the VirtualMachine that reference objects outside the VM
+const (
+	sshNamesAnnotation = "harvesterhci.io/sshNames"    // JSON list of "namespace/name" KeyPair references
+	ipsAnnotation      = "network.harvesterhci.io/ips" // IPs observed on the source cluster
+)
+
+var (
+	// KeyPairGVR is the GroupVersionResource for Harvester SSH KeyPairs
+	KeyPairGVR = schema.GroupVersionResource{
+		Group:    "harvesterhci.io",
+		Version:  "v1beta1",
+		Resource: "keypairs",
+	}
+)
+
+// sshKeyPairRefs parses the sshNames annotation into "namespace/name" references.
+// Entries without a namespace are resolved against the VM's namespace.
+func sshKeyPairRefs(annotations map[string]string, namespace string, strict bool) ([]string, error) {
+	value, ok := annotations[sshNamesAnnotation]
+	if !ok || value == "" {
+		return nil, nil
+	}
+
+	var names []string
+	if err := json.Unmarshal([]byte(value), &names); err != nil {
+		return nil, strictf(strict, "Failed to parse %s annotation %q: %v", sshNamesAnnotation, value, err)
+	}
+
+	refs := make([]string, 0, len(names))
+	for _, name := range names {
+		if !strings.Contains(name, "/") {
+			name = namespace + "/" + name
+		}
+		refs = append(refs, name)
+	}
+	return refs, nil
+}
+
+// backupKeyPairs reads the Harvester KeyPairs referenced by the VM
+func backupKeyPairs(vmObj *unstructured.Unstructured, strict bool) ([]KeyPairBackup, error) {
+	keyPairBackups := []KeyPairBackup{}
+
+	refs, err := sshKeyPairRefs(vmObj.GetAnnotations(), vmObj.GetNamespace(), strict)
+	if err != nil {
+		return nil, err
+	}
+	for _, ref := range refs {
+		namespace, name, _ := strings.Cut(ref, "/")
+		obj, err := k8s.DynamicClient.Resource(KeyPairGVR).Namespace(namespace).Get(context.Background(), name, metav1.GetOptions{})
+		if err != nil {
+			if err := strictf(strict, "Failed to get KeyPair %s: %v", ref, err); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		publicKey, _, _ := unstructured.NestedString(obj.Object, "spec", "publicKey")
+		keyPairBackups = append(keyPairBackups, KeyPairBackup{
+			Name:      name,
+			Namespace: namespace,
+			PublicKey: publicKey,
+		})
+		log.Printf("🔑 Backed up KeyPair: %s", ref)
+	}
+
+	return keyPairBackups, nil
+}
+
+// restoreKeyPairs recreates the backed-up KeyPairs that are missing on this cluster and
+// rewrites the sshNames annotation to the references that resolve after the restore.
+func restoreKeyPairs(config *VMBackupConfig, namespace string, strict bool) error {
+	annotations := config.VMSourceSpec.Metadata.Annotations
+	refs, err := sshKeyPairRefs(annotations, config.Namespace, strict)
+	if err != nil {
+		return err
+	}
+	if len(refs) == 0 {
+		return nil
+	}
+
+	backedUp := make(map[string]KeyPairBackup, len(config.KeyPairBackups))
+	for _, kp := range config.KeyPairBackups {
+		backedUp[kp.Namespace+"/"+kp.Name] = kp
+	}
+
+	kept := []string{}
+	for _, ref := range refs {
+		kpNamespace, name, _ := strings.Cut(ref, "/")
+		// KeyPairs from the VM's own namespace follow the VM into the target namespace
+		if kpNamespace == config.Namespace {
+			kpNamespace = namespace
+		}
+		target := kpNamespace + "/" + name
+
+		keyPairs := k8s.DynamicClient.Resource(KeyPairGVR).Namespace(kpNamespace)
+		if _, err := keyPairs.Get(context.Background(), name, metav1.GetOptions{}); err == nil {
+			kept = append(kept, target)
+			continue
+		}
+
+		kp, ok := backedUp[ref]
+		if !ok {
+			if err := strictf(strict, "KeyPair %s does not exist and was not backed up; dropping it from %s", target, sshNamesAnnotation); err != nil {
+				return err
+			}
+			continue
+		}
+
+		obj := &unstructured.Unstructured{
+			Object: map[string]interface{}{
+				"apiVersion": KeyPairGVR.GroupVersion().String(),
+				"kind":       "KeyPair",
+				"metadata": map[string]interface{}{
+					"name":      name,
+					"namespace": kpNamespace,
+				},
+				"spec": map[string]interface{}{
+					"publicKey": kp.PublicKey,
+				},
+			},
+		}
+		if _, err := keyPairs.Create(context.Background(), obj, metav1.CreateOptions{}); err != nil && !apierrors.IsAlreadyExists(err) {
+			if err := strictf(strict, "Failed to recreate KeyPair %s: %v; dropping it from %s", target, err, sshNamesAnnotation); err != nil {
+				return err
+			}
+			continue
+		}
+		kept = append(kept, target)
+		log.Printf("🔑 Restored KeyPair: %s", target)
+	}
+
+	if len(kept) == 0 {
+		delete(annotations, sshNamesAnnotation)
+		return nil
+	}
+	value, _ := json.Marshal(kept)
+	annotations[sshNamesAnnotation] = string(value)
+	return nil
+}
@@ -0,0 +1,68 @@
+package vm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/webberhuang/hv-vmbr/pkg/k8s"
+)
+
+// namespaceLabels returns the labels of the VM's namespace, e.g. its Pod Security admission level,
+// dropping the name label the API server sets on every namespace
+func namespaceLabels(ctx context.Context, namespace string) map[string]string {
+	ns, err := k8s.Clientset.CoreV1().Namespaces().Get(ctx, namespace, metav1.GetOptions{})
+	if err != nil {
+		log.Printf("⚠️  Failed to get the labels of namespace %s: %v", namespace, err)
+		return nil
+	}
+	labels := map[string]string{}
+	for key, value := range ns.Labels {
+		if key != corev1.LabelMetadataName {
+			labels[key] = value
+		}
+	}
+	if len(labels) == 0 {
+		return nil
+	}
+	return labels
+}
+
+// copyNamespaceLabels adds the labels of the backed-up VM's namespace to the target namespace,
+// keeping the value of every label the target namespace already has
+func copyNamespaceLabels(ctx context.Context, config *VMBackupConfig, namespace string) error {
+	if len(config.NamespaceLabels) == 0 {
+		log.Printf("⚠️  Backup %s recorded no namespace labels; not copying any to namespace %s", config.Name, namespace)
+		return nil
+	}
+	ns, err := k8s.Clientset.CoreV1().Namespaces().Get(ctx, namespace, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to get namespace %s: %w", namespace, err)
+	}
+
+	missing := map[string]string{}
+	for key, value := range config.NamespaceLabels {
+		if _, ok := ns.Labels[key]; !ok {
+			missing[key] = value
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{"labels": missing},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to build namespace label patch: %w", err)
+	}
+	if _, err := k8s.Clientset.CoreV1().Namespaces().Patch(ctx, namespace, types.MergePatchType, patch, metav1.PatchOptions{}); err != nil {
+		return fmt.Errorf("failed to label namespace %s: %w", namespace, err)
+	}
+	log.Printf("🏷️  Copied %d label(s) of namespace %s to namespace %s", len(missing), config.Namespace, namespace)
+	return nil
+}
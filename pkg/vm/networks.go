@@ -0,0 +1,171 @@
+package vm
+
+import (
+	"context"
+	"log"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"github.com/webberhuang/hv-vmbr/pkg/k8s"
+)
+
+// nadResourceNameAnnotation names the device plugin resource (e.g. an SR-IOV VF pool) that
+// pods attached to a NetworkAttachmentDefinition are allocated from
+const nadResourceNameAnnotation = "k8s.v1.cni.cncf.io/resourceName"
+
+// NetworkAttachmentDefinitionGVR is the GroupVersionResource for Multus NetworkAttachmentDefinitions
+var NetworkAttachmentDefinitionGVR = schema.GroupVersionResource{
+	Group:    "k8s.cni.cncf.io",
+	Version:  "v1",
+	Resource: "network-attachment-definitions",
+}
+
+// vmNetworks returns the networks of a VM spec with the binding of the interface attached to each
+func vmNetworks(spec interface{}) []NetworkBackup {
+	specMap, ok := spec.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+
+	bindings := map[string]string{}
+	interfaces, _, _ := unstructured.NestedSlice(specMap, "template", "spec", "domain", "devices", "interfaces")
+	for _, iface := range interfaces {
+		ifaceMap, ok := iface.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		name, _, _ := unstructured.NestedString(ifaceMap, "name")
+		bindings[name] = interfaceBinding(ifaceMap)
+	}
+
+	var networks []NetworkBackup
+	items, _, _ := unstructured.NestedSlice(specMap, "template", "spec", "networks")
+	for _, item := range items {
+		network, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		name, _, _ := unstructured.NestedString(network, "name")
+		networkBackup := NetworkBackup{Name: name, Type: "pod", Binding: bindings[name]}
+		if networkName, found, _ := unstructured.NestedString(network, "multus", "networkName"); found {
+			networkBackup.Type = "multus"
+			networkBackup.NetworkName = networkName
+		}
+		networks = append(networks, networkBackup)
+	}
+	return networks
+}
+
+// interfaceBinding returns how an interface is bound to its network, e.g. masquerade, bridge or sriov
+func interfaceBinding(iface map[string]interface{}) string {
+	for _, binding := range []string{"masquerade", "bridge", "sriov", "slirp", "macvtap", "passt"} {
+		if _, ok := iface[binding]; ok {
+			return binding
+		}
+	}
+	if plugin, found, _ := unstructured.NestedString(iface, "binding", "name"); found {
+		return plugin
+	}
+	return ""
+}
+
+// networkAttachmentRef splits a Multus networkName into namespace and name. Names without a
+// namespace are resolved against the VM's namespace.
+func networkAttachmentRef(networkName, namespace string) (string, string) {
+	if ns, name, ok := strings.Cut(networkName, "/"); ok {
+		return ns, name
+	}
+	return namespace, networkName
+}
+
+// backupNetworks records the networks of the VM and the device plugin resource behind each
+// Multus network, logging the SR-IOV and bridge bindings that depend on the host's networking
+func backupNetworks(vmObj *unstructured.Unstructured) []NetworkBackup {
+	networks := vmNetworks(vmObj.Object["spec"])
+	for i := range networks {
+		network := &networks[i]
+		if network.Type != "multus" {
+			continue
+		}
+		namespace, name := networkAttachmentRef(network.NetworkName, vmObj.GetNamespace())
+		nad, err := k8s.DynamicClient.Resource(NetworkAttachmentDefinitionGVR).Namespace(namespace).Get(context.Background(), name, metav1.GetOptions{})
+		if err != nil {
+			log.Printf("⚠️  Failed to get NetworkAttachmentDefinition %s/%s of network %s: %v", namespace, name, network.Name, err)
+		} else {
+			network.ResourceName = nad.GetAnnotations()[nadResourceNameAnnotation]
+		}
+		if network.Binding == "sriov" || network.Binding == "bridge" {
+			log.Printf("🌐 Network %s uses %s binding on %s", network.Name, network.Binding, network.NetworkName)
+		}
+	}
+	return networks
+}
+
+// checkNetworks warns about networks of the backed-up VM that the target cluster cannot provide:
+// Multus networks whose NetworkAttachmentDefinition does not exist, and SR-IOV networks whose
+// device plugin resource no node advertises. Backups taken before networks were recorded are
+// checked against the VM spec. Under -strict, such a network is an error.
+func checkNetworks(config *VMBackupConfig, namespace string, strict bool) error {
+	networks := config.Networks
+	if len(networks) == 0 {
+		networks = vmNetworks(config.VMSourceSpec.Spec)
+	}
+
+	var nodes []corev1.Node
+	for _, network := range networks {
+		if network.Type != "multus" {
+			continue
+		}
+		nadNamespace, name := networkAttachmentRef(network.NetworkName, namespace)
+		nad, err := k8s.DynamicClient.Resource(NetworkAttachmentDefinitionGVR).Namespace(nadNamespace).Get(context.Background(), name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			if err := strictf(strict, "NetworkAttachmentDefinition %s/%s of network %s does not exist; the restored VM will not start until it is created", nadNamespace, name, network.Name); err != nil {
+				return err
+			}
+			continue
+		} else if err != nil {
+			log.Printf("⚠️  Could not check NetworkAttachmentDefinition %s/%s of network %s: %v", nadNamespace, name, network.Name, err)
+			continue
+		}
+
+		if network.Binding != "sriov" {
+			continue
+		}
+		resourceName := nad.GetAnnotations()[nadResourceNameAnnotation]
+		if resourceName == "" {
+			resourceName = network.ResourceName
+		}
+		if resourceName == "" {
+			continue
+		}
+		if nodes == nil {
+			nodeList, err := k8s.Clientset.CoreV1().Nodes().List(context.Background(), metav1.ListOptions{})
+			if err != nil {
+				log.Printf("⚠️  Could not list nodes to check SR-IOV resource %s: %v", resourceName, err)
+				continue
+			}
+			nodes = nodeList.Items
+		}
+		if !nodeAllocatable(nodes, corev1.ResourceName(resourceName)) {
+			if err := strictf(strict, "No node advertises SR-IOV resource %s used by network %s; the restored VM cannot be scheduled", resourceName, network.Name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// nodeAllocatable reports whether any node can allocate the resource
+func nodeAllocatable(nodes []corev1.Node, resource corev1.ResourceName) bool {
+	for _, node := range nodes {
+		if quantity, ok := node.Status.Allocatable[resource]; ok && !quantity.IsZero() {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,186 @@
+package vm
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/webberhuang/hv-vmbr/pkg/k8s"
+)
+
+// transientJobPrefixes are the name prefixes of the Jobs this tool creates, each followed by a job suffix.
+var transientJobPrefixes = []string{
+	"block-backup-job-", "block-restore-job-", "block-verify-job-",
+	"restic-check-", "restic-init-", "restic-migrate-", "restic-verify-", "restic-prune-",
+	"find-config-", "find-snapshots-", "tag-snapshot-", "delete-snapshot-", "delete-vm-config-",
+	"vm-backup-config-", "vm-cleanup-config-", "vm-restore-config-",
+	"vm-archive-", "vm-unarchive-backup-", "vm-unarchive-receive-", "selftest-checksum-",
+}
+
+// orphan is a transient resource that no running job uses anymore
+type orphan struct {
+	kind    string
+	name    string
+	created time.Time
+	storage *resource.Quantity
+}
+
+// RunListOrphans reports the transient resources backups and restores leave behind when they are
+// interrupted: clone and staging PVCs no running pod mounts, VolumeSnapshots without their clone,
+// ConfigMaps whose upload job is gone, and finished Jobs past their TTL. Nothing is deleted.
+// Only resources labeled as managed by this tool are considered; their names tell which kind of
+// transient resource they are.
+func RunListOrphans(namespace string) error {
+	log.Printf("🔍 Looking for orphaned backup resources in namespace %s", namespace)
+	ctx := context.Background()
+	managed := metav1.ListOptions{LabelSelector: k8s.ManagedByLabel + "=" + k8s.ManagedByValue}
+
+	pods, err := k8s.Clientset.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to list pods: %w", err)
+	}
+	mounted := map[string]bool{}
+	for _, pod := range pods.Items {
+		if pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+			continue
+		}
+		for _, volume := range pod.Spec.Volumes {
+			if volume.PersistentVolumeClaim != nil {
+				mounted[volume.PersistentVolumeClaim.ClaimName] = true
+			}
+		}
+	}
+
+	jobs, err := k8s.Clientset.BatchV1().Jobs(namespace).List(ctx, managed)
+	if err != nil {
+		return fmt.Errorf("failed to list jobs: %w", err)
+	}
+	activeJobs := map[string]bool{}
+	var orphans []orphan
+	for _, job := range jobs.Items {
+		if !hasTransientJobPrefix(job.Name) {
+			continue
+		}
+		finished, ok := jobFinishedAt(&job)
+		if !ok {
+			activeJobs[job.Name] = true
+			continue
+		}
+		if ttl := job.Spec.TTLSecondsAfterFinished; ttl == nil || time.Since(finished) > time.Duration(*ttl)*time.Second {
+			orphans = append(orphans, orphan{kind: "Job", name: job.Name, created: job.CreationTimestamp.Time})
+		}
+	}
+
+	pvcs, err := k8s.Clientset.CoreV1().PersistentVolumeClaims(namespace).List(ctx, managed)
+	if err != nil {
+		return fmt.Errorf("failed to list PVCs: %w", err)
+	}
+	clones := map[string]bool{}
+	for _, pvc := range pvcs.Items {
+		isClone := strings.HasSuffix(pvc.Name, "-clone")
+		if !isClone && !strings.HasPrefix(pvc.Name, "unarchive-staging-") && !strings.Contains(pvc.Name, "-selftest-") {
+			continue
+		}
+		if mounted[pvc.Name] {
+			if isClone {
+				clones[pvc.Name] = true
+			}
+			continue
+		}
+		orphans = append(orphans, orphan{kind: "PVC", name: pvc.Name, created: pvc.CreationTimestamp.Time, storage: pvcStorage(&pvc)})
+	}
+
+	snapshots, err := k8s.DynamicClient.Resource(k8s.VsGVR).Namespace(namespace).List(ctx, managed)
+	if err != nil {
+		return fmt.Errorf("failed to list VolumeSnapshots: %w", err)
+	}
+	for _, vs := range snapshots.Items {
+		if !strings.HasSuffix(vs.GetName(), "-vs") || clones[strings.TrimSuffix(vs.GetName(), "-vs")+"-clone"] {
+			continue
+		}
+		orphans = append(orphans, orphan{kind: "VolumeSnapshot", name: vs.GetName(), created: vs.GetCreationTimestamp().Time, storage: snapshotStorage(&vs)})
+	}
+
+	configMaps, err := k8s.Clientset.CoreV1().ConfigMaps(namespace).List(ctx, managed)
+	if err != nil {
+		return fmt.Errorf("failed to list ConfigMaps: %w", err)
+	}
+	for _, cm := range configMaps.Items {
+		// saveBackupConfig names the ConfigMap after the job that uploads it
+		if strings.HasPrefix(cm.Name, "vm-backup-config-") && !activeJobs[cm.Name] {
+			orphans = append(orphans, orphan{kind: "ConfigMap", name: cm.Name, created: cm.CreationTimestamp.Time})
+		}
+	}
+
+	if len(orphans) == 0 {
+		log.Printf("✅ No orphaned backup resources in namespace %s", namespace)
+		return nil
+	}
+
+	total := resource.NewQuantity(0, resource.BinarySI)
+	log.Printf("⚠️  Found %d resource(s) that appear orphaned:", len(orphans))
+	for _, o := range orphans {
+		size := "-"
+		if o.storage != nil {
+			size = o.storage.String()
+			total.Add(*o.storage)
+		}
+		log.Printf("   %s %s (age %s, storage %s)", o.kind, o.name, time.Since(o.created).Round(time.Second), size)
+	}
+	log.Printf("💾 Estimated storage held: %s", total.String())
+	log.Println("💡 A resource that is only seconds old may belong to a backup that is still starting")
+	return nil
+}
+
+// hasTransientJobPrefix reports whether name looks like a Job created by this tool
+func hasTransientJobPrefix(name string) bool {
+	for _, prefix := range transientJobPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// jobFinishedAt returns when the job completed or failed, and false if it is still running
+func jobFinishedAt(job *batchv1.Job) (time.Time, bool) {
+	for _, cond := range job.Status.Conditions {
+		if (cond.Type == batchv1.JobComplete || cond.Type == batchv1.JobFailed) && cond.Status == corev1.ConditionTrue {
+			return cond.LastTransitionTime.Time, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// pvcStorage returns the provisioned capacity of a PVC, or its request if it is not bound yet
+func pvcStorage(pvc *corev1.PersistentVolumeClaim) *resource.Quantity {
+	if capacity, ok := pvc.Status.Capacity[corev1.ResourceStorage]; ok {
+		return &capacity
+	}
+	if request, ok := pvc.Spec.Resources.Requests[corev1.ResourceStorage]; ok {
+		return &request
+	}
+	return nil
+}
+
+// snapshotStorage returns the restore size a VolumeSnapshot reports, if any
+func snapshotStorage(vs *unstructured.Unstructured) *resource.Quantity {
+	size, found, err := unstructured.NestedString(vs.Object, "status", "restoreSize")
+	if err != nil || !found {
+		return nil
+	}
+	q, err := resource.ParseQuantity(size)
+	if err != nil {
+		log.Printf("⚠️  VolumeSnapshot %s has an invalid restore size %q: %v", vs.GetName(), size, err)
+		return nil
+	}
+	return &q
+}
@@ -0,0 +1,65 @@
+package vm
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+
+	"github.com/webberhuang/hv-vmbr/pkg/k8s"
+)
+
+func TestRunListOrphansIgnoresUnmanagedResources(t *testing.T) {
+	managed := map[string]string{k8s.ManagedByLabel: k8s.ManagedByValue}
+	pvc := func(name string, labels map[string]string) *corev1.PersistentVolumeClaim {
+		return &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", Labels: labels}}
+	}
+	snapshot := func(name string, labels map[string]interface{}) *unstructured.Unstructured {
+		return &unstructured.Unstructured{Object: map[string]interface{}{
+			"apiVersion": "snapshot.storage.k8s.io/v1",
+			"kind":       "VolumeSnapshot",
+			"metadata":   map[string]interface{}{"name": name, "namespace": "default", "labels": labels},
+		}}
+	}
+	kube := kubefake.NewSimpleClientset(
+		pvc("disk-0-clone", managed),
+		pvc("data-clone", nil),
+		&corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "vm-backup-config-user", Namespace: "default"}},
+	)
+	dyn := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		k8s.VsGVR: "VolumeSnapshotList",
+	}, snapshot("disk-0-vs", map[string]interface{}{k8s.ManagedByLabel: k8s.ManagedByValue}), snapshot("data-vs", nil))
+	defer func(clientset kubernetes.Interface, client dynamic.Interface) {
+		k8s.Clientset, k8s.DynamicClient = clientset, client
+	}(k8s.Clientset, k8s.DynamicClient)
+	k8s.Clientset, k8s.DynamicClient = kube, dyn
+
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	defer log.SetOutput(os.Stderr)
+	if err := RunListOrphans("default"); err != nil {
+		t.Fatalf("RunListOrphans returned %v", err)
+	}
+
+	for _, want := range []string{"PVC disk-0-clone", "VolumeSnapshot disk-0-vs"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("%s is not reported:\n%s", want, out.String())
+		}
+	}
+	for _, unwanted := range []string{"data-clone", "data-vs", "vm-backup-config-user"} {
+		if strings.Contains(out.String(), unwanted) {
+			t.Errorf("user resource %s is reported:\n%s", unwanted, out.String())
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package vm
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+
+	"github.com/webberhuang/hv-vmbr/pkg/k8s"
+)
+
+// ownedResourceClient returns the dynamic client for the namespaced resources of the given kind
+func ownedResourceClient(gk schema.GroupKind, version, namespace string) (dynamic.ResourceInterface, string, error) {
+	var versions []string
+	if version != "" {
+		versions = append(versions, version)
+	}
+	mapping, err := k8s.RestMapper.RESTMapping(gk, versions...)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to get REST mapping for %s: %w", gk, err)
+	}
+	return k8s.DynamicClient.Resource(mapping.Resource).Namespace(namespace), mapping.GroupVersionKind.GroupVersion().String(), nil
+}
+
+// backupOwnedResources collects the resources of the included kinds whose owner references point
+// at the VM. Secrets already captured as cloud-init secrets are skipped.
+func backupOwnedResources(vmObj *unstructured.Unstructured, secretBackups []SecretBackup, opts BackupOptions) ([]OwnedResourceBackup, error) {
+	ownedBackups := []OwnedResourceBackup{}
+
+	capturedSecrets := map[string]bool{}
+	for _, secretBackup := range secretBackups {
+		capturedSecrets[secretBackup.Name] = true
+	}
+
+	for _, kind := range opts.IncludeKinds {
+		gk := schema.ParseGroupKind(kind)
+		client, apiVersion, err := ownedResourceClient(gk, "", vmObj.GetNamespace())
+		if err != nil {
+			if err := strictf(opts.Strict, "Skipping owned %s resources: %v", kind, err); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		list, err := client.List(context.Background(), metav1.ListOptions{})
+		if err != nil {
+			if err := strictf(opts.Strict, "Failed to list %s resources: %v", kind, err); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		for _, item := range list.Items {
+			if !isOwnedBy(&item, vmObj) {
+				continue
+			}
+			if gk == (schema.GroupKind{Kind: "Secret"}) && capturedSecrets[item.GetName()] {
+				continue
+			}
+
+			sanitizeOwnedResource(&item)
+			ownedBackups = append(ownedBackups, OwnedResourceBackup{
+				APIVersion: apiVersion,
+				Kind:       item.GetKind(),
+				Name:       item.GetName(),
+				Object:     item.Object,
+			})
+			log.Printf("📝 Backed up owned %s: %s", item.GetKind(), item.GetName())
+		}
+	}
+
+	return ownedBackups, nil
+}
+
+// isOwnedBy reports whether obj has an owner reference to the VM
+func isOwnedBy(obj, vmObj *unstructured.Unstructured) bool {
+	for _, ref := range obj.GetOwnerReferences() {
+		if ref.UID == vmObj.GetUID() {
+			return true
+		}
+	}
+	return false
+}
+
+// sanitizeOwnedResource removes runtime fields and fields assigned by the source cluster
+func sanitizeOwnedResource(obj *unstructured.Unstructured) {
+	unstructured.RemoveNestedField(obj.Object, "status")
+	obj.SetUID("")
+	obj.SetResourceVersion("")
+	obj.SetGeneration(0)
+	obj.SetCreationTimestamp(metav1.Time{})
+	obj.SetManagedFields(nil)
+	obj.SetOwnerReferences(nil)
+	obj.SetNamespace("")
+
+	if obj.GetKind() == "Service" {
+		unstructured.RemoveNestedField(obj.Object, "spec", "clusterIP")
+		unstructured.RemoveNestedField(obj.Object, "spec", "clusterIPs")
+		unstructured.RemoveNestedField(obj.Object, "spec", "healthCheckNodePort")
+		ports, _, _ := unstructured.NestedSlice(obj.Object, "spec", "ports")
+		for _, p := range ports {
+			if port, ok := p.(map[string]interface{}); ok {
+				delete(port, "nodePort")
+			}
+		}
+		if ports != nil {
+			_ = unstructured.SetNestedSlice(obj.Object, ports, "spec", "ports")
+		}
+	}
+}
+
+// restoreOwnedResources recreates the backed-up owned resources with an owner reference to the
+// restored VM. Label selectors naming the source VM are pointed at the restored VM. A resource
+// that cannot be restored is skipped, or fails the restore under -strict.
+func restoreOwnedResources(config *VMBackupConfig, namespace string, ownerRef metav1.OwnerReference, opts RestoreOptions) error {
+	sourceVM := config.BackupSpec.Source.Name
+
+	for _, owned := range config.OwnedResources {
+		obj := &unstructured.Unstructured{Object: owned.Object}
+		obj.SetNamespace(namespace)
+		obj.SetOwnerReferences([]metav1.OwnerReference{ownerRef})
+		obj.SetAnnotations(mergeAnnotations(obj.GetAnnotations(), opts.Annotations))
+
+		if selector, found, err := unstructured.NestedStringMap(obj.Object, "spec", "selector"); err == nil && found && sourceVM != ownerRef.Name {
+			for k, v := range selector {
+				if v == sourceVM {
+					selector[k] = ownerRef.Name
+				}
+			}
+			_ = unstructured.SetNestedStringMap(obj.Object, selector, "spec", "selector")
+		}
+
+		gv, err := schema.ParseGroupVersion(owned.APIVersion)
+		if err != nil {
+			if err := strictf(opts.Strict, "Failed to restore %s %s: %v", owned.Kind, owned.Name, err); err != nil {
+				return err
+			}
+			continue
+		}
+		client, _, err := ownedResourceClient(gv.WithKind(owned.Kind).GroupKind(), gv.Version, namespace)
+		if err != nil {
+			if err := strictf(opts.Strict, "Failed to restore %s %s: %v", owned.Kind, owned.Name, err); err != nil {
+				return err
+			}
+			continue
+		}
+
+		_, err = client.Create(context.Background(), obj, metav1.CreateOptions{})
+		if apierrors.IsAlreadyExists(err) {
+			if err := strictf(opts.Strict, "%s %s already exists, keeping it", owned.Kind, owned.Name); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			if err := strictf(opts.Strict, "Failed to restore %s %s: %v", owned.Kind, owned.Name, err); err != nil {
+				return err
+			}
+			continue
+		}
+		log.Printf("📝 Restored owned %s: %s", owned.Kind, owned.Name)
+	}
+	return nil
+}
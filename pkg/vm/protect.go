@@ -0,0 +1,150 @@
+package vm
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/webberhuang/hv-vmbr/pkg/find"
+	"github.com/webberhuang/hv-vmbr/pkg/k8s"
+	"github.com/webberhuang/hv-vmbr/pkg/manifests"
+)
+
+// ProtectedTag marks the snapshots of a backup that cleanup must not delete
+const ProtectedTag = "protected=true"
+
+// RunVMProtect adds ProtectedTag to, or with protect false removes it from, every snapshot of a backup
+func RunVMProtect(ctx context.Context, namespace, backupName string, protect bool, awsID, awsSecret, repository, password string) error {
+	action := "Protecting"
+	if !protect {
+		action = "Unprotecting"
+	}
+	log.Printf("🔧 %s backup %s", action, backupName)
+
+	config, err := downloadBackupConfig(ctx, namespace, backupName, awsID, awsSecret, repository, password)
+	if err != nil {
+		return fmt.Errorf("failed to download backup config: %w", err)
+	}
+
+	for _, tags := range backupSnapshotTags(config, namespace, backupName) {
+		if err := setProtected(ctx, namespace, tags, protect, awsID, awsSecret, repository, password); err != nil {
+			return fmt.Errorf("failed to update snapshot with tags %s: %w", strings.Join(tags, ","), err)
+		}
+	}
+
+	if protect {
+		log.Printf("🔒 Backup %s is protected; cleanup refuses to delete it without -force-protected", backupName)
+	} else {
+		log.Printf("🔓 Backup %s is no longer protected", backupName)
+	}
+	return nil
+}
+
+// backupSnapshotTags returns the tags identifying each snapshot of a backup: its volumes, then its config
+func backupSnapshotTags(config *VMBackupConfig, namespace, backupName string) [][]string {
+	tagSets := [][]string{}
+	for _, volumeBackup := range config.VolumeBackups {
+		tagSets = append(tagSets, volumeSnapshotTags(namespace, backupName, volumeBackup))
+	}
+	if len(config.ConfigTags) > 0 {
+		tagSets = append(tagSets, config.ConfigTags)
+	} else {
+		tagSets = append(tagSets, configSnapshotTags(namespace, backupName))
+	}
+	return tagSets
+}
+
+// setProtected adds or removes ProtectedTag on the snapshot carrying all of the given tags
+func setProtected(ctx context.Context, namespace string, tags []string, protect bool, awsID, awsSecret, repository, password string) error {
+	snapshots, err := find.RunFind(ctx, namespace, tags, awsID, awsSecret, repository, password)
+	if err != nil {
+		return fmt.Errorf("failed to find snapshot: %w", err)
+	}
+	if len(snapshots) == 0 {
+		return fmt.Errorf("snapshot not found")
+	}
+	if isProtected(snapshots[0].Tags) == protect {
+		return nil
+	}
+
+	tagArgs := "--add " + ProtectedTag
+	if !protect {
+		tagArgs = "--remove " + ProtectedTag
+	}
+	return tagSnapshot(ctx, namespace, snapshots[0].ShortID, tagArgs, awsID, awsSecret, repository, password)
+}
+
+// checkNotProtected fails unless forceProtected is set when any snapshot of the backup is protected.
+// All snapshots of the namespace are listed once instead of running a find job per snapshot.
+func checkNotProtected(ctx context.Context, tagSets [][]string, namespace, backupName, awsID, awsSecret, repository, password string, forceProtected bool) error {
+	snapshots, err := find.RunFind(ctx, namespace, []string{"ns=" + namespace, ProtectedTag}, awsID, awsSecret, repository, password)
+	if err != nil {
+		return fmt.Errorf("failed to check whether backup %s is protected: %w", backupName, err)
+	}
+
+	for _, snapshot := range snapshots {
+		for _, tags := range tagSets {
+			if !hasTags(snapshot.Tags, tags) {
+				continue
+			}
+			if !forceProtected {
+				return fmt.Errorf("backup %s is protected (snapshot %s); run -mode=unprotect first or pass -force-protected", backupName, snapshot.ShortID)
+			}
+			log.Printf("⚠️  Deleting protected backup %s because -force-protected is set", backupName)
+			return nil
+		}
+	}
+	return nil
+}
+
+// isProtected reports whether tags include ProtectedTag
+func isProtected(tags []string) bool {
+	return hasTags(tags, []string{ProtectedTag})
+}
+
+// hasTags reports whether tags include every one of want
+func hasTags(tags, want []string) bool {
+	for _, w := range want {
+		found := false
+		for _, tag := range tags {
+			if tag == w {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// tagSnapshot runs restic tag with the given --add/--remove options on a snapshot
+func tagSnapshot(ctx context.Context, namespace, snapshotID, tagArgs, awsID, awsSecret, repository, password string) error {
+	jobSuffix, err := k8s.GenerateJobSuffix()
+	if err != nil {
+		return fmt.Errorf("failed to generate job suffix: %w", err)
+	}
+
+	replacements := map[string]string{
+		"AWS_ACCESS_KEY_ID":     awsID,
+		"AWS_SECRET_ACCESS_KEY": awsSecret,
+		"RESTIC_REPOSITORY":     repository,
+		"RESTIC_PASSWORD":       password,
+		"SNAPSHOT_ID":           snapshotID,
+		"TAG_ARGS":              tagArgs,
+	}
+
+	jobName := "tag-snapshot-" + jobSuffix
+	timeout := 120 * time.Second
+	if err := k8s.ApplyJob(ctx, manifests.ResticTagJob, namespace, jobName, timeout, replacements); err != nil {
+		return fmt.Errorf("failed to apply tag job: %w", err)
+	}
+
+	if err := k8s.WaitForJob(ctx, jobName, namespace, timeout); err != nil {
+		return fmt.Errorf("tag job failed: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,230 @@
+package vm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/webberhuang/hv-vmbr/pkg/find"
+	"github.com/webberhuang/hv-vmbr/pkg/k8s"
+	"github.com/webberhuang/hv-vmbr/pkg/manifests"
+)
+
+// PrunePolicy is how many backups of each VM a prune keeps, as with restic forget's
+// --keep-last, --keep-daily and --keep-weekly
+type PrunePolicy struct {
+	Last   int
+	Daily  int
+	Weekly int
+}
+
+// keepArgs returns the restic forget arguments of the policy
+func (p PrunePolicy) keepArgs() string {
+	var args []string
+	for _, keep := range []struct {
+		flag  string
+		count int
+	}{
+		{"--keep-last", p.Last},
+		{"--keep-daily", p.Daily},
+		{"--keep-weekly", p.Weekly},
+	} {
+		if keep.count > 0 {
+			args = append(args, fmt.Sprintf("%s %d", keep.flag, keep.count))
+		}
+	}
+	return strings.Join(args, " ")
+}
+
+// forgetGroup is one group of restic forget's JSON output
+type forgetGroup struct {
+	Keep   []find.Snapshot `json:"keep"`
+	Remove []find.Snapshot `json:"remove"`
+}
+
+// RunVMPrune applies the retention policy to the backups of each VM in the namespace and deletes
+// the backups it does not keep, with all their volume snapshots, before pruning the repository.
+// Backups are the unit of retention: restic decides which config snapshots of a VM to keep, and
+// a backup's volume snapshots go with its config. Protected backups are always kept, and
+// snapshots without the namespace's ns= tag are never touched.
+func RunVMPrune(ctx context.Context, namespace string, policy PrunePolicy, awsID, awsSecret, repository, password string) error {
+	log.Printf("🔧 Pruning backups in namespace %s (%s)", namespace, policy.keepArgs())
+
+	configs, err := find.RunFind(ctx, namespace, []string{"ns=" + namespace, "type=vm-config"}, awsID, awsSecret, repository, password)
+	if err != nil {
+		return fmt.Errorf("failed to list backups: %w", err)
+	}
+	vmNames := map[string]bool{}
+	untagged := 0
+	for _, config := range configs {
+		if vmName := tagValue(config.Tags, "vm="); vmName != "" {
+			vmNames[vmName] = true
+		} else {
+			untagged++
+		}
+	}
+	if untagged > 0 {
+		log.Printf("⚠️  Keeping %d backup(s) taken before the source VM was recorded as a vm= tag", untagged)
+	}
+	vms := make([]string, 0, len(vmNames))
+	for vmName := range vmNames {
+		vms = append(vms, vmName)
+	}
+	sort.Strings(vms)
+
+	var removed []find.Snapshot
+	for _, vmName := range vms {
+		tags := []string{"ns=" + namespace, "type=vm-config", "vm=" + vmName}
+		keep, remove, err := planPrune(ctx, namespace, tags, policy, awsID, awsSecret, repository, password)
+		if err != nil {
+			return fmt.Errorf("failed to apply the policy to the backups of VM %s: %w", vmName, err)
+		}
+		log.Printf("📋 VM %s: keeping %d backup(s), removing %d", vmName, keep, len(remove))
+		removed = append(removed, remove...)
+	}
+	if len(removed) == 0 {
+		log.Println("✅ No backups to prune")
+		return nil
+	}
+
+	all, err := find.RunFind(ctx, namespace, []string{"ns=" + namespace}, awsID, awsSecret, repository, password)
+	if err != nil {
+		return fmt.Errorf("failed to list snapshots: %w", err)
+	}
+	var ids []string
+	for _, config := range removed {
+		backupName := tagValue(config.Tags, "sn=")
+		volumes := backupVolumeSnapshots(ctx, namespace, backupName, all, awsID, awsSecret, repository, password)
+		log.Printf("🗑️  Removing backup %s (%s) with %d volume snapshot(s)", backupName, config.Time.Local().Format(time.RFC3339), len(volumes))
+		for _, snapshot := range volumes {
+			ids = append(ids, snapshot.ShortID)
+		}
+		ids = append(ids, config.ShortID)
+	}
+
+	if err := forgetSnapshots(ctx, namespace, ids, awsID, awsSecret, repository, password); err != nil {
+		return fmt.Errorf("failed to remove snapshots: %w", err)
+	}
+	log.Printf("✅ Pruned %d backup(s): removed %d snapshot(s)", len(removed), len(ids))
+	return nil
+}
+
+// planPrune runs the prune job on the snapshots carrying all of tags and returns how many it
+// keeps and the ones it would remove
+func planPrune(ctx context.Context, namespace string, tags []string, policy PrunePolicy, awsID, awsSecret, repository, password string) (int, []find.Snapshot, error) {
+	jobSuffix, err := k8s.GenerateJobSuffix()
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to generate job suffix: %w", err)
+	}
+	replacements := map[string]string{
+		"AWS_ACCESS_KEY_ID":     awsID,
+		"AWS_SECRET_ACCESS_KEY": awsSecret,
+		"RESTIC_REPOSITORY":     repository,
+		"RESTIC_PASSWORD":       password,
+		"TAGS":                  strings.Join(tags, ","),
+		"KEEP_ARGS":             policy.keepArgs(),
+	}
+	jobName := "restic-prune-" + jobSuffix
+	timeout := 300 * time.Second
+	if err := k8s.ApplyJob(ctx, manifests.ResticPruneJob, namespace, jobName, timeout, replacements); err != nil {
+		return 0, nil, fmt.Errorf("failed to apply prune job: %w", err)
+	}
+	if err := k8s.WaitForJob(ctx, jobName, namespace, timeout); err != nil {
+		return 0, nil, fmt.Errorf("prune job failed: %w", err)
+	}
+	logs, err := k8s.GetJobLogs(jobName, namespace, "prune")
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to get prune job logs: %w", err)
+	}
+
+	// restic prints nothing when no snapshot carries the tags
+	if strings.TrimSpace(logs) == "" {
+		return 0, nil, nil
+	}
+	var groups []forgetGroup
+	if err := json.Unmarshal([]byte(logs), &groups); err != nil {
+		return 0, nil, fmt.Errorf("failed to parse prune job output: %w", err)
+	}
+	keep := 0
+	var remove []find.Snapshot
+	for _, group := range groups {
+		keep += len(group.Keep)
+		remove = append(remove, group.Remove...)
+	}
+	return keep, remove, nil
+}
+
+// backupVolumeSnapshots returns the snapshots among all that hold the volumes of a backup. The
+// volumes are read from the backup config; if it cannot be downloaded, volume snapshots are
+// matched by the {backupName}-pvc- naming convention instead.
+func backupVolumeSnapshots(ctx context.Context, namespace, backupName string, all []find.Snapshot, awsID, awsSecret, repository, password string) []find.Snapshot {
+	var tagSets [][]string
+	config, err := downloadBackupConfigForCleanup(ctx, namespace, backupName, awsID, awsSecret, repository, password)
+	if err != nil {
+		log.Printf("⚠️  Failed to download the config of backup %s; matching its volumes by name: %v", backupName, err)
+	} else {
+		for _, volumeBackup := range config.VolumeBackups {
+			tagSets = append(tagSets, volumeSnapshotTags(namespace, backupName, volumeBackup))
+		}
+	}
+
+	var volumes []find.Snapshot
+	for _, snapshot := range all {
+		if hasTags(snapshot.Tags, []string{"type=vm-config"}) || hasTags(snapshot.Tags, []string{ProtectedTag}) {
+			continue
+		}
+		if config == nil {
+			if strings.HasPrefix(tagValue(snapshot.Tags, "sn="), backupName+"-pvc-") {
+				volumes = append(volumes, snapshot)
+			}
+			continue
+		}
+		for _, tags := range tagSets {
+			if hasTags(snapshot.Tags, tags) {
+				volumes = append(volumes, snapshot)
+				break
+			}
+		}
+	}
+	return volumes
+}
+
+// forgetSnapshots removes the snapshots with the given IDs and prunes the data only they referenced
+func forgetSnapshots(ctx context.Context, namespace string, ids []string, awsID, awsSecret, repository, password string) error {
+	jobSuffix, err := k8s.GenerateJobSuffix()
+	if err != nil {
+		return fmt.Errorf("failed to generate job suffix: %w", err)
+	}
+	replacements := map[string]string{
+		"AWS_ACCESS_KEY_ID":     awsID,
+		"AWS_SECRET_ACCESS_KEY": awsSecret,
+		"RESTIC_REPOSITORY":     repository,
+		"RESTIC_PASSWORD":       password,
+		"SNAPSHOT_ID":           strings.Join(ids, " "),
+	}
+	jobName := "delete-snapshot-" + jobSuffix
+	timeout := 3600 * time.Second
+	if err := k8s.ApplyJob(ctx, manifests.ResticForgetJob, namespace, jobName, timeout, replacements); err != nil {
+		return fmt.Errorf("failed to apply delete job: %w", err)
+	}
+
+	log.Printf("⌛ Removing %d snapshot(s) and pruning the repository...", len(ids))
+	if err := k8s.WaitForJob(ctx, jobName, namespace, timeout); err != nil {
+		return fmt.Errorf("delete job failed: %w", err)
+	}
+	return nil
+}
+
+// tagValue returns the value of the first tag with the given prefix (e.g. "sn="), or "" if there is none
+func tagValue(tags []string, prefix string) string {
+	for _, tag := range tags {
+		if strings.HasPrefix(tag, prefix) {
+			return strings.TrimPrefix(tag, prefix)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,133 @@
+package vm
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/webberhuang/hv-vmbr/pkg/find"
+)
+
+// RunVMRename renames a backup in place: the sn= tag of every volume snapshot is rewritten and the
+// backup config is uploaded again under the new name before the old config snapshot is forgotten.
+// A rename that failed half-way can be run again; volumes already carrying the new tag are skipped.
+// With strict, failing to protect the new config snapshot or to delete the old one is an error.
+func RunVMRename(ctx context.Context, namespace, backupName, newName, awsID, awsSecret, repository, password string, strict bool) error {
+	log.Printf("🔧 Renaming backup %s to %s", backupName, newName)
+
+	snapshots, err := find.RunFind(ctx, namespace, configSnapshotTags(namespace, newName), awsID, awsSecret, repository, password)
+	if err != nil {
+		return fmt.Errorf("failed to check whether backup name %s is in use: %w", newName, err)
+	}
+	if len(snapshots) > 0 {
+		return fmt.Errorf("backup name '%s' is already in use", newName)
+	}
+
+	config, err := downloadBackupConfig(ctx, namespace, backupName, awsID, awsSecret, repository, password)
+	if err != nil {
+		return fmt.Errorf("failed to download backup config: %w", err)
+	}
+
+	oldConfigTags := config.ConfigTags
+	if len(oldConfigTags) == 0 {
+		oldConfigTags = configSnapshotTags(namespace, backupName)
+	}
+	oldConfigSnapshots, err := find.RunFind(ctx, namespace, oldConfigTags, awsID, awsSecret, repository, password)
+	if err != nil {
+		return fmt.Errorf("failed to find the config snapshot of %s: %w", backupName, err)
+	}
+	protected := len(oldConfigSnapshots) > 0 && isProtected(oldConfigSnapshots[0].Tags)
+
+	for i, volumeBackup := range config.VolumeBackups {
+		pvcName := volumeBackup.PersistentVolumeClaim.Name
+		snapshot, err := renameVolumeSnapshot(ctx, volumeBackup, namespace, backupName, newName, awsID, awsSecret, repository, password)
+		if err != nil {
+			return fmt.Errorf("failed to rename snapshot of PVC %s: %w", pvcName, err)
+		}
+		config.VolumeBackups[i].ResticSnapshotID = snapshot.ShortID
+		config.VolumeBackups[i].SnapshotTags = snapshot.Tags
+		log.Printf("✅ Renamed snapshot of PVC %s (new snapshot ID: %s)", pvcName, snapshot.ShortID)
+	}
+
+	config.Name = newName
+	config.ConfigTags = renameTag(oldConfigTags, "sn="+backupName, "sn="+newName)
+	if err := saveBackupConfig(ctx, *config, namespace, awsID, awsSecret, repository, password, strict); err != nil {
+		return fmt.Errorf("failed to save backup config: %w", err)
+	}
+
+	if protected {
+		// The tag is added to the snapshot only; ConfigTags must keep matching after -mode=unprotect
+		if err := setProtected(ctx, namespace, config.ConfigTags, true, awsID, awsSecret, repository, password); err != nil {
+			if err := strictf(strict, "Failed to protect the config snapshot of %s: %v", newName, err); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := deleteVMConfigSnapshot(ctx, namespace, oldConfigTags, awsID, awsSecret, repository, password); err != nil {
+		if err := strictf(strict, "Failed to delete the config snapshot of %s; remove it with -mode=cleanup -backupname %s after checking %s restores: %v", backupName, backupName, newName, err); err != nil {
+			return err
+		}
+	}
+
+	filename := fmt.Sprintf("%s.cfg", backupName)
+	if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+		log.Printf("⚠️  Failed to delete local config file %s: %v", filename, err)
+	}
+
+	log.Printf("✅ Backup %s renamed to %s", backupName, newName)
+	return nil
+}
+
+// renameVolumeSnapshot moves the sn= tag of a volume snapshot to the new backup name and
+// returns the rewritten snapshot
+func renameVolumeSnapshot(ctx context.Context, volumeBackup VolumeBackup, namespace, backupName, newName, awsID, awsSecret, repository, password string) (*find.Snapshot, error) {
+	pvcName := volumeBackup.PersistentVolumeClaim.Name
+	oldTags := volumeSnapshotTags(namespace, backupName, volumeBackup)
+	oldTag := fmt.Sprintf("sn=%s-pvc-%s", backupName, pvcName)
+	newTag := fmt.Sprintf("sn=%s-pvc-%s", newName, pvcName)
+	newTags := renameTag(oldTags, oldTag, newTag)
+
+	snapshots, err := find.RunFind(ctx, namespace, oldTags, awsID, awsSecret, repository, password)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find snapshot: %w", err)
+	}
+	if len(snapshots) == 0 {
+		// Already renamed by an earlier, interrupted run
+		snapshots, err = find.RunFind(ctx, namespace, newTags, awsID, awsSecret, repository, password)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find snapshot: %w", err)
+		}
+		if len(snapshots) == 0 {
+			return nil, fmt.Errorf("snapshot not found with tags: %s", strings.Join(oldTags, ","))
+		}
+		return &snapshots[0], nil
+	}
+
+	if err := tagSnapshot(ctx, namespace, snapshots[0].ShortID, fmt.Sprintf("--remove %s --add %s", oldTag, newTag), awsID, awsSecret, repository, password); err != nil {
+		return nil, err
+	}
+
+	snapshots, err = find.RunFind(ctx, namespace, newTags, awsID, awsSecret, repository, password)
+	if err != nil {
+		return nil, fmt.Errorf("failed to verify snapshot: %w", err)
+	}
+	if len(snapshots) == 0 {
+		return nil, fmt.Errorf("snapshot not found with tags: %s", strings.Join(newTags, ","))
+	}
+	return &snapshots[0], nil
+}
+
+// renameTag returns a copy of tags with oldTag replaced by newTag
+func renameTag(tags []string, oldTag, newTag string) []string {
+	renamed := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		if tag == oldTag {
+			tag = newTag
+		}
+		renamed = append(renamed, tag)
+	}
+	return renamed
+}
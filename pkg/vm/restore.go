@@ -1,16 +1,27 @@
 package vm
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"path"
+	"strings"
 	"time"
 
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/types"
 
 	"github.com/webberhuang/hv-vmbr/pkg/k8s"
@@ -18,14 +29,57 @@ import (
 	"github.com/webberhuang/hv-vmbr/pkg/restore"
 )
 
-// RunVMRestore executes the VM restore workflow
-func RunVMRestore(namespace, vmName, backupName, awsID, awsSecret, repository, password string) {
+// Restored PVCs are labeled with the ID of the restore and annotated with the PVC they were restored
+// from, and marked restored once their data is written, so that -resume can pick up where an
+// interrupted restore stopped.
+const (
+	restoreIDLabel      = "hv-vmbr/restore-id"
+	sourcePVCAnnotation = "hv-vmbr/source-pvc"
+	restoredAnnotation  = "hv-vmbr/restored"
+)
+
+// RunVMRestore executes the VM restore workflow. If it fails, e.g. at the -deadline, after
+// creating the VM but before the VM is complete, the VM is deleted again so the restore can be
+// resumed.
+func RunVMRestore(ctx context.Context, namespace, vmName, backupName, awsID, awsSecret, repository, password string, opts RestoreOptions) (err error) {
 	log.Printf("🔧 Starting VM restore for backup: %s", backupName)
 
+	if opts.StorageClass != "" {
+		if _, err := k8s.Clientset.StorageV1().StorageClasses().Get(context.Background(), opts.StorageClass, metav1.GetOptions{}); err != nil {
+			if apierrors.IsNotFound(err) {
+				return fmt.Errorf("StorageClass %s does not exist in the target cluster", opts.StorageClass)
+			}
+			return fmt.Errorf("failed to get StorageClass %s: %w", opts.StorageClass, err)
+		}
+		log.Printf("💾 Restoring volumes with StorageClass %s", opts.StorageClass)
+	}
+
+	if _, err := k8s.Clientset.CoreV1().Namespaces().Get(context.Background(), namespace, metav1.GetOptions{}); err != nil {
+		if apierrors.IsNotFound(err) {
+			return fmt.Errorf("target namespace %s does not exist; create it or add -create-namespace", namespace)
+		}
+		return fmt.Errorf("failed to get namespace %s: %w", namespace, err)
+	}
+	sourceNamespace := namespace
+	if opts.SourceNamespace != "" {
+		sourceNamespace = opts.SourceNamespace
+		log.Printf("🔀 Restoring backup taken in namespace %s into namespace %s", sourceNamespace, namespace)
+	}
+
 	// Step 1: Download and parse backup config from restic
-	backupConfig, err := downloadBackupConfig(namespace, backupName, awsID, awsSecret, repository, password)
+	backupConfig, err := downloadBackupConfigFrom(ctx, namespace, sourceNamespace, backupName, awsID, awsSecret, repository, password)
 	if err != nil {
-		log.Fatalf("❌ Failed to download backup config: %v", err)
+		return fmt.Errorf("failed to download backup config: %w", err)
+	}
+
+	if err := checkResize(backupConfig, opts.Resize); err != nil {
+		return fmt.Errorf("invalid -resize: %w", err)
+	}
+
+	// Volume data lives in the repository recorded at backup time. It matches the one the
+	// config was just downloaded from, unless the repository was moved since.
+	if backupConfig.Repository != "" && backupConfig.Repository != repository {
+		log.Printf("⚠️  Backup was recorded in repository %s; reading volume data from %s", k8s.RedactRepository(backupConfig.Repository), k8s.RedactRepository(repository))
 	}
 
 	// Step 2: Update namespace and VM name if different
@@ -36,9 +90,38 @@ func RunVMRestore(namespace, vmName, backupName, awsID, awsSecret, repository, p
 		vmName = backupConfig.VMSourceSpec.Metadata.Name
 	}
 	backupConfig.VMSourceSpec.Metadata.Namespace = namespace
+	backupConfig.VMSourceSpec.Metadata.Annotations = mergeAnnotations(backupConfig.VMSourceSpec.Metadata.Annotations, opts.Annotations)
+
+	restoreID := restoreIDFor(namespace, backupName, vmName)
+	if opts.Resume {
+		log.Printf("🔁 Resuming restore %s", restoreID)
+		_, err := k8s.DynamicClient.Resource(VMGVR).Namespace(namespace).Get(context.Background(), vmName, metav1.GetOptions{})
+		if err == nil {
+			return fmt.Errorf("VM %s/%s already exists; the interrupted restore got past creating it and cannot be resumed", namespace, vmName)
+		}
+		if !apierrors.IsNotFound(err) {
+			return fmt.Errorf("failed to check for VM %s/%s: %w", namespace, vmName, err)
+		}
+	}
+
+	if opts.DryRun {
+		return planRestore(ctx, backupConfig, namespace, vmName, backupName, restoreID, awsID, awsSecret, repository, password, opts)
+	}
+
+	if opts.CopyNamespaceLabels {
+		if err := copyNamespaceLabels(ctx, backupConfig, namespace); err != nil {
+			return err
+		}
+	}
+
+	// Record disk order, boot order and disk-to-PVC bindings so they can be checked after the rewrite
+	originalDisks := diskBindings(backupConfig.VMSourceSpec.Spec)
 
 	// Step 3: Create new PVCs and restore data
-	pvcMapping := restoreVolumes(backupConfig, namespace, backupName, awsID, awsSecret, repository, password)
+	pvcMapping, err := restoreVolumes(ctx, backupConfig, namespace, backupName, restoreID, awsID, awsSecret, repository, password, opts)
+	if err != nil {
+		return err
+	}
 	log.Printf("✅ Restored %d volume(s)", len(pvcMapping))
 
 	// Step 4: Generate secret names mapping (but don't create them yet)
@@ -46,22 +129,95 @@ func RunVMRestore(namespace, vmName, backupName, awsID, awsSecret, repository, p
 
 	// Step 5: Update VM spec with new PVC and secret names
 	updatedVMSpec := updateVMSpec(backupConfig.VMSourceSpec, pvcMapping, secretMapping)
+	if err := verifyDiskBindings(originalDisks, diskBindings(updatedVMSpec.Spec), pvcMapping); err != nil {
+		return fmt.Errorf("disk ordering was not preserved: %w", err)
+	}
+
+	// Recreate missing SSH KeyPairs and drop sshNames references that cannot be resolved
+	if err := restoreKeyPairs(backupConfig, namespace, opts.Strict); err != nil {
+		return err
+	}
+
+	// Warn about Multus networks and SR-IOV resources the target cluster does not provide
+	if err := checkNetworks(backupConfig, namespace, opts.Strict); err != nil {
+		return err
+	}
 
 	// Step 6: Create the VM first
-	vmUID, err := createVM(updatedVMSpec, namespace)
+	if opts.KeepMAC {
+		if err := checkMACConflict(backupConfig, opts.Strict); err != nil {
+			return err
+		}
+	}
+	createdVM, err := createVM(updatedVMSpec, namespace, opts)
 	if err != nil {
-		log.Fatalf("❌ Failed to create VM: %v", err)
+		return fmt.Errorf("failed to create VM: %w", err)
+	}
+	complete := false
+	defer func() {
+		if err != nil && !complete {
+			rollbackVM(ctx, namespace, vmName)
+		}
+	}()
+	if err := verifyDiskBindings(originalDisks, diskBindings(createdVM.Object["spec"]), pvcMapping); err != nil {
+		return fmt.Errorf("disk ordering of created VM %s differs from the backup: %w", vmName, err)
 	}
+	vmUID := string(createdVM.GetUID())
 
 	// Step 7: Now restore secrets with owner reference to the VM
-	restoreSecretsWithOwner(backupConfig, namespace, vmName, vmUID, secretMapping)
+	if err := restoreSecretsWithOwner(backupConfig, namespace, vmName, vmUID, secretMapping, opts); err != nil {
+		return err
+	}
 	log.Printf("✅ Restored %d secret(s)", len(secretMapping))
 
+	// Step 8: Recreate the other resources the source VM owned
+	if len(backupConfig.OwnedResources) > 0 {
+		if err := restoreOwnedResources(backupConfig, namespace, vmOwnerReference(vmName, vmUID), opts); err != nil {
+			return err
+		}
+	}
+
+	// Step 9: Start the VM only now that everything it references exists
+	if opts.Start {
+		if err := startVM(ctx, namespace, vmName); err != nil {
+			return fmt.Errorf("failed to start VM: %w", err)
+		}
+	}
+	complete = true
+
+	if opts.VerifyBoot > 0 {
+		if err := waitForGuestAgent(ctx, namespace, vmName, opts.VerifyBoot); err != nil {
+			k8s.RecordEvent(createdVM, corev1.EventTypeWarning, "RestoreBootFailed", err.Error())
+			return err
+		}
+	}
+
 	log.Printf("✅ VM restore completed successfully: %s/%s", namespace, vmName)
+	k8s.RecordEvent(createdVM, corev1.EventTypeNormal, "RestoreCompleted", fmt.Sprintf("Restored from backup %s with %d volume(s)", backupName, len(pvcMapping)))
+	return nil
+}
+
+// rollbackVM deletes the VM of a failed restore. The cluster garbage-collects the secrets and
+// owned resources restored with an owner reference to it; the restored PVCs are kept for -resume.
+func rollbackVM(ctx context.Context, namespace, vmName string) {
+	propagation := metav1.DeletePropagationBackground
+	// Roll back even when the restore was interrupted or ran past the deadline
+	err := k8s.DynamicClient.Resource(VMGVR).Namespace(namespace).Delete(context.WithoutCancel(ctx), vmName, metav1.DeleteOptions{PropagationPolicy: &propagation})
+	if err != nil && !apierrors.IsNotFound(err) {
+		log.Printf("⚠️  Failed to delete VM %s/%s of the failed restore; delete it before rerunning the restore with -resume: %v", namespace, vmName, err)
+		return
+	}
+	log.Printf("↩️  Deleted VM %s/%s of the failed restore; the restored PVCs are kept, so rerun the restore with -resume to continue", namespace, vmName)
 }
 
 // downloadBackupConfig downloads the backup config from restic
-func downloadBackupConfig(namespace, backupName, awsID, awsSecret, repository, password string) (*VMBackupConfig, error) {
+func downloadBackupConfig(ctx context.Context, namespace, backupName, awsID, awsSecret, repository, password string) (*VMBackupConfig, error) {
+	return downloadBackupConfigFrom(ctx, namespace, namespace, backupName, awsID, awsSecret, repository, password)
+}
+
+// downloadBackupConfigFrom downloads the config of a backup taken in sourceNamespace with a job
+// in namespace
+func downloadBackupConfigFrom(ctx context.Context, namespace, sourceNamespace, backupName, awsID, awsSecret, repository, password string) (*VMBackupConfig, error) {
 	jobSuffix, err := k8s.GenerateJobSuffix()
 	if err != nil {
 		return nil, fmt.Errorf("failed to generate job suffix: %w", err)
@@ -73,15 +229,17 @@ func downloadBackupConfig(namespace, backupName, awsID, awsSecret, repository, p
 		"RESTIC_REPOSITORY":     repository,
 		"RESTIC_PASSWORD":       password,
 		"BACKUP_NAME":           backupName,
+		"BACKUP_NAMESPACE":      sourceNamespace,
 	}
 
 	jobName := "vm-restore-config-" + jobSuffix
-	if err := k8s.ApplyManifest(manifests.VMRestoreConfigJob, namespace, jobName, replacements); err != nil {
+	timeout := 60 * time.Second
+	if err := k8s.ApplyJob(ctx, manifests.VMRestoreConfigJob, namespace, jobName, timeout, replacements); err != nil {
 		return nil, fmt.Errorf("failed to apply restore config job: %w", err)
 	}
 
 	log.Println("⌛ Downloading VM config from restic...")
-	if err := k8s.WaitForJob(jobName, namespace, 60*time.Second); err != nil {
+	if err := k8s.WaitForJob(ctx, jobName, namespace, timeout); err != nil {
 		return nil, fmt.Errorf("restore config job failed: %w", err)
 	}
 
@@ -101,79 +259,230 @@ func downloadBackupConfig(namespace, backupName, awsID, awsSecret, repository, p
 	return &config, nil
 }
 
-// restoreSecrets restores secrets and returns a mapping of old names to new names
-func restoreSecrets(config *VMBackupConfig, namespace string) map[string]string {
-	secretMapping := make(map[string]string)
+// restoreVolumes restores all volumes and returns a mapping of old PVC names to new PVC names
+func restoreVolumes(ctx context.Context, config *VMBackupConfig, namespace, backupName, restoreID, awsID, awsSecret, repository, password string, opts RestoreOptions) (map[string]string, error) {
+	pvcMapping := make(map[string]string)
+	var corrupted []string
 
-	for _, secretBackup := range config.SecretBackups {
-		// Generate new secret name
-		newSecretName := fmt.Sprintf("%s-%s", secretBackup.Name, generateRandomSuffix(5))
+	var previous map[string]*corev1.PersistentVolumeClaim
+	if opts.Resume {
+		var err error
+		previous, err = previouslyRestoredPVCs(namespace, restoreID)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-		// Convert base64 strings back to binary data
-		dataMap := make(map[string][]byte)
-		for k, v := range secretBackup.Data {
-			decoded, err := base64.StdEncoding.DecodeString(v)
+	for _, volumeBackup := range config.VolumeBackups {
+		oldPVCName := volumeBackup.PersistentVolumeClaim.Name
+
+		if pvc, ok := previous[oldPVCName]; ok && pvc.Annotations[restoredAnnotation] == "true" {
+			pvcMapping[oldPVCName] = pvc.Name
+			log.Printf("⏭️  Volume %s was already restored into PVC %s", oldPVCName, pvc.Name)
+			continue
+		}
+
+		var newPVCName string
+		if pvc, ok := previous[oldPVCName]; ok {
+			// The PVC was created but its data may be incomplete; restoring overwrites the whole device
+			newPVCName = pvc.Name
+			log.Printf("🔁 Restoring volume again into existing PVC: %s -> %s", oldPVCName, newPVCName)
+		} else {
+			newPVCName = fmt.Sprintf("%s-%s", oldPVCName, generateRandomSuffix(5))
+
+			log.Printf("📦 Restoring volume: %s -> %s", oldPVCName, newPVCName)
+
+			// Create new PVC with cleaned metadata
+			newPVC := createCleanPVC(&volumeBackup.PersistentVolumeClaim, newPVCName, namespace, opts.StorageClass)
+			newPVC.Annotations = mergeAnnotations(newPVC.Annotations, opts.Annotations)
+			if newPVC.Annotations == nil {
+				newPVC.Annotations = map[string]string{}
+			}
+			newPVC.Annotations[sourcePVCAnnotation] = oldPVCName
+			if newPVC.Labels == nil {
+				newPVC.Labels = map[string]string{}
+			}
+			newPVC.Labels[restoreIDLabel] = restoreID
+			if size, ok := opts.Resize[oldPVCName]; ok {
+				log.Printf("📏 Resizing PVC %s from %s to %s", newPVCName, newPVC.Spec.Resources.Requests.Storage().String(), size.String())
+				if newPVC.Spec.Resources.Requests == nil {
+					newPVC.Spec.Resources.Requests = corev1.ResourceList{}
+				}
+				newPVC.Spec.Resources.Requests[corev1.ResourceStorage] = size
+			}
+			requestDeviceSize(newPVC, volumeBackup.DeviceSize)
+
+			_, err := k8s.Clientset.CoreV1().PersistentVolumeClaims(namespace).Create(context.Background(), newPVC, metav1.CreateOptions{})
 			if err != nil {
-				log.Printf("⚠️  Failed to decode secret data for %s: %v", k, err)
-				continue
+				return nil, fmt.Errorf("failed to create PVC %s: %w", newPVCName, err)
 			}
-			dataMap[k] = decoded
+
+			log.Printf("✅ PVC %s created successfully", newPVCName)
 		}
 
-		// Create the secret
-		secret := &corev1.Secret{
-			ObjectMeta: metav1.ObjectMeta{
-				Name:      newSecretName,
-				Namespace: namespace,
-			},
-			Data: dataMap,
+		if err := verifyVolumeMode(volumeBackup, newPVCName, namespace); err != nil {
+			return nil, err
 		}
 
-		_, err := k8s.Clientset.CoreV1().Secrets(namespace).Create(context.Background(), secret, metav1.CreateOptions{})
-		if err != nil {
-			log.Printf("⚠️  Failed to create secret %s: %v", newSecretName, err)
+		// Restore the data. A volume the repository lacks data of does not stop the other volumes,
+		// so a single restore reports every damaged one.
+		if err := restoreVolumeData(ctx, volumeBackup, newPVCName, namespace, backupName, oldPVCName, awsID, awsSecret, repository, password); err != nil {
+			if !errors.Is(err, restore.ErrRepoCorruption) {
+				return nil, err
+			}
+			log.Printf("❌ Volume %s: %v", oldPVCName, err)
+			corrupted = append(corrupted, oldPVCName)
 			continue
 		}
+		if err := markPVCRestored(namespace, newPVCName); err != nil {
+			log.Printf("⚠️  Failed to mark PVC %s as restored; -resume would restore it again: %v", newPVCName, err)
+		}
 
-		secretMapping[secretBackup.Name] = newSecretName
-		log.Printf("📝 Restored secret: %s -> %s", secretBackup.Name, newSecretName)
+		pvcMapping[oldPVCName] = newPVCName
+		log.Printf("✅ Volume restored: %s -> %s", oldPVCName, newPVCName)
 	}
 
-	return secretMapping
+	if len(corrupted) > 0 {
+		return nil, fmt.Errorf("the repository is missing data of volume(s) %s; the VM was not created. The restored PVCs are kept, so once the repository is repaired, rerun the restore with -resume", strings.Join(corrupted, ", "))
+	}
+	return pvcMapping, nil
 }
 
-// restoreVolumes restores all volumes and returns a mapping of old PVC names to new PVC names
-func restoreVolumes(config *VMBackupConfig, namespace, backupName, awsID, awsSecret, repository, password string) map[string]string {
-	pvcMapping := make(map[string]string)
+// restoreIDFor identifies the restore of a backup as a VM name in a namespace, so that running the
+// same restore again yields the same ID
+func restoreIDFor(namespace, backupName, vmName string) string {
+	sum := sha256.Sum256([]byte(namespace + "/" + backupName + "/" + vmName))
+	return hex.EncodeToString(sum[:8])
+}
 
-	for _, volumeBackup := range config.VolumeBackups {
-		oldPVCName := volumeBackup.PersistentVolumeClaim.Name
-		newPVCName := fmt.Sprintf("%s-%s", oldPVCName, generateRandomSuffix(5))
+// previouslyRestoredPVCs returns the PVCs labeled with restoreID by the backed up PVC they were
+// restored from. When an earlier run created several for the same PVC, one that was fully
+// restored is preferred.
+func previouslyRestoredPVCs(namespace, restoreID string) (map[string]*corev1.PersistentVolumeClaim, error) {
+	selector := labels.SelectorFromSet(labels.Set{restoreIDLabel: restoreID}).String()
+	pvcs, err := k8s.Clientset.CoreV1().PersistentVolumeClaims(namespace).List(context.Background(), metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list PVCs of restore %s: %w", restoreID, err)
+	}
 
-		log.Printf("📦 Restoring volume: %s -> %s", oldPVCName, newPVCName)
+	previous := make(map[string]*corev1.PersistentVolumeClaim)
+	for i := range pvcs.Items {
+		pvc := &pvcs.Items[i]
+		source := pvc.Annotations[sourcePVCAnnotation]
+		if source == "" || pvc.DeletionTimestamp != nil {
+			continue
+		}
+		if existing, ok := previous[source]; ok && existing.Annotations[restoredAnnotation] == "true" {
+			continue
+		}
+		previous[source] = pvc
+	}
+	log.Printf("🔍 Found %d PVC(s) from the interrupted restore", len(previous))
+	return previous, nil
+}
 
-		// Create new PVC with cleaned metadata
-		newPVC := createCleanPVC(&volumeBackup.PersistentVolumeClaim, newPVCName, namespace)
+// markPVCRestored records on a PVC that its data was restored completely
+func markPVCRestored(namespace, pvcName string) error {
+	patch := []byte(fmt.Sprintf(`{"metadata":{"annotations":{%q:"true"}}}`, restoredAnnotation))
+	_, err := k8s.Clientset.CoreV1().PersistentVolumeClaims(namespace).Patch(context.Background(), pvcName, types.MergePatchType, patch, metav1.PatchOptions{})
+	return err
+}
 
-		_, err := k8s.Clientset.CoreV1().PersistentVolumeClaims(namespace).Create(context.Background(), newPVC, metav1.CreateOptions{})
-		if err != nil {
-			log.Fatalf("❌ Failed to create PVC %s: %v", newPVCName, err)
+// checkResize rejects -resize entries naming a PVC that is not in the backup or shrinking one
+// below its backed up size, before anything is restored.
+func checkResize(config *VMBackupConfig, sizes map[string]resource.Quantity) error {
+	for pvcName, size := range sizes {
+		found := false
+		for _, volumeBackup := range config.VolumeBackups {
+			if volumeBackup.PersistentVolumeClaim.Name != pvcName {
+				continue
+			}
+			found = true
+			if size.Value() < volumeBackup.VolumeSize {
+				return fmt.Errorf("PVC %s was backed up at %d bytes and cannot be restored smaller (%s)", pvcName, volumeBackup.VolumeSize, size.String())
+			}
+		}
+		if !found {
+			return fmt.Errorf("backup has no PVC named %s", pvcName)
 		}
+	}
+	return nil
+}
 
-		log.Printf("✅ PVC %s created successfully", newPVCName)
+// deviceSizeUnit is the granularity requestDeviceSize rounds requests up to. CSI drivers
+// allocate volumes in units of at least this size, and some reject requests that are not.
+const deviceSizeUnit = 1 << 20
 
-		// Restore the data
-		restoreVolumeData(volumeBackup, newPVCName, namespace, backupName, oldPVCName, awsID, awsSecret, repository, password)
+// requestDeviceSize raises the storage request of pvc to deviceSize, rounded up to a whole
+// deviceSizeUnit, when the backed up device was larger than its PVC requested (some CSI
+// drivers round volumes up), so the data fits.
+func requestDeviceSize(pvc *corev1.PersistentVolumeClaim, deviceSize int64) {
+	request := pvc.Spec.Resources.Requests.Storage()
+	if deviceSize <= request.Value() {
+		return
+	}
+	size := resource.NewQuantity((deviceSize+deviceSizeUnit-1)/deviceSizeUnit*deviceSizeUnit, resource.BinarySI)
+	log.Printf("📏 Requesting %s (%d bytes) for PVC %s instead of %s to fit the %d byte device that was backed up", size.String(), size.Value(), pvc.Name, request.String(), deviceSize)
+	if pvc.Spec.Resources.Requests == nil {
+		pvc.Spec.Resources.Requests = corev1.ResourceList{}
+	}
+	pvc.Spec.Resources.Requests[corev1.ResourceStorage] = *size
+}
 
-		pvcMapping[oldPVCName] = newPVCName
-		log.Printf("✅ Volume restored: %s -> %s", oldPVCName, newPVCName)
+// verifyVolumeSize checks that the restored PVC is at least as large as the backed up volume, so
+// the block image is not cut short. The PVC's capacity counts once it is bound, its storage
+// request before that.
+func verifyVolumeSize(volumeBackup VolumeBackup, pvcName, namespace string) error {
+	if volumeBackup.VolumeSize == 0 {
+		return nil
+	}
+	pvc, err := k8s.Clientset.CoreV1().PersistentVolumeClaims(namespace).Get(context.Background(), pvcName, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to get PVC %s: %w", pvcName, err)
+	}
+	size, ok := pvc.Status.Capacity[corev1.ResourceStorage]
+	if !ok {
+		request, err := k8s.GetPVCStorageSize(pvcName, namespace)
+		if err != nil {
+			return fmt.Errorf("failed to get size of PVC %s: %w", pvcName, err)
+		}
+		if size, err = resource.ParseQuantity(request); err != nil {
+			return fmt.Errorf("failed to parse size of PVC %s: %w", pvcName, err)
+		}
 	}
+	if size.Value() < volumeBackup.VolumeSize {
+		return fmt.Errorf("PVC %s is %s but the backed up volume was %s; the restored data would not fit", pvcName, size.String(), resource.NewQuantity(volumeBackup.VolumeSize, resource.BinarySI).String())
+	}
+	return nil
+}
 
-	return pvcMapping
+// verifyVolumeMode checks that the recreated PVC has the volume mode recorded at backup time.
+// Backups taken before the volume mode was recorded fall back to the mode in the saved PVC spec.
+func verifyVolumeMode(volumeBackup VolumeBackup, pvcName, namespace string) error {
+	expected := volumeBackup.VolumeMode
+	if expected == "" {
+		expected = string(corev1.PersistentVolumeFilesystem)
+		if mode := volumeBackup.PersistentVolumeClaim.Spec.VolumeMode; mode != nil {
+			expected = string(*mode)
+		}
+	}
+
+	actual, err := k8s.GetPVCVolumeMode(pvcName, namespace)
+	if err != nil {
+		return fmt.Errorf("failed to get volume mode of PVC %s: %w", pvcName, err)
+	}
+	if actual != expected {
+		return fmt.Errorf("volume mode mismatch for PVC %s: backup was taken from a %s volume but the restored PVC is %s", pvcName, expected, actual)
+	}
+	if actual != string(corev1.PersistentVolumeBlock) {
+		return fmt.Errorf("PVC %s has volume mode %s; only Block volumes can be restored", pvcName, actual)
+	}
+	return nil
 }
 
-// createCleanPVC creates a new PVC with all CDI and binding metadata removed
-func createCleanPVC(sourcePVC *corev1.PersistentVolumeClaim, newName, namespace string) *corev1.PersistentVolumeClaim {
+// createCleanPVC creates a new PVC with all CDI and binding metadata removed, using
+// storageClass instead of the source PVC's StorageClass when it is set
+func createCleanPVC(sourcePVC *corev1.PersistentVolumeClaim, newName, namespace, storageClass string) *corev1.PersistentVolumeClaim {
 	newPVC := sourcePVC.DeepCopy()
 	newPVC.Name = newName
 	newPVC.Namespace = namespace
@@ -190,6 +499,10 @@ func createCleanPVC(sourcePVC *corev1.PersistentVolumeClaim, newName, namespace
 	// Clear the old PV binding - this is critical!
 	newPVC.Spec.VolumeName = ""
 
+	if storageClass != "" {
+		newPVC.Spec.StorageClassName = &storageClass
+	}
+
 	// Clear dataSource and dataSourceRef to prevent CDI from managing this PVC
 	newPVC.Spec.DataSource = nil
 	newPVC.Spec.DataSourceRef = nil
@@ -238,6 +551,10 @@ func cleanPVCAnnotations(pvc *corev1.PersistentVolumeClaim) {
 	// Storage provisioner annotations
 	delete(pvc.Annotations, "volume.beta.kubernetes.io/storage-provisioner")
 	delete(pvc.Annotations, "volume.kubernetes.io/storage-provisioner")
+
+	// Progress markers of the restore that created the backed up PVC, if any
+	delete(pvc.Annotations, sourcePVCAnnotation)
+	delete(pvc.Annotations, restoredAnnotation)
 }
 
 // cleanPVCLabels removes CDI-related labels
@@ -249,10 +566,11 @@ func cleanPVCLabels(pvc *corev1.PersistentVolumeClaim) {
 	delete(pvc.Labels, "app")
 	delete(pvc.Labels, "app.kubernetes.io/component")
 	delete(pvc.Labels, "app.kubernetes.io/managed-by")
+	delete(pvc.Labels, restoreIDLabel)
 }
 
 // restoreVolumeData restores the actual volume data using restic
-func restoreVolumeData(volumeBackup VolumeBackup, newPVCName, namespace, backupName, oldPVCName, awsID, awsSecret, repository, password string) {
+func restoreVolumeData(ctx context.Context, volumeBackup VolumeBackup, newPVCName, namespace, backupName, oldPVCName, awsID, awsSecret, repository, password string) error {
 	// Get the source PV name from the backup
 	sourcePV := volumeBackup.PersistentVolumeClaim.Spec.VolumeName
 	sourceNs := volumeBackup.PersistentVolumeClaim.Namespace
@@ -260,8 +578,12 @@ func restoreVolumeData(volumeBackup VolumeBackup, newPVCName, namespace, backupN
 	// The tag format is: {backupName}-pvc-{oldPVCName}
 	snapshotTag := fmt.Sprintf("%s-pvc-%s", backupName, oldPVCName)
 
+	if err := verifyVolumeSize(volumeBackup, newPVCName, namespace); err != nil {
+		return err
+	}
+
 	// Restore the data using existing restore functionality
-	restore.RunRestore(namespace, newPVCName, sourceNs, sourcePV, snapshotTag, awsID, awsSecret, repository, password)
+	return restore.RunRestore(ctx, namespace, newPVCName, sourceNs, sourcePV, snapshotTag, volumeBackup.DeviceSize, volumeBackup.Checksum, awsID, awsSecret, repository, password)
 }
 
 // updateVMSpec updates the VM spec with new PVC and secret names
@@ -280,12 +602,14 @@ func updateVMSpec(vmSpec VMSpec, pvcMapping, secretMapping map[string]string) VM
 		return vmSpec
 	}
 
+	updateSecretReferences(templateSpec, secretMapping)
+
 	volumes, ok := templateSpec["volumes"].([]interface{})
 	if !ok {
 		return vmSpec
 	}
 
-	// Update PVC and secret references
+	// Update PVC references
 	for _, vol := range volumes {
 		volume, ok := vol.(map[string]interface{})
 		if !ok {
@@ -293,7 +617,6 @@ func updateVMSpec(vmSpec VMSpec, pvcMapping, secretMapping map[string]string) VM
 		}
 
 		updatePVCReference(volume, pvcMapping)
-		updateSecretReferences(volume, secretMapping)
 	}
 
 	return vmSpec
@@ -317,56 +640,51 @@ func updatePVCReference(volume map[string]interface{}, pvcMapping map[string]str
 	}
 }
 
-// updateSecretReferences updates secret references in cloudInitNoCloud volume
-func updateSecretReferences(volume map[string]interface{}, secretMapping map[string]string) {
-	cloudInit, found := volume["cloudInitNoCloud"].(map[string]interface{})
-	if !found {
-		return
-	}
-
-	updateSecretRef(cloudInit, "secretRef", secretMapping, true)
-	updateSecretRef(cloudInit, "networkDataSecretRef", secretMapping, false)
-}
-
-// updateSecretRef updates a single secret reference field
-func updateSecretRef(cloudInit map[string]interface{}, fieldName string, secretMapping map[string]string, logUpdate bool) {
-	secretRef, found := cloudInit[fieldName].(map[string]interface{})
-	if !found {
-		return
-	}
-
-	oldName, ok := secretRef["name"].(string)
-	if !ok {
-		return
-	}
-
-	if newName, exists := secretMapping[oldName]; exists {
-		secretRef["name"] = newName
-		if logUpdate {
+// updateSecretReferences updates every secret reference in the VM template spec
+func updateSecretReferences(templateSpec map[string]interface{}, secretMapping map[string]string) {
+	for _, ref := range templateSecretRefs(templateSpec) {
+		oldName := ref.name()
+		if newName, exists := secretMapping[oldName]; exists {
+			ref.holder[ref.field] = newName
 			log.Printf("📝 Updated secret reference: %s -> %s", oldName, newName)
 		}
 	}
 }
 
-// createVM creates the VirtualMachine resource
-func createVM(vmSpec VMSpec, namespace string) (string, error) {
+// createVM creates the VirtualMachine resource and returns the created object.
+// Interfaces named in macAddresses get that MAC; all others have their MAC cleared.
+// The VM is always created Halted; with opts.Start, startVM boots it once its secrets and owned
+// resources exist.
+func createVM(vmSpec VMSpec, namespace string, opts RestoreOptions) (*unstructured.Unstructured, error) {
 	// Delete the harvesterhci.io/volumeClaimTemplates annotation if present
 	if vmSpec.Metadata.Annotations != nil {
-		delete(vmSpec.Metadata.Annotations, "harvesterhci.io/volumeClaimTemplates")
-		log.Println("📝 Removed harvesterhci.io/volumeClaimTemplates annotation")
+		removeAnnotation(vmSpec.Metadata.Annotations, "harvesterhci.io/volumeClaimTemplates", opts.PreserveAnnotations)
 
-		// Remove the harvesterhci.io/mac-address annotation if present
-		delete(vmSpec.Metadata.Annotations, "harvesterhci.io/mac-address")
-		log.Println("📝 Removed harvesterhci.io/mac-address annotation")
+		// Remove the harvesterhci.io/mac-address annotation if present, unless the MACs are kept
+		if !opts.KeepMAC {
+			removeAnnotation(vmSpec.Metadata.Annotations, "harvesterhci.io/mac-address", opts.PreserveAnnotations)
+		}
+
+		// The source cluster's IPs would confuse IPAM on the restored VM
+		removeAnnotation(vmSpec.Metadata.Annotations, ipsAnnotation, opts.PreserveAnnotations)
 	}
 
-	// Clear MAC addresses for all network interfaces
-	clearMACAddresses(&vmSpec)
+	// Clear MAC addresses for all network interfaces unless one is given explicitly or they are kept
+	reused, err := clearMACAddresses(&vmSpec, opts.MACAddresses, opts.KeepMAC, opts.Strict)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Start && !opts.KeepMAC && len(reused) > 0 {
+		if err := strictf(opts.Strict, "Starting the restored VM with the original MAC address on interface(s) %s; it collides with the source VM if both run on the same network", strings.Join(reused, ", ")); err != nil {
+			return nil, err
+		}
+	}
 
-	// Set runStrategy to Halted for the restored VM
 	if specMap, ok := vmSpec.Spec.(map[string]interface{}); ok {
+		// KubeVirt rejects a spec setting both the deprecated running field and runStrategy
+		delete(specMap, "running")
 		specMap["runStrategy"] = "Halted"
-		log.Println("📝 Set runStrategy to Halted")
+		log.Printf("📝 Set runStrategy to Halted")
 	}
 
 	// Construct the VM object
@@ -387,58 +705,124 @@ func createVM(vmSpec VMSpec, namespace string) (string, error) {
 	// Create the VM
 	createdVM, err := k8s.DynamicClient.Resource(VMGVR).Namespace(namespace).Create(context.Background(), vmObj, metav1.CreateOptions{})
 	if err != nil {
-		return "", fmt.Errorf("failed to create VirtualMachine: %w", err)
+		return nil, fmt.Errorf("failed to create VirtualMachine: %w", err)
 	}
 
-	vmUID := string(createdVM.GetUID())
 	log.Printf("✅ VirtualMachine created: %s/%s", namespace, vmSpec.Metadata.Name)
-	return vmUID, nil
+	return createdVM, nil
+}
+
+// startVM sets the runStrategy of the VM to RerunOnFailure so it boots
+func startVM(ctx context.Context, namespace, vmName string) error {
+	patch := []byte(`{"spec":{"runStrategy":"RerunOnFailure"}}`)
+	if _, err := k8s.DynamicClient.Resource(VMGVR).Namespace(namespace).Patch(ctx, vmName, types.MergePatchType, patch, metav1.PatchOptions{}); err != nil {
+		return fmt.Errorf("failed to set runStrategy of VM %s/%s: %w", namespace, vmName, err)
+	}
+	log.Printf("▶️  Started VM %s/%s with runStrategy RerunOnFailure", namespace, vmName)
+	return nil
 }
 
-// clearMACAddresses clears MAC addresses for all network interfaces in the VM spec
-func clearMACAddresses(vmSpec *VMSpec) {
+// removeAnnotation deletes the annotation key unless it matches one of the preserve patterns
+func removeAnnotation(annotations map[string]string, key string, preserve []string) {
+	if _, ok := annotations[key]; !ok {
+		return
+	}
+	for _, pattern := range preserve {
+		if matched, _ := path.Match(pattern, key); matched {
+			log.Printf("📝 Preserved %s annotation", key)
+			return
+		}
+	}
+	delete(annotations, key)
+	log.Printf("📝 Removed %s annotation", key)
+}
+
+// clearMACAddresses clears MAC addresses for all network interfaces in the VM spec,
+// except that interfaces named in macAddresses are set to the given MAC. With keep, the other
+// interfaces keep their MAC instead. It returns the interfaces that were set to the MAC address
+// they had in the backup, or an error under -strict if an interface of macAddresses is missing.
+func clearMACAddresses(vmSpec *VMSpec, macAddresses map[string]string, keep, strict bool) ([]string, error) {
 	specMap, ok := vmSpec.Spec.(map[string]interface{})
 	if !ok {
-		return
+		return nil, nil
 	}
 
 	template, ok := specMap["template"].(map[string]interface{})
 	if !ok {
-		return
+		return nil, nil
 	}
 
 	templateSpec, ok := template["spec"].(map[string]interface{})
 	if !ok {
-		return
+		return nil, nil
 	}
 
 	domain, ok := templateSpec["domain"].(map[string]interface{})
 	if !ok {
-		return
+		return nil, nil
 	}
 
 	devices, ok := domain["devices"].(map[string]interface{})
 	if !ok {
-		return
+		return nil, nil
 	}
 
 	interfaces, ok := devices["interfaces"].([]interface{})
 	if !ok {
-		return
+		return nil, nil
 	}
 
 	// Clear MAC address for each interface
+	assigned := map[string]bool{}
+	var reused []string
 	for i, iface := range interfaces {
 		ifaceMap, ok := iface.(map[string]interface{})
 		if !ok {
 			continue
 		}
 
+		name, _ := ifaceMap["name"].(string)
+		if mac, ok := macAddresses[name]; ok {
+			if original, _ := ifaceMap["macAddress"].(string); strings.EqualFold(original, mac) {
+				reused = append(reused, name)
+			}
+			ifaceMap["macAddress"] = mac
+			assigned[name] = true
+			log.Printf("📝 Set MAC address of interface %s to %s", name, mac)
+			continue
+		}
+
+		if keep {
+			continue
+		}
 		if _, hasMac := ifaceMap["macAddress"]; hasMac {
 			ifaceMap["macAddress"] = ""
 			log.Printf("📝 Cleared MAC address for interface[%d]", i)
 		}
 	}
+
+	for name := range macAddresses {
+		if !assigned[name] {
+			if err := strictf(strict, "VM has no interface %s to set a MAC address on", name); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return reused, nil
+}
+
+// checkMACConflict warns that the restored VM keeps the source VM's MAC addresses, and fails
+// under -strict if the source VM still exists, as both would then share the addresses
+func checkMACConflict(config *VMBackupConfig, strict bool) error {
+	source := config.BackupSpec.Source.Name
+	log.Printf("⚠️  ⚠️  ⚠️  Keeping the MAC addresses of VM %s/%s; the restored VM conflicts with it on the network if it still exists", config.Namespace, source)
+	_, err := k8s.DynamicClient.Resource(VMGVR).Namespace(config.Namespace).Get(context.Background(), source, metav1.GetOptions{})
+	if err == nil {
+		return strictf(strict, "Source VM %s/%s still exists; the restored VM will have the same MAC addresses and cause an address conflict", config.Namespace, source)
+	} else if !apierrors.IsNotFound(err) {
+		log.Printf("⚠️  Could not check whether source VM %s/%s still exists: %v", config.Namespace, source, err)
+	}
+	return nil
 }
 
 // generateRandomSuffix generates a random suffix for resource names
@@ -450,21 +834,21 @@ func generateRandomSuffix(length int) string {
 	return suffix
 }
 
-// generateSecretMapping generates new secret names without creating them
+// generateSecretMapping maps each backed-up secret to the name it is restored under without creating
+// it. Secrets keep their original names, so one that already exists in the target namespace is
+// referenced as is and the -on-existing-secret policy decides what happens to its data.
 func generateSecretMapping(config *VMBackupConfig) map[string]string {
 	secretMapping := make(map[string]string)
 	for _, secretBackup := range config.SecretBackups {
-		newSecretName := fmt.Sprintf("%s-%s", secretBackup.Name, generateRandomSuffix(5))
-		secretMapping[secretBackup.Name] = newSecretName
+		secretMapping[secretBackup.Name] = secretBackup.Name
 	}
 	return secretMapping
 }
 
-// restoreSecretsWithOwner restores secrets with owner reference to the VM
-func restoreSecretsWithOwner(config *VMBackupConfig, namespace, vmName, vmUID string, secretMapping map[string]string) {
-	// Set up owner reference
+// vmOwnerReference returns the owner reference that ties a restored resource to the restored VM
+func vmOwnerReference(vmName, vmUID string) metav1.OwnerReference {
 	trueVal := true
-	ownerRef := metav1.OwnerReference{
+	return metav1.OwnerReference{
 		APIVersion:         "kubevirt.io/v1",
 		Kind:               "VirtualMachine",
 		Name:               vmName,
@@ -472,6 +856,12 @@ func restoreSecretsWithOwner(config *VMBackupConfig, namespace, vmName, vmUID st
 		Controller:         &trueVal,
 		BlockOwnerDeletion: &trueVal,
 	}
+}
+
+// restoreSecretsWithOwner restores secrets with owner reference to the VM. A secret that cannot
+// be restored is skipped, or fails the restore under -strict.
+func restoreSecretsWithOwner(config *VMBackupConfig, namespace, vmName, vmUID string, secretMapping map[string]string, opts RestoreOptions) error {
+	ownerRef := vmOwnerReference(vmName, vmUID)
 
 	for _, secretBackup := range config.SecretBackups {
 		newSecretName := secretMapping[secretBackup.Name]
@@ -480,8 +870,13 @@ func restoreSecretsWithOwner(config *VMBackupConfig, namespace, vmName, vmUID st
 		dataMap := make(map[string][]byte)
 		for k, v := range secretBackup.Data {
 			decoded, err := base64.StdEncoding.DecodeString(v)
+			if err == nil && secretBackup.Compressed[k] {
+				decoded, err = gunzip(decoded)
+			}
 			if err != nil {
-				log.Printf("⚠️  Failed to decode secret data for %s: %v", k, err)
+				if err := strictf(opts.Strict, "Failed to decode secret data for %s: %v", k, err); err != nil {
+					return err
+				}
 				continue
 			}
 			dataMap[k] = decoded
@@ -492,17 +887,91 @@ func restoreSecretsWithOwner(config *VMBackupConfig, namespace, vmName, vmUID st
 			ObjectMeta: metav1.ObjectMeta{
 				Name:            newSecretName,
 				Namespace:       namespace,
+				Annotations:     mergeAnnotations(nil, opts.Annotations),
 				OwnerReferences: []metav1.OwnerReference{ownerRef},
 			},
 			Data: dataMap,
 		}
 
 		_, err := k8s.Clientset.CoreV1().Secrets(namespace).Create(context.Background(), secret, metav1.CreateOptions{})
+		if apierrors.IsAlreadyExists(err) {
+			if err := handleExistingSecret(secret, opts.OnExistingSecret); err != nil {
+				if err := strictf(opts.Strict, "Failed to restore into existing secret %s: %v", newSecretName, err); err != nil {
+					return err
+				}
+			}
+			continue
+		}
 		if err != nil {
-			log.Printf("⚠️  Failed to create secret %s: %v", newSecretName, err)
+			if err := strictf(opts.Strict, "Failed to create secret %s: %v", newSecretName, err); err != nil {
+				return err
+			}
 			continue
 		}
 
-		log.Printf("📝 Restored secret with owner reference: %s -> %s", secretBackup.Name, newSecretName)
+		log.Printf("📝 Restored secret with owner reference: %s", newSecretName)
+	}
+	return nil
+}
+
+// gunzip decompresses a secret value stored gzip-compressed
+func gunzip(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// handleExistingSecret applies the existing-secret policy to a restored secret whose name is already taken.
+// The existing secret is never given an owner reference, so deleting the VM does not delete a shared secret.
+func handleExistingSecret(secret *corev1.Secret, policy string) error {
+	if policy == SecretPolicySkip {
+		log.Printf("📝 Secret %s already exists, keeping it", secret.Name)
+		return nil
+	}
+
+	secrets := k8s.Clientset.CoreV1().Secrets(secret.Namespace)
+	existing, err := secrets.Get(context.Background(), secret.Name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+
+	switch policy {
+	case SecretPolicyOverwrite:
+		existing.Data = secret.Data
+	case SecretPolicyMerge:
+		if existing.Data == nil {
+			existing.Data = make(map[string][]byte)
+		}
+		for k, v := range secret.Data {
+			if _, ok := existing.Data[k]; !ok {
+				existing.Data[k] = v
+			}
+		}
+	default:
+		return fmt.Errorf("unknown existing-secret policy %q", policy)
+	}
+	existing.Annotations = mergeAnnotations(existing.Annotations, secret.Annotations)
+
+	if _, err := secrets.Update(context.Background(), existing, metav1.UpdateOptions{}); err != nil {
+		return err
+	}
+	log.Printf("📝 Secret %s already exists, applied %s policy", secret.Name, policy)
+	return nil
+}
+
+// mergeAnnotations returns existing with the extra annotations added, overriding duplicate keys.
+func mergeAnnotations(existing, extra map[string]string) map[string]string {
+	if len(extra) == 0 {
+		return existing
+	}
+	if existing == nil {
+		existing = make(map[string]string, len(extra))
+	}
+	for k, v := range extra {
+		existing[k] = v
 	}
+	return existing
 }
@@ -0,0 +1,199 @@
+package vm
+
+import (
+	"context"
+	"encoding/base64"
+	"reflect"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+
+	"github.com/webberhuang/hv-vmbr/pkg/k8s"
+)
+
+func TestRequestDeviceSize(t *testing.T) {
+	tests := []struct {
+		name       string
+		request    string
+		deviceSize int64
+		want       string
+	}{
+		{"device matches request", "10Gi", 10 << 30, "10Gi"},
+		{"device smaller than request", "10Gi", 5 << 30, "10Gi"},
+		{"device a whole MiB larger", "10Gi", 10<<30 + 2<<20, "10242Mi"},
+		{"device larger by less than a MiB", "10Gi", 10<<30 + 512, "10241Mi"},
+		{"unaligned device larger than unaligned request", "1000000", 1048577, "2Mi"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pvc := &corev1.PersistentVolumeClaim{
+				ObjectMeta: metav1.ObjectMeta{Name: "disk-0"},
+				Spec: corev1.PersistentVolumeClaimSpec{
+					Resources: corev1.VolumeResourceRequirements{
+						Requests: corev1.ResourceList{corev1.ResourceStorage: resource.MustParse(test.request)},
+					},
+				},
+			}
+			requestDeviceSize(pvc, test.deviceSize)
+
+			got := pvc.Spec.Resources.Requests[corev1.ResourceStorage]
+			if want := resource.MustParse(test.want); got.Cmp(want) != 0 {
+				t.Fatalf("request is %s, want %s", got.String(), want.String())
+			}
+			if got.Value() < test.deviceSize {
+				t.Fatalf("request of %d bytes does not fit the %d byte device", got.Value(), test.deviceSize)
+			}
+		})
+	}
+}
+
+func TestRemoveAnnotation(t *testing.T) {
+	const key = "harvesterhci.io/mac-address"
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		preserve    []string
+		want        map[string]string
+	}{
+		{
+			name:        "present",
+			annotations: map[string]string{key: "{}", "description": "db"},
+			want:        map[string]string{"description": "db"},
+		},
+		{
+			name:        "missing key",
+			annotations: map[string]string{"description": "db"},
+			want:        map[string]string{"description": "db"},
+		},
+		{
+			name:        "nil map",
+			annotations: nil,
+			want:        nil,
+		},
+		{
+			name:        "last remaining key",
+			annotations: map[string]string{key: "{}"},
+			want:        map[string]string{},
+		},
+		{
+			name:        "preserved by pattern",
+			annotations: map[string]string{key: "{}"},
+			preserve:    []string{"network.example.com/*", "harvesterhci.io/*"},
+			want:        map[string]string{key: "{}"},
+		},
+		{
+			name:        "pattern matching another key",
+			annotations: map[string]string{key: "{}"},
+			preserve:    []string{"harvesterhci.io/volumeClaimTemplates"},
+			want:        map[string]string{},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			removeAnnotation(test.annotations, key, test.preserve)
+			if !reflect.DeepEqual(test.annotations, test.want) {
+				t.Fatalf("annotations are %v, want %v", test.annotations, test.want)
+			}
+		})
+	}
+}
+
+func TestClearMACAddressesMissingInterface(t *testing.T) {
+	spec := func() *VMSpec {
+		return &VMSpec{Spec: map[string]interface{}{
+			"template": map[string]interface{}{
+				"spec": map[string]interface{}{
+					"domain": map[string]interface{}{
+						"devices": map[string]interface{}{
+							"interfaces": []interface{}{
+								map[string]interface{}{"name": "default", "macAddress": "52:54:00:00:00:01"},
+							},
+						},
+					},
+				},
+			},
+		}}
+	}
+	macs := map[string]string{"default": "52:54:00:00:00:02", "storage": "52:54:00:00:00:03"}
+
+	if _, err := clearMACAddresses(spec(), macs, false, false); err != nil {
+		t.Fatalf("missing interface failed without -strict: %v", err)
+	}
+	if _, err := clearMACAddresses(spec(), macs, false, true); err == nil || !strings.Contains(err.Error(), "no interface storage") {
+		t.Fatalf("error %v, want one naming the missing interface under -strict", err)
+	}
+}
+
+func TestRollbackVMAfterDeadline(t *testing.T) {
+	vmObj := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "kubevirt.io/v1",
+		"kind":       "VirtualMachine",
+		"metadata":   map[string]interface{}{"name": "vm1", "namespace": "default"},
+	}}
+	dyn := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		VMGVR: "VirtualMachineList",
+	}, vmObj)
+	defer func(client dynamic.Interface) { k8s.DynamicClient = client }(k8s.DynamicClient)
+	k8s.DynamicClient = dyn
+
+	// The deadline of the restore has passed
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	rollbackVM(ctx, "default", "vm1")
+
+	if _, err := dyn.Resource(VMGVR).Namespace("default").Get(context.Background(), "vm1", metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Fatalf("VM still exists after the rollback (err %v)", err)
+	}
+	// A VM that is already gone is not an error
+	rollbackVM(ctx, "default", "vm1")
+}
+
+func TestRestoreSecretsIntoExistingSecret(t *testing.T) {
+	kube := kubefake.NewSimpleClientset(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "vm1-cloudinit", Namespace: "default"},
+		Data:       map[string][]byte{"userdata": []byte("old")},
+	})
+	defer func(clientset kubernetes.Interface) { k8s.Clientset = clientset }(k8s.Clientset)
+	k8s.Clientset = kube
+
+	config := &VMBackupConfig{SecretBackups: []SecretBackup{
+		{Name: "vm1-cloudinit", Data: map[string]string{"userdata": base64.StdEncoding.EncodeToString([]byte("new"))}},
+	}}
+	secretMapping := generateSecretMapping(config)
+	if got := secretMapping["vm1-cloudinit"]; got != "vm1-cloudinit" {
+		t.Fatalf("secret is restored as %q, want its original name", got)
+	}
+	opts := RestoreOptions{OnExistingSecret: SecretPolicyOverwrite}
+	if err := restoreSecretsWithOwner(config, "default", "vm1", "uid", secretMapping, opts); err != nil {
+		t.Fatalf("restoreSecretsWithOwner returned %v", err)
+	}
+
+	secret, err := kube.CoreV1().Secrets("default").Get(context.Background(), "vm1-cloudinit", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(secret.Data["userdata"]); got != "new" {
+		t.Errorf("existing secret holds %q, want it overwritten", got)
+	}
+	if len(secret.OwnerReferences) != 0 {
+		t.Errorf("existing secret was given owner references %v", secret.OwnerReferences)
+	}
+	secrets, err := kube.CoreV1().Secrets("default").List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(secrets.Items) != 1 {
+		t.Errorf("restore created %d secrets, want only the existing one", len(secrets.Items))
+	}
+}
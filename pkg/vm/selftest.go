@@ -0,0 +1,140 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/webberhuang/hv-vmbr/pkg/backup"
+	"github.com/webberhuang/hv-vmbr/pkg/k8s"
+	"github.com/webberhuang/hv-vmbr/pkg/manifests"
+	"github.com/webberhuang/hv-vmbr/pkg/restore"
+)
+
+// RunSelfTest backs up a PVC, restores the snapshot into a temporary PVC and compares its
+// SHA-256 with that of the clone of the VolumeSnapshot the backup read, validating the whole
+// pipeline against the PVC's storage. The temporary PVCs, the VolumeSnapshot and the test
+// snapshot are removed afterwards, whether or not the test passes.
+func RunSelfTest(ctx context.Context, namespace, pvcName string, vscMapping map[string]string, awsID, awsSecret, repository, password string, repoInitialized bool, opts BackupOptions) error {
+	log.Printf("🧪 Starting self-test of PVC %s", pvcName)
+
+	pvc, err := k8s.Clientset.CoreV1().PersistentVolumeClaims(namespace).Get(context.Background(), pvcName, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to get PVC %s: %w", pvcName, err)
+	}
+	if pvc.Spec.VolumeMode == nil || *pvc.Spec.VolumeMode != corev1.PersistentVolumeBlock {
+		return fmt.Errorf("PVC %s is not a Block volume; only Block volumes can be backed up", pvcName)
+	}
+	vsc, _, err := vscForPVC(pvc, vscMapping, opts)
+	if err != nil {
+		return err
+	}
+
+	suffix, err := k8s.GenerateJobSuffix()
+	if err != nil {
+		return fmt.Errorf("failed to generate suffix: %w", err)
+	}
+	snapshotTag := fmt.Sprintf("selftest-%s-pvc-%s", suffix, pvcName)
+
+	// The backup job may write the snapshot before a later phase of the backup fails
+	defer func() {
+		tags := []string{"ns=" + namespace, "sn=" + snapshotTag}
+		// Clean up even when the test was interrupted
+		err := deleteResticSnapshot(context.WithoutCancel(ctx), namespace, tags, awsID, awsSecret, repository, password)
+		if errors.Is(err, errSnapshotNotFound) {
+			return
+		}
+		if err != nil {
+			log.Printf("⚠️  Failed to delete self-test snapshot %s: %v", snapshotTag, err)
+			return
+		}
+		log.Printf("🗑️  Deleted self-test snapshot %s", snapshotTag)
+	}()
+	log.Printf("📦 Backing up PVC %s", pvcName)
+	volumeOpts := opts.Volume
+	volumeOpts.KeepClone = true
+	result, err := backup.RunBackup(ctx, namespace, pvcName, snapshotTag, vsc, awsID, awsSecret, repository, password, repoInitialized, volumeOpts)
+	if err != nil {
+		return fmt.Errorf("backup failed: %w", err)
+	}
+	// The clone holds exactly what the backup read, even if the PVC has been written to since
+	clonePVC := backup.ClonePVCName(pvcName)
+	defer k8s.CleanupResources(namespace, backup.VolumeSnapshotName(pvcName), clonePVC, true, true)
+	deviceSize := result.DeviceSize
+
+	restoredPVC := fmt.Sprintf("%s-selftest-%s", pvcName, suffix)
+	log.Printf("📦 Restoring the snapshot into PVC %s", restoredPVC)
+	newPVC := createCleanPVC(pvc, restoredPVC, namespace, "")
+	requestDeviceSize(newPVC, deviceSize)
+	if newPVC.Labels == nil {
+		newPVC.Labels = map[string]string{}
+	}
+	newPVC.Labels[k8s.ManagedByLabel] = k8s.ManagedByValue
+	if _, err := k8s.Clientset.CoreV1().PersistentVolumeClaims(namespace).Create(context.Background(), newPVC, metav1.CreateOptions{}); err != nil {
+		return fmt.Errorf("failed to create PVC %s: %w", restoredPVC, err)
+	}
+	defer func() {
+		if err := k8s.Clientset.CoreV1().PersistentVolumeClaims(namespace).Delete(context.Background(), restoredPVC, metav1.DeleteOptions{}); err != nil {
+			log.Printf("⚠️  Failed to delete PVC %s: %v", restoredPVC, err)
+			return
+		}
+		log.Printf("🗑️  Deleted PVC %s", restoredPVC)
+	}()
+	if err := restore.RunRestore(ctx, namespace, restoredPVC, namespace, pvc.Spec.VolumeName, snapshotTag, deviceSize, result.Checksum, awsID, awsSecret, repository, password); err != nil {
+		return err
+	}
+
+	log.Printf("🔍 Comparing the first %d bytes of PVC %s and PVC %s", deviceSize, clonePVC, restoredPVC)
+	sourceSum, err := blockDeviceChecksum(ctx, namespace, clonePVC, deviceSize)
+	if err != nil {
+		return err
+	}
+	restoredSum, err := blockDeviceChecksum(ctx, namespace, restoredPVC, deviceSize)
+	if err != nil {
+		return err
+	}
+	if sourceSum != restoredSum {
+		return fmt.Errorf("checksum mismatch: the snapshot of PVC %s has sha256 %s but its restored copy has %s", pvcName, sourceSum, restoredSum)
+	}
+
+	log.Printf("✅ Self-test passed: PVC %s was restored byte-identical (sha256 %s)", pvcName, sourceSum)
+	return nil
+}
+
+// blockDeviceChecksum runs a job that hashes the first size bytes of a Block PVC
+func blockDeviceChecksum(ctx context.Context, namespace, pvcName string, size int64) (string, error) {
+	jobSuffix, err := k8s.GenerateJobSuffix()
+	if err != nil {
+		return "", fmt.Errorf("failed to generate job suffix: %w", err)
+	}
+	replacements := map[string]string{
+		"PVC_NAME": pvcName,
+		"SIZE":     strconv.FormatInt(size, 10),
+	}
+	jobName := "selftest-checksum-" + jobSuffix
+	timeout := 3600 * time.Second
+	if err := k8s.ApplyJob(ctx, manifests.ChecksumJob, namespace, jobName, timeout, replacements); err != nil {
+		return "", fmt.Errorf("failed to apply checksum job: %w", err)
+	}
+
+	log.Printf("⌛ Hashing PVC %s...", pvcName)
+	if err := k8s.WaitForJob(ctx, jobName, namespace, timeout); err != nil {
+		return "", fmt.Errorf("checksum job for PVC %s failed: %w", pvcName, err)
+	}
+	logs, err := k8s.GetJobLogs(jobName, namespace, "checksum")
+	if err != nil {
+		return "", fmt.Errorf("failed to get checksum of PVC %s: %w", pvcName, err)
+	}
+	fields := strings.Fields(logs)
+	if len(fields) == 0 {
+		return "", fmt.Errorf("checksum job for PVC %s printed nothing", pvcName)
+	}
+	return fields[0], nil
+}
@@ -0,0 +1,17 @@
+package vm
+
+import (
+	"fmt"
+	"log"
+)
+
+// strictf logs a warning and returns nil, or with strict returns the warning as an error. Strict
+// mode promotes warnings that would otherwise leave an incomplete backup or restore (e.g. a
+// referenced secret that could not be read) to fatal errors.
+func strictf(strict bool, format string, args ...interface{}) error {
+	if strict {
+		return fmt.Errorf(format+" (strict mode)", args...)
+	}
+	log.Printf("⚠️  "+format, args...)
+	return nil
+}
@@ -1,18 +1,39 @@
 package vm
 
 import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/webberhuang/hv-vmbr/pkg/backup"
 )
 
 // VMBackupConfig represents the complete backup configuration for a VM
 type VMBackupConfig struct {
-	Name          string         `json:"name"`
-	Namespace     string         `json:"namespace"`
-	BackupSpec    BackupSpec     `json:"backupSpec"`
-	VMSourceSpec  VMSpec         `json:"vmSourceSpec"`
-	VolumeBackups []VolumeBackup `json:"volumeBackups"`
-	SecretBackups []SecretBackup `json:"secretBackups"`
+	Name          string            `json:"name"`
+	Namespace     string            `json:"namespace"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+	Repository    string            `json:"repository,omitempty"` // Resolved RESTIC_REPOSITORY the backup was written to
+	ConfigTags    []string          `json:"configTags,omitempty"` // Restic tags of the snapshot holding this config
+	BackupSpec    BackupSpec        `json:"backupSpec"`
+	VMSourceSpec  VMSpec            `json:"vmSourceSpec"`
+	VolumeBackups []VolumeBackup    `json:"volumeBackups"`
+	SecretBackups []SecretBackup    `json:"secretBackups"`
+	// Harvester KeyPairs referenced by the VM, recorded when -backup-keypairs is set
+	KeyPairBackups []KeyPairBackup `json:"keyPairBackups,omitempty"`
+	// Networks of the VM, with the interface binding and device plugin resource of each
+	Networks []NetworkBackup `json:"networks,omitempty"`
+	// Labels of the VM's namespace, copied to the target namespace with -copy-namespace-labels
+	NamespaceLabels map[string]string `json:"namespaceLabels,omitempty"`
+	// Resources owned by the VM of the kinds given with -include-kind
+	OwnedResources []OwnedResourceBackup `json:"ownedResources,omitempty"`
+	// MB/s achieved backing up the volumes, including snapshot and clone time; feeds later estimates
+	ThroughputMBps float64 `json:"throughputMBps,omitempty"`
 }
 
 // BackupSpec defines the source of the backup
@@ -39,9 +60,13 @@ type VolumeBackup struct {
 	Name                  string                       `json:"name"`
 	VolumeName            string                       `json:"volumeName"`
 	CSIDriverName         string                       `json:"csiDriverName"`
+	VolumeMode            string                       `json:"volumeMode,omitempty"`
 	PersistentVolumeClaim corev1.PersistentVolumeClaim `json:"persistentVolumeClaim"`
 	ResticSnapshotID      string                       `json:"resticSnapshotID,omitempty"` // Our addition for restic
+	SnapshotTags          []string                     `json:"snapshotTags,omitempty"`     // Full restic tag set of the snapshot
 	VolumeSize            int64                        `json:"volumeSize"`
+	DeviceSize            int64                        `json:"deviceSize,omitempty"` // Bytes accelerated_io read, may exceed the PVC request
+	Checksum              string                       `json:"checksum,omitempty"`   // SHA-256 of the data accelerated_io read, checked on restore
 	Progress              int                          `json:"progress"`
 }
 
@@ -49,4 +74,247 @@ type VolumeBackup struct {
 type SecretBackup struct {
 	Name string            `json:"name"`
 	Data map[string]string `json:"data"`
+	// Keys whose value was gzip-compressed before base64 encoding
+	Compressed map[string]bool `json:"compressed,omitempty"`
+}
+
+// KeyPairBackup represents a backed-up Harvester SSH KeyPair
+type KeyPairBackup struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+	PublicKey string `json:"publicKey"`
+}
+
+// NetworkBackup represents a network of the VM and what it needs from the cluster
+type NetworkBackup struct {
+	Name         string `json:"name"`
+	Type         string `json:"type"`                   // pod or multus
+	NetworkName  string `json:"networkName,omitempty"`  // NetworkAttachmentDefinition of a multus network
+	Binding      string `json:"binding,omitempty"`      // Interface binding, e.g. masquerade, bridge or sriov
+	ResourceName string `json:"resourceName,omitempty"` // Device plugin resource of the NetworkAttachmentDefinition
+}
+
+// OwnedResourceBackup represents a backed-up resource whose owner reference points at the VM
+type OwnedResourceBackup struct {
+	APIVersion string                 `json:"apiVersion"`
+	Kind       string                 `json:"kind"`
+	Name       string                 `json:"name"`
+	Object     map[string]interface{} `json:"object"` // Sanitized manifest without owner references
+}
+
+// VolumeResult is the outcome of backing up one PVC of a VM
+type VolumeResult struct {
+	PVC   string
+	Phase string // Phase that failed, e.g. snapshot or backup; empty if the PVC was not attempted
+	Err   error  // nil if the PVC was backed up
+}
+
+// BackupError is returned when backing up the PVCs of a VM fails and lists what happened to each PVC
+type BackupError struct {
+	Results []VolumeResult
+}
+
+func (e *BackupError) Error() string {
+	failed := 0
+	lines := []string{}
+	for _, r := range e.Results {
+		switch {
+		case r.Err == nil:
+			lines = append(lines, fmt.Sprintf("PVC %s backed up", r.PVC))
+		case errors.Is(r.Err, errVolumeSkipped):
+			lines = append(lines, fmt.Sprintf("PVC %s %v", r.PVC, r.Err))
+		default:
+			failed++
+			lines = append(lines, fmt.Sprintf("PVC %s failed at %s phase: %v", r.PVC, r.Phase, r.Err))
+		}
+	}
+	return fmt.Sprintf("%d of %d PVC(s) failed:\n  %s", failed, len(e.Results), strings.Join(lines, "\n  "))
+}
+
+// errVolumeSkipped marks the PVCs not backed up because another PVC had already failed
+var errVolumeSkipped = errors.New("skipped after an earlier failure")
+
+// errSnapshotNotFound is returned by deleteResticSnapshot when no snapshot carries the tags
+var errSnapshotNotFound = errors.New("snapshot not found")
+
+// phasePrepare is the phase of reading the PVC before backup.RunBackup starts
+const phasePrepare = "prepare"
+
+// BackupPlan is what a dry run of a VM backup found the backup would create and run
+type BackupPlan struct {
+	VM                   string          `json:"vm"`
+	Namespace            string          `json:"namespace"`
+	BackupName           string          `json:"backupName"`
+	InitializeRepository bool            `json:"initializeRepository"`
+	Volumes              []PlannedVolume `json:"volumes"`
+	Secrets              []string        `json:"secrets"`
+	ConfigTags           []string        `json:"configTags"`
+}
+
+// PlannedVolume is a PVC a backup would snapshot, clone and upload to restic
+type PlannedVolume struct {
+	PVC                 string `json:"pvc"`
+	Size                string `json:"size"`
+	CSIDriver           string `json:"csiDriver"`
+	VolumeSnapshotClass string `json:"volumeSnapshotClass"`
+	VolumeSnapshot      string `json:"volumeSnapshot"`
+	ClonePVC            string `json:"clonePVC"`
+	SnapshotTag         string `json:"snapshotTag"`
+}
+
+// RestorePlan is what a dry run of a VM restore found the restore would create
+type RestorePlan struct {
+	VM             string           `json:"vm"`
+	Namespace      string           `json:"namespace"`
+	BackupName     string           `json:"backupName"`
+	Volumes        []PlannedRestore `json:"volumes"`
+	Secrets        []PlannedSecret  `json:"secrets"`
+	KeyPairs       []string         `json:"keyPairs,omitempty"`       // namespace/name
+	OwnedResources []string         `json:"ownedResources,omitempty"` // Kind/name
+	Start          bool             `json:"start"`
+}
+
+// PlannedRestore is a volume a restore would dump from restic into a PVC
+type PlannedRestore struct {
+	SourcePVC    string `json:"sourcePVC"`
+	PVC          string `json:"pvc"`                // Ends in a random suffix unless an earlier attempt created it
+	Snapshot     string `json:"snapshot,omitempty"` // Short ID of the restic snapshot; empty if already restored
+	Size         string `json:"size,omitempty"`     // Empty for an existing PVC
+	StorageClass string `json:"storageClass,omitempty"`
+	Existing     bool   `json:"existing,omitempty"` // PVC of an earlier attempt, restored into again
+	Restored     bool   `json:"restored,omitempty"` // Already restored by an earlier attempt; skipped
+}
+
+// PlannedSecret is a secret a restore would create, or apply the -on-existing-secret policy to
+type PlannedSecret struct {
+	Name   string `json:"name"`
+	Exists bool   `json:"exists"`
+}
+
+// BackupOptions holds the optional settings of a VM backup
+type BackupOptions struct {
+	// Annotations are recorded on the backup config
+	Annotations map[string]string
+	// ExcludeVMs are the VMs, as name or namespace/name, that RunVMBackups skips even if they
+	// match the selector
+	ExcludeVMs []string
+	// ExcludeNamespaces are the namespaces whose VMs RunVMBackups skips
+	ExcludeNamespaces []string
+	// Parallelism is the number of PVCs of the VM backed up concurrently
+	Parallelism int
+	// MaxInflightBytes, when set, bounds the sum of JobInflightBytes over the backup jobs running
+	// at once, so further PVCs wait for a running one to finish
+	MaxInflightBytes int64
+	// JobInflightBytes is the block size × workers of accelerated_io in every backup job
+	JobInflightBytes int64
+	// AllowedDrivers, when set, are the only CSI drivers whose volumes may be backed up
+	AllowedDrivers []string
+	// VMFile, when set, is a YAML manifest the VM is read from instead of the cluster
+	VMFile string
+	// KeyPairs records the Harvester KeyPairs referenced by the VM's sshNames annotation in the
+	// backup config, so they can be recreated when restoring to another cluster
+	KeyPairs bool
+	// IncludeKinds lists the kinds (e.g. Service, ConfigMap, or Kind.group for other API groups)
+	// of namespaced resources owned by the VM that are backed up together with it
+	IncludeKinds []string
+	// ShowETA prints an estimate of the backup duration before the volumes are backed up
+	ShowETA bool
+	// ThroughputMBps is the expected backup throughput in MB/s used for the estimate. Zero uses
+	// the throughput recorded by the most recent backup of the same VM.
+	ThroughputMBps float64
+	// Volume holds the settings of every PVC backup
+	Volume backup.Options
+	// Progress, when set, receives the percentage of each PVC's backup job in place of the
+	// progress log lines
+	Progress func(pvcName string, percent float64)
+	// ProgressBoard makes RunVMBackups show one line per VM with its progress, redrawn in place
+	// on a terminal instead of the interleaved job logs
+	ProgressBoard bool
+	// DryRun logs the objects the backup would create and the restic commands it would run
+	// instead of running them. Read-only jobs still run.
+	DryRun bool
+	// Plan, when set, receives the plan of a dry run, e.g. to print it as JSON
+	Plan func(plan *BackupPlan) error
+	// Strict fails the backup instead of warning when it would be incomplete
+	Strict bool
+}
+
+// RestoreOptions holds the optional settings of a VM restore
+type RestoreOptions struct {
+	// Annotations are stamped on the restored VM, PVCs and secrets
+	Annotations map[string]string
+	// OnExistingSecret is one of the SecretPolicy values and decides what happens
+	// when a secret being restored already exists in the target namespace
+	OnExistingSecret string
+	// MACAddresses maps interface names to the MAC address they get on the restored VM;
+	// the MAC of every other interface is cleared
+	MACAddresses map[string]string
+	// StorageClass, when set, replaces the StorageClass of every restored PVC
+	StorageClass string
+	// Resize maps backed up PVC names to the larger size their restored PVC requests
+	Resize map[string]resource.Quantity
+	// Resume reuses the PVCs an interrupted restore of the same backup and VM name already created
+	Resume bool
+	// PreserveAnnotations are annotation keys, or path.Match patterns, that createVM keeps
+	// even though it would otherwise remove them
+	PreserveAnnotations []string
+	// KeepMAC keeps the MAC addresses of the backed up VM instead of clearing them
+	KeepMAC bool
+	// Start sets the runStrategy of the VM to RerunOnFailure once its secrets and owned resources
+	// are restored, so it boots; otherwise it stays Halted
+	Start bool
+	// CopyNamespaceLabels adds the labels of the backed-up VM's namespace to the target namespace
+	CopyNamespaceLabels bool
+	// SourceNamespace is the namespace the backup was taken in, when it differs from the target
+	// namespace of the restore
+	SourceNamespace string
+	// VerifyBoot, when positive, is how long the restore waits for the started VM to run with a
+	// connected guest agent before it fails
+	VerifyBoot time.Duration
+	// DryRun logs the objects the restore would create and the restic snapshots it would read
+	// instead of creating them. Read-only jobs, e.g. the one downloading the backup config, still run.
+	DryRun bool
+	// Plan, when set, receives the plan of a dry run, e.g. to print it as JSON
+	Plan func(plan *RestorePlan) error
+	// Strict fails the restore instead of warning when it would be incomplete
+	Strict bool
+}
+
+// UnarchiveOptions holds the optional settings of unarchiving a backup
+type UnarchiveOptions struct {
+	// StagingStorageClass is the StorageClass of the PVCs volume data is staged on before it is
+	// backed up. Empty uses the cluster's default StorageClass.
+	StagingStorageClass string
+	// Strict fails the unarchive instead of warning when a staging PVC or receive job cannot be
+	// cleaned up
+	Strict bool
+}
+
+// Policies for restoring a secret that already exists
+const (
+	SecretPolicySkip      = "skip"      // keep the existing secret untouched
+	SecretPolicyOverwrite = "overwrite" // replace the existing secret's data
+	SecretPolicyMerge     = "merge"     // add keys missing from the existing secret
+)
+
+// ArchiveManifest describes a backup exported to local files by the archive mode
+type ArchiveManifest struct {
+	BackupName string           `json:"backupName"`
+	Namespace  string           `json:"namespace"`
+	SourceVM   string           `json:"sourceVM,omitempty"`
+	Repository string           `json:"repository"` // Repository the archive was read from
+	CreatedAt  time.Time        `json:"createdAt"`
+	ConfigFile string           `json:"configFile"` // Backup config, relative to the archive directory
+	ConfigTags []string         `json:"configTags"` // Restic tags of the config snapshot
+	Volumes    []ArchivedVolume `json:"volumes"`
+}
+
+// ArchivedVolume is the raw data of one backed-up volume in an archive
+type ArchivedVolume struct {
+	PVCName       string   `json:"pvcName"`
+	File          string   `json:"file"`          // Raw volume data, relative to the archive directory
+	StdinFilename string   `json:"stdinFilename"` // Filename of the data inside the restic snapshot
+	Tags          []string `json:"tags"`          // Restic tags of the volume snapshot
+	Size          int64    `json:"size"`
+	SHA256        string   `json:"sha256"`
 }
@@ -0,0 +1,307 @@
+package vm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/webberhuang/hv-vmbr/pkg/backup"
+	"github.com/webberhuang/hv-vmbr/pkg/find"
+	"github.com/webberhuang/hv-vmbr/pkg/k8s"
+	"github.com/webberhuang/hv-vmbr/pkg/manifests"
+)
+
+const (
+	receivePort     = 8080
+	uploadChunkSize = 16 * 1024 * 1024
+	uploadRetries   = 3
+	// receiveTokenHeader carries the token the receive job requires on every request
+	receiveTokenHeader = "X-Receive-Token"
+)
+
+// RunVMUnarchive uploads a backup written by the archive mode from inputDir into the repository,
+// recreating the restic tags of every snapshot so the backup can be found and restored as usual.
+func RunVMUnarchive(ctx context.Context, namespace, inputDir, awsID, awsSecret, repository, password string, repoInitialized bool, opts UnarchiveOptions) error {
+	archive, config, err := readArchive(inputDir)
+	if err != nil {
+		return fmt.Errorf("failed to read archive: %w", err)
+	}
+	log.Printf("🔧 Starting unarchive of backup %s from %s", archive.BackupName, inputDir)
+
+	// The recreated tags keep the namespace the backup was taken in
+	if archive.Namespace != namespace {
+		log.Printf("⚠️  Backup was archived from namespace %s; use -namespace %s to find, restore or clean it up", archive.Namespace, archive.Namespace)
+	}
+
+	if !repoInitialized {
+		log.Println("🔧 Restic repository not initialized. Applying init job...")
+		if err := backup.InitializeRepository(ctx, namespace, awsID, awsSecret, repository, password); err != nil {
+			return err
+		}
+	} else {
+		snapshots, err := find.RunFind(ctx, namespace, configSnapshotTags(archive.Namespace, archive.BackupName), awsID, awsSecret, repository, password)
+		if err != nil {
+			return fmt.Errorf("failed to check for an existing backup %s: %w", archive.BackupName, err)
+		}
+		if len(snapshots) > 0 {
+			return fmt.Errorf("backup %s already exists in repository %s", archive.BackupName, k8s.RedactRepository(repository))
+		}
+	}
+
+	for _, volume := range archive.Volumes {
+		snapshot, err := unarchiveVolume(ctx, volume, inputDir, namespace, awsID, awsSecret, repository, password, repoInitialized, opts)
+		if err != nil {
+			return fmt.Errorf("failed to unarchive volume %s: %w", volume.PVCName, err)
+		}
+		for i := range config.VolumeBackups {
+			if config.VolumeBackups[i].PersistentVolumeClaim.Name == volume.PVCName {
+				config.VolumeBackups[i].ResticSnapshotID = snapshot.ShortID
+				config.VolumeBackups[i].SnapshotTags = snapshot.Tags
+			}
+		}
+	}
+
+	config.Repository = repository
+	config.ConfigTags = archive.ConfigTags
+	if err := saveBackupConfig(ctx, *config, namespace, awsID, awsSecret, repository, password, opts.Strict); err != nil {
+		return fmt.Errorf("failed to save backup config: %w", err)
+	}
+
+	log.Printf("✅ Unarchived backup %s (%d volume(s)) into %s", archive.BackupName, len(archive.Volumes), k8s.RedactRepository(repository))
+	return nil
+}
+
+// readArchive loads the manifest and backup config of an archive directory
+func readArchive(inputDir string) (*ArchiveManifest, *VMBackupConfig, error) {
+	data, err := os.ReadFile(filepath.Join(inputDir, ArchiveManifestFile))
+	if err != nil {
+		return nil, nil, err
+	}
+	var archive ArchiveManifest
+	if err := json.Unmarshal(data, &archive); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse %s: %w", ArchiveManifestFile, err)
+	}
+
+	data, err = os.ReadFile(filepath.Join(inputDir, archive.ConfigFile))
+	if err != nil {
+		return nil, nil, err
+	}
+	var config VMBackupConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse %s: %w", archive.ConfigFile, err)
+	}
+	return &archive, &config, nil
+}
+
+// unarchiveVolume copies one archived volume onto a staging PVC, backs it up to restic with the
+// archived tags and returns the new snapshot.
+func unarchiveVolume(ctx context.Context, volume ArchivedVolume, inputDir, namespace, awsID, awsSecret, repository, password string, repoInitialized bool, opts UnarchiveOptions) (snapshot *find.Snapshot, err error) {
+	if repoInitialized {
+		snapshots, err := find.RunFind(ctx, namespace, volume.Tags, awsID, awsSecret, repository, password)
+		if err != nil {
+			return nil, fmt.Errorf("failed to check for an existing snapshot: %w", err)
+		}
+		if len(snapshots) > 0 {
+			return nil, fmt.Errorf("snapshot %s with tags %s already exists", snapshots[0].ShortID, strings.Join(volume.Tags, ","))
+		}
+	}
+
+	file, err := os.Open(filepath.Join(inputDir, volume.File))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	if stat, err := file.Stat(); err != nil {
+		return nil, err
+	} else if stat.Size() != volume.Size {
+		return nil, fmt.Errorf("%s is %d bytes, archive manifest records %d", volume.File, stat.Size(), volume.Size)
+	}
+
+	jobSuffix, err := k8s.GenerateJobSuffix()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate job suffix: %w", err)
+	}
+	stagingPVC := "unarchive-staging-" + jobSuffix
+	if err := createStagingPVC(stagingPVC, namespace, volume.Size, opts.StagingStorageClass); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if cleanupErr := deleteStagingPVC(stagingPVC, namespace, opts.Strict); err == nil {
+			err = cleanupErr
+		}
+	}()
+
+	if err := receiveVolume(ctx, file, volume, stagingPVC, namespace, jobSuffix, opts.Strict); err != nil {
+		return nil, err
+	}
+
+	replacements := map[string]string{
+		"AWS_ACCESS_KEY_ID":     awsID,
+		"AWS_SECRET_ACCESS_KEY": awsSecret,
+		"RESTIC_REPOSITORY":     repository,
+		"RESTIC_PASSWORD":       password,
+		"PVC_NAME":              stagingPVC,
+		"PV_NAME":               volume.StdinFilename,
+		"SIZE":                  strconv.FormatInt(volume.Size, 10),
+		"TAGS":                  strings.Join(volume.Tags, ","),
+	}
+	jobName := "vm-unarchive-backup-" + jobSuffix
+	timeout := 3600 * time.Second
+	if err := k8s.ApplyJob(ctx, manifests.UnarchiveBackupJob, namespace, jobName, timeout, replacements); err != nil {
+		return nil, fmt.Errorf("failed to apply unarchive backup job: %w", err)
+	}
+
+	log.Printf("⌛ Backing up PVC %s to restic...", volume.PVCName)
+	if err := k8s.WaitForJob(ctx, jobName, namespace, timeout); err != nil {
+		return nil, fmt.Errorf("unarchive backup job failed: %w", err)
+	}
+
+	snapshots, err := find.RunFind(ctx, namespace, volume.Tags, awsID, awsSecret, repository, password)
+	if err != nil {
+		return nil, fmt.Errorf("failed to verify snapshot: %w", err)
+	}
+	if len(snapshots) == 0 {
+		return nil, fmt.Errorf("snapshot not found with tags: %s", strings.Join(volume.Tags, ","))
+	}
+
+	log.Printf("✅ PVC %s unarchived with snapshot ID: %s", volume.PVCName, snapshots[0].ShortID)
+	return &snapshots[0], nil
+}
+
+// createStagingPVC creates the Block PVC that archived volume data is written to, of storageClass
+// unless it is empty
+func createStagingPVC(name, namespace string, size int64, storageClass string) error {
+	volumeMode := corev1.PersistentVolumeBlock
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+			Labels:    map[string]string{k8s.ManagedByLabel: k8s.ManagedByValue},
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			AccessModes: []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+			VolumeMode:  &volumeMode,
+			Resources: corev1.VolumeResourceRequirements{
+				Requests: corev1.ResourceList{
+					corev1.ResourceStorage: *resource.NewQuantity(size, resource.BinarySI),
+				},
+			},
+		},
+	}
+	if storageClass != "" {
+		pvc.Spec.StorageClassName = &storageClass
+	}
+
+	if _, err := k8s.Clientset.CoreV1().PersistentVolumeClaims(namespace).Create(context.Background(), pvc, metav1.CreateOptions{}); err != nil {
+		return fmt.Errorf("failed to create staging PVC %s: %w", name, err)
+	}
+	log.Printf("✅ Staging PVC %s created", name)
+	return nil
+}
+
+// deleteStagingPVC removes a staging PVC once its data has been backed up. Failing to is an
+// error only with strict.
+func deleteStagingPVC(name, namespace string, strict bool) error {
+	if err := k8s.Clientset.CoreV1().PersistentVolumeClaims(namespace).Delete(context.Background(), name, metav1.DeleteOptions{}); err != nil {
+		return strictf(strict, "Failed to delete staging PVC %s: %v", name, err)
+	}
+	log.Printf("🗑️  Deleted staging PVC %s", name)
+	return nil
+}
+
+// receiveVolume runs the receive job on the staging PVC, uploads the archived data to it in
+// chunks through the API server's pod proxy and checks the written data against the archive checksum.
+func receiveVolume(ctx context.Context, src io.Reader, volume ArchivedVolume, stagingPVC, namespace, jobSuffix string, strict bool) (err error) {
+	replacements := map[string]string{
+		"PVC_NAME": stagingPVC,
+		"PORT":     strconv.Itoa(receivePort),
+	}
+	jobName := "vm-unarchive-receive-" + jobSuffix
+	replacements["TOKEN_SECRET"] = jobName + "-token"
+	token, err := k8s.GenerateToken()
+	if err != nil {
+		return fmt.Errorf("failed to generate receive token: %w", err)
+	}
+	if err := k8s.ApplyJob(ctx, manifests.UnarchiveReceiveJob, namespace, jobName, 3600*time.Second, replacements); err != nil {
+		return fmt.Errorf("failed to apply unarchive receive job: %w", err)
+	}
+	// The receiver refuses requests without the token; its pod starts once the Secret exists
+	if err := k8s.CreateJobSecret(ctx, namespace, jobName, replacements["TOKEN_SECRET"], map[string]string{"token": token}); err != nil {
+		return err
+	}
+	headers := map[string]string{receiveTokenHeader: token}
+
+	podName, err := k8s.FindRunningJobPod(jobName, namespace, "receive")
+	if err != nil {
+		return err
+	}
+	// Stop the receiver on every path; it exits on its own only when told so
+	defer func() {
+		if _, stopErr := k8s.ProxyPodRequest(namespace, podName, receivePort, "POST", "done", headers, nil, nil); stopErr != nil {
+			if strictErr := strictf(strict, "Failed to stop unarchive receive job %s: %v", jobName, stopErr); err == nil {
+				err = strictErr
+			}
+		}
+	}()
+
+	log.Printf("⌛ Uploading %s (%d bytes) to staging PVC %s...", volume.File, volume.Size, stagingPVC)
+	buf := make([]byte, uploadChunkSize)
+	var offset int64
+	lastReport := time.Now()
+	for {
+		n, err := io.ReadFull(src, buf)
+		if err == io.EOF {
+			break
+		} else if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+
+		params := map[string]string{"offset": strconv.FormatInt(offset, 10)}
+		if err := withRetries(func() error {
+			_, err := k8s.ProxyPodRequest(namespace, podName, receivePort, "PUT", "blocks", headers, params, buf[:n])
+			return err
+		}); err != nil {
+			return fmt.Errorf("failed to upload chunk at offset %d: %w", offset, err)
+		}
+		offset += int64(n)
+
+		if time.Since(lastReport) >= 10*time.Second {
+			log.Printf("progress: %.2f%%", float64(offset)/float64(volume.Size)*100)
+			lastReport = time.Now()
+		}
+	}
+
+	sum, err := k8s.ProxyPodRequest(namespace, podName, receivePort, "GET", "sha256", headers, map[string]string{"size": strconv.FormatInt(volume.Size, 10)}, nil)
+	if err != nil {
+		return fmt.Errorf("failed to checksum staging PVC: %w", err)
+	}
+	if string(sum) != volume.SHA256 {
+		return fmt.Errorf("checksum mismatch on staging PVC: archive records %s, staged data is %s", volume.SHA256, sum)
+	}
+	log.Printf("✅ Uploaded %s, sha256 %s", volume.File, sum)
+	return nil
+}
+
+// withRetries calls fn until it succeeds, up to uploadRetries times.
+// The first attempts may race the receiver starting to listen.
+func withRetries(fn func() error) error {
+	var err error
+	for i := 0; i < uploadRetries; i++ {
+		if err = fn(); err == nil {
+			return nil
+		}
+		time.Sleep(2 * time.Second)
+	}
+	return err
+}